@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Origin describes what triggered a state transition
+type Origin string
+
+// those are the origins that can be found in the audit records
+const (
+	// the namespace has been seen for the first time by the controller
+	OriginController Origin = "controller"
+	// the dailySuspendTime of the namespace is past
+	OriginSchedule Origin = "schedule"
+	// the nextSuspendTime of the namespace is expired
+	OriginNextSuspendTime Origin = "nextSuspendTime"
+	// the state has been propagated from another member of the group
+	OriginGroup Origin = "group"
+	// the state has been changed by a user from the web UI
+	OriginWebUI Origin = "webui"
+	// the state has been changed using the API
+	OriginAPI Origin = "api"
+	// the annotation has been edited manually (kubectl, another tool...)
+	OriginManual Origin = "manual"
+	// the desiredState of the NamespaceSuspension of the namespace has been
+	// changed
+	OriginSuspension Origin = "suspension"
+	// the namespace has been suspended for too long. The state does not
+	// change, it is only used by the notifications.
+	OriginStale Origin = "stale"
+)
+
+// those are the supported sinks kinds
+const (
+	SinkNone    = ""
+	SinkFile    = "file"
+	SinkEvents  = "events"
+	SinkWebhook = "webhook"
+)
+
+// ErrHistoryNotSupported is returned when the configured sink cannot be read
+// back to display the history of a namespace
+var ErrHistoryNotSupported = errors.New("the configured audit sink does not support reading history")
+
+// Record is a single state transition of a namespace
+type Record struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Origin    Origin    `json:"origin"`
+	Actor     string    `json:"actor,omitempty"`
+	Message   string    `json:"message,omitempty"`
+}
+
+// Sink is an append-only destination for the audit records
+type Sink interface {
+	// Write appends a record to the sink
+	Write(ctx context.Context, r Record) error
+	// History returns at most limit records of the given namespace, the most
+	// recent first. It returns ErrHistoryNotSupported if the sink cannot be
+	// read.
+	History(ctx context.Context, namespace string, limit int) ([]Record, error)
+}
+
+// Options holds the configuration of the audit sink
+type Options struct {
+	Sink           string
+	File           string
+	WebhookURL     string
+	ControllerName string
+}
+
+// New returns the sink described by the options. The clientset is only used
+// by the events sink.
+func New(opt Options, cs kubernetes.Interface) (Sink, error) {
+	switch opt.Sink {
+	case SinkNone:
+		return Nop{}, nil
+	case SinkFile:
+		if opt.File == "" {
+			return nil, errors.New("an audit file path is required with the file sink")
+		}
+		return NewFileSink(opt.File), nil
+	case SinkEvents:
+		return NewEventsSink(cs, opt.ControllerName), nil
+	case SinkWebhook:
+		if opt.WebhookURL == "" {
+			return nil, errors.New("a webhook URL is required with the webhook sink")
+		}
+		return NewWebhookSink(opt.WebhookURL), nil
+	default:
+		return nil, fmt.Errorf("unknown audit sink '%s'", opt.Sink)
+	}
+}
+
+// Nop is a sink that drops all the records
+type Nop struct{}
+
+// Write does nothing
+func (Nop) Write(context.Context, Record) error {
+	return nil
+}
+
+// History always returns ErrHistoryNotSupported
+func (Nop) History(context.Context, string, int) ([]Record, error) {
+	return nil, ErrHistoryNotSupported
+}
@@ -0,0 +1,241 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var now = time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+func record(ns string, minutes int, to string) Record {
+	return Record{Time: now.Add(time.Duration(minutes) * time.Minute), Namespace: ns, From: "Running", To: to,
+		Origin: OriginSchedule}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		opt     Options
+		want    Sink
+		wantErr bool
+	}{
+		{name: "none", opt: Options{}, want: Nop{}},
+		{name: "file", opt: Options{Sink: SinkFile, File: "/tmp/audit.jsonl"}, want: NewFileSink("/tmp/audit.jsonl")},
+		{name: "file without path", opt: Options{Sink: SinkFile}, wantErr: true},
+		{name: "webhook without url", opt: Options{Sink: SinkWebhook}, wantErr: true},
+		{name: "unknown", opt: Options{Sink: "syslog"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(tt.opt, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("New() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	s := NewFileSink(path)
+
+	if records, err := s.History(ctx, "team-a", 0); err != nil || len(records) != 0 {
+		t.Fatalf("History() of a missing file = %v, %v, want nothing", records, err)
+	}
+	for _, r := range []Record{record("team-a", 0, "Suspended"), record("team-b", 1, "Suspended"), record("team-a", 2, "Running")} {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one JSON document per line, appended in order
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("file has %d lines, want 3:\n%s", len(lines), b)
+	}
+	var r Record
+	if err := json.Unmarshal([]byte(lines[1]), &r); err != nil || !reflect.DeepEqual(r, record("team-b", 1, "Suspended")) {
+		t.Errorf("second line = %s, want the team-b record", lines[1])
+	}
+
+	// a corrupted line does not prevent reading the others
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("{not json\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	records, err := s.History(ctx, "team-a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Record{record("team-a", 2, "Running"), record("team-a", 0, "Suspended")}; !reflect.DeepEqual(records, want) {
+		t.Errorf("History() = %v, want %v", records, want)
+	}
+	if records, _ := s.History(ctx, "", 1); len(records) != 1 || records[0].Namespace != "team-a" {
+		t.Errorf("History() limited to 1 = %v, want the last record", records)
+	}
+
+	// the file is opened again on each write, so it can be rotated
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, record("team-b", 3, "Running")); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := s.History(ctx, "", 0); !reflect.DeepEqual(records, []Record{record("team-b", 3, "Running")}) {
+		t.Errorf("History() after the rotation = %v, want only the new record", records)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		timeout bool
+		wantErr string
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "no content", status: http.StatusNoContent},
+		{name: "redirect", status: http.StatusMovedPermanently, wantErr: "301"},
+		{name: "error", status: http.StatusInternalServerError, wantErr: "500"},
+		{name: "timeout", status: http.StatusOK, timeout: true, wantErr: "Timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			var got Record
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.timeout {
+					<-release
+				}
+				b, _ := io.ReadAll(r.Body)
+				if ct := r.Header.Get("Content-Type"); r.Method != http.MethodPost || ct != "application/json" {
+					t.Errorf("request %s with Content-Type %q, want a JSON POST", r.Method, ct)
+				}
+				if err := json.Unmarshal(b, &got); err != nil {
+					t.Errorf("cannot decode the record: %v", err)
+				}
+				if tt.status == http.StatusMovedPermanently {
+					w.Header().Set("Location", "/elsewhere")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			defer close(release)
+
+			s := NewWebhookSink(srv.URL)
+			s.client.Timeout = 50 * time.Millisecond
+			s.client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+			err := s.Write(context.Background(), record("team-a", 0, "Suspended"))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Write() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, record("team-a", 0, "Suspended")) {
+				t.Errorf("webhook received %v", got)
+			}
+			if _, err := s.History(context.Background(), "team-a", 0); !errors.Is(err, ErrHistoryNotSupported) {
+				t.Errorf("History() error = %v, want ErrHistoryNotSupported", err)
+			}
+		})
+	}
+}
+
+func TestEventsSink(t *testing.T) {
+	ctx := context.Background()
+	cs := fake.NewSimpleClientset()
+	// the fake clientset does not generate the names
+	generated := 0
+	cs.PrependReactor("create", "events", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		ev := action.(k8stesting.CreateAction).GetObject().(*corev1.Event)
+		if ev.Name == "" {
+			generated++
+			ev.Name = fmt.Sprintf("%s%d", ev.GenerateName, generated)
+		}
+		return false, nil, nil
+	})
+	s := NewEventsSink(cs, "kube-ns-suspender")
+
+	r := record("team-a", 0, "Suspended")
+	r.Actor = "jane"
+	for _, r := range []Record{record("team-a", 1, "Running"), r, record("team-b", 2, "Suspended")} {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the events of another controller are ignored
+	if _, err := cs.CoreV1().Events("team-a").Create(ctx, &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "other", Namespace: "team-a"},
+		InvolvedObject: corev1.ObjectReference{Kind: "Namespace", Name: "team-a"},
+		Reason:         eventReason,
+		Source:         corev1.EventSource{Component: "another-controller"},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := cs.CoreV1().Events("team-a").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	for _, ev := range events.Items {
+		if ev.Source.Component == "kube-ns-suspender" {
+			msgs = append(msgs, ev.Message)
+		}
+	}
+	if want := "desired state changed from 'Running' to 'Suspended' (origin: schedule) by jane"; len(msgs) != 2 || (msgs[0] != want && msgs[1] != want) {
+		t.Errorf("events messages = %q, want %q", msgs, want)
+	}
+
+	records, err := s.History(ctx, "team-a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Record{record("team-a", 1, "Running"), r}; !reflect.DeepEqual(records, want) {
+		t.Errorf("History() = %v, want %v", records, want)
+	}
+}
+
+func TestNop(t *testing.T) {
+	var s Sink = Nop{}
+	if err := s.Write(context.Background(), record("team-a", 0, "Suspended")); err != nil {
+		t.Errorf("Write() error = %v", err)
+	}
+	if _, err := s.History(context.Background(), "team-a", 0); !errors.Is(err, ErrHistoryNotSupported) {
+		t.Errorf("History() error = %v, want ErrHistoryNotSupported", err)
+	}
+}
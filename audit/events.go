@@ -0,0 +1,100 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// eventReason is the reason of the events created for the transitions
+	eventReason = "StateTransition"
+	// recordAnnotation holds the JSON encoded record on the event, so it can
+	// be read back without parsing the message
+	recordAnnotation = "kube-ns-suspender/audit-record"
+)
+
+// EventsSink records the transitions as Kubernetes events on the namespaces.
+// Note that events are garbage collected by the API server (after 1 hour by
+// default), so the history is limited.
+type EventsSink struct {
+	cs             kubernetes.Interface
+	controllerName string
+}
+
+// NewEventsSink returns a sink creating events with the given clientset
+func NewEventsSink(cs kubernetes.Interface, controllerName string) *EventsSink {
+	return &EventsSink{cs: cs, controllerName: controllerName}
+}
+
+// Write creates an event on the namespace
+func (s *EventsSink) Write(ctx context.Context, r Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("desired state changed from '%s' to '%s' (origin: %s)", r.From, r.To, r.Origin)
+	if r.Actor != "" {
+		msg += fmt.Sprintf(" by %s", r.Actor)
+	}
+
+	ts := metav1.NewTime(r.Time)
+	ev := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: r.Namespace + ".",
+			Namespace:    r.Namespace,
+			Annotations:  map[string]string{recordAnnotation: string(b)},
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Namespace",
+			Name:       r.Namespace,
+		},
+		Reason:              eventReason,
+		Message:             msg,
+		Type:                corev1.EventTypeNormal,
+		Source:              corev1.EventSource{Component: s.controllerName},
+		FirstTimestamp:      ts,
+		LastTimestamp:       ts,
+		Count:               1,
+		ReportingController: s.controllerName,
+	}
+	_, err = s.cs.CoreV1().Events(r.Namespace).Create(ctx, ev, metav1.CreateOptions{})
+	return err
+}
+
+// History lists the transition events of the namespace
+func (s *EventsSink) History(ctx context.Context, namespace string, limit int) ([]Record, error) {
+	selector := fields.Set{
+		"involvedObject.kind": "Namespace",
+		"reason":              eventReason,
+	}.AsSelector().String()
+
+	events, err := s.cs.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, ev := range events.Items {
+		if ev.Source.Component != s.controllerName {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal([]byte(ev.Annotations[recordAnnotation]), &r); err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return latest(records, limit), nil
+}
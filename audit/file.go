@@ -0,0 +1,90 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileSink writes the records as JSON lines in a file
+type FileSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileSink returns a sink appending records to the file at path
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+// Write appends the record to the file
+func (s *FileSink) Write(_ context.Context, r Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// History reads the whole file and returns the records of the namespace
+func (s *FileSink) History(_ context.Context, namespace string, limit int) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// a corrupted line should not prevent reading the others
+			continue
+		}
+		if namespace == "" || r.Namespace == namespace {
+			records = append(records, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return latest(records, limit), nil
+}
+
+// latest returns at most limit records from the end of the slice, in reverse
+// order. A limit lower than 1 means no limit.
+func latest(records []Record, limit int) []Record {
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	res := make([]Record, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		res = append(res, records[i])
+	}
+	return res
+}
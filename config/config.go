@@ -0,0 +1,276 @@
+// Package config reads the optional configuration file of the controller. The
+// file holds the same options as the flags, and the structures that cannot be
+// given as flags: the schedules and profiles the namespaces can refer to, the
+// rules excluding resources from the suspension, the notification sinks and
+// the budgets of the teams.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/namsral/flag"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// those are the resources kinds the rules can apply to
+const (
+	KindDeployment   = "Deployment"
+	KindStatefulSet  = "StatefulSet"
+	KindCronJob      = "CronJob"
+	KindJob          = "Job"
+	KindScaledObject = "ScaledObject"
+)
+
+// those are the supported notification sinks kinds
+const (
+	NotificationWebhook = "webhook"
+	NotificationSlack   = "slack"
+)
+
+// File is the content of the configuration file
+type File struct {
+	// Options holds the values of the flags, by flag name (log-level,
+	// running-duration...). The flags and environment variables take
+	// precedence over them.
+	Options map[string]interface{} `json:"options"`
+	// Schedules are the named schedules the namespaces can refer to with the
+	// schedule annotation, instead of setting their own dailySuspendTime
+	Schedules map[string]Schedule `json:"schedules"`
+	// Profiles are the named settings the namespaces can refer to with the
+	// profile annotation
+	Profiles map[string]Profile `json:"profiles"`
+	// ResourceRules select the resources that are never suspended
+	ResourceRules []ResourceRule `json:"resourceRules"`
+	// Notifications are the sinks notified of the changes of state
+	Notifications []Notification `json:"notifications"`
+	// Budgets limit the running namespaces of each team, by team name. The
+	// team of a namespace is given by its team label.
+	Budgets map[string]Budget `json:"budgets"`
+}
+
+// Schedule tells when namespaces are suspended
+type Schedule struct {
+	// DailySuspendTime follows the same format as the dailySuspendTime
+	// annotation (e.g. 8:15PM)
+	DailySuspendTime string `json:"dailySuspendTime"`
+	// Days are the days of the week (Monday, Tuesday...) the namespaces are
+	// suspended on. They are suspended every day if empty.
+	Days []string `json:"days,omitempty"`
+}
+
+// Profile holds settings shared by several namespaces
+type Profile struct {
+	// Schedule is the name of the schedule used by the namespaces that do
+	// not set their own dailySuspendTime or schedule
+	Schedule string `json:"schedule,omitempty"`
+	// RunningDuration replaces the running duration of the controller for
+	// the namespaces of the profile
+	RunningDuration string `json:"runningDuration,omitempty"`
+}
+
+// ResourceRule selects resources the controller leaves untouched
+type ResourceRule struct {
+	// Kind is the kind of the resources (Deployment, StatefulSet, CronJob, Job
+	// or ScaledObject)
+	Kind string `json:"kind"`
+	// Selector is a label selector (e.g. app=db,tier!=front). All the
+	// resources of the kind are selected if empty.
+	Selector string `json:"selector,omitempty"`
+	// Namespaces restricts the rule to some namespaces. It applies to all of
+	// them if empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// Notification is a sink notified when a namespace changes of state
+type Notification struct {
+	// Name identifies the sink in the logs
+	Name string `json:"name"`
+	// Kind is either webhook or slack
+	Kind string `json:"kind"`
+	// URL is the URL of the webhook, or of the Slack incoming webhook
+	URL string `json:"url"`
+	// States restricts the notifications to the transitions to those states
+	// (Running, Suspended). All the transitions are notified if empty.
+	States []string `json:"states,omitempty"`
+}
+
+// Budget limits the namespaces of a team that can be resumed. A zero value
+// means no limit.
+type Budget struct {
+	// MaxRunning is the maximum number of namespaces of the team with the
+	// desired state Running at the same time
+	MaxRunning int `json:"maxRunning,omitempty"`
+	// MonthlyRunningHours is the time the namespaces of the team can spend
+	// running during a calendar month, summed over all of them
+	MonthlyRunningHours float64 `json:"monthlyRunningHours,omitempty"`
+}
+
+// Load reads and validates the configuration file
+func Load(path string) (*File, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read configuration file: %w", err)
+	}
+	var f File
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("cannot parse configuration file %s: %w", path, err)
+	}
+	if err := f.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	return &f, nil
+}
+
+// Validate checks the structures of the file. The options are checked when
+// they are applied to the flags.
+func (f *File) Validate() error {
+	var errs []string
+
+	names := make([]string, 0, len(f.Schedules))
+	for name := range f.Schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := f.Schedules[name]
+		if _, err := time.Parse(time.Kitchen, s.DailySuspendTime); err != nil {
+			errs = append(errs, fmt.Sprintf("schedules.%s.dailySuspendTime: '%s' is not a valid time, expected format is '%s'", name, s.DailySuspendTime, time.Kitchen))
+		}
+		for _, d := range s.Days {
+			if _, ok := ParseWeekday(d); !ok {
+				errs = append(errs, fmt.Sprintf("schedules.%s.days: '%s' is not a day of the week", name, d))
+			}
+		}
+	}
+
+	names = make([]string, 0, len(f.Profiles))
+	for name := range f.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := f.Profiles[name]
+		if _, ok := f.Schedules[p.Schedule]; p.Schedule != "" && !ok {
+			errs = append(errs, fmt.Sprintf("profiles.%s.schedule: unknown schedule '%s'", name, p.Schedule))
+		}
+		if p.RunningDuration != "" {
+			if d, err := time.ParseDuration(p.RunningDuration); err != nil || d <= 0 {
+				errs = append(errs, fmt.Sprintf("profiles.%s.runningDuration: '%s' is not a valid duration", name, p.RunningDuration))
+			}
+		}
+	}
+
+	for i, r := range f.ResourceRules {
+		switch r.Kind {
+		case KindDeployment, KindStatefulSet, KindCronJob, KindJob, KindScaledObject:
+		default:
+			errs = append(errs, fmt.Sprintf("resourceRules[%d].kind: '%s' is not supported, expected one of %s, %s, %s, %s or %s", i, r.Kind, KindDeployment, KindStatefulSet, KindCronJob, KindJob, KindScaledObject))
+		}
+		if _, err := labels.Parse(r.Selector); err != nil {
+			errs = append(errs, fmt.Sprintf("resourceRules[%d].selector: %s", i, err))
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, n := range f.Notifications {
+		if n.Name == "" {
+			errs = append(errs, fmt.Sprintf("notifications[%d].name: a name is required", i))
+		} else if seen[n.Name] {
+			errs = append(errs, fmt.Sprintf("notifications[%d].name: duplicated name '%s'", i, n.Name))
+		}
+		seen[n.Name] = true
+		if n.Kind != NotificationWebhook && n.Kind != NotificationSlack {
+			errs = append(errs, fmt.Sprintf("notifications[%d].kind: '%s' is not supported, expected %s or %s", i, n.Kind, NotificationWebhook, NotificationSlack))
+		}
+		if n.URL == "" {
+			errs = append(errs, fmt.Sprintf("notifications[%d].url: an URL is required", i))
+		}
+		for _, s := range n.States {
+			if s != "Running" && s != "Suspended" {
+				errs = append(errs, fmt.Sprintf("notifications[%d].states: '%s' is not a state, expected Running or Suspended", i, s))
+			}
+		}
+	}
+
+	names = make([]string, 0, len(f.Budgets))
+	for name := range f.Budgets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := f.Budgets[name]
+		if b.MaxRunning < 0 {
+			errs = append(errs, fmt.Sprintf("budgets.%s.maxRunning: %d cannot be negative", name, b.MaxRunning))
+		}
+		if b.MonthlyRunningHours < 0 {
+			errs = append(errs, fmt.Sprintf("budgets.%s.monthlyRunningHours: %g cannot be negative", name, b.MonthlyRunningHours))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Apply sets the flags from the options of the file. The flags that have
+// already been set, on the command line or with an environment variable, are
+// left as is.
+func (f *File) Apply(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+
+	names := make([]string, 0, len(f.Options))
+	for name := range f.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []string
+	for _, name := range names {
+		if fs.Lookup(name) == nil || name == "config-file" {
+			errs = append(errs, fmt.Sprintf("options.%s: unknown option", name))
+			continue
+		}
+		if set[name] {
+			continue
+		}
+		var val string
+		switch v := f.Options[name].(type) {
+		case string:
+			val = v
+		case bool, float64:
+			val = fmt.Sprint(v)
+		default:
+			errs = append(errs, fmt.Sprintf("options.%s: expected a string, a number or a boolean", name))
+			continue
+		}
+		if err := fs.Set(name, val); err != nil {
+			errs = append(errs, fmt.Sprintf("options.%s: %s", name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration file: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ParseWeekday returns the day of the week of the given name. The name is
+// case insensitive and can be abbreviated to three letters (Mon, Tue...).
+func ParseWeekday(name string) (time.Weekday, bool) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(name, d.String()) || strings.EqualFold(name, d.String()[:3]) {
+			return d, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/namsral/flag"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			content: `options:
+  log-level: info
+schedules:
+  office-hours:
+    dailySuspendTime: 7:00PM
+    days: [Monday, tue, WED]
+profiles:
+  dev:
+    schedule: office-hours
+    runningDuration: 2h
+resourceRules:
+- kind: StatefulSet
+  selector: app=db
+  namespaces: [team-a]
+- kind: Job
+  selector: app=migration
+notifications:
+- name: team
+  kind: slack
+  url: https://hooks.slack.com/services/x
+  states: [Suspended]
+budgets:
+  team-a:
+    maxRunning: 3
+    monthlyRunningHours: 200
+`,
+		},
+		{
+			name:    "unknown field",
+			content: "schedule: {}\n",
+			wantErr: "unknown field",
+		},
+		{
+			name:    "invalid daily suspend time",
+			content: "schedules:\n  night:\n    dailySuspendTime: \"25:00\"\n",
+			wantErr: "schedules.night.dailySuspendTime",
+		},
+		{
+			name:    "invalid day",
+			content: "schedules:\n  night:\n    dailySuspendTime: 8:00PM\n    days: [Someday]\n",
+			wantErr: "schedules.night.days",
+		},
+		{
+			name:    "unknown schedule",
+			content: "profiles:\n  dev:\n    schedule: night\n",
+			wantErr: "profiles.dev.schedule: unknown schedule 'night'",
+		},
+		{
+			name:    "invalid running duration",
+			content: "profiles:\n  dev:\n    runningDuration: forever\n",
+			wantErr: "profiles.dev.runningDuration",
+		},
+		{
+			name:    "unsupported kind",
+			content: "resourceRules:\n- kind: Pod\n",
+			wantErr: "resourceRules[0].kind",
+		},
+		{
+			name:    "invalid selector",
+			content: "resourceRules:\n- kind: Deployment\n  selector: \"app in (\"\n",
+			wantErr: "resourceRules[0].selector",
+		},
+		{
+			name:    "invalid notification",
+			content: "notifications:\n- name: a\n  kind: mail\n- name: a\n  kind: webhook\n  url: http://x\n  states: [Stopped]\n",
+			wantErr: "notifications[0].url: an URL is required; notifications[1].name: duplicated name 'a'; notifications[1].states",
+		},
+		{
+			name:    "negative budget",
+			content: "budgets:\n  team-a:\n    maxRunning: -1\n",
+			wantErr: "budgets.team-a.maxRunning",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Load(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Load() unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		options     map[string]interface{}
+		wantLevel   string
+		wantIdle    int
+		wantEnabled bool
+		wantErr     bool
+	}{
+		{
+			name:        "file values",
+			options:     map[string]interface{}{"log-level": "info", "watcher-idle": float64(30), "keda-enabled": true},
+			wantLevel:   "info",
+			wantIdle:    30,
+			wantEnabled: true,
+		},
+		{
+			name:      "flags take precedence",
+			args:      []string{"--log-level", "error"},
+			options:   map[string]interface{}{"log-level": "info"},
+			wantLevel: "error",
+			wantIdle:  15,
+		},
+		{
+			name:    "unknown option",
+			options: map[string]interface{}{"log-levl": "info"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			options: map[string]interface{}{"watcher-idle": "soon"},
+			wantErr: true,
+		},
+		{
+			name:    "not a scalar",
+			options: map[string]interface{}{"log-level": []interface{}{"info"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var level string
+			var idle int
+			var enabled bool
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.StringVar(&level, "log-level", "debug", "")
+			fs.IntVar(&idle, "watcher-idle", 15, "")
+			fs.BoolVar(&enabled, "keda-enabled", false, "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			f := &File{Options: tt.options}
+			err := f.Apply(fs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if level != tt.wantLevel || idle != tt.wantIdle || enabled != tt.wantEnabled {
+				t.Errorf("Apply() got log-level=%s watcher-idle=%d keda-enabled=%v", level, idle, enabled)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+)
+
+// reloadDelay is the time waited after the last change of the file before
+// reloading it, as editors and ConfigMap updates write it in several steps
+const reloadDelay = 500 * time.Millisecond
+
+// Watch calls reload each time the file at path changes, until ctx is
+// cancelled. The directory of the file is watched rather than the file
+// itself, so that it keeps working when the file is replaced, as done for the
+// ConfigMaps mounted as volumes.
+func Watch(ctx context.Context, l zerolog.Logger, path string, reload func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("cannot watch configuration file: %w", err)
+	}
+	defer w.Close()
+
+	path = filepath.Clean(path)
+	dir := filepath.Dir(path)
+	if err := w.Add(dir); err != nil {
+		return fmt.Errorf("cannot watch configuration file: %w", err)
+	}
+	l.Info().Msgf("watching configuration file %s", path)
+
+	// ConfigMaps volumes switch a ..data symlink to update all their files
+	data := filepath.Join(dir, "..data")
+	timer := time.NewTimer(0)
+	<-timer.C
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if name := filepath.Clean(ev.Name); name != path && name != data {
+				continue
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			l.Debug().Msgf("configuration file changed (%s)", ev.Op)
+			timer.Reset(reloadDelay)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			l.Error().Err(err).Msg("error while watching configuration file")
+		case <-timer.C:
+			reload()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/audit"
+	"github.com/govirtuo/kube-ns-suspender/notify"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recordTransition writes a state transition to the audit sink and notifies
+// it. Failing to record or notify a transition is logged but does not stop
+// the processing.
+func (eng *Engine) recordTransition(ctx context.Context, l zerolog.Logger, n v1.Namespace, from, to string, origin audit.Origin, actor, msg string) {
+	r := audit.Record{
+		Time:      eng.Clock.Now().Local(),
+		Namespace: n.Name,
+		From:      from,
+		To:        to,
+		Origin:    origin,
+		Actor:     actor,
+		Message:   msg,
+	}
+	if err := eng.Audit.Write(ctx, r); err != nil {
+		l.Error().Err(err).Str("namespace", n.Name).Msg("cannot write audit record")
+	}
+	eng.notifyTransition(ctx, l, n, r)
+}
+
+// notifyTransition sends a state transition to the notification sinks of the
+// configuration file and of the policy selecting the namespace
+func (eng *Engine) notifyTransition(ctx context.Context, l zerolog.Logger, ns v1.Namespace, r audit.Record) {
+	n := notify.Notification{
+		Time:      r.Time,
+		Namespace: r.Namespace,
+		From:      r.From,
+		To:        r.To,
+		Origin:    string(r.Origin),
+		Actor:     r.Actor,
+		Message:   r.Message,
+	}
+	cur := eng.settings()
+	if err := cur.notifier.Notify(ctx, n); err != nil {
+		l.Error().Err(err).Str("namespace", r.Namespace).Msg("cannot send notification")
+	}
+	if p := cur.policyOf(ns); p != nil {
+		if err := p.notifier.Notify(ctx, n); err != nil {
+			l.Error().Err(err).Str("namespace", r.Namespace).Str("policy", p.name).Msg("cannot send notification")
+		}
+	}
+}
+
+// detectManualTransitions compares the desired state of the namespaces with
+// the one seen during the last inventory. The changes that have not been done
+// by the controller or the web UI (which record their own transitions) are
+// recorded as manual edits, with the field manager that did the change as
+// actor. The changes done by the web UI are only notified, as the web UI can
+// run without the controller.
+func (eng *Engine) detectManualTransitions(ctx context.Context, l zerolog.Logger, namespaces []v1.Namespace) {
+	for _, n := range namespaces {
+		state := n.Annotations[eng.Options.Prefix+DesiredState]
+		known, ok := eng.knownStates[n.Name]
+		if !ok || known == state {
+			continue
+		}
+
+		manager := lastManagerOf(n, eng.Options.Prefix+DesiredState)
+		if manager == FieldManager {
+			continue
+		}
+		if manager == WebUIFieldManager {
+			eng.notifyTransition(ctx, l, n, audit.Record{Time: eng.Clock.Now().Local(), Namespace: n.Name, From: known, To: state, Origin: audit.OriginWebUI})
+			continue
+		}
+		l.Info().Str("namespace", n.Name).Msgf("desired state manually changed from '%s' to '%s' by '%s'", known, state, manager)
+		eng.recordTransition(ctx, l, n, known, state, audit.OriginManual, manager, "annotation edited outside of the controller")
+	}
+}
+
+// updateKnownStates saves the desired state of the namespaces for the next
+// inventory. Namespaces that are not managed anymore are forgotten.
+func (eng *Engine) updateKnownStates(namespaces []v1.Namespace) {
+	known := make(map[string]string, len(namespaces))
+	for _, n := range namespaces {
+		known[n.Name] = n.Annotations[eng.Options.Prefix+DesiredState]
+	}
+	eng.knownStates = known
+}
+
+// lastManagerOf returns the name of the field manager that did the most recent
+// update of the given annotation, or "unknown" if it cannot be found.
+func lastManagerOf(n v1.Namespace, annotation string) string {
+	manager, _ := lastUpdateOf(n, annotation)
+	return manager
+}
+
+// lastUpdateOf returns the name of the field manager that did the most recent
+// update of the given annotation and the time of the update, or "unknown" and
+// the zero time if it cannot be found.
+func lastUpdateOf(n v1.Namespace, annotation string) (string, time.Time) {
+	return lastFieldUpdate(n.ManagedFields, "f:metadata", "f:annotations", "f:"+annotation)
+}
+
+// lastFieldUpdate returns the name of the field manager that did the most
+// recent update of the field at path in the managed fields of an object, e.g.
+// "f:spec", "f:desiredState", and the time of the update, or "unknown" and the
+// zero time if it cannot be found.
+func lastFieldUpdate(managedFields []metav1.ManagedFieldsEntry, path ...string) (string, time.Time) {
+	manager := "unknown"
+	var last time.Time
+	for _, mf := range managedFields {
+		if mf.FieldsV1 == nil || mf.Time == nil {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(mf.FieldsV1.Raw, &fields); err != nil || !hasField(fields, path) {
+			continue
+		}
+		if mf.Time.Time.After(last) {
+			last = mf.Time.Time
+			manager = mf.Manager
+		}
+	}
+	return manager, last
+}
+
+// hasField returns true if the managed fields hold the field at path
+func hasField(fields map[string]interface{}, path []string) bool {
+	for i, key := range path {
+		child, ok := fields[key]
+		if !ok {
+			return false
+		}
+		if i == len(path)-1 {
+			return true
+		}
+		if fields, ok = child.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return false
+}
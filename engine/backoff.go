@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// backoffs holds the namespaces whose last reconciliation failed. They are not
+// sent to the Suspender again before their retry time, which grows
+// exponentially with the number of consecutive failures. It is accessed by both
+// the Watcher and the Suspender.
+type backoffs struct {
+	mu         sync.Mutex
+	namespaces map[string]*backoff
+}
+
+type backoff struct {
+	// failures is the number of consecutive failed reconciliations
+	failures int
+	// retryAt is the time before which the namespace is not reconciled again
+	retryAt time.Time
+}
+
+// backoffDelay returns the delay before retrying a namespace that failed the
+// given number of consecutive times. It starts at the watcher idle duration
+// and doubles at each failure, up to the maximum backoff.
+func (eng *Engine) backoffDelay(failures int) time.Duration {
+	s := eng.settings()
+	delay := s.watcherIdle
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if delay >= s.maxBackoff {
+			return s.maxBackoff
+		}
+	}
+	if delay > s.maxBackoff {
+		return s.maxBackoff
+	}
+	return delay
+}
+
+// reconcileFailed records a failed reconciliation of a namespace, and returns
+// the delay before it is retried
+func (eng *Engine) reconcileFailed(ns string) time.Duration {
+	eng.backoffs.mu.Lock()
+	b, ok := eng.backoffs.namespaces[ns]
+	if !ok {
+		b = &backoff{}
+		eng.backoffs.namespaces[ns] = b
+	}
+	b.failures++
+	delay := eng.backoffDelay(b.failures)
+	b.retryAt = eng.Clock.Now().Add(delay)
+	failures := b.failures
+	eng.backoffs.mu.Unlock()
+
+	eng.MetricsServ.NamespaceFailures.WithLabelValues(ns).Set(float64(failures))
+	return delay
+}
+
+// reconcileSucceeded records a successful reconciliation of a namespace, which
+// resets its backoff. Its failures series is removed, so that only the
+// failing namespaces are exported.
+func (eng *Engine) reconcileSucceeded(ns string) {
+	eng.backoffs.mu.Lock()
+	_, ok := eng.backoffs.namespaces[ns]
+	delete(eng.backoffs.namespaces, ns)
+	eng.backoffs.mu.Unlock()
+
+	if ok {
+		eng.MetricsServ.NamespaceFailures.DeletePartialMatch(prometheus.Labels{"namespace": ns})
+	}
+}
+
+// backingOff tells if a namespace must not be reconciled yet, and until when
+func (eng *Engine) backingOff(ns string) (time.Time, bool) {
+	eng.backoffs.mu.Lock()
+	defer eng.backoffs.mu.Unlock()
+	b, ok := eng.backoffs.namespaces[ns]
+	if !ok || eng.Clock.Now().After(b.retryAt) {
+		return time.Time{}, false
+	}
+	return b.retryAt, true
+}
+
+// forgetBackoff removes a namespace that is not managed anymore
+func (eng *Engine) forgetBackoff(ns string) {
+	eng.backoffs.mu.Lock()
+	delete(eng.backoffs.namespaces, ns)
+	eng.backoffs.mu.Unlock()
+
+	eng.MetricsServ.NamespaceFailures.DeletePartialMatch(prometheus.Labels{"namespace": ns})
+}
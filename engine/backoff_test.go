@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func Test_backoffDelay(t *testing.T) {
+	tests := []struct {
+		name        string
+		watcherIdle int
+		maxBackoff  string
+		failures    int
+		want        time.Duration
+	}{
+		{name: "first failure", watcherIdle: 15, maxBackoff: "10m", failures: 1, want: 15 * time.Second},
+		{name: "doubled", watcherIdle: 15, maxBackoff: "10m", failures: 2, want: 30 * time.Second},
+		{name: "doubled twice", watcherIdle: 15, maxBackoff: "10m", failures: 3, want: time.Minute},
+		{name: "below the maximum", watcherIdle: 15, maxBackoff: "10m", failures: 6, want: 8 * time.Minute},
+		{name: "capped", watcherIdle: 15, maxBackoff: "10m", failures: 7, want: 10 * time.Minute},
+		{name: "many failures", watcherIdle: 15, maxBackoff: "10m", failures: 100, want: 10 * time.Minute},
+		{name: "maximum below the watcher idle", watcherIdle: 60, maxBackoff: "30s", failures: 1, want: 30 * time.Second},
+		{name: "no watcher idle", watcherIdle: 0, maxBackoff: "10m", failures: 2, want: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eng := newTestEngine(t, time.Now(), false, false)
+			opt := eng.Options
+			opt.WatcherIdle = tt.watcherIdle
+			opt.MaxBackoff = tt.maxBackoff
+			if _, err := eng.Reload(opt); err != nil {
+				t.Fatal(err)
+			}
+			if got := eng.backoffDelay(tt.failures); got != tt.want {
+				t.Errorf("backoffDelay(%d) = %s, want %s", tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_reconcileFailed(t *testing.T) {
+	now := time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local)
+	clk := clocktesting.NewFakePassiveClock(now)
+
+	for _, forget := range []bool{false, true} {
+		eng := newTestEngine(t, now, false, false)
+		eng.Clock = clk
+		clk.SetTime(now)
+
+		for i, want := range []time.Duration{15 * time.Second, 30 * time.Second} {
+			if got := eng.reconcileFailed(testNamespace); got != want {
+				t.Fatalf("reconcileFailed() #%d = %s, want %s", i+1, got, want)
+			}
+		}
+		if retryAt, ok := eng.backingOff(testNamespace); !ok || !retryAt.Equal(now.Add(30*time.Second)) {
+			t.Errorf("backingOff() = %s, %v, want until %s", retryAt, ok, now.Add(30*time.Second))
+		}
+		if got := testutil.ToFloat64(eng.MetricsServ.NamespaceFailures.WithLabelValues(testNamespace)); got != 2 {
+			t.Errorf("consecutive failures = %v, want 2", got)
+		}
+		clk.SetTime(now.Add(31 * time.Second))
+		if _, ok := eng.backingOff(testNamespace); ok {
+			t.Error("still backing off after the retry time")
+		}
+
+		if forget {
+			eng.forgetBackoff(testNamespace)
+		} else {
+			eng.reconcileSucceeded(testNamespace)
+		}
+		eng.backoffs.mu.Lock()
+		_, ok := eng.backoffs.namespaces[testNamespace]
+		eng.backoffs.mu.Unlock()
+		if ok {
+			t.Errorf("backoff kept (forget = %v)", forget)
+		}
+		if got := testutil.CollectAndCount(eng.MetricsServ.NamespaceFailures); got != 0 {
+			t.Errorf("%d consecutive failures series kept (forget = %v), want none", got, forget)
+		}
+		// the delay starts again from the beginning
+		if got := eng.reconcileFailed(testNamespace); got != 15*time.Second {
+			t.Errorf("reconcileFailed() = %s after the reset, want 15s", got)
+		}
+	}
+}
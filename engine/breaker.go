@@ -0,0 +1,215 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Breaker is the circuit breaker pausing the automatic suspensions when too
+// many namespaces would be suspended within one inventory, which is more
+// likely to come from a wrong annotation or policy than from the schedules.
+// The namespaces due for suspension by their schedule are counted along with
+// the ones whose desired state has just been set to Suspended, e.g. by a bulk
+// edit of the annotations or by their group. It stays open until it is reset. A nil *Breaker means that the circuit breaker
+// is disabled. It is safe for concurrent use.
+type Breaker struct {
+	mu sync.Mutex
+	// maxCount and maxPercent are the number and percentage of managed
+	// namespaces that can be suspended within one inventory. Zero means no
+	// limit.
+	maxCount   int
+	maxPercent float64
+	status     BreakerStatus
+	// approving tells that the breaker has been reset, and that the
+	// namespaces due for suspension at the next inventory are approved
+	approving bool
+	// approved are the namespaces approved by the last reset. They are not
+	// counted again by the next inventories, which may not have handled them
+	// yet, until they are no longer due.
+	approved map[string]bool
+	// lastDue are the namespaces due at the last check. The controller
+	// suspends them afterwards, so they are not counted again when their
+	// desired state changes to Suspended.
+	lastDue map[string]bool
+	// held are the namespaces whose desired state has been set to Suspended
+	// while the breaker is open. Their suspension is paused until the
+	// breaker is reset.
+	held map[string]bool
+}
+
+// BreakerStatus is the state of the circuit breaker
+type BreakerStatus struct {
+	Open     bool       `json:"open"`
+	OpenedAt *time.Time `json:"openedAt,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+}
+
+// NewBreaker returns a closed circuit breaker with the given limits
+func NewBreaker(maxCount int, maxPercent float64) *Breaker {
+	return &Breaker{maxCount: maxCount, maxPercent: maxPercent}
+}
+
+// Status returns the state of the circuit breaker
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status
+}
+
+// Reset closes the circuit breaker. The namespaces due for suspension at the
+// next inventory are approved: they are not counted again until they have been
+// suspended, so that the suspensions that opened the breaker can be done, even
+// over several inventories. The namespaces held are released.
+func (b *Breaker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status = BreakerStatus{}
+	b.approving = true
+	b.held = nil
+}
+
+// check opens the circuit breaker if the due namespaces and the suspended
+// ones, whose desired state has just been set to Suspended, out of total
+// managed namespaces, exceed the limits. The namespaces approved by the last
+// reset are not counted, nor the suspended ones that were due at the last
+// check. The suspended namespaces are held while the breaker is open. It
+// returns true if the breaker has just been opened.
+func (b *Breaker) check(due, suspended []string, total int, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lastDue := b.lastDue
+	b.lastDue = make(map[string]bool, len(due))
+	for _, name := range due {
+		b.lastDue[name] = true
+	}
+	if b.approving {
+		b.approving = false
+		b.approved = make(map[string]bool, len(due))
+		for _, name := range due {
+			b.approved[name] = true
+		}
+		return false
+	}
+
+	// the approved namespaces that are no longer due have been handled
+	approved := make(map[string]bool, len(b.approved))
+	count := 0
+	for _, name := range due {
+		if b.approved[name] {
+			approved[name] = true
+			continue
+		}
+		count++
+	}
+	b.approved = approved
+	// the suspended namespaces that were due have been suspended by the
+	// controller, and are already counted
+	var suspendedNow []string
+	for _, name := range suspended {
+		if !lastDue[name] {
+			suspendedNow = append(suspendedNow, name)
+		}
+	}
+	count += len(suspendedNow)
+
+	opened := false
+	if !b.status.Open {
+		var reason string
+		switch {
+		case b.maxCount > 0 && count > b.maxCount:
+			reason = fmt.Sprintf("%d namespaces would be suspended, more than the limit of %d", count, b.maxCount)
+		case b.maxPercent > 0 && total > 0 && float64(count)*100/float64(total) > b.maxPercent:
+			reason = fmt.Sprintf("%d out of %d namespaces would be suspended, more than the limit of %g%%", count, total, b.maxPercent)
+		}
+		if reason != "" {
+			b.status = BreakerStatus{Open: true, OpenedAt: &now, Reason: reason}
+			opened = true
+		}
+	}
+	if b.status.Open && len(suspendedNow) > 0 {
+		if b.held == nil {
+			b.held = make(map[string]bool, len(suspendedNow))
+		}
+		for _, name := range suspendedNow {
+			b.held[name] = true
+		}
+	}
+	return opened
+}
+
+// holds returns true if the suspension of the namespace is paused until the
+// breaker is reset
+func (b *Breaker) holds(name string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.held[name]
+}
+
+// paused returns true if the automatic suspensions are paused: the circuit
+// breaker is open and not overridden
+func (b *Breaker) paused(override bool) bool {
+	if b == nil || override {
+		return false
+	}
+	return b.Status().Open
+}
+
+// checkBreaker counts the managed namespaces that would be suspended by their
+// schedule during this inventory, and the ones whose desired state has been
+// set to Suspended since the last inventory, and opens the circuit breaker if
+// there are too many of them. Their suspension is then paused until the
+// breaker is reset.
+func (eng *Engine) checkBreaker(l zerolog.Logger, namespaces []corev1.Namespace) {
+	if eng.Breaker == nil {
+		return
+	}
+	cur := eng.settings()
+	now := eng.Clock.Now()
+
+	var due, suspended []corev1.Namespace
+	var dueNames, suspendedNames []string
+	for _, n := range namespaces {
+		if eng.Scope.Protected(n.Name) {
+			continue
+		}
+		switch n.Annotations[eng.Options.Prefix+DesiredState] {
+		case Running:
+			if cur.dueForSuspension(n, eng.Options.Prefix, now) {
+				due = append(due, n)
+				dueNames = append(dueNames, n.Name)
+			}
+		case Suspended:
+			if eng.knownStates[n.Name] == Running {
+				suspended = append(suspended, n)
+				suspendedNames = append(suspendedNames, n.Name)
+			}
+		}
+	}
+	opened := eng.Breaker.check(dueNames, suspendedNames, len(namespaces), now)
+	status := eng.Breaker.Status()
+	if opened {
+		l.Error().Int("due", len(due)).Int("suspended", len(suspended)).Msgf("circuit breaker opened, automatic suspensions paused until it is reset: %s", status.Reason)
+		for _, n := range due {
+			eng.Recorder.Eventf(namespaceRef(n), corev1.EventTypeWarning, ReasonSuspensionPaused, "automatic suspension paused by the circuit breaker: %s", status.Reason)
+		}
+	}
+	if status.Open {
+		for _, n := range suspended {
+			if eng.Breaker.holds(n.Name) {
+				eng.Recorder.Eventf(namespaceRef(n), corev1.EventTypeWarning, ReasonSuspensionPaused, "suspension paused by the circuit breaker: %s", status.Reason)
+			}
+		}
+	}
+
+	if status.Open && cur.breakerOverride {
+		l.Warn().Msg("circuit breaker open but overridden, automatic suspensions are done")
+	}
+	eng.MetricsServ.CircuitBreakerOpen.Set(boolToFloat(status.Open))
+}
@@ -0,0 +1,301 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/govirtuo/kube-ns-suspender/policy"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBreaker(t *testing.T) {
+	ctx := context.Background()
+	// the namespaces are all due for suspension at 20:00
+	eng := newTestEngine(t, time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local), false, false)
+	eng.Breaker = NewBreaker(2, 0)
+
+	var namespaces []corev1.Namespace
+	cs := fake.NewSimpleClientset()
+	for _, name := range []string{"team-a", "team-b", "team-c"} {
+		n := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{
+			testPrefix + ControllerName:   "kube-ns-suspender",
+			testPrefix + DesiredState:     Running,
+			testPrefix + DailySuspendTime: "8:00PM",
+		}}}
+		if _, err := cs.CoreV1().Namespaces().Create(ctx, &n, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		namespaces = append(namespaces, n)
+	}
+	// reconcile does an inventory, and reconciles the namespaces returned
+	reconcile := func() {
+		t.Helper()
+		list, err := cs.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range eng.inventory(ctx, zerolog.Nop(), cs, nil, list.Items) {
+			if err := eng.reconcile(ctx, cs, nil, nil, n); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	suspended := func() int {
+		t.Helper()
+		var count int
+		for _, n := range namespaces {
+			res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Annotations[testPrefix+DesiredState] == Suspended {
+				count++
+			}
+		}
+		return count
+	}
+
+	reconcile()
+	if !eng.Breaker.Status().Open {
+		t.Fatal("breaker closed, want it open as 3 namespaces are due")
+	}
+	if got := suspended(); got != 0 {
+		t.Errorf("%d namespaces suspended while the breaker is open, want 0", got)
+	}
+
+	// the override lets the suspensions through without closing the breaker
+	opt := eng.Options
+	opt.CircuitBreakerOverride = true
+	if _, err := eng.Reload(opt); err != nil {
+		t.Fatal(err)
+	}
+	if !eng.Breaker.paused(false) || eng.Breaker.paused(eng.settings().breakerOverride) {
+		t.Error("breaker not overridden")
+	}
+	opt.CircuitBreakerOverride = false
+	if _, err := eng.Reload(opt); err != nil {
+		t.Fatal(err)
+	}
+
+	// once reset, the suspensions that opened the breaker are done
+	eng.Breaker.Reset()
+	reconcile()
+	if eng.Breaker.Status().Open {
+		t.Error("breaker open after a reset")
+	}
+	if got := suspended(); got != 3 {
+		t.Errorf("%d namespaces suspended after a reset, want 3", got)
+	}
+}
+
+func TestBreaker_check(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxCount   int
+		maxPercent float64
+		due, total int
+		// suspended are the namespaces just set to Suspended
+		suspended int
+		want      bool
+	}{
+		{name: "under the limits", maxCount: 5, maxPercent: 50, due: 5, total: 10},
+		{name: "over the count", maxCount: 5, due: 6, total: 100, want: true},
+		{name: "over the count with the suspended", maxCount: 5, due: 3, suspended: 3, total: 100, want: true},
+		{name: "over the percentage", maxPercent: 50, due: 6, total: 10, want: true},
+		{name: "no namespace", maxPercent: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBreaker(tt.maxCount, tt.maxPercent)
+			due := make([]string, tt.due)
+			for i := range due {
+				due[i] = fmt.Sprintf("team-%d", i)
+			}
+			suspended := make([]string, tt.suspended)
+			for i := range suspended {
+				suspended[i] = fmt.Sprintf("team-s%d", i)
+			}
+			if got := b.check(due, suspended, tt.total, time.Now()); got != tt.want {
+				t.Errorf("check() = %v, want %v", got, tt.want)
+			}
+			if got := b.Status().Open; got != tt.want {
+				t.Errorf("breaker open = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerResetSeveralInventories(t *testing.T) {
+	ctx := context.Background()
+	// the namespaces are all due for suspension at 20:00, and the suspender
+	// handles one namespace per inventory
+	eng := newTestEngine(t, time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local), false, false)
+	eng.Breaker = NewBreaker(2, 0)
+
+	cs := fake.NewSimpleClientset()
+	for i := 0; i < 5; i++ {
+		n := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("team-%d", i), Annotations: map[string]string{
+			testPrefix + ControllerName:   "kube-ns-suspender",
+			testPrefix + DesiredState:     Running,
+			testPrefix + DailySuspendTime: "8:00PM",
+		}}}
+		if _, err := cs.CoreV1().Namespaces().Create(ctx, &n, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// reconcileOne does an inventory, and reconciles the first namespace
+	// still running. It returns false if none is.
+	reconcileOne := func() bool {
+		t.Helper()
+		list, err := cs.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range eng.inventory(ctx, zerolog.Nop(), cs, nil, list.Items) {
+			if n.Annotations[testPrefix+DesiredState] != Running || eng.Breaker.Status().Open {
+				continue
+			}
+			if err := eng.reconcile(ctx, cs, nil, nil, n); err != nil {
+				t.Fatal(err)
+			}
+			return true
+		}
+		return false
+	}
+
+	reconcileOne()
+	if !eng.Breaker.Status().Open {
+		t.Fatal("breaker closed, want it open as 5 namespaces are due")
+	}
+
+	// the namespaces approved by the reset are not counted again by the next
+	// inventories
+	eng.Breaker.Reset()
+	handled := 0
+	for reconcileOne() {
+		handled++
+		if eng.Breaker.Status().Open {
+			t.Fatalf("breaker reopened after %d namespaces were suspended: %s", handled, eng.Breaker.Status().Reason)
+		}
+	}
+	if handled != 5 {
+		t.Errorf("%d namespaces suspended after a reset, want 5", handled)
+	}
+
+	// the namespaces due afterwards are counted again
+	for i := 5; i < 8; i++ {
+		n := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("team-%d", i), Annotations: map[string]string{
+			testPrefix + ControllerName:   "kube-ns-suspender",
+			testPrefix + DesiredState:     Running,
+			testPrefix + DailySuspendTime: "8:00PM",
+		}}}
+		if _, err := cs.CoreV1().Namespaces().Create(ctx, &n, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reconcileOne()
+	if !eng.Breaker.Status().Open {
+		t.Error("breaker closed, want it open as 3 new namespaces are due")
+	}
+}
+
+func TestBreakerBulkChanges(t *testing.T) {
+	tests := []struct {
+		name string
+		// change suspends the namespaces at once
+		change func(t *testing.T, cs *fake.Clientset, lister *fakePolicies)
+	}{
+		{
+			name: "policy schedule",
+			change: func(t *testing.T, cs *fake.Clientset, lister *fakePolicies) {
+				lister.policies = []policy.SuspendPolicy{testPolicy("previews", 0, map[string]string{"env": "preview"}, policy.Spec{
+					Schedules: []config.Schedule{{DailySuspendTime: "8:00PM"}},
+				})}
+			},
+		},
+		{
+			name: "desiredState annotations",
+			change: func(t *testing.T, cs *fake.Clientset, lister *fakePolicies) {
+				for i := 0; i < 3; i++ {
+					if err := patchNamespaceAnnotations(context.Background(), cs, nil, fmt.Sprintf("preview-%d", i), map[string]string{testPrefix + DesiredState: Suspended}); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			eng := newTestEngine(t, time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local), false, false)
+			eng.Breaker = NewBreaker(2, 0)
+			lister := &fakePolicies{}
+			eng.Policies = lister
+
+			cs := fake.NewSimpleClientset()
+			for i := 0; i < 3; i++ {
+				n := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:        fmt.Sprintf("preview-%d", i),
+					Labels:      map[string]string{"env": "preview"},
+					Annotations: map[string]string{testPrefix + ControllerName: "kube-ns-suspender", testPrefix + DesiredState: Running},
+				}}
+				if _, err := cs.CoreV1().Namespaces().Create(ctx, &n, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// reconcile does an inventory, reconciles the namespaces returned
+			// and returns the number of suspended ones
+			reconcile := func() int {
+				t.Helper()
+				list, err := cs.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, n := range eng.inventory(ctx, zerolog.Nop(), cs, nil, list.Items) {
+					if err := eng.reconcile(ctx, cs, nil, nil, n); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if list, err = cs.CoreV1().Namespaces().List(ctx, metav1.ListOptions{}); err != nil {
+					t.Fatal(err)
+				}
+				var count int
+				for _, n := range list.Items {
+					if n.Annotations[testPrefix+ObservedState] == Suspended {
+						count++
+					}
+				}
+				return count
+			}
+
+			if got := reconcile(); got != 0 || eng.Breaker.Status().Open {
+				t.Fatalf("%d namespaces suspended, breaker open = %v, want none and closed", got, eng.Breaker.Status().Open)
+			}
+			tt.change(t, cs, lister)
+			if got := reconcile(); got != 0 {
+				t.Errorf("%d namespaces suspended at once, want none", got)
+			}
+			if !eng.Breaker.Status().Open {
+				t.Fatal("breaker closed, want it open as 3 namespaces are suspended at once")
+			}
+			if got := reconcile(); got != 0 {
+				t.Errorf("%d namespaces suspended while the breaker is open, want none", got)
+			}
+
+			eng.Breaker.Reset()
+			if got := reconcile(); got != 3 {
+				t.Errorf("%d namespaces suspended after a reset, want 3", got)
+			}
+			if eng.Breaker.Status().Open {
+				t.Errorf("breaker reopened: %s", eng.Breaker.Status().Reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ErrBudgetExceeded is returned when a namespace cannot be resumed because
+// its team is over budget
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Budgets tracks the running namespaces of each team, and the time they spent
+// running during the current month, to enforce the budgets of the teams. The
+// team of a namespace is the value of its team label. The running hours are
+// kept in memory and start again from zero when the controller restarts. It
+// is safe for concurrent use.
+type Budgets struct {
+	mu        sync.Mutex
+	teamLabel string
+	// admins are the web UI users allowed to resume a namespace over budget,
+	// and adminManagers the field managers allowed to do it by editing the
+	// annotations. They are kept apart, so that a user named after a field
+	// manager is not taken for it.
+	admins        map[string]bool
+	adminManagers map[string]bool
+	limits        map[string]config.Budget
+	usage         map[string]*teamUsage
+	// admitted are the namespaces admitted by Admit since they were last
+	// inventoried, i.e. resumed from the web UI embedded in the controller
+	admitted map[string]bool
+	// month is the month of the running hours (e.g. 2024-03)
+	month        string
+	lastObserved time.Time
+}
+
+// teamUsage is the consumption of a team
+type teamUsage struct {
+	running      int
+	runningHours float64
+	// rejections is the number of resumes rejected during the month
+	rejections int
+}
+
+// BudgetUsage is the consumption of a team with a budget, compared to its
+// limits. A zero limit means no limit.
+type BudgetUsage struct {
+	Team                string  `json:"team"`
+	Running             int     `json:"running"`
+	MaxRunning          int     `json:"maxRunning,omitempty"`
+	RunningHours        float64 `json:"runningHours"`
+	MonthlyRunningHours float64 `json:"monthlyRunningHours,omitempty"`
+	Rejections          int     `json:"rejections"`
+}
+
+// NewBudgets returns budgets without limits, identifying the teams of the
+// namespaces with the given label. The admins are web UI users, and the
+// adminManagers field managers.
+func NewBudgets(teamLabel string, admins, adminManagers []string) *Budgets {
+	b := &Budgets{
+		teamLabel:     teamLabel,
+		admins:        make(map[string]bool, len(admins)),
+		adminManagers: make(map[string]bool, len(adminManagers)),
+		limits:        make(map[string]config.Budget),
+		usage:         make(map[string]*teamUsage),
+		admitted:      make(map[string]bool),
+	}
+	for _, a := range admins {
+		b.admins[a] = true
+	}
+	for _, m := range adminManagers {
+		b.adminManagers[m] = true
+	}
+	return b
+}
+
+// setLimits replaces the budgets of the teams. The consumption is kept.
+func (b *Budgets) setLimits(limits map[string]config.Budget) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limits = make(map[string]config.Budget, len(limits))
+	for team, l := range limits {
+		b.limits[team] = l
+	}
+}
+
+// TeamOf returns the team of the namespace, or an empty string if it has
+// none
+func (b *Budgets) TeamOf(n corev1.Namespace) string {
+	return n.Labels[b.teamLabel]
+}
+
+// Admit checks that the namespace can be resumed by actor, a web UI user, and
+// counts it as running until the next inventory. An admin can resume a namespace over
+// budget by asking for an override. The returned error wraps
+// ErrBudgetExceeded and tells which limit is reached. The namespace is not
+// checked again by the next inventory, unless its admission is released
+// because its resume failed.
+func (b *Budgets) Admit(n corev1.Namespace, actor string, override bool) error {
+	return b.AdmitAll([]corev1.Namespace{n}, actor, override)
+}
+
+// AdmitAll is Admit for several namespaces resumed together. Either all of
+// them are admitted, or none.
+func (b *Budgets) AdmitAll(namespaces []corev1.Namespace, actor string, override bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.check(namespaces, actor, override, b.admins); err != nil {
+		return err
+	}
+	for _, n := range namespaces {
+		b.admitted[n.Name] = true
+	}
+	return nil
+}
+
+// Release cancels the admission of a namespace whose resume could not be
+// written: it is no longer counted as running, and an unrelated resume of the
+// namespace is not taken as admitted by the next inventory.
+func (b *Budgets) Release(n corev1.Namespace) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.admitted[n.Name] {
+		return
+	}
+	delete(b.admitted, n.Name)
+	b.uncount(n)
+}
+
+// release is Release for a namespace admitted by admit
+func (b *Budgets) release(n corev1.Namespace) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.uncount(n)
+}
+
+// uncount stops counting the namespace as running. b.mu must be held.
+func (b *Budgets) uncount(n corev1.Namespace) {
+	team := b.TeamOf(n)
+	if _, ok := b.limits[team]; team == "" || !ok {
+		return
+	}
+	if u := b.usageOf(team); u.running > 0 {
+		u.running--
+	}
+}
+
+// admit is AdmitAll for the namespaces resumed by a field manager, without
+// remembering them
+func (b *Budgets) admit(namespaces []corev1.Namespace, manager string, override bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.check(namespaces, manager, override, b.adminManagers)
+}
+
+// isAdminManager returns true if the field manager is allowed to resume a
+// namespace over budget
+func (b *Budgets) isAdminManager(manager string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.adminManagers[manager]
+}
+
+// takeAdmitted returns true if the namespace has been admitted by Admit
+// since it was last inventoried, and forgets it
+func (b *Budgets) takeAdmitted(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	admitted := b.admitted[name]
+	delete(b.admitted, name)
+	return admitted
+}
+
+// check checks that the namespaces can be resumed together by actor, and
+// counts them as running. Either all of them are counted, or none. actor can
+// override the budgets if it is one of the admins. b.mu must be held.
+func (b *Budgets) check(namespaces []corev1.Namespace, actor string, override bool, admins map[string]bool) error {
+	var teams, names []string
+	resumed := make(map[string]int)
+	for _, n := range namespaces {
+		names = append(names, n.Name)
+		team := b.TeamOf(n)
+		if _, ok := b.limits[team]; team == "" || !ok {
+			continue
+		}
+		if resumed[team] == 0 {
+			teams = append(teams, team)
+		}
+		resumed[team]++
+	}
+	subject := "namespace " + strings.Join(names, ", ")
+	if len(names) > 1 {
+		subject = "namespaces " + strings.Join(names, ", ")
+	}
+
+	for _, team := range teams {
+		limit := b.limits[team]
+		u := b.usageOf(team)
+
+		var err error
+		switch {
+		case limit.MaxRunning > 0 && u.running+resumed[team] > limit.MaxRunning:
+			err = fmt.Errorf("%w: team '%s' already has %d running namespaces, the maximum is %d", ErrBudgetExceeded, team, u.running, limit.MaxRunning)
+		case limit.MonthlyRunningHours > 0 && u.runningHours >= limit.MonthlyRunningHours:
+			err = fmt.Errorf("%w: team '%s' used %.1f of its %g running hours this month", ErrBudgetExceeded, team, u.runningHours, limit.MonthlyRunningHours)
+		}
+		if err == nil {
+			continue
+		}
+		if !override {
+			u.rejections++
+			return fmt.Errorf("%s cannot be resumed: %w", subject, err)
+		}
+		if !admins[actor] {
+			u.rejections++
+			return fmt.Errorf("%s cannot be resumed: %w, and '%s' is not allowed to override it", subject, err, actor)
+		}
+	}
+	for _, team := range teams {
+		b.usageOf(team).running += resumed[team]
+	}
+	return nil
+}
+
+// usageOf returns the consumption of the team. b.mu must be held.
+func (b *Budgets) usageOf(team string) *teamUsage {
+	u, ok := b.usage[team]
+	if !ok {
+		u = &teamUsage{}
+		b.usage[team] = u
+	}
+	return u
+}
+
+// observe counts the running namespaces of each team, and adds the time
+// elapsed since the last inventory to the running hours of the teams. The
+// running hours start again from zero each month.
+func (b *Budgets) observe(namespaces []corev1.Namespace, prefix string, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var elapsed time.Duration
+	if !b.lastObserved.IsZero() {
+		elapsed = now.Sub(b.lastObserved)
+	}
+	b.lastObserved = now
+	if month := now.Local().Format("2006-01"); month != b.month {
+		b.month = month
+		for _, u := range b.usage {
+			u.runningHours = 0
+			u.rejections = 0
+		}
+	}
+
+	for _, u := range b.usage {
+		u.running = 0
+	}
+	for _, n := range namespaces {
+		team := b.TeamOf(n)
+		if team == "" || n.Annotations[prefix+DesiredState] != Running {
+			continue
+		}
+		u := b.usageOf(team)
+		u.running++
+		u.runningHours += elapsed.Hours()
+	}
+}
+
+// Usage returns the consumption of the teams with a budget, by team name
+func (b *Budgets) Usage() []BudgetUsage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	usage := make([]BudgetUsage, 0, len(b.limits))
+	for team, l := range b.limits {
+		u := b.usageOf(team)
+		usage = append(usage, BudgetUsage{Team: team, Running: u.running, MaxRunning: l.MaxRunning,
+			RunningHours: u.runningHours, MonthlyRunningHours: l.MonthlyRunningHours, Rejections: u.rejections})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Team < usage[j].Team })
+	return usage
+}
+
+// enforceBudgets reverts the resumes done by editing the desiredState
+// annotation of namespaces whose team is over budget, then updates the
+// consumption of the teams. The changes done by the controller, and the ones
+// already admitted by the web UI embedded in the controller, are left as is.
+// The changes done by a web UI started with --ui-only, which cannot check the
+// budgets, are checked like the manual ones. The namespaces in the slice are
+// updated in place.
+func (eng *Engine) enforceBudgets(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, namespaces []corev1.Namespace) {
+	for i := range namespaces {
+		n := &namespaces[i]
+		// the admission is forgotten once the namespace has been seen, even
+		// if the change of the web UI failed
+		admitted := eng.Budgets.takeAdmitted(n.Name)
+		if eng.knownStates[n.Name] != Suspended || n.Annotations[eng.Options.Prefix+DesiredState] != Running {
+			continue
+		}
+		manager := lastManagerOf(*n, eng.Options.Prefix+DesiredState)
+		if manager == FieldManager || (manager == WebUIFieldManager && admitted) {
+			continue
+		}
+		// there is no way to ask for an override when editing the
+		// annotation, the admin field managers are always allowed to
+		err := eng.Budgets.admit([]corev1.Namespace{*n}, manager, true)
+		if err == nil {
+			continue
+		}
+
+		l.Warn().Err(err).Str("namespace", n.Name).Msgf("resume by '%s' rejected, setting the desired state back to %s", manager, Suspended)
+		eng.Recorder.Eventf(namespaceRef(*n), corev1.EventTypeWarning, ReasonBudgetExceeded, "resume rejected: %s", err)
+		if err := patchNamespaceAnnotations(ctx, cs, eng.DryRun, n.Name, map[string]string{eng.Options.Prefix + DesiredState: Suspended}); err != nil {
+			eng.observeError(n.Name, "namespaces", "update")
+			l.Error().Err(err).Str("namespace", n.Name).Msg("cannot set the desired state back")
+			continue
+		}
+		n.Annotations[eng.Options.Prefix+DesiredState] = Suspended
+	}
+
+	eng.Budgets.observe(namespaces, eng.Options.Prefix, eng.Clock.Now())
+	exported := make(map[string]bool)
+	for _, u := range eng.Budgets.Usage() {
+		eng.MetricsServ.BudgetRunningNamespaces.WithLabelValues(u.Team).Set(float64(u.Running))
+		eng.MetricsServ.BudgetMaxRunningNamespaces.WithLabelValues(u.Team).Set(float64(u.MaxRunning))
+		eng.MetricsServ.BudgetRunningHours.WithLabelValues(u.Team).Set(u.RunningHours)
+		eng.MetricsServ.BudgetMonthlyRunningHours.WithLabelValues(u.Team).Set(u.MonthlyRunningHours)
+		eng.MetricsServ.BudgetRejections.WithLabelValues(u.Team).Set(float64(u.Rejections))
+		exported[u.Team] = true
+	}
+	// the series of the teams whose budget has been removed by a reload are
+	// deleted, so that their last values are not exported forever
+	for team := range eng.budgetTeams {
+		if exported[team] {
+			continue
+		}
+		for _, g := range []*prometheus.GaugeVec{eng.MetricsServ.BudgetRunningNamespaces, eng.MetricsServ.BudgetMaxRunningNamespaces,
+			eng.MetricsServ.BudgetRunningHours, eng.MetricsServ.BudgetMonthlyRunningHours, eng.MetricsServ.BudgetRejections} {
+			g.DeleteLabelValues(team)
+		}
+	}
+	eng.budgetTeams = exported
+}
@@ -0,0 +1,307 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// teamNamespace returns a managed namespace of the team, in the given state
+func teamNamespace(name, team, state string) corev1.Namespace {
+	return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        name,
+		Labels:      map[string]string{"team": team},
+		Annotations: map[string]string{testPrefix + ControllerName: "kube-ns-suspender", testPrefix + DesiredState: state},
+	}}
+}
+
+func TestBudgets_Admit(t *testing.T) {
+	now := time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		name     string
+		team     string
+		actor    string
+		override bool
+		// manager tells that actor is a field manager editing the annotation
+		manager bool
+		wantErr bool
+	}{
+		{name: "under budget", team: "b"},
+		{name: "no budget", team: "c"},
+		{name: "no team"},
+		{name: "max running reached", team: "a", wantErr: true},
+		{name: "override by a user", team: "a", actor: "bob", override: true, wantErr: true},
+		{name: "override by an admin", team: "a", actor: "alice", override: true},
+		{name: "admin without override", team: "a", actor: "alice", wantErr: true},
+		{name: "running hours used", team: "hours", wantErr: true},
+		// the web UI users and the field managers are different identities
+		{name: "override by a user named after an admin field manager", team: "a", actor: "kubectl-edit", override: true, wantErr: true},
+		{name: "override by an admin field manager", team: "a", actor: "kubectl-edit", manager: true, override: true},
+		{name: "override by a field manager named after an admin", team: "a", actor: "alice", manager: true, override: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBudgets("team", []string{"alice"}, []string{"kubectl-edit"})
+			b.setLimits(map[string]config.Budget{
+				"a":     {MaxRunning: 1},
+				"b":     {MaxRunning: 2},
+				"hours": {MonthlyRunningHours: 1},
+			})
+			running := []corev1.Namespace{teamNamespace("a-1", "a", Running), teamNamespace("b-1", "b", Running), teamNamespace("hours-1", "hours", Running)}
+			b.observe(running, testPrefix, now)
+			b.observe(running, testPrefix, now.Add(90*time.Minute))
+
+			n := teamNamespace("new", tt.team, Suspended)
+			var err error
+			if tt.manager {
+				err = b.admit([]corev1.Namespace{n}, tt.actor, tt.override)
+			} else {
+				err = b.Admit(n, tt.actor, tt.override)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Admit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, ErrBudgetExceeded) {
+				t.Errorf("Admit() error = %v, want it to wrap ErrBudgetExceeded", err)
+			}
+		})
+	}
+}
+
+func TestBudgets_AdmitAll(t *testing.T) {
+	b := NewBudgets("team", nil, nil)
+	b.setLimits(map[string]config.Budget{"a": {MaxRunning: 2}})
+	b.observe([]corev1.Namespace{teamNamespace("a-1", "a", Running)}, testPrefix, time.Now())
+
+	// the namespaces resumed together do not fit in the budget, none is
+	// admitted
+	together := []corev1.Namespace{teamNamespace("a-2", "a", Suspended), teamNamespace("a-3", "a", Suspended)}
+	if err := b.AdmitAll(together, "bob", false); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("AdmitAll() error = %v, want it to wrap ErrBudgetExceeded", err)
+	}
+	if b.takeAdmitted("a-2") || b.takeAdmitted("a-3") {
+		t.Error("namespaces admitted, want none of them")
+	}
+	if err := b.AdmitAll(together[:1], "bob", false); err != nil {
+		t.Fatalf("AdmitAll() error = %v, want the namespace admitted alone", err)
+	}
+	if !b.takeAdmitted("a-2") {
+		t.Error("namespace not admitted")
+	}
+}
+
+func Test_enforceBudgets(t *testing.T) {
+	ctx := context.Background()
+	eng := newTestEngine(t, time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local), false, false)
+	eng.Budgets = NewBudgets("team", nil, nil)
+	eng.Budgets.setLimits(map[string]config.Budget{"a": {MaxRunning: 1}})
+
+	running := teamNamespace("a-1", "a", Running)
+	resumed := teamNamespace("a-2", "a", Running)
+	cs := fake.NewSimpleClientset(&running, &resumed)
+	eng.knownStates = map[string]string{"a-1": Running, "a-2": Suspended}
+	eng.Budgets.observe([]corev1.Namespace{running}, testPrefix, eng.Clock.Now())
+
+	namespaces := []corev1.Namespace{running, resumed}
+	eng.enforceBudgets(ctx, zerolog.Nop(), cs, namespaces)
+
+	if got := namespaces[1].Annotations[testPrefix+DesiredState]; got != Suspended {
+		t.Errorf("inventoried desiredState = %s, want %s", got, Suspended)
+	}
+	res, err := cs.CoreV1().Namespaces().Get(ctx, "a-2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Annotations[testPrefix+DesiredState]; got != Suspended {
+		t.Errorf("desiredState = %s, want the resume to be reverted", got)
+	}
+	usage := eng.Budgets.Usage()
+	if len(usage) != 1 || usage[0].Running != 1 || usage[0].Rejections != 1 {
+		t.Errorf("Usage() = %+v, want 1 running namespace and 1 rejection", usage)
+	}
+}
+
+func Test_enforceBudgetsWebUI(t *testing.T) {
+	ctx := context.Background()
+	eng := newTestEngine(t, time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local), false, false)
+	eng.Budgets = NewBudgets("team", nil, nil)
+	eng.Budgets.setLimits(map[string]config.Budget{"a": {MaxRunning: 2}})
+
+	// the desiredState annotation of the resumed namespaces has last been
+	// set by the web UI
+	fromWebUI := func(n corev1.Namespace) corev1.Namespace {
+		n.ManagedFields = []metav1.ManagedFieldsEntry{{
+			Manager:    WebUIFieldManager,
+			Operation:  metav1.ManagedFieldsOperationUpdate,
+			Time:       &metav1.Time{Time: eng.Clock.Now()},
+			FieldsType: "FieldsV1",
+			FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{"f:` + testPrefix + DesiredState + `":{}}}}`)},
+		}}
+		return n
+	}
+	running := teamNamespace("a-1", "a", Running)
+	embedded := fromWebUI(teamNamespace("a-2", "a", Running))
+	uiOnly := fromWebUI(teamNamespace("a-3", "a", Running))
+	cs := fake.NewSimpleClientset(&running, &embedded, &uiOnly)
+	eng.knownStates = map[string]string{"a-1": Running, "a-2": Suspended, "a-3": Suspended}
+	eng.Budgets.observe([]corev1.Namespace{running}, testPrefix, eng.Clock.Now())
+
+	// a-2 has been resumed from the embedded web UI, which admitted it,
+	// while a-3 has been resumed from a web UI started with --ui-only
+	if err := eng.Budgets.Admit(teamNamespace("a-2", "a", Suspended), "bob", false); err != nil {
+		t.Fatal(err)
+	}
+	namespaces := []corev1.Namespace{running, embedded, uiOnly}
+	eng.enforceBudgets(ctx, zerolog.Nop(), cs, namespaces)
+
+	for _, want := range []struct{ name, state string }{{"a-2", Running}, {"a-3", Suspended}} {
+		res, err := cs.CoreV1().Namespaces().Get(ctx, want.name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Annotations[testPrefix+DesiredState]; got != want.state {
+			t.Errorf("%s desiredState = %s, want %s", want.name, got, want.state)
+		}
+	}
+	if usage := eng.Budgets.Usage(); len(usage) != 1 || usage[0].Running != 2 {
+		t.Errorf("Usage() = %+v, want 2 running namespaces", usage)
+	}
+}
+
+func Test_enforceBudgetsReleased(t *testing.T) {
+	ctx := context.Background()
+	eng := newTestEngine(t, time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local), false, false)
+	running := teamNamespace("a-1", "a", Running)
+
+	// the web UI admitted a-2, an admin overriding the budget, but could not
+	// write its desired state
+	eng.Budgets = NewBudgets("team", []string{"alice"}, nil)
+	eng.Budgets.setLimits(map[string]config.Budget{"a": {MaxRunning: 1}})
+	eng.Budgets.observe([]corev1.Namespace{running}, testPrefix, eng.Clock.Now())
+	suspended := teamNamespace("a-2", "a", Suspended)
+	if err := eng.Budgets.Admit(suspended, "alice", true); err != nil {
+		t.Fatal(err)
+	}
+	eng.Budgets.Release(suspended)
+	if usage := eng.Budgets.Usage(); usage[0].Running != 1 {
+		t.Errorf("Usage() = %+v, want the released namespace not counted", usage)
+	}
+
+	// it is then resumed by another instance of the web UI, which is not
+	// taken as admitted
+	resumed := teamNamespace("a-2", "a", Running)
+	resumed.ManagedFields = []metav1.ManagedFieldsEntry{{
+		Manager:    WebUIFieldManager,
+		Operation:  metav1.ManagedFieldsOperationUpdate,
+		Time:       &metav1.Time{Time: eng.Clock.Now()},
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{"f:` + testPrefix + DesiredState + `":{}}}}`)},
+	}}
+	cs := fake.NewSimpleClientset(&running, &resumed)
+	eng.knownStates = map[string]string{"a-1": Running, "a-2": Suspended}
+	eng.enforceBudgets(ctx, zerolog.Nop(), cs, []corev1.Namespace{running, resumed})
+
+	res, err := cs.CoreV1().Namespaces().Get(ctx, "a-2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Annotations[testPrefix+DesiredState]; got != Suspended {
+		t.Errorf("desiredState = %s, want the resume to be reverted", got)
+	}
+}
+
+func Test_syncGroupsBudgets(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRunning int
+		want       string
+	}{
+		{name: "under budget", maxRunning: 3, want: Running},
+		{name: "over budget", maxRunning: 2, want: Suspended},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			eng := newTestEngine(t, time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local), false, false)
+			eng.Budgets = NewBudgets("team", nil, nil)
+			eng.Budgets.setLimits(map[string]config.Budget{"a": {MaxRunning: tt.maxRunning}})
+
+			// g-1 has just been resumed, and the group with it
+			namespaces := []corev1.Namespace{
+				teamNamespace("g-1", "a", Running),
+				teamNamespace("g-2", "a", Suspended),
+				teamNamespace("g-3", "a", Suspended),
+			}
+			var objects []runtime.Object
+			for i := range namespaces {
+				namespaces[i].Labels[testPrefix+Group] = "g"
+				objects = append(objects, namespaces[i].DeepCopy())
+			}
+			cs := fake.NewSimpleClientset(objects...)
+			eng.groupStates["g"] = Suspended
+			eng.Budgets.observe(namespaces[:1], testPrefix, eng.Clock.Now())
+
+			eng.syncGroups(ctx, zerolog.Nop(), cs, namespaces)
+
+			for _, n := range namespaces {
+				res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := res.Annotations[testPrefix+DesiredState]; got != tt.want {
+					t.Errorf("%s desiredState = %s, want %s", n.Name, got, tt.want)
+				}
+			}
+			if got := eng.groupStates["g"]; got != tt.want {
+				t.Errorf("group state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_enforceBudgetsMetrics(t *testing.T) {
+	ctx := context.Background()
+	eng := newTestEngine(t, time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local), false, false)
+	eng.Budgets = NewBudgets("team", nil, nil)
+	running := teamNamespace("a-1", "a", Running)
+	cs := fake.NewSimpleClientset(&running)
+	eng.knownStates = map[string]string{"a-1": Running}
+
+	opt := eng.Options
+	opt.Budgets = map[string]config.Budget{"a": {MaxRunning: 1}, "b": {MaxRunning: 2}}
+	if _, err := eng.Reload(opt); err != nil {
+		t.Fatal(err)
+	}
+	eng.enforceBudgets(ctx, zerolog.Nop(), cs, []corev1.Namespace{running})
+	if got := testutil.CollectAndCount(eng.MetricsServ.BudgetMaxRunningNamespaces); got != 2 {
+		t.Errorf("%d max running series, want 2", got)
+	}
+
+	// the series of the team whose budget has been removed are deleted
+	opt.Budgets = map[string]config.Budget{"a": {MaxRunning: 1}}
+	if _, err := eng.Reload(opt); err != nil {
+		t.Fatal(err)
+	}
+	eng.enforceBudgets(ctx, zerolog.Nop(), cs, []corev1.Namespace{running})
+	for _, g := range []*prometheus.GaugeVec{eng.MetricsServ.BudgetRunningNamespaces, eng.MetricsServ.BudgetMaxRunningNamespaces,
+		eng.MetricsServ.BudgetRunningHours, eng.MetricsServ.BudgetMonthlyRunningHours, eng.MetricsServ.BudgetRejections} {
+		if got := testutil.CollectAndCount(g); got != 1 {
+			t.Errorf("%d series, want 1 for team a", got)
+		}
+	}
+	if got := testutil.ToFloat64(eng.MetricsServ.BudgetRunningNamespaces.WithLabelValues("a")); got != 1 {
+		t.Errorf("running namespaces of team a = %g, want 1", got)
+	}
+}
@@ -0,0 +1,51 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// conformityResults gathers the results of the conformity checks, which are
+// run concurrently
+type conformityResults struct {
+	mu      sync.Mutex
+	patched int
+	// jobsPatched is the number of those checks that patched Jobs. Resuming
+	// the Jobs alone does not tell that the namespace has been unsuspended.
+	jobsPatched int
+	errs        []string
+	// patchedKinds and failedKinds hold the kinds of resources that have
+	// been patched and the ones that could not be
+	patchedKinds []string
+	failedKinds  []string
+}
+
+// add saves the result of the conformity check of a kind of resource
+func (r *conformityResults) add(resource string, hasBeenPatched bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errs = append(r.errs, fmt.Sprintf("%s: %s", resource, err))
+		r.failedKinds = append(r.failedKinds, resource)
+	}
+	if hasBeenPatched {
+		r.patched++
+		if resource == "jobs" {
+			r.jobsPatched++
+		}
+		r.patchedKinds = append(r.patchedKinds, resource)
+	}
+}
+
+// err returns an error containing all the errors of the checks, or nil if
+// they all succeeded
+func (r *conformityResults) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(r.errs, "; "))
+}
@@ -2,20 +2,31 @@ package engine
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/rs/zerolog"
 	v1 "k8s.io/api/batch/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 )
 
-func checkRunningCronjobsConformity(ctx context.Context, l zerolog.Logger, cronjobs []v1.CronJob, cs *kubernetes.Clientset, ns string) (bool, error) {
+// checkRunningCronjobsConformity resumes the cronjobs suspended by the
+// controller. The cronjobs suspended by their owners, which do not have the
+// suspendedByController annotation, are left suspended.
+func checkRunningCronjobsConformity(ctx context.Context, l zerolog.Logger, rec record.EventRecorder, dr *DryRun, reason string, cronjobs []v1.CronJob, cs kubernetes.Interface, ns, prefix string) (bool, error) {
 	hasBeenPatched := false
 	for _, c := range cronjobs {
 		if *c.Spec.Suspend {
+			if c.Annotations[prefix+suspendedByController] != "true" {
+				l.Debug().Str("cronjob", c.Name).Msgf("%s has not been suspended by the controller, leaving it suspended", c.Name)
+				continue
+			}
 			l.Info().Str("cronjob", c.Name).Msgf("updating %s from suspend: true to suspend: false", c.Name)
-			if err := patchCronjobSuspend(ctx, cs, ns, c.Name, false); err != nil {
+			err := patchCronjobSuspend(ctx, cs, dr, ns, c.Name, prefix, false)
+			patchEvent(rec, objectRef("batch/v1", "CronJob", ns, c.Name, c.UID), reason, err, "updated from suspend: true to suspend: false")
+			if err != nil {
 				return hasBeenPatched, err
 			}
 			hasBeenPatched = true
@@ -24,25 +35,72 @@ func checkRunningCronjobsConformity(ctx context.Context, l zerolog.Logger, cronj
 	return hasBeenPatched, nil
 }
 
-func checkSuspendedCronjobsConformity(ctx context.Context, l zerolog.Logger, cronjobs []v1.CronJob, cs *kubernetes.Clientset, ns string) error {
+// adoptSuspendedCronjobs records the suspended cronjobs as suspended by the
+// controller, so that they are resumed with the namespace. It is used for the
+// namespaces suspended by a version of the controller that did not record them.
+func adoptSuspendedCronjobs(ctx context.Context, l zerolog.Logger, dr *DryRun, cronjobs []v1.CronJob, cs kubernetes.Interface, ns, prefix string) error {
 	for _, c := range cronjobs {
-		if !*c.Spec.Suspend {
-			l.Info().Str("cronjob", c.Name).Msgf("updating %s from suspend: false to suspend: true", c.Name)
-			if err := patchCronjobSuspend(ctx, cs, ns, c.Name, true); err != nil {
+		if !*c.Spec.Suspend || c.Annotations[prefix+suspendedByController] == "true" {
+			continue
+		}
+		l.Info().Str("cronjob", c.Name).Msgf("recording %s as suspended by the controller", c.Name)
+		if dr.intercept(Change{Namespace: ns, Kind: "CronJob", Name: c.Name, Action: ActionAnnotate, Detail: suspendedByController + ": true"}) {
+			continue
+		}
+		if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			result, err := cs.BatchV1().CronJobs(ns).Get(ctx, c.Name, metav1.GetOptions{})
+			if err != nil {
 				return err
 			}
+			if result.Annotations == nil {
+				result.Annotations = make(map[string]string)
+			}
+			result.Annotations[prefix+suspendedByController] = "true"
+			_, err = cs.BatchV1().CronJobs(ns).Update(ctx, result, metav1.UpdateOptions{})
+			return err
+		}); err != nil {
+			return fmt.Errorf("cannot annotate cronjob %s: %w", c.Name, err)
 		}
 	}
 	return nil
 }
 
+func checkSuspendedCronjobsConformity(ctx context.Context, l zerolog.Logger, rec record.EventRecorder, dr *DryRun, reason string, cronjobs []v1.CronJob, cs kubernetes.Interface, ns, prefix string) (bool, error) {
+	hasBeenPatched := false
+	for _, c := range cronjobs {
+		if !*c.Spec.Suspend {
+			l.Info().Str("cronjob", c.Name).Msgf("updating %s from suspend: false to suspend: true", c.Name)
+			err := patchCronjobSuspend(ctx, cs, dr, ns, c.Name, prefix, true)
+			patchEvent(rec, objectRef("batch/v1", "CronJob", ns, c.Name, c.UID), reason, err, "updated from suspend: false to suspend: true")
+			if err != nil {
+				return hasBeenPatched, err
+			}
+			hasBeenPatched = true
+		}
+	}
+	return hasBeenPatched, nil
+}
+
 // patchCronjobSuspend updates the suspend state of a giver cronjob
-func patchCronjobSuspend(ctx context.Context, cs *kubernetes.Clientset, ns, c string, suspend bool) error {
+func patchCronjobSuspend(ctx context.Context, cs kubernetes.Interface, dr *DryRun, ns, c, prefix string, suspend bool) error {
+	if dr.intercept(Change{Namespace: ns, Kind: "CronJob", Name: c, Action: suspendAction(suspend), Detail: fmt.Sprintf("suspend: %t", suspend)}) {
+		return nil
+	}
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		result, err := cs.BatchV1().CronJobs(ns).Get(ctx, c, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
+		// the cronjobs suspended by the controller are recorded, so that only
+		// those are resumed with the namespace
+		if suspend {
+			if result.Annotations == nil {
+				result.Annotations = make(map[string]string)
+			}
+			result.Annotations[prefix+suspendedByController] = "true"
+		} else {
+			delete(result.Annotations, prefix+suspendedByController)
+		}
 		result.Spec.Suspend = &suspend
 		_, err = cs.BatchV1().CronJobs(ns).Update(ctx, result, metav1.UpdateOptions{})
 		return err
@@ -2,18 +2,20 @@ package engine
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 
 	"github.com/rs/zerolog"
 	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 )
 
 // checkRunningDeploymentsConformity verifies that all deployments within the namespace are
 // currently running
-func checkRunningDeploymentsConformity(ctx context.Context, l zerolog.Logger, deployments []appsv1.Deployment, cs *kubernetes.Clientset, ns, prefix string) (bool, error) {
+func checkRunningDeploymentsConformity(ctx context.Context, l zerolog.Logger, rec record.EventRecorder, dr *DryRun, reason string, deployments []appsv1.Deployment, cs kubernetes.Interface, ns, prefix string) (bool, error) {
 	hasBeenPatched := false
 	for _, d := range deployments {
 		repl := int(*d.Spec.Replicas)
@@ -34,7 +36,10 @@ func checkRunningDeploymentsConformity(ctx context.Context, l zerolog.Logger, de
 			if desiredRepl != 0 {
 				l.Info().Str("deployment", d.Name).Msgf("scaling %s from 0 to %d replicas", d.Name, desiredRepl)
 				// patch the deployment
-				if err := patchDeploymentReplicas(ctx, cs, ns, d.Name, prefix, desiredRepl); err != nil {
+				err := patchDeploymentReplicas(ctx, cs, dr, ns, d.Name, prefix, desiredRepl)
+				patchEvent(rec, objectRef("apps/v1", "Deployment", ns, d.Name, d.UID), reason, err,
+					fmt.Sprintf("scaled from 0 to %d replicas", desiredRepl))
+				if err != nil {
 					return hasBeenPatched, err
 				}
 				hasBeenPatched = true
@@ -44,23 +49,31 @@ func checkRunningDeploymentsConformity(ctx context.Context, l zerolog.Logger, de
 	return hasBeenPatched, nil
 }
 
-func checkSuspendedDeploymentsConformity(ctx context.Context, l zerolog.Logger, deployments []appsv1.Deployment, cs *kubernetes.Clientset, ns, prefix string) error {
+func checkSuspendedDeploymentsConformity(ctx context.Context, l zerolog.Logger, rec record.EventRecorder, dr *DryRun, reason string, deployments []appsv1.Deployment, cs kubernetes.Interface, ns, prefix string) (bool, error) {
+	hasBeenPatched := false
 	for _, d := range deployments {
 		repl := int(*d.Spec.Replicas)
 		if repl != 0 {
 			// TODO: what about fixing the annotation original Replicas here ?
 			l.Info().Str("deployment", d.Name).Msgf("scaling %s from %d to 0 replicas", d.Name, repl)
 			// patch the deployment
-			if err := patchDeploymentReplicas(ctx, cs, ns, d.Name, prefix, 0); err != nil {
-				return err
+			err := patchDeploymentReplicas(ctx, cs, dr, ns, d.Name, prefix, 0)
+			patchEvent(rec, objectRef("apps/v1", "Deployment", ns, d.Name, d.UID), reason, err,
+				fmt.Sprintf("scaled from %d to 0 replicas", repl))
+			if err != nil {
+				return hasBeenPatched, err
 			}
+			hasBeenPatched = true
 		}
 	}
-	return nil
+	return hasBeenPatched, nil
 }
 
 // patchDeploymentReplicas updates the number of replicas of a given deployment
-func patchDeploymentReplicas(ctx context.Context, cs *kubernetes.Clientset, ns, d, prefix string, repl int) error {
+func patchDeploymentReplicas(ctx context.Context, cs kubernetes.Interface, dr *DryRun, ns, d, prefix string, repl int) error {
+	if dr.intercept(Change{Namespace: ns, Kind: "Deployment", Name: d, Action: ActionScale, Detail: fmt.Sprintf("replicas: %d", repl)}) {
+		return nil
+	}
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		result, err := cs.AppsV1().Deployments(ns).Get(ctx, d, metav1.GetOptions{})
 		if err != nil {
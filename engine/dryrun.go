@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// actions of the changes recorded in dry-run mode
+const (
+	ActionScale    = "Scale"
+	ActionSuspend  = "Suspend"
+	ActionResume   = "Resume"
+	ActionAnnotate = "Annotate"
+	// the status of a NamespaceSuspension
+	ActionUpdateStatus = "UpdateStatus"
+	// the cleanup of the stale namespaces
+	ActionDelete  = "Delete"
+	ActionArchive = "Archive"
+	// the hooks run before a suspension and after a resume
+	ActionRunHook = "RunHook"
+)
+
+// Change is a change that the controller would have done if it was not in
+// dry-run mode
+type Change struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	Action    string    `json:"action"`
+	Detail    string    `json:"detail"`
+}
+
+// DryRun records the changes that would have been done during the last
+// handling of each namespace, instead of doing them. A nil *DryRun means that
+// dry-run mode is disabled. It is safe for concurrent use.
+type DryRun struct {
+	mu         sync.Mutex
+	logger     zerolog.Logger
+	namespaces map[string][]Change
+}
+
+// NewDryRun returns a new empty DryRun, logging the changes with l
+func NewDryRun(l zerolog.Logger) *DryRun {
+	return &DryRun{
+		logger:     l.With().Bool("dry_run", true).Logger(),
+		namespaces: make(map[string][]Change),
+	}
+}
+
+// intercept records the change and returns true if dry-run mode is enabled. The
+// caller must not do the change in that case.
+func (d *DryRun) intercept(c Change) bool {
+	if d == nil {
+		return false
+	}
+	d.logger.Info().Str("namespace", c.Namespace).Str("kind", c.Kind).Str("name", c.Name).
+		Msgf("dry run: would %s %s %s (%s)", strings.ToLower(c.Action), strings.ToLower(c.Kind), c.Name, c.Detail)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c.Time = time.Now()
+	d.namespaces[c.Namespace] = append(d.namespaces[c.Namespace], c)
+	return true
+}
+
+// reset removes the changes recorded for the namespace
+func (d *DryRun) reset(ns string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.namespaces, ns)
+}
+
+// changesOf returns the changes recorded for the namespace
+func (d *DryRun) changesOf(ns string) []Change {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Change(nil), d.namespaces[ns]...)
+}
+
+// Changes returns all the changes recorded, sorted by namespace
+func (d *DryRun) Changes() []Change {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.namespaces))
+	for ns := range d.namespaces {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+
+	changes := []Change{}
+	for _, ns := range names {
+		changes = append(changes, d.namespaces[ns]...)
+	}
+	return changes
+}
+
+// suspendAction returns the action of a change of the suspend state of a
+// resource
+func suspendAction(suspend bool) string {
+	if suspend {
+		return ActionSuspend
+	}
+	return ActionResume
+}
+
+// observeDryRun updates the number of changes that would have been done on
+// each kind of resource of the namespace
+func (eng *Engine) observeDryRun(ns string) {
+	if eng.DryRun == nil {
+		return
+	}
+	eng.MetricsServ.DryRunChanges.DeletePartialMatch(prometheus.Labels{"namespace": ns})
+	for _, c := range eng.DryRun.changesOf(ns) {
+		eng.MetricsServ.DryRunChanges.WithLabelValues(ns, c.Kind, c.Action).Inc()
+	}
+}
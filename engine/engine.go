@@ -3,11 +3,19 @@ package engine
 import (
 	"errors"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/govirtuo/kube-ns-suspender/audit"
+	"github.com/govirtuo/kube-ns-suspender/config"
 	"github.com/govirtuo/kube-ns-suspender/metrics"
+	"github.com/govirtuo/kube-ns-suspender/savings"
+	"github.com/govirtuo/kube-ns-suspender/suspension"
 	"github.com/rs/zerolog"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
 )
 
 // those states constants they are used with the annotation desiredState.
@@ -27,17 +35,91 @@ const (
 	// in the webui package
 	DailySuspendTime = "dailySuspendTime"
 	DesiredState     = "desiredState"
+	Group            = "group"
+	// those ones refer to the schedules and profiles of the configuration
+	// file
+	Schedule = "schedule"
+	Profile  = "profile"
+	// JobsPolicy tells what is done with the Jobs running in the namespace
+	// when it is suspended
+	JobsPolicy = "jobsPolicy"
 
 	// annotation used on resources (deployments, statefulsets...)
 	originalReplicas = "originalReplicas"
+	// annotation set on the cronjobs suspended by the controller
+	suspendedByController = "suspendedByController"
+)
+
+// field managers used when updating namespaces. They allow to know who did the
+// last change of an annotation by looking at the managed fields.
+const (
+	FieldManager      = "kube-ns-suspender"
+	WebUIFieldManager = "kube-ns-suspender-webui"
 )
 
 type Engine struct {
-	Logger          zerolog.Logger
-	Wl              chan v1.Namespace
-	MetricsServ     metrics.Server
-	RunningDuration time.Duration
-	Options         Options
+	Logger               zerolog.Logger
+	Wl                   chan v1.Namespace
+	MetricsServ          metrics.Server
+	UIMaxRunningDuration time.Duration
+	StallTimeout         time.Duration
+	ShutdownTimeout      time.Duration
+	// Options holds the options the engine has been started with. The
+	// reloadable ones are read from the current settings instead.
+	Options  Options
+	Audit    audit.Sink
+	Recorder record.EventRecorder
+	Savings  *savings.Tracker
+	// Clock tells the time used by the schedules, the backoffs and the
+	// status of the namespaces. It is replaced in the tests and by the
+	// simulation.
+	Clock clock.PassiveClock
+	// DryRun records the changes instead of doing them. It is nil unless
+	// dry-run mode is enabled.
+	DryRun *DryRun
+	// Policies lists the SuspendPolicy resources at each inventory. It is
+	// nil unless the policies are enabled.
+	Policies PolicyLister
+	// Suspensions reads and updates the NamespaceSuspension resources. It is
+	// nil unless the suspensions are enabled.
+	Suspensions SuspensionClient
+	// Scope selects the namespaces managed by the controller
+	Scope Scope
+	// Breaker pauses the automatic suspensions when too many namespaces would
+	// be suspended at once. It is nil unless a limit is set.
+	Breaker *Breaker
+	// Budgets enforces the budgets of the teams
+	Budgets *Budgets
+
+	// groupStates holds the last desired state known for each group of
+	// namespaces. It is only accessed by the Watcher.
+	groupStates map[string]string
+	// knownStates holds the desired state of each namespace as seen during the
+	// last inventory. It is only accessed by the Watcher.
+	knownStates map[string]string
+	// budgetTeams are the teams whose budget metrics are exported. It is
+	// only accessed by the Watcher.
+	budgetTeams map[string]bool
+	// archivesTooLarge holds the error last reported for each stale
+	// namespace whose workloads do not fit in the archive ConfigMap. It is
+	// only accessed by the Watcher.
+	archivesTooLarge map[string]string
+	// invalidJobsPolicies holds the invalid jobsPolicy annotation last
+	// reported for each namespace, so that it is reported once
+	invalidJobsPolicies invalidJobsPolicies
+	// invalidPolicies holds the generation of the invalid policies last
+	// reported, by UID. It is only accessed by the Watcher.
+	invalidPolicies map[types.UID]int64
+	heartbeats      heartbeats
+	// resources holds the resources seen during the last handling of each
+	// namespace, reported in the status of the suspensions
+	resourcesMu sync.Mutex
+	resources   map[string][]suspension.ManagedResource
+	backoffs    backoffs
+	hookCalls   hookCalls
+	// current holds the reloadable settings, replaced by Reload
+	settingsMu sync.RWMutex
+	current    settings
 }
 
 type Options struct {
@@ -56,6 +138,52 @@ type Options struct {
 	KedaEnabled               bool
 	AwsRdsEnabled             bool
 	AwsRdsNamespaceTag        string
+	UIMaxRunningDuration      string
+	UITrustedProxies          string
+	AuditSink                 string
+	AuditFile                 string
+	AuditWebhookURL           string
+	TransitionTimeout         string
+	MaxHookTimeout            string
+	HookAnnotationsEnabled    bool
+	PricingFile               string
+	StallTimeout              string
+	ShutdownTimeout           string
+	TracingEndpoint           string
+	TracingInsecure           bool
+	TracingSampleRatio        float64
+	MaxBackoff                string
+	Kubeconfig                string
+	KubeContext               string
+	KubeQPS                   float64
+	KubeBurst                 int
+	DryRun                    bool
+	ConfigFile                string
+	PoliciesEnabled           bool
+	SuspensionsEnabled        bool
+	NamespaceSelector         string
+	IncludeNamespaces         string
+	ExcludeNamespaces         string
+	OptInLabel                bool
+	ProtectedNamespaces       string
+	MaxSuspensions            int
+	MaxSuspensionsPercent     float64
+	CircuitBreakerOverride    bool
+	TeamLabel                 string
+	BudgetAdmins              string
+	BudgetAdminFieldManagers  string
+	StaleAfterDays            int
+	StaleWarningDays          int
+	StaleGraceDays            int
+	StaleAction               string
+	JobsPolicy                string
+
+	// those ones can only be set in the configuration file
+	Schedules     map[string]config.Schedule
+	Profiles      map[string]config.Profile
+	ResourceRules []config.ResourceRule
+	Notifications []config.Notification
+	Budgets       map[string]config.Budget
 }
 
 // New returns a new engine instance
@@ -70,26 +198,67 @@ func New(opt Options) (*Engine, error) {
 		Logger:  zerolog.New(os.Stderr).With().Timestamp().Logger(),
 		Wl:      make(chan v1.Namespace, opt.WatchListSize),
 		Options: opt,
+		Audit:   audit.Nop{},
+		// events are dropped until a recorder connected to the API server is
+		// set
+		Recorder:            nopRecorder{},
+		Savings:             savings.NewTracker(savings.Pricing{}),
+		Clock:               clock.RealClock{},
+		groupStates:         make(map[string]string),
+		knownStates:         make(map[string]string),
+		invalidJobsPolicies: invalidJobsPolicies{values: make(map[string]string)},
+		resources:           make(map[string][]suspension.ManagedResource),
+		heartbeats:          heartbeats{started: time.Now()},
+		backoffs:            backoffs{namespaces: make(map[string]*backoff)},
+		hookCalls:           hookCalls{calls: make(map[string]*hookCall)},
 	}
 
-	lvl, err := zerolog.ParseLevel(e.Options.LogLevel)
+	e.current, err = newSettings(opt)
 	if err != nil {
 		return nil, err
 	}
-	e.Logger = e.Logger.Level(lvl)
+	// the log level is global, so that it can be changed when the
+	// configuration is reloaded
+	zerolog.SetGlobalLevel(e.current.logLevel)
 	if e.Options.HumanLogs {
 		e.Logger = e.Logger.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	}
 
+	if opt.DryRun {
+		e.DryRun = NewDryRun(e.Logger)
+	}
+
 	if e.Options.Prefix[len(e.Options.Prefix)-1] != '/' {
 		e.Options.Prefix = e.Options.Prefix + "/"
 	}
 
-	e.RunningDuration, err = time.ParseDuration(opt.RunningDuration)
+	e.Scope, err = NewScope(e.Options)
+	if err != nil {
+		return nil, err
+	}
+	if opt.MaxSuspensions < 0 || opt.MaxSuspensionsPercent < 0 || opt.MaxSuspensionsPercent > 100 {
+		return nil, errors.New("the maximum number of suspensions cannot be negative, and its percentage must be between 0 and 100")
+	}
+	if opt.MaxSuspensions > 0 || opt.MaxSuspensionsPercent > 0 {
+		e.Breaker = NewBreaker(opt.MaxSuspensions, opt.MaxSuspensionsPercent)
+	}
+	e.Budgets = NewBudgets(opt.TeamLabel, splitPatterns(opt.BudgetAdmins), splitPatterns(opt.BudgetAdminFieldManagers))
+	e.Budgets.setLimits(opt.Budgets)
+
+	e.UIMaxRunningDuration, err = time.ParseDuration(opt.UIMaxRunningDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	e.StallTimeout, err = time.ParseDuration(opt.StallTimeout)
 	if err != nil {
 		return nil, err
 	}
 
+	e.ShutdownTimeout, err = time.ParseDuration(opt.ShutdownTimeout)
+	if err != nil {
+		return nil, err
+	}
 	return &e, nil
 }
 
@@ -97,16 +266,28 @@ func flip(i int32) *int32 {
 	return &i
 }
 
+// ParseDailySuspendTime parses the value of a dailySuspendTime annotation. It
+// must follow the time.Kitchen format (e.g. 8:15PM).
+func ParseDailySuspendTime(val string) (time.Time, error) {
+	return time.Parse(time.Kitchen, val)
+}
+
+// ParseNextSuspendTime parses the value of a nextSuspendTime annotation. It
+// must follow the time.RFC822Z format (e.g. 02 Jan 06 15:04 -0700).
+func ParseNextSuspendTime(val string) (time.Time, error) {
+	return time.Parse(time.RFC822Z, val)
+}
+
 // getTimes takes a suspendAt value and convert its value into minutes, and do
-// the same with time.Now().
-func getTimes(suspendAt string) (int, int, error) {
-	suspendTime, err := time.Parse(time.Kitchen, suspendAt)
+// the same with now.
+func getTimes(now time.Time, suspendAt string) (int, int, error) {
+	suspendTime, err := ParseDailySuspendTime(suspendAt)
 	if err != nil {
 		return 0, 0, err
 	}
 	suspendTimeInt := suspendTime.Minute() + suspendTime.Hour()*60
 
-	now := time.Now().Local()
+	now = now.Local()
 	nowInt := now.Minute() + now.Hour()*60
 	return nowInt, suspendTimeInt, nil
 }
@@ -0,0 +1,263 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+)
+
+// reasons of the events emitted by the engine
+const (
+	ReasonSuspended     = "Suspended"
+	ReasonResumed       = "Resumed"
+	ReasonConformityFix = "ConformityFix"
+	ReasonSuspendFailed = "SuspendFailed"
+	ReasonResumeFailed  = "ResumeFailed"
+	ReasonPatchFailed   = "PatchFailed"
+	ReasonUpdateFailed  = "UpdateFailed"
+	// the resources of the namespace cannot be listed, the namespace is
+	// retried later
+	ReasonListFailed = "ListFailed"
+	// the namespace has been transitioning for longer than the transition
+	// timeout
+	ReasonTransitionStuck = "TransitionStuck"
+	// the annotations of the namespace cannot be understood
+	ReasonInvalidAnnotation = "InvalidAnnotation"
+	// a SuspendPolicy cannot be understood and is ignored
+	ReasonInvalidPolicy = "InvalidPolicy"
+	// the spec of a NamespaceSuspension cannot be understood and is not
+	// applied
+	ReasonInvalidSuspension = "InvalidSuspension"
+	// the namespace would have been suspended by its schedule, but the
+	// circuit breaker is open
+	ReasonSuspensionPaused = "SuspensionPaused"
+	// the namespace is protected and its desired state is Suspended, it is
+	// left as is
+	ReasonProtected = "Protected"
+	// the namespace has been resumed by editing its desiredState annotation
+	// while its team is over budget, and has been set back to Suspended
+	ReasonBudgetExceeded = "BudgetExceeded"
+	// the namespace has been suspended for too long and has been labelled
+	// stale
+	ReasonStale = "Stale"
+	// the stale namespace has been deleted or its workloads archived
+	ReasonStaleCleanup = "StaleCleanup"
+	// the workloads of the stale namespace do not fit in the archive
+	// ConfigMap
+	ReasonArchiveTooLarge = "ArchiveTooLarge"
+	// a pre-suspend or post-resume hook has completed
+	ReasonHookCompleted = "HookCompleted"
+	// a pre-suspend or post-resume hook has failed or timed out
+	ReasonHookFailed = "HookFailed"
+)
+
+// reasons of the transitions, stored in the lastTransitionReason annotation
+const (
+	TransitionFirstSeen           = "FirstSeen"
+	TransitionDailySuspendTime    = "DailySuspendTimePast"
+	TransitionNextSuspendTime     = "NextSuspendTimeExpired"
+	TransitionDesiredStateChanged = "DesiredStateChanged"
+)
+
+// status annotations, maintained by the engine on the namespaces
+const (
+	LastTransitionTime   = "lastTransitionTime"
+	LastTransitionReason = "lastTransitionReason"
+	ObservedState        = "observedState"
+	LastError            = "lastError"
+	// SuspendedSince is the time the namespace was first observed Suspended
+	// since its last resume
+	SuspendedSince = "suspendedSince"
+	// PreSuspendHookStarted and PreSuspendHookCompleted are the times the
+	// pre-suspend hook of the current suspension started and completed, so
+	// that it runs once per suspension even if the namespace is retried or
+	// the controller restarted. The Job of the hook is named after its start.
+	PreSuspendHookStarted   = "preSuspendHookStarted"
+	PreSuspendHookCompleted = "preSuspendHookCompleted"
+	// PostResumeHookStarted and PostResumeHookCompleted are the same for the
+	// post-resume hook of the current resume
+	PostResumeHookStarted   = "postResumeHookStarted"
+	PostResumeHookCompleted = "postResumeHookCompleted"
+	// CronjobsTracked is set once the namespace has been handled by a version
+	// of the controller recording the cronjobs it suspends with the
+	// suspendedByController annotation
+	CronjobsTracked = "cronjobsTracked"
+)
+
+// NewEventRecorder returns an event recorder sending the events to the API
+// server, using the controller name as source
+func NewEventRecorder(cs kubernetes.Interface, controllerName string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cs.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerName})
+}
+
+// nopRecorder is the event recorder used until a recorder connected to the
+// API server is set. It drops the events.
+type nopRecorder struct{}
+
+func (nopRecorder) Event(runtime.Object, string, string, string) {}
+
+func (nopRecorder) Eventf(runtime.Object, string, string, string, ...interface{}) {}
+
+func (nopRecorder) AnnotatedEventf(runtime.Object, map[string]string, string, string, string, ...interface{}) {
+}
+
+// objectRef returns a reference to an object, used as the subject of the
+// events
+func objectRef(apiVersion, kind, ns, name string, uid types.UID) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Namespace:  ns,
+		Name:       name,
+		UID:        uid,
+	}
+}
+
+// namespaceRef returns a reference to a namespace
+func namespaceRef(n corev1.Namespace) *corev1.ObjectReference {
+	return objectRef("v1", "Namespace", "", n.Name, n.UID)
+}
+
+// namespaceStatus holds the values of the status annotations of a namespace
+type namespaceStatus struct {
+	ObservedState        string
+	LastTransitionTime   string
+	LastTransitionReason string
+	LastError            string
+	SuspendedSince       string
+	// the times the hooks of the current transition started and completed
+	PreSuspendHookStarted   string
+	PreSuspendHookCompleted string
+	PostResumeHookStarted   string
+	PostResumeHookCompleted string
+	CronjobsTracked         string
+}
+
+// statusOf reads the status annotations of a namespace
+func (eng *Engine) statusOf(n corev1.Namespace) namespaceStatus {
+	return namespaceStatus{
+		ObservedState:        n.Annotations[eng.Options.Prefix+ObservedState],
+		LastTransitionTime:   n.Annotations[eng.Options.Prefix+LastTransitionTime],
+		LastTransitionReason: n.Annotations[eng.Options.Prefix+LastTransitionReason],
+		LastError:            n.Annotations[eng.Options.Prefix+LastError],
+		SuspendedSince:       n.Annotations[eng.Options.Prefix+SuspendedSince],
+
+		PreSuspendHookStarted:   n.Annotations[eng.Options.Prefix+PreSuspendHookStarted],
+		PreSuspendHookCompleted: n.Annotations[eng.Options.Prefix+PreSuspendHookCompleted],
+		PostResumeHookStarted:   n.Annotations[eng.Options.Prefix+PostResumeHookStarted],
+		PostResumeHookCompleted: n.Annotations[eng.Options.Prefix+PostResumeHookCompleted],
+		CronjobsTracked:         n.Annotations[eng.Options.Prefix+CronjobsTracked],
+	}
+}
+
+// transitionTo returns the status of a namespace that has been observed in the
+// given phase at the given time
+func (s namespaceStatus) transitionTo(now time.Time, phase, reason string) namespaceStatus {
+	if s.ObservedState != phase {
+		s.ObservedState = phase
+		s.LastTransitionTime = now.Local().Format(time.RFC3339)
+		s.LastTransitionReason = reason
+	}
+	// the namespace stays suspended since the same time when it is degraded
+	// or suspended again, until it is resumed. The hooks of the previous
+	// transition are forgotten once the namespace goes the other way.
+	switch phase {
+	case Suspending, Suspended:
+		if phase == Suspended && s.SuspendedSince == "" {
+			s.SuspendedSince = s.LastTransitionTime
+		}
+		s.PostResumeHookStarted, s.PostResumeHookCompleted = "", ""
+	case Resuming, Running:
+		s.SuspendedSince = ""
+		s.PreSuspendHookStarted, s.PreSuspendHookCompleted = "", ""
+	}
+	// the cronjobs suspended from now on are recorded
+	s.CronjobsTracked = "true"
+	s.LastError = ""
+	return s
+}
+
+// updateStatus writes the status annotations of the namespace if they differ
+// from the current ones
+func (eng *Engine) updateStatus(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, n corev1.Namespace, status namespaceStatus) {
+	if eng.statusOf(n) == status {
+		return
+	}
+
+	values := eng.statusAnnotations(status)
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if eng.DryRun.intercept(Change{Namespace: n.Name, Kind: "Namespace", Name: n.Name, Action: ActionAnnotate,
+			Detail: fmt.Sprintf("%s: %s, %s: %s", ObservedState, status.ObservedState, LastError, status.LastError)}) {
+			return nil
+		}
+		res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if res.Annotations == nil {
+			res.Annotations = make(map[string]string)
+		}
+		setOrDelete(res.Annotations, values)
+		_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{FieldManager: FieldManager})
+		return err
+	}); err != nil {
+		eng.observeError(n.Name, "namespaces", "update")
+		l.Error().Err(err).Msg("cannot update namespace status annotations")
+	}
+}
+
+// statusAnnotations returns the status annotations of a namespace, an empty
+// value meaning that the annotation is removed
+func (eng *Engine) statusAnnotations(status namespaceStatus) map[string]string {
+	return map[string]string{
+		eng.Options.Prefix + ObservedState:           status.ObservedState,
+		eng.Options.Prefix + LastTransitionTime:      status.LastTransitionTime,
+		eng.Options.Prefix + LastTransitionReason:    status.LastTransitionReason,
+		eng.Options.Prefix + LastError:               status.LastError,
+		eng.Options.Prefix + SuspendedSince:          status.SuspendedSince,
+		eng.Options.Prefix + PreSuspendHookStarted:   status.PreSuspendHookStarted,
+		eng.Options.Prefix + PreSuspendHookCompleted: status.PreSuspendHookCompleted,
+		eng.Options.Prefix + PostResumeHookStarted:   status.PostResumeHookStarted,
+		eng.Options.Prefix + PostResumeHookCompleted: status.PostResumeHookCompleted,
+		eng.Options.Prefix + CronjobsTracked:         status.CronjobsTracked,
+	}
+}
+
+// reportFailure emits a warning event on the namespace and saves the error in
+// its status annotations
+func (eng *Engine) reportFailure(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, n corev1.Namespace, reason string, err error) {
+	switch reason {
+	case ReasonUpdateFailed:
+		eng.observeError(n.Name, "namespaces", "update")
+	case ReasonInvalidAnnotation:
+		eng.observeError(n.Name, "namespaces", "parse")
+	}
+	eng.Recorder.Event(namespaceRef(n), corev1.EventTypeWarning, reason, err.Error())
+	status := eng.statusOf(n)
+	status.LastError = err.Error()
+	eng.updateStatus(ctx, l, cs, n, status)
+}
+
+// patchEvent emits the event related to the patch of a resource: a warning if
+// the patch failed, and an event with the given reason and message otherwise
+func patchEvent(rec record.EventRecorder, ref *corev1.ObjectReference, reason string, err error, msg string) {
+	if err != nil {
+		rec.Eventf(ref, corev1.EventTypeWarning, ReasonPatchFailed, "cannot patch %s %s: %s", strings.ToLower(ref.Kind), ref.Name, err)
+		return
+	}
+	rec.Event(ref, corev1.EventTypeNormal, reason, msg)
+}
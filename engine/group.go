@@ -0,0 +1,253 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/audit"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// GroupOf returns the name of the group the namespace belongs to, or an empty
+// string if it is not part of any group. The group can be set either with a
+// label or with an annotation, the label having the precedence.
+func GroupOf(n v1.Namespace, prefix string) string {
+	if g, ok := n.Labels[prefix+Group]; ok {
+		return g
+	}
+	return n.Annotations[prefix+Group]
+}
+
+// syncGroups ensures that all the members of a group share the same desired
+// state. When the members disagree, the state that differs from the last one
+// known for the group is the one that has just been set, so it is propagated
+// to the other members. The members resumed along with the group are admitted
+// together by the budgets: if their team would go over budget, the resume is
+// refused and the group is set back to Suspended. The suspension of a group is
+// not propagated while the circuit breaker is open, nor to its protected
+// members. The namespaces in the slice are updated in place.
+func (eng *Engine) syncGroups(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, namespaces []v1.Namespace) {
+	cur := eng.settings()
+	groups := make(map[string][]*v1.Namespace)
+	for i := range namespaces {
+		if g := GroupOf(namespaces[i], eng.Options.Prefix); g != "" {
+			groups[g] = append(groups[g], &namespaces[i])
+		}
+	}
+
+	for g, members := range groups {
+		gLogger := l.With().Str("group", g).Logger()
+
+		target := eng.groupTarget(g, members)
+		if target == "" {
+			continue
+		}
+		switch target {
+		case Running:
+			if err := eng.admitGroup(members); err != nil {
+				eng.refuseGroupResume(ctx, gLogger, cs, g, members, err)
+				continue
+			}
+		case Suspended:
+			// the group state is not recorded, so that the suspension is
+			// propagated once the breaker is reset
+			if eng.Breaker.paused(cur.breakerOverride) {
+				gLogger.Warn().Msg("circuit breaker open, suspension of the group paused")
+				continue
+			}
+		}
+
+		for _, n := range members {
+			if n.Annotations[eng.Options.Prefix+DesiredState] == target {
+				continue
+			}
+			if target == Suspended && eng.Scope.Protected(n.Name) {
+				gLogger.Debug().Str("namespace", n.Name).Msg("namespace protected, not propagating the suspension of the group")
+				continue
+			}
+			gLogger.Info().Str("namespace", n.Name).Msgf("propagating group state '%s' to namespace", target)
+			if err := patchNamespaceAnnotations(ctx, cs, eng.DryRun, n.Name, map[string]string{eng.Options.Prefix + DesiredState: target}); err != nil {
+				gLogger.Error().Err(err).Str("namespace", n.Name).Msg("cannot propagate group state to namespace")
+				continue
+			}
+			eng.recordTransition(ctx, gLogger, *n, n.Annotations[eng.Options.Prefix+DesiredState], target, audit.OriginGroup, g,
+				fmt.Sprintf("state propagated from group '%s'", g))
+			n.Annotations[eng.Options.Prefix+DesiredState] = target
+		}
+		eng.groupStates[g] = target
+	}
+}
+
+// admitGroup admits the members of the group that are about to be resumed,
+// on behalf of the field manager that resumed the group: the one that did the
+// most recent update of the desiredState annotation of the running members.
+// As for the edits of the annotation, the admin field managers are always
+// allowed to resume it over budget.
+func (eng *Engine) admitGroup(members []*v1.Namespace) error {
+	var resumed []v1.Namespace
+	actor := ""
+	var last time.Time
+	for _, n := range members {
+		if n.Annotations[eng.Options.Prefix+DesiredState] != Running {
+			resumed = append(resumed, *n)
+			continue
+		}
+		// the protected members do not resume the group
+		if eng.Scope.Protected(n.Name) {
+			continue
+		}
+		if manager, at := lastUpdateOf(*n, eng.Options.Prefix+DesiredState); actor == "" || at.After(last) {
+			actor, last = manager, at
+		}
+	}
+	if len(resumed) == 0 {
+		return nil
+	}
+	return eng.Budgets.admit(resumed, actor, eng.Budgets.isAdminManager(actor))
+}
+
+// refuseGroupResume sets the members of the group resumed over budget back to
+// Suspended
+func (eng *Engine) refuseGroupResume(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, g string, members []*v1.Namespace, err error) {
+	l.Warn().Err(err).Msgf("resume of the group rejected, setting the desired state back to %s", Suspended)
+	for _, n := range members {
+		if n.Annotations[eng.Options.Prefix+DesiredState] != Running {
+			continue
+		}
+		eng.Recorder.Eventf(namespaceRef(*n), v1.EventTypeWarning, ReasonBudgetExceeded, "resume of group '%s' rejected: %s", g, err)
+		if err := patchNamespaceAnnotations(ctx, cs, eng.DryRun, n.Name, map[string]string{eng.Options.Prefix + DesiredState: Suspended}); err != nil {
+			eng.observeError(n.Name, "namespaces", "update")
+			l.Error().Err(err).Str("namespace", n.Name).Msg("cannot set the desired state back")
+			continue
+		}
+		eng.recordTransition(ctx, l, *n, Running, Suspended, audit.OriginGroup, g,
+			fmt.Sprintf("resume of group '%s' rejected: %s", g, err))
+		n.Annotations[eng.Options.Prefix+DesiredState] = Suspended
+	}
+	eng.groupStates[g] = Suspended
+}
+
+// groupTarget returns the desired state that all the members of the group
+// should have. If the members disagree and no state is known yet for the group
+// (e.g. after a restart), Running is preferred to avoid suspending a namespace
+// that is being used. The protected members always stay running, so their
+// state does not tell anything about the group.
+func (eng *Engine) groupTarget(g string, members []*v1.Namespace) string {
+	previous := eng.groupStates[g]
+
+	var hasRunning, hasSuspended bool
+	changed := ""
+	for _, n := range members {
+		s := n.Annotations[eng.Options.Prefix+DesiredState]
+		switch s {
+		case Running:
+			if eng.Scope.Protected(n.Name) {
+				continue
+			}
+			hasRunning = true
+		case Suspended:
+			hasSuspended = true
+		default:
+			// namespaces without state or with an unknown state are aligned on
+			// the others
+			continue
+		}
+		if previous != "" && s != previous {
+			changed = s
+		}
+	}
+
+	switch {
+	case changed != "":
+		return changed
+	case hasRunning:
+		return Running
+	case hasSuspended:
+		return Suspended
+	}
+	return ""
+}
+
+// patchNamespaceAnnotations sets the annotations (key to value) on the given
+// namespace
+func patchNamespaceAnnotations(ctx context.Context, cs kubernetes.Interface, dr *DryRun, name string, values map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	intercepted := false
+	for _, k := range keys {
+		intercepted = dr.intercept(Change{Namespace: name, Kind: "Namespace", Name: name, Action: ActionAnnotate, Detail: k + ": " + values[k]})
+	}
+	if intercepted {
+		return nil
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		res, err := cs.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if res.Annotations == nil {
+			res.Annotations = make(map[string]string)
+		}
+		for k, v := range values {
+			res.Annotations[k] = v
+		}
+		_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{FieldManager: FieldManager})
+		return err
+	})
+}
+
+// patchNamespaceMetadata sets the given labels and annotations on a
+// namespace. An empty value removes the label or annotation.
+func patchNamespaceMetadata(ctx context.Context, cs kubernetes.Interface, dr *DryRun, name string, labels, annotations map[string]string) error {
+	keys := make([]string, 0, len(labels)+len(annotations))
+	for k := range labels {
+		keys = append(keys, "label "+k+": "+labels[k])
+	}
+	for k := range annotations {
+		keys = append(keys, k+": "+annotations[k])
+	}
+	sort.Strings(keys)
+	intercepted := false
+	for _, k := range keys {
+		intercepted = dr.intercept(Change{Namespace: name, Kind: "Namespace", Name: name, Action: ActionAnnotate, Detail: k})
+	}
+	if intercepted {
+		return nil
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		res, err := cs.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if res.Labels == nil {
+			res.Labels = make(map[string]string)
+		}
+		if res.Annotations == nil {
+			res.Annotations = make(map[string]string)
+		}
+		setOrDelete(res.Labels, labels)
+		setOrDelete(res.Annotations, annotations)
+		_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{FieldManager: FieldManager})
+		return err
+	})
+}
+
+// setOrDelete sets the values in m, deleting the keys with an empty value
+func setOrDelete(m, values map[string]string) {
+	for k, v := range values {
+		if v == "" {
+			delete(m, k)
+		} else {
+			m[k] = v
+		}
+	}
+}
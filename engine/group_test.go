@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_syncGroups(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local)
+	eng := newTestEngine(t, now, false, false)
+	opt := eng.Options
+	opt.ProtectedNamespaces = "g-protected"
+	var err error
+	if eng.Scope, err = NewScope(opt); err != nil {
+		t.Fatal(err)
+	}
+	eng.Breaker = NewBreaker(1, 0)
+	eng.Breaker.check([]string{"g-1", "g-2"}, nil, 3, now)
+
+	// g-1 has just been suspended, and the group with it
+	namespaces := []corev1.Namespace{
+		teamNamespace("g-1", "", Suspended),
+		teamNamespace("g-2", "", Running),
+		teamNamespace("g-protected", "", Running),
+	}
+	var objects []runtime.Object
+	for i := range namespaces {
+		namespaces[i].Labels[testPrefix+Group] = "g"
+		objects = append(objects, namespaces[i].DeepCopy())
+	}
+	cs := fake.NewSimpleClientset(objects...)
+	eng.groupStates["g"] = Running
+
+	check := func(want map[string]string) {
+		t.Helper()
+		for name, state := range want {
+			res, err := cs.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := res.Annotations[testPrefix+DesiredState]; got != state {
+				t.Errorf("%s desiredState = %s, want %s", name, got, state)
+			}
+		}
+	}
+
+	// the suspension is not propagated while the circuit breaker is open
+	eng.syncGroups(ctx, zerolog.Nop(), cs, namespaces)
+	check(map[string]string{"g-1": Suspended, "g-2": Running, "g-protected": Running})
+
+	// nor to the protected members once it is reset
+	eng.Breaker.Reset()
+	eng.syncGroups(ctx, zerolog.Nop(), cs, namespaces)
+	check(map[string]string{"g-1": Suspended, "g-2": Suspended, "g-protected": Running})
+
+	// the running protected member does not resume the group
+	eng.syncGroups(ctx, zerolog.Nop(), cs, namespaces)
+	check(map[string]string{"g-1": Suspended, "g-2": Suspended, "g-protected": Running})
+}
+
+func Test_syncGroupsResumedBy(t *testing.T) {
+	now := time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local)
+	// managedBy sets the field manager of the last update of the desiredState
+	// annotation of the namespace, ago before now
+	managedBy := func(n corev1.Namespace, manager string, ago time.Duration) corev1.Namespace {
+		n.ManagedFields = []metav1.ManagedFieldsEntry{{
+			Manager:    manager,
+			Operation:  metav1.ManagedFieldsOperationUpdate,
+			Time:       &metav1.Time{Time: now.Add(-ago)},
+			FieldsType: "FieldsV1",
+			FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{"f:` + testPrefix + DesiredState + `":{}}}}`)},
+		}}
+		return n
+	}
+
+	tests := []struct {
+		name string
+		// the managers of the running members, the second one being the most
+		// recent
+		older, newer string
+		want         string
+	}{
+		{name: "resumed by a user after an admin", older: "admin-tool", newer: "kubectl-edit", want: Suspended},
+		{name: "resumed by an admin after the controller", older: FieldManager, newer: "admin-tool", want: Running},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			eng := newTestEngine(t, now, false, false)
+			eng.Budgets = NewBudgets("team", nil, []string{"admin-tool"})
+			eng.Budgets.setLimits(map[string]config.Budget{"a": {MaxRunning: 2}})
+
+			// the newer member has just been resumed, the group is over
+			// budget with the last one
+			namespaces := []corev1.Namespace{
+				managedBy(teamNamespace("g-1", "a", Running), tt.older, time.Hour),
+				managedBy(teamNamespace("g-2", "a", Running), tt.newer, time.Minute),
+				teamNamespace("g-3", "a", Suspended),
+			}
+			var objects []runtime.Object
+			for i := range namespaces {
+				namespaces[i].Labels[testPrefix+Group] = "g"
+				objects = append(objects, namespaces[i].DeepCopy())
+			}
+			cs := fake.NewSimpleClientset(objects...)
+			eng.groupStates["g"] = Suspended
+			eng.Budgets.observe(namespaces[:2], testPrefix, now)
+
+			eng.syncGroups(ctx, zerolog.Nop(), cs, namespaces)
+
+			for _, n := range namespaces {
+				res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := res.Annotations[testPrefix+DesiredState]; got != tt.want {
+					t.Errorf("%s desiredState = %s, want %s", n.Name, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/kedacore/keda/v2/pkg/generated/clientset/versioned/typed/keda/v1alpha1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// heartbeats holds the last time the routines of the engine made progress. It
+// is used by the health checks.
+type heartbeats struct {
+	mu sync.Mutex
+	// started is the time the engine has been created
+	started time.Time
+	// lastAttempt is the start of the last inventory of the Watcher, whether
+	// it succeeded or not. It tells that the Watcher loop is still running.
+	lastAttempt time.Time
+	// lastInventory is the end of the last successful inventory of the
+	// Watcher
+	lastInventory time.Time
+	// lastReceived is the last time the Suspender received a namespace. As
+	// it handles them one by one, it is not updated if it is stuck.
+	lastReceived time.Time
+}
+
+// inventoryStarted records the start of an inventory
+func (eng *Engine) inventoryStarted() {
+	eng.heartbeats.mu.Lock()
+	defer eng.heartbeats.mu.Unlock()
+	eng.heartbeats.lastAttempt = eng.Clock.Now()
+}
+
+// inventoryDone records the end of a successful inventory
+func (eng *Engine) inventoryDone() {
+	eng.heartbeats.mu.Lock()
+	defer eng.heartbeats.mu.Unlock()
+	eng.heartbeats.lastInventory = eng.Clock.Now()
+}
+
+// namespaceReceived records that the Suspender received a namespace
+func (eng *Engine) namespaceReceived() {
+	eng.heartbeats.mu.Lock()
+	defer eng.heartbeats.mu.Unlock()
+	eng.heartbeats.lastReceived = eng.Clock.Now()
+}
+
+// CheckWatcher fails if the Watcher has not started any inventory for longer
+// than the stall timeout, on top of its idle duration. The inventories that
+// fail, e.g. because the API server cannot be reached, still tell that the
+// Watcher is running: restarting the controller would not help.
+func (eng *Engine) CheckWatcher(ctx context.Context) error {
+	eng.heartbeats.mu.Lock()
+	last := eng.heartbeats.lastAttempt
+	if last.IsZero() {
+		last = eng.heartbeats.started
+	}
+	eng.heartbeats.mu.Unlock()
+
+	timeout := eng.StallTimeout + eng.settings().watcherIdle
+	if since := eng.Clock.Since(last); since > timeout {
+		return fmt.Errorf("no inventory started for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// CheckSuspender fails if namespaces are waiting in the watchlist while the
+// Suspender has not handled any namespace for longer than the stall timeout
+func (eng *Engine) CheckSuspender(ctx context.Context) error {
+	if len(eng.Wl) == 0 {
+		return nil
+	}
+
+	eng.heartbeats.mu.Lock()
+	last := eng.heartbeats.lastReceived
+	if last.IsZero() {
+		last = eng.heartbeats.started
+	}
+	eng.heartbeats.mu.Unlock()
+
+	if since := eng.Clock.Since(last); since > eng.StallTimeout {
+		return fmt.Errorf("%d namespaces waiting, none handled for %s", len(eng.Wl), since.Round(time.Second))
+	}
+	return nil
+}
+
+// CheckInventory fails until the Watcher has done its first inventory, and
+// when it has not done any successful inventory for longer than the stall
+// timeout, on top of its idle duration
+func (eng *Engine) CheckInventory(ctx context.Context) error {
+	eng.heartbeats.mu.Lock()
+	last := eng.heartbeats.lastInventory
+	eng.heartbeats.mu.Unlock()
+
+	if last.IsZero() {
+		return errors.New("first inventory not done yet")
+	}
+	timeout := eng.StallTimeout + eng.settings().watcherIdle
+	if since := eng.Clock.Since(last); since > timeout {
+		return fmt.Errorf("no successful inventory for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// APIServerCheck returns a check failing if the API server cannot be reached
+func APIServerCheck(cs kubernetes.Interface) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return cs.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+	}
+}
+
+// KedaCheck returns a check failing if the Keda API cannot be reached
+func KedaCheck(kedacs v1alpha1.KedaV1alpha1Interface) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return kedacs.RESTClient().Get().AbsPath("/apis/keda.sh/v1alpha1").Do(ctx).Error()
+	}
+}
+
+// RDSCheck returns a check failing if the AWS RDS API cannot be reached
+func RDSCheck(rdsclient RDSAPI) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := rdsclient.DescribeDBClusters(ctx, &rds.DescribeDBClustersInput{MaxRecords: aws.Int32(20)})
+		return err
+	}
+}
@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func Test_watcherHealth(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local)
+	eng := newTestEngine(t, now, false, false)
+	clock := eng.Clock.(*clocktesting.FakePassiveClock)
+	eng.heartbeats.started = now
+
+	check := func(step string, wantWatcher, wantInventory bool) {
+		t.Helper()
+		if err := eng.CheckWatcher(ctx); (err == nil) != wantWatcher {
+			t.Errorf("%s: CheckWatcher() = %v, want passing %v", step, err, wantWatcher)
+		}
+		if err := eng.CheckInventory(ctx); (err == nil) != wantInventory {
+			t.Errorf("%s: CheckInventory() = %v, want passing %v", step, err, wantInventory)
+		}
+	}
+
+	check("started", true, false)
+	clock.SetTime(now.Add(6 * time.Minute))
+	check("no inventory", false, false)
+
+	// the inventories failing, e.g. because the API server cannot be
+	// reached, keep the watcher alive but not ready
+	eng.inventoryStarted()
+	check("failing inventory", true, false)
+	eng.inventoryDone()
+	check("successful inventory", true, true)
+	clock.SetTime(now.Add(12 * time.Minute))
+	eng.inventoryStarted()
+	check("failing inventories", true, false)
+}
@@ -0,0 +1,344 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/policy"
+	"github.com/rs/zerolog"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// names of the hooks a policy can declare, and of the annotations declaring
+// the hooks of a namespace when --hook-annotations-enabled is set. The value
+// of the annotations is either the URL of an HTTP hook, or a hook in JSON or
+// YAML, with the same fields as the hooks of the policies.
+const (
+	PreSuspendHook = "preSuspendHook"
+	PostResumeHook = "postResumeHook"
+)
+
+// HookLabel is the label set on the Jobs created by the hooks, with the name
+// of the hook as value
+const HookLabel = "hook"
+
+// defaultHookTimeout is the timeout of the hooks that do not set one, and
+// defaultMaxHookTimeout the cap of their timeout if none is configured
+const (
+	defaultHookTimeout    = 5 * time.Minute
+	defaultMaxHookTimeout = 15 * time.Minute
+)
+
+// hookClient calls the HTTP hooks. Their timeout is enforced with the
+// context of the call.
+var hookClient = &http.Client{}
+
+// hookJobNames are the names of the Jobs created by the hooks, without their
+// timestamp suffix
+var hookJobNames = map[string]string{
+	PreSuspendHook: "kube-ns-suspender-pre-suspend",
+	PostResumeHook: "kube-ns-suspender-post-resume",
+}
+
+// hook is a parsed policy.Hook
+type hook struct {
+	url     string
+	job     *batchv1.JobTemplateSpec
+	timeout time.Duration
+}
+
+// hookRequest is the body of the requests sent to the HTTP hooks
+type hookRequest struct {
+	Namespace string `json:"namespace"`
+	Hook      string `json:"hook"`
+}
+
+// hookCalls holds the calls to the HTTP hooks in progress, by namespace and
+// hook name. They are made in the background, and their result is read by
+// the next handling of the namespace.
+type hookCalls struct {
+	mu    sync.Mutex
+	calls map[string]*hookCall
+}
+
+// hookCall is a call to an HTTP hook. err is set before done is closed.
+type hookCall struct {
+	done chan struct{}
+	err  error
+}
+
+// parseHook checks a hook and sets its default timeout
+func parseHook(h policy.Hook) (*hook, error) {
+	if (h.URL == "") == (h.Job == nil) {
+		return nil, errors.New("a hook needs either an URL or a Job")
+	}
+	parsed := &hook{url: h.URL, job: h.Job, timeout: defaultHookTimeout}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("'%s' is not an HTTP URL", h.URL)
+		}
+	}
+	if h.Timeout != "" {
+		d, err := time.ParseDuration(h.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("'%s' is not a valid timeout", h.Timeout)
+		}
+		parsed.timeout = d
+	}
+	return parsed, nil
+}
+
+// parseHookAnnotation parses the value of a hook annotation
+func parseHookAnnotation(val string) (*hook, error) {
+	if strings.HasPrefix(val, "http://") || strings.HasPrefix(val, "https://") {
+		return parseHook(policy.Hook{URL: val})
+	}
+	var h policy.Hook
+	if err := yaml.UnmarshalStrict([]byte(val), &h); err != nil {
+		return nil, fmt.Errorf("cannot parse hook: %w", err)
+	}
+	return parseHook(h)
+}
+
+// hookOf returns the hook of the namespace with the given name, or nil if it
+// has none. The controller creates the Jobs and calls the URLs of the hooks
+// with its own permissions, so the annotations of the namespace are only read
+// if annotations is true, the administrators having allowed it. They take
+// precedence over the policy of the namespace.
+func (s settings) hookOf(n corev1.Namespace, prefix, name string, annotations bool) (*hook, error) {
+	if val, ok := n.Annotations[prefix+name]; ok && annotations {
+		h, err := parseHookAnnotation(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid '%s' annotation: %w", name, err)
+		}
+		return h, nil
+	}
+	p := s.policyOf(n)
+	if p == nil {
+		return nil, nil
+	}
+	switch name {
+	case PreSuspendHook:
+		return p.preSuspend, nil
+	case PostResumeHook:
+		return p.postResume, nil
+	}
+	return nil, nil
+}
+
+// runHook runs the hook of the namespace with the given name, if it has one,
+// without waiting for it: it returns true once the hook has completed, and
+// false while it is in progress, the namespace being handled again by the next
+// loops. A failure is reported with an event on the namespace and returned.
+// The start and the completion of the hook are saved in the status of the
+// namespace, which is updated in place: a completed hook is not run again
+// during the same transition, and the Job of a hook is adopted after a
+// restart of the controller.
+func (eng *Engine) runHook(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, cur settings, n *corev1.Namespace, name string) (bool, error) {
+	h, err := cur.hookOf(*n, eng.Options.Prefix, name, eng.Options.HookAnnotationsEnabled)
+	if err != nil {
+		return false, eng.hookFailed(l, *n, name, err)
+	}
+	if h == nil {
+		return true, nil
+	}
+	status := eng.statusOf(*n)
+	started, completed := status.hook(name)
+	if *completed != "" {
+		l.Debug().Str("hook", name).Msgf("hook already completed at %s", *completed)
+		return true, nil
+	}
+	target := h.url
+	if h.job != nil {
+		target = "job " + hookJobNames[name]
+	}
+	if eng.DryRun.intercept(Change{Namespace: n.Name, Kind: "Hook", Name: name, Action: ActionRunHook, Detail: target}) {
+		return true, nil
+	}
+
+	// the timeout set by the hook is capped by the administrators
+	timeout := h.timeout
+	if timeout > cur.maxHookTimeout {
+		timeout = cur.maxHookTimeout
+	}
+	startedAt, err := time.Parse(time.RFC3339, *started)
+	if err != nil {
+		startedAt = eng.Clock.Now()
+		*started = startedAt.Local().Format(time.RFC3339)
+		eng.setStatus(ctx, l, cs, n, status)
+		l.Info().Str("hook", name).Msgf("starting hook, timeout %s", timeout)
+	}
+	deadline := startedAt.Add(timeout)
+
+	var done bool
+	if h.job != nil {
+		done, err = eng.checkJobHook(ctx, cs, *n, name, h, startedAt, deadline)
+	} else {
+		done, err = eng.checkCallHook(*n, name, h.url, deadline)
+	}
+
+	status = eng.statusOf(*n)
+	started, completed = status.hook(name)
+	switch {
+	case err != nil:
+		// the next attempt runs the hook from the start again
+		*started = ""
+		eng.setStatus(ctx, l, cs, n, status)
+		return false, eng.hookFailed(l, *n, name, err)
+	case !done:
+		l.Info().Str("hook", name).Msgf("hook started at %s still in progress", *started)
+		return false, nil
+	}
+	*completed = eng.Clock.Now().Local().Format(time.RFC3339)
+	eng.setStatus(ctx, l, cs, n, status)
+	elapsed := eng.Clock.Since(startedAt).Round(time.Second)
+	l.Info().Str("hook", name).Msgf("hook completed in %s", elapsed)
+	eng.Recorder.Eventf(namespaceRef(*n), corev1.EventTypeNormal, ReasonHookCompleted, "%s hook completed in %s", name, elapsed)
+	return true, nil
+}
+
+// hook returns the start and completion times of the hook with the given name
+func (s *namespaceStatus) hook(name string) (started, completed *string) {
+	if name == PreSuspendHook {
+		return &s.PreSuspendHookStarted, &s.PreSuspendHookCompleted
+	}
+	return &s.PostResumeHookStarted, &s.PostResumeHookCompleted
+}
+
+// setStatus saves the status of the namespace, and sets it on the namespace
+// so that the next updates of its status keep it
+func (eng *Engine) setStatus(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, n *corev1.Namespace, status namespaceStatus) {
+	eng.updateStatus(ctx, l, cs, *n, status)
+	if n.Annotations == nil {
+		n.Annotations = make(map[string]string)
+	}
+	setOrDelete(n.Annotations, eng.statusAnnotations(status))
+}
+
+// hookFailed reports the failure of a hook, and returns it
+func (eng *Engine) hookFailed(l zerolog.Logger, n corev1.Namespace, name string, err error) error {
+	err = fmt.Errorf("%s hook failed: %w", name, err)
+	l.Error().Err(err).Str("hook", name).Msg("hook failed")
+	eng.observeError(n.Name, "hooks", "run")
+	eng.Recorder.Event(namespaceRef(n), corev1.EventTypeWarning, ReasonHookFailed, err.Error())
+	return err
+}
+
+// checkCallHook starts the call to the URL of the hook in the background if
+// none is in progress, and returns true once it has succeeded. A call
+// interrupted by a restart of the controller is made again, with the time
+// left before the deadline.
+func (eng *Engine) checkCallHook(n corev1.Namespace, name, target string, deadline time.Time) (bool, error) {
+	key := n.Name + "/" + name
+	eng.hookCalls.mu.Lock()
+	defer eng.hookCalls.mu.Unlock()
+
+	c, ok := eng.hookCalls.calls[key]
+	if !ok {
+		timeout := deadline.Sub(eng.Clock.Now())
+		if timeout <= 0 {
+			return false, fmt.Errorf("%s did not answer before %s", target, deadline.Format(time.RFC3339))
+		}
+		c = &hookCall{done: make(chan struct{})}
+		eng.hookCalls.calls[key] = c
+		go func() {
+			c.err = callHook(context.Background(), n, name, target, timeout)
+			close(c.done)
+		}()
+	}
+	select {
+	case <-c.done:
+		delete(eng.hookCalls.calls, key)
+		return true, c.err
+	default:
+		return false, nil
+	}
+}
+
+// callHook posts the namespace and the hook name to the URL of the hook
+func callHook(ctx context.Context, n corev1.Namespace, name, target string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := json.Marshal(hookRequest{Namespace: n.Name, Hook: name})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered with status %d", target, resp.StatusCode)
+	}
+	return nil
+}
+
+// checkJobHook creates the Job of the hook in the namespace if it does not
+// exist yet, and returns true once it has completed. The Job is named after
+// the start of the hook, so that it is adopted by the next handlings of the
+// namespace, even after a restart of the controller. It is deleted if it has
+// not completed by the deadline, so that it does not go on once the hook has
+// been given up.
+func (eng *Engine) checkJobHook(ctx context.Context, cs kubernetes.Interface, n corev1.Namespace, name string, h *hook, started, deadline time.Time) (bool, error) {
+	jobName := fmt.Sprintf("%s-%d", hookJobNames[name], started.Unix())
+	res, err := cs.BatchV1().Jobs(n.Name).Get(ctx, jobName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		job := &batchv1.Job{ObjectMeta: *h.job.ObjectMeta.DeepCopy(), Spec: *h.job.Spec.DeepCopy()}
+		job.Name = jobName
+		job.Namespace = n.Name
+		if job.Labels == nil {
+			job.Labels = make(map[string]string)
+		}
+		job.Labels[eng.Options.Prefix+HookLabel] = name
+		if job.Spec.Template.Spec.RestartPolicy == "" {
+			job.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+		}
+		res, err = cs.BatchV1().Jobs(n.Name).Create(ctx, job, metav1.CreateOptions{FieldManager: FieldManager})
+		if err != nil {
+			return false, fmt.Errorf("cannot create job: %w", err)
+		}
+	} else if err != nil {
+		return false, fmt.Errorf("cannot get job: %w", err)
+	}
+
+	for _, c := range res.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			return true, nil
+		case batchv1.JobFailed:
+			return false, fmt.Errorf("job %s failed: %s", jobName, c.Message)
+		}
+	}
+	if !eng.Clock.Now().Before(deadline) {
+		propagation := metav1.DeletePropagationBackground
+		if err := cs.BatchV1().Jobs(n.Name).Delete(ctx, jobName, metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil && !apierrors.IsNotFound(err) {
+			eng.observeError(n.Name, "jobs", "delete")
+		}
+		return false, fmt.Errorf("job %s did not complete before %s", jobName, deadline.Format(time.RFC3339))
+	}
+	return false, nil
+}
@@ -0,0 +1,437 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/policy"
+	"github.com/rs/zerolog"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// hookServer is an HTTP hook recording the paths it is called with
+type hookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	received []string
+}
+
+func newHookServer() *hookServer {
+	s := &hookServer{status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.received = append(s.received, r.URL.Path)
+		if r.URL.Path == "/failing" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(s.status)
+	}))
+	return s
+}
+
+func (s *hookServer) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func (s *hookServer) calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+// withHooks loads a policy declaring the hooks for all the namespaces
+func withHooks(eng *Engine, hooks policy.Hooks) {
+	eng.Policies = &fakePolicies{policies: []policy.SuspendPolicy{testPolicy("hooks", 0, nil, policy.Spec{Hooks: hooks})}}
+	eng.loadPolicies(context.Background(), zerolog.Nop())
+}
+
+// waitHookCall waits for the call to the HTTP hook of the namespace in
+// progress, if any
+func waitHookCall(eng *Engine, ns, name string) {
+	eng.hookCalls.mu.Lock()
+	c, ok := eng.hookCalls.calls[ns+"/"+name]
+	eng.hookCalls.mu.Unlock()
+	if ok {
+		<-c.done
+	}
+}
+
+func Test_parseHook(t *testing.T) {
+	job := &batchv1.JobTemplateSpec{}
+	tests := []struct {
+		name        string
+		hook        policy.Hook
+		wantErr     bool
+		wantJob     bool
+		wantTimeout time.Duration
+	}{
+		{name: "url", hook: policy.Hook{URL: "https://hooks.example.com/dump"}, wantTimeout: defaultHookTimeout},
+		{name: "url with timeout", hook: policy.Hook{URL: "http://dump.team-a/", Timeout: "10m"}, wantTimeout: 10 * time.Minute},
+		{name: "job", hook: policy.Hook{Job: job}, wantJob: true, wantTimeout: defaultHookTimeout},
+		{name: "url and job", hook: policy.Hook{URL: "http://dump.team-a/", Job: job}, wantErr: true},
+		{name: "nothing", wantErr: true},
+		{name: "not an http url", hook: policy.Hook{URL: "ftp://dump.team-a/"}, wantErr: true},
+		{name: "invalid timeout", hook: policy.Hook{URL: "http://dump.team-a/", Timeout: "soon"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := parseHook(tt.hook)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (h.job != nil) != tt.wantJob || h.timeout != tt.wantTimeout {
+				t.Errorf("parseHook() = %+v, want job %v and timeout %s", h, tt.wantJob, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func Test_hookOf(t *testing.T) {
+	eng := newTestEngine(t, time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local), false, false)
+	withHooks(eng, policy.Hooks{PreSuspend: &policy.Hook{URL: "http://policy.tools/dump"}})
+
+	tests := []struct {
+		name        string
+		annotation  string
+		annotations bool
+		wantErr     bool
+		wantURL     string
+		wantJob     bool
+		wantTimeout time.Duration
+	}{
+		{name: "policy", annotations: true, wantURL: "http://policy.tools/dump", wantTimeout: defaultHookTimeout},
+		{name: "annotation disabled", annotation: "http://dump.team-a/", wantURL: "http://policy.tools/dump", wantTimeout: defaultHookTimeout},
+		{name: "url annotation", annotation: "http://dump.team-a/", annotations: true, wantURL: "http://dump.team-a/", wantTimeout: defaultHookTimeout},
+		{name: "json annotation", annotations: true, wantJob: true, wantTimeout: 10 * time.Minute,
+			annotation: `{"job": {"spec": {"template": {"spec": {"containers": [{"name": "dump", "image": "postgres"}]}}}}, "timeout": "10m"}`},
+		{name: "yaml annotation", annotation: "url: http://dump.team-a/\ntimeout: 1m", annotations: true, wantURL: "http://dump.team-a/", wantTimeout: time.Minute},
+		{name: "invalid annotation", annotation: "dump the database", annotations: true, wantErr: true},
+		{name: "unknown field", annotation: "command: dump", annotations: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var annotations map[string]string
+			if tt.annotation != "" {
+				annotations = map[string]string{PreSuspendHook: tt.annotation}
+			}
+			h, err := eng.settings().hookOf(*namespace(annotations), testPrefix, PreSuspendHook, tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("hookOf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if h.url != tt.wantURL || (h.job != nil) != tt.wantJob || h.timeout != tt.wantTimeout {
+				t.Errorf("hookOf() = %+v, want url %q, job %v and timeout %s", h, tt.wantURL, tt.wantJob, tt.wantTimeout)
+			}
+		})
+	}
+	h, err := eng.settings().hookOf(*namespace(nil), testPrefix, PostResumeHook, true)
+	if h != nil || err != nil {
+		t.Errorf("hookOf() = %+v, %v, want no post-resume hook", h, err)
+	}
+}
+
+func Test_runHookAnnotation(t *testing.T) {
+	srv := newHookServer()
+	defer srv.Close()
+	ctx := context.Background()
+	now := time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local)
+
+	for _, enabled := range []bool{false, true} {
+		eng := newTestEngine(t, now, false, false)
+		eng.Options.HookAnnotationsEnabled = enabled
+		n := namespace(map[string]string{PreSuspendHook: srv.URL + "/annotation"})
+		cs := fake.NewSimpleClientset(n)
+
+		done, err := eng.runHook(ctx, zerolog.Nop(), cs, eng.settings(), n, PreSuspendHook)
+		if enabled && !done && err == nil {
+			waitHookCall(eng, testNamespace, PreSuspendHook)
+			done, err = eng.runHook(ctx, zerolog.Nop(), cs, eng.settings(), n, PreSuspendHook)
+		}
+		if !done || err != nil {
+			t.Fatalf("runHook() with annotations enabled %v = %v, %v, want it done", enabled, done, err)
+		}
+		if completed := n.Annotations[testPrefix+PreSuspendHookCompleted] != ""; completed != enabled {
+			t.Errorf("hook completed with annotations enabled %v = %v, want %v", enabled, completed, enabled)
+		}
+	}
+	if got := srv.calls(); len(got) != 1 || got[0] != "/annotation" {
+		t.Errorf("hooks called = %v, want the annotation hook called once", got)
+	}
+
+	// an invalid annotation fails the hook
+	eng := newTestEngine(t, now, false, false)
+	eng.Options.HookAnnotationsEnabled = true
+	n := namespace(map[string]string{PreSuspendHook: "dump the database"})
+	if done, err := eng.runHook(ctx, zerolog.Nop(), fake.NewSimpleClientset(n), eng.settings(), n, PreSuspendHook); done || err == nil {
+		t.Errorf("runHook() = %v, %v, want an error", done, err)
+	}
+}
+
+func Test_runHook(t *testing.T) {
+	srv := newHookServer()
+	defer srv.Close()
+	job := &batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "dump", Image: "postgres"}},
+	}}}}
+
+	now := time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local)
+	// the Job of a hook started before a restart of the controller
+	existing := func(started time.Time, conditions ...batchv1.JobConditionType) *batchv1.Job {
+		j := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-%d", hookJobNames[PreSuspendHook], started.Unix()), Namespace: testNamespace}}
+		for _, c := range conditions {
+			j.Status.Conditions = append(j.Status.Conditions, batchv1.JobCondition{Type: c, Status: corev1.ConditionTrue})
+		}
+		return j
+	}
+
+	tests := []struct {
+		name        string
+		hook        *policy.Hook
+		annotations map[string]string
+		objects     []runtime.Object
+		// jobCondition is set on the Jobs when they are created
+		jobCondition  batchv1.JobConditionType
+		wantErr       bool
+		wantJob       bool
+		wantStarted   bool
+		wantCompleted bool
+	}{
+		{name: "no hook"},
+		{name: "http", hook: &policy.Hook{URL: srv.URL + "/dump"}, wantStarted: true, wantCompleted: true},
+		{name: "http failure", hook: &policy.Hook{URL: srv.URL + "/failing"}, wantErr: true},
+		{name: "http timeout", hook: &policy.Hook{URL: srv.URL + "/dump"},
+			annotations: map[string]string{PreSuspendHookStarted: now.Add(-time.Hour).Format(time.RFC3339)}, wantErr: true},
+		{name: "already completed", hook: &policy.Hook{URL: srv.URL + "/dump"},
+			annotations: map[string]string{PreSuspendHookCompleted: now.Format(time.RFC3339)}, wantCompleted: true},
+		{name: "job", hook: &policy.Hook{Job: job}, jobCondition: batchv1.JobComplete, wantJob: true, wantStarted: true, wantCompleted: true},
+		{name: "job failure", hook: &policy.Hook{Job: job}, jobCondition: batchv1.JobFailed, wantErr: true, wantJob: true},
+		{name: "job in progress", hook: &policy.Hook{Job: job}, wantJob: true, wantStarted: true},
+		{name: "job timeout", hook: &policy.Hook{Job: job},
+			annotations: map[string]string{PreSuspendHookStarted: now.Add(-10 * time.Minute).Format(time.RFC3339)},
+			objects:     []runtime.Object{existing(now.Add(-10 * time.Minute))}, wantErr: true},
+		// the timeout of the policy is capped by the max hook timeout
+		{name: "job timeout capped", hook: &policy.Hook{Job: job, Timeout: "1h"},
+			annotations: map[string]string{PreSuspendHookStarted: now.Add(-20 * time.Minute).Format(time.RFC3339)},
+			objects:     []runtime.Object{existing(now.Add(-20 * time.Minute))}, wantErr: true},
+		{name: "job adopted", hook: &policy.Hook{Job: job},
+			annotations: map[string]string{PreSuspendHookStarted: now.Add(-time.Minute).Format(time.RFC3339)},
+			objects:     []runtime.Object{existing(now.Add(-time.Minute), batchv1.JobComplete)},
+			wantJob:     true, wantStarted: true, wantCompleted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			eng := newTestEngine(t, now, false, false)
+			withHooks(eng, policy.Hooks{PreSuspend: tt.hook})
+			n := namespace(tt.annotations)
+			cs := fake.NewSimpleClientset(append(tt.objects, n)...)
+			cs.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				j := action.(k8stesting.CreateAction).GetObject().(*batchv1.Job)
+				if tt.objects != nil {
+					t.Errorf("job %s created, want the existing one adopted", j.Name)
+				}
+				if tt.jobCondition != "" {
+					j.Status.Conditions = []batchv1.JobCondition{{Type: tt.jobCondition, Status: corev1.ConditionTrue}}
+				}
+				return false, nil, nil
+			})
+
+			done, err := eng.runHook(ctx, zerolog.Nop(), cs, eng.settings(), n, PreSuspendHook)
+			// the HTTP hooks are called in the background, their result is
+			// read by the next run
+			if tt.hook != nil && tt.hook.URL != "" && !done && err == nil {
+				waitHookCall(eng, testNamespace, PreSuspendHook)
+				done, err = eng.runHook(ctx, zerolog.Nop(), cs, eng.settings(), n, PreSuspendHook)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runHook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if want := !tt.wantErr && (tt.hook == nil || tt.wantCompleted); done != want {
+				t.Errorf("runHook() = %v, want %v", done, want)
+			}
+			jobs, err := cs.BatchV1().Jobs(testNamespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(jobs.Items) == 1; got != tt.wantJob {
+				t.Fatalf("job kept = %v, want %v", got, tt.wantJob)
+			}
+			if tt.wantJob && tt.objects == nil && jobs.Items[0].Labels[testPrefix+HookLabel] != PreSuspendHook {
+				t.Errorf("job labels = %v, want the hook label", jobs.Items[0].Labels)
+			}
+
+			// the namespace is updated in place and on the API server
+			res, err := cs.CoreV1().Namespaces().Get(ctx, testNamespace, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, got := range []map[string]string{n.Annotations, res.Annotations} {
+				if completed := got[testPrefix+PreSuspendHookCompleted] != ""; completed != tt.wantCompleted {
+					t.Errorf("hook completed = %v, want %v", completed, tt.wantCompleted)
+				}
+				if started := got[testPrefix+PreSuspendHookStarted] != ""; started != tt.wantStarted {
+					t.Errorf("hook started = %v, want %v", started, tt.wantStarted)
+				}
+			}
+		})
+	}
+	if got := len(srv.calls()); got != 2 {
+		t.Errorf("http hooks called %d times, want 2", got)
+	}
+}
+
+func Test_runHookTimeout(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local)
+	clock := clocktesting.NewFakePassiveClock(now)
+	eng := newTestEngine(t, now, false, false)
+	eng.Clock = clock
+	withHooks(eng, policy.Hooks{PreSuspend: &policy.Hook{Job: &batchv1.JobTemplateSpec{}, Timeout: "10m"}})
+	n := namespace(nil)
+	cs := fake.NewSimpleClientset(n)
+
+	// the Job in progress is checked again by the next runs, until its
+	// deadline
+	for _, d := range []time.Duration{0, 5 * time.Minute, 10 * time.Minute} {
+		clock.SetTime(now.Add(d))
+		done, err := eng.runHook(ctx, zerolog.Nop(), cs, eng.settings(), n, PreSuspendHook)
+		if wantErr := d == 10*time.Minute; done || (err != nil) != wantErr {
+			t.Fatalf("runHook() after %s = %v, %v, want an error %v", d, done, err, wantErr)
+		}
+	}
+	jobs, err := cs.BatchV1().Jobs(testNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 0 {
+		t.Errorf("jobs = %v, want the timed out job deleted", jobs.Items)
+	}
+}
+
+func Test_reconcileHooks(t *testing.T) {
+	now := time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local)
+	srv := newHookServer()
+	defer srv.Close()
+
+	ctx := context.Background()
+	eng := newTestEngine(t, now, false, false)
+	withHooks(eng, policy.Hooks{PreSuspend: &policy.Hook{URL: srv.URL + "/pre"}, PostResume: &policy.Hook{URL: srv.URL + "/post"}})
+	n := namespace(map[string]string{DesiredState: Suspended, ObservedState: Running})
+	c := clients{cs: fake.NewSimpleClientset(n, deployment("api", 2, nil))}
+
+	// the namespace is left running while the pre-suspend hook is called,
+	// and a failed hook leaves it running
+	srv.setStatus(http.StatusInternalServerError)
+	for i := 0; i < 2; i++ {
+		if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); (err != nil) != (i == 1) {
+			t.Fatalf("reconcile() error = %v, want an error from the pre-suspend hook %v", err, i == 1)
+		}
+		if got := *c.deployment(t, "api").Spec.Replicas; got != 2 {
+			t.Errorf("replicas = %d, want them unchanged", got)
+		}
+		waitHookCall(eng, testNamespace, PreSuspendHook)
+	}
+	if c.namespace(t).Annotations[testPrefix+LastError] == "" {
+		t.Error("lastError not set")
+	}
+
+	srv.setStatus(http.StatusOK)
+	for i := 0; i < 2; i++ {
+		if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+			t.Fatal(err)
+		}
+		waitHookCall(eng, testNamespace, PreSuspendHook)
+	}
+	if got := *c.deployment(t, "api").Spec.Replicas; got != 0 {
+		t.Errorf("replicas = %d, want 0", got)
+	}
+	// the hook is not run again while the namespace is suspended
+	if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+		t.Fatal(err)
+	}
+	// nor when the suspension is retried after a failure
+	res := c.namespace(t)
+	res.Annotations[testPrefix+ObservedState] = Degraded
+	if _, err := c.cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the post-resume hook runs once the deployment is ready, the namespace
+	// is still resuming until it has completed
+	res = c.namespace(t)
+	res.Annotations[testPrefix+DesiredState] = Running
+	if _, err := c.cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+		t.Fatal(err)
+	}
+	d := c.deployment(t, "api")
+	d.Status.ReadyReplicas = 2
+	if _, err := c.cs.AppsV1().Deployments(testNamespace).Update(ctx, d, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{Resuming, Running} {
+		if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.namespace(t).Annotations[testPrefix+ObservedState]; got != want {
+			t.Errorf("observed state = %s, want %s", got, want)
+		}
+		waitHookCall(eng, testNamespace, PostResumeHook)
+	}
+
+	if got := c.namespace(t).Annotations; got[testPrefix+PreSuspendHookCompleted] != "" || got[testPrefix+PostResumeHookCompleted] == "" {
+		t.Errorf("hook status = %v, want only the post-resume hook completed", got)
+	}
+
+	// a namespace suspended before the controller was upgraded has no
+	// observed state, its pre-suspend hook is not run
+	n = namespace(map[string]string{DesiredState: Suspended})
+	n.Name = "suspended-before-upgrade"
+	if _, err := c.cs.CoreV1().Namespaces().Create(ctx, n, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.reconcile(ctx, c.cs, nil, nil, *n); err != nil {
+		t.Fatal(err)
+	}
+	waitHookCall(eng, n.Name, PreSuspendHook)
+
+	want := []string{"/pre", "/pre", "/post"}
+	got := srv.calls()
+	if len(got) != len(want) {
+		t.Fatalf("hooks called = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("hooks called = %v, want %v", got, want)
+		}
+	}
+}
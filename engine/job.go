@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/batch/v1"
+	"k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+)
+
+// behaviours with the Jobs running in a namespace being suspended
+const (
+	// JobsPolicyWait lets the Jobs finish
+	JobsPolicyWait = "wait"
+	// JobsPolicySuspend suspends the Jobs with their spec.suspend field, and
+	// resumes them with the namespace
+	JobsPolicySuspend = "suspend"
+	// JobsPolicyDelete deletes the Jobs, and their pods
+	JobsPolicyDelete = "delete"
+)
+
+// invalidJobsPolicies holds the invalid jobsPolicy annotations last reported,
+// by namespace
+type invalidJobsPolicies struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+// jobsPolicyOf returns the jobs policy of the namespace. An invalid annotation
+// is reported once per value, and the Jobs are then left running.
+func (eng *Engine) jobsPolicyOf(l zerolog.Logger, cur settings, n corev1.Namespace) string {
+	policy, err := cur.jobsPolicyOf(n, eng.Options.Prefix)
+	eng.invalidJobsPolicies.mu.Lock()
+	defer eng.invalidJobsPolicies.mu.Unlock()
+	if err == nil {
+		delete(eng.invalidJobsPolicies.values, n.Name)
+		return policy
+	}
+	if val := n.Annotations[eng.Options.Prefix+JobsPolicy]; eng.invalidJobsPolicies.values[n.Name] != val {
+		l.Warn().Err(err).Msgf("cannot read the '%s' annotation, letting the jobs finish", JobsPolicy)
+		eng.Recorder.Event(namespaceRef(n), corev1.EventTypeWarning, ReasonInvalidAnnotation, err.Error())
+		eng.invalidJobsPolicies.values[n.Name] = val
+	}
+	return JobsPolicyWait
+}
+
+// forgetJobsPolicy removes a namespace that is not managed anymore
+func (eng *Engine) forgetJobsPolicy(ns string) {
+	eng.invalidJobsPolicies.mu.Lock()
+	defer eng.invalidJobsPolicies.mu.Unlock()
+	delete(eng.invalidJobsPolicies.values, ns)
+}
+
+// parseJobsPolicy checks a jobs policy
+func parseJobsPolicy(val string) (string, error) {
+	switch val {
+	case JobsPolicyWait, JobsPolicySuspend, JobsPolicyDelete:
+		return val, nil
+	}
+	return "", fmt.Errorf("invalid jobs policy '%s', expected %s, %s or %s", val, JobsPolicyWait, JobsPolicySuspend, JobsPolicyDelete)
+}
+
+// managedJobs returns the Jobs handled with the namespace: the Jobs run by the
+// hooks, the ones created by a cronjob left untouched, and the ones excluded
+// by the resource rules or the policy of the namespace are skipped
+func (s settings) managedJobs(l zerolog.Logger, n corev1.Namespace, jobs []v1.Job, cronjobs []v1.CronJob, cronjobsBeta []v1beta1.CronJob, prefix string) []v1.Job {
+	p := s.policyOf(n)
+	kept := make(map[string]bool, len(cronjobs)+len(cronjobsBeta))
+	for _, c := range cronjobs {
+		kept[c.Name] = true
+	}
+	for _, c := range cronjobsBeta {
+		kept[c.Name] = true
+	}
+
+	var managed []v1.Job
+	for _, j := range jobs {
+		if _, ok := j.Labels[prefix+HookLabel]; ok {
+			continue
+		}
+		if owner := metav1.GetControllerOf(&j); owner != nil && owner.Kind == "CronJob" && !kept[owner.Name] {
+			continue
+		}
+		if s.excludes(l, n, p, config.KindJob, j.Name, j.Labels) {
+			continue
+		}
+		managed = append(managed, j)
+	}
+	return managed
+}
+
+// jobFinished returns true if the Job has completed or failed
+func jobFinished(j v1.Job) bool {
+	for _, c := range j.Status.Conditions {
+		if (c.Type == v1.JobComplete || c.Type == v1.JobFailed) && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRunningJobsConformity resumes the Jobs suspended by the controller,
+// whatever the jobs policy. The Jobs suspended by their owners are left
+// suspended.
+func checkRunningJobsConformity(ctx context.Context, l zerolog.Logger, rec record.EventRecorder, dr *DryRun, reason string, jobs []v1.Job, cs kubernetes.Interface, ns, prefix string) (bool, error) {
+	hasBeenPatched := false
+	for _, j := range jobs {
+		if j.Spec.Suspend == nil || !*j.Spec.Suspend || j.Annotations[prefix+suspendedByController] != "true" {
+			continue
+		}
+		l.Info().Str("job", j.Name).Msgf("updating %s from suspend: true to suspend: false", j.Name)
+		err := patchJobSuspend(ctx, cs, dr, ns, j.Name, prefix, false)
+		patchEvent(rec, objectRef("batch/v1", "Job", ns, j.Name, j.UID), reason, err, "updated from suspend: true to suspend: false")
+		if err != nil {
+			return hasBeenPatched, err
+		}
+		hasBeenPatched = true
+	}
+	return hasBeenPatched, nil
+}
+
+// checkSuspendedJobsConformity suspends or deletes the unfinished Jobs,
+// according to the jobs policy. Nothing is done with JobsPolicyWait.
+func checkSuspendedJobsConformity(ctx context.Context, l zerolog.Logger, rec record.EventRecorder, dr *DryRun, reason, policy string, jobs []v1.Job, cs kubernetes.Interface, ns, prefix string) (bool, error) {
+	hasBeenPatched := false
+	for _, j := range jobs {
+		if jobFinished(j) {
+			continue
+		}
+		var err error
+		switch policy {
+		case JobsPolicySuspend:
+			if j.Spec.Suspend != nil && *j.Spec.Suspend {
+				continue
+			}
+			l.Info().Str("job", j.Name).Msgf("updating %s from suspend: false to suspend: true", j.Name)
+			err = patchJobSuspend(ctx, cs, dr, ns, j.Name, prefix, true)
+			patchEvent(rec, objectRef("batch/v1", "Job", ns, j.Name, j.UID), reason, err, "updated from suspend: false to suspend: true")
+		case JobsPolicyDelete:
+			// a Job suspended by its owner is not running
+			if j.Spec.Suspend != nil && *j.Spec.Suspend {
+				continue
+			}
+			l.Info().Str("job", j.Name).Msgf("deleting %s", j.Name)
+			err = deleteJob(ctx, cs, dr, ns, j.Name)
+			patchEvent(rec, objectRef("batch/v1", "Job", ns, j.Name, j.UID), reason, err, "deleted")
+		default:
+			continue
+		}
+		if err != nil {
+			return hasBeenPatched, err
+		}
+		hasBeenPatched = true
+	}
+	return hasBeenPatched, nil
+}
+
+// patchJobSuspend updates the suspend state of a given Job. The Jobs
+// suspended by the controller are recorded, as the cronjobs are.
+func patchJobSuspend(ctx context.Context, cs kubernetes.Interface, dr *DryRun, ns, j, prefix string, suspend bool) error {
+	if dr.intercept(Change{Namespace: ns, Kind: "Job", Name: j, Action: suspendAction(suspend), Detail: fmt.Sprintf("suspend: %t", suspend)}) {
+		return nil
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, err := cs.BatchV1().Jobs(ns).Get(ctx, j, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if suspend {
+			if result.Annotations == nil {
+				result.Annotations = make(map[string]string)
+			}
+			result.Annotations[prefix+suspendedByController] = "true"
+		} else {
+			delete(result.Annotations, prefix+suspendedByController)
+		}
+		result.Spec.Suspend = &suspend
+		_, err = cs.BatchV1().Jobs(ns).Update(ctx, result, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// deleteJob deletes a Job and its pods
+func deleteJob(ctx context.Context, cs kubernetes.Interface, dr *DryRun, ns, j string) error {
+	if dr.intercept(Change{Namespace: ns, Kind: "Job", Name: j, Action: ActionDelete}) {
+		return nil
+	}
+	propagation := metav1.DeletePropagationBackground
+	err := cs.BatchV1().Jobs(ns).Delete(ctx, j, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
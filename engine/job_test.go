@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_parseJobsPolicy(t *testing.T) {
+	for _, val := range []string{JobsPolicyWait, JobsPolicySuspend, JobsPolicyDelete} {
+		if got, err := parseJobsPolicy(val); err != nil || got != val {
+			t.Errorf("parseJobsPolicy(%s) = %s, %v", val, got, err)
+		}
+	}
+	for _, val := range []string{"", "kill", "Suspend"} {
+		if _, err := parseJobsPolicy(val); err == nil {
+			t.Errorf("parseJobsPolicy(%q) expected an error", val)
+		}
+	}
+}
+
+func Test_managedJobs(t *testing.T) {
+	s, err := newSettings(testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// startedBy returns a Job started by the given cronjob
+	startedBy := func(name, cronjob string) batchv1.Job {
+		controller := true
+		j := *job(name, nil, nil)
+		j.OwnerReferences = []metav1.OwnerReference{{APIVersion: "batch/v1", Kind: "CronJob", Name: cronjob, Controller: &controller}}
+		return j
+	}
+	jobs := []batchv1.Job{
+		*job("import", nil, nil),
+		*job("dump", map[string]string{testPrefix + HookLabel: PreSuspendHook}, nil),
+		*job("migrate", map[string]string{"app": "migration"}, nil),
+		startedBy("backup-28500000", "backup"),
+		startedBy("report-28500000", "report"),
+	}
+	// the report cronjob is excluded, it is not in the list of cronjobs
+	cronjobs := []batchv1.CronJob{*cronjob("backup", false)}
+
+	got := s.managedJobs(zerolog.Nop(), *namespace(nil), jobs, cronjobs, nil, testPrefix)
+	want := []string{"import", "backup-28500000"}
+	if len(got) != len(want) {
+		t.Fatalf("managedJobs() = %d jobs, want %v", len(got), want)
+	}
+	for i := range want {
+		if got[i].Name != want[i] {
+			t.Errorf("managedJobs()[%d] = %s, want %s", i, got[i].Name, want[i])
+		}
+	}
+}
+
+func Test_jobFinished(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions []batchv1.JobCondition
+		want       bool
+	}{
+		{name: "running"},
+		{name: "complete", conditions: []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}, want: true},
+		{name: "failed", conditions: []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}, want: true},
+		{name: "suspended", conditions: []batchv1.JobCondition{{Type: batchv1.JobSuspended, Status: corev1.ConditionTrue}}},
+		{name: "not failed", conditions: []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionFalse}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := *job("import", nil, nil)
+			j.Status.Conditions = tt.conditions
+			if got := jobFinished(j); got != tt.want {
+				t.Errorf("jobFinished() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/tracing"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// step is a step of the reconciliation of a namespace by the suspender. Its
+// duration is measured and it is traced.
+type step struct {
+	name  string
+	start time.Time
+	span  trace.Span
+}
+
+// startStep starts a step of the suspender. The returned context must be used
+// by the calls done during the step.
+func (eng *Engine) startStep(ctx context.Context, name string) (context.Context, *step) {
+	ctx, span := tracing.Start(ctx, name)
+	return ctx, &step{name: name, start: time.Now(), span: span}
+}
+
+// endStep records the duration of a step of the suspender and ends its span
+func (eng *Engine) endStep(s *step) {
+	eng.MetricsServ.ReconcileDuration.WithLabelValues(s.name).Observe(time.Since(s.start).Seconds())
+	s.span.End()
+}
+
+// observeError counts an error that occurred while doing an operation on a
+// kind of resource of a namespace
+func (eng *Engine) observeError(ns, kind, operation string) {
+	eng.MetricsServ.Errors.WithLabelValues(ns, kind, operation).Inc()
+}
+
+// observeConformity counts the kinds of resources that have been patched or
+// that could not be patched during the conformity checks of a namespace
+func (eng *Engine) observeConformity(ns string, r *conformityResults) {
+	for _, kind := range r.patchedKinds {
+		eng.MetricsServ.ConformityPatches.WithLabelValues(kind).Inc()
+	}
+	for _, kind := range r.failedKinds {
+		eng.observeError(ns, kind, "patch")
+	}
+}
+
+// observeNamespaces updates the per namespace gauges. The series of the
+// namespaces that are not managed anymore are removed.
+func (eng *Engine) observeNamespaces(namespaces []v1.Namespace) {
+	managed := make(map[string]bool, len(namespaces))
+	for _, n := range namespaces {
+		managed[n.Name] = true
+
+		state := n.Annotations[eng.Options.Prefix+DesiredState]
+		if state != Running && state != Suspended {
+			state = "Unknown"
+		}
+		for _, s := range []string{Running, Suspended, "Unknown"} {
+			eng.MetricsServ.NamespaceState.WithLabelValues(n.Name, s).Set(boolToFloat(s == state))
+		}
+
+		phase := n.Annotations[eng.Options.Prefix+ObservedState]
+		for _, p := range []string{Suspending, Suspended, Resuming, Running, Degraded} {
+			eng.MetricsServ.NamespacePhase.WithLabelValues(n.Name, p).Set(boolToFloat(p == phase))
+		}
+	}
+
+	for name := range eng.knownStates {
+		if !managed[name] {
+			eng.MetricsServ.NamespaceState.DeletePartialMatch(prometheus.Labels{"namespace": name})
+			eng.MetricsServ.NamespacePhase.DeletePartialMatch(prometheus.Labels{"namespace": name})
+			eng.MetricsServ.Errors.DeletePartialMatch(prometheus.Labels{"namespace": name})
+			for _, vec := range []*prometheus.CounterVec{eng.MetricsServ.SavedSeconds, eng.MetricsServ.SavedCPUCoreHours,
+				eng.MetricsServ.SavedMemoryGiBHours, eng.MetricsServ.SavedRDSInstanceHours, eng.MetricsServ.SavedCost} {
+				vec.DeletePartialMatch(prometheus.Labels{"namespace": name})
+			}
+			eng.Savings.Forget(name)
+			eng.forgetBackoff(name)
+			eng.forgetJobsPolicy(name)
+			eng.DryRun.reset(name)
+			eng.MetricsServ.DryRunChanges.DeletePartialMatch(prometheus.Labels{"namespace": name})
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
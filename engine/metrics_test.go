@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_observeNamespaces(t *testing.T) {
+	eng := newTestEngine(t, time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local), false, false)
+	ns := func(name, state, phase string) corev1.Namespace {
+		return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{
+			testPrefix + DesiredState: state, testPrefix + ObservedState: phase}}}
+	}
+	namespaces := []corev1.Namespace{ns("team-a", Suspended, Suspending), ns("team-b", "Sleeping", "")}
+	eng.observeNamespaces(namespaces)
+	eng.updateKnownStates(namespaces)
+	eng.observeConformity("team-a", &conformityResults{patchedKinds: []string{"Deployment", "Deployment"}, failedKinds: []string{"CronJob"}})
+	eng.observeError("team-b", "deployments", "list")
+
+	tests := []struct {
+		ns, value string
+		want      float64
+	}{
+		{"team-a", Suspended, 1},
+		{"team-a", Running, 0},
+		{"team-a", "Unknown", 0},
+		{"team-b", Suspended, 0},
+		{"team-b", "Unknown", 1},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(eng.MetricsServ.NamespaceState.WithLabelValues(tt.ns, tt.value)); got != tt.want {
+			t.Errorf("namespace_state{namespace=%q, state=%q} = %v, want %v", tt.ns, tt.value, got, tt.want)
+		}
+	}
+	for _, p := range []string{Suspending, Suspended, Resuming, Running, Degraded} {
+		want := boolToFloat(p == Suspending)
+		if got := testutil.ToFloat64(eng.MetricsServ.NamespacePhase.WithLabelValues("team-a", p)); got != want {
+			t.Errorf("namespace_phase{namespace=\"team-a\", phase=%q} = %v, want %v", p, got, want)
+		}
+		if got := testutil.ToFloat64(eng.MetricsServ.NamespacePhase.WithLabelValues("team-b", p)); got != 0 {
+			t.Errorf("namespace_phase{namespace=\"team-b\", phase=%q} = %v, want 0", p, got)
+		}
+	}
+	if got := testutil.ToFloat64(eng.MetricsServ.ConformityPatches.WithLabelValues("Deployment")); got != 2 {
+		t.Errorf("conformity_patches_total{kind=\"Deployment\"} = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(eng.MetricsServ.Errors.WithLabelValues("team-a", "CronJob", "patch")); got != 1 {
+		t.Errorf("errors_total{namespace=\"team-a\", kind=\"CronJob\", operation=\"patch\"} = %v, want 1", got)
+	}
+
+	// team-a is not managed anymore: only the series of team-b are kept
+	namespaces = namespaces[1:]
+	eng.observeNamespaces(namespaces)
+	eng.updateKnownStates(namespaces)
+	if got := testutil.CollectAndCount(eng.MetricsServ.NamespaceState); got != 3 {
+		t.Errorf("%d namespace_state series, want the 3 of team-b", got)
+	}
+	if got := testutil.CollectAndCount(eng.MetricsServ.NamespacePhase); got != 5 {
+		t.Errorf("%d namespace_phase series, want the 5 of team-b", got)
+	}
+	if got := testutil.CollectAndCount(eng.MetricsServ.Errors); got != 1 {
+		t.Errorf("%d errors_total series, want the one of team-b", got)
+	}
+}
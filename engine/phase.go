@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/rs/zerolog"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// those are the phases a namespace can be observed in. They are stored in the
+// observedState annotation. Running and Suspended are the same values as the
+// desired states.
+const (
+	Suspending = "Suspending"
+	Resuming   = "Resuming"
+	Degraded   = "Degraded"
+)
+
+// rds clusters status we expect once they are started or stopped
+const (
+	rdsStatusAvailable = "available"
+	rdsStatusStopped   = "stopped"
+)
+
+// IsTransitional returns true if the phase is an intermediate one, where the
+// resources of the namespace have been patched but have not reached their
+// desired state yet
+func IsTransitional(phase string) bool {
+	return phase == Suspending || phase == Resuming
+}
+
+// observePhase computes the phase of a namespace from the state of its
+// resources. The resources have been listed before being patched, so if any
+// of them has been patched the namespace is still transitioning.
+func observePhase(dState string, patched int, deployments []appsv1.Deployment, statefulsets []appsv1.StatefulSet, rdsclusters []types.DBCluster) string {
+	switch dState {
+	case Suspended:
+		if patched > 0 {
+			return Suspending
+		}
+		for _, d := range deployments {
+			if d.Status.Replicas > 0 {
+				return Suspending
+			}
+		}
+		for _, ss := range statefulsets {
+			if ss.Status.Replicas > 0 {
+				return Suspending
+			}
+		}
+		for _, c := range rdsclusters {
+			if c.Status == nil || *c.Status != rdsStatusStopped {
+				return Suspending
+			}
+		}
+		return Suspended
+	case Running:
+		if patched > 0 {
+			return Resuming
+		}
+		for _, d := range deployments {
+			if d.Spec.Replicas != nil && d.Status.ReadyReplicas < *d.Spec.Replicas {
+				return Resuming
+			}
+		}
+		for _, ss := range statefulsets {
+			if ss.Spec.Replicas != nil && ss.Status.ReadyReplicas < *ss.Spec.Replicas {
+				return Resuming
+			}
+		}
+		for _, c := range rdsclusters {
+			if c.Status == nil || *c.Status != rdsStatusAvailable {
+				return Resuming
+			}
+		}
+		return Running
+	default:
+		return Degraded
+	}
+}
+
+// isStuck returns true if the namespace has been in a transitional phase for
+// longer than the transition timeout
+func (eng *Engine) isStuck(status namespaceStatus) bool {
+	if !IsTransitional(status.ObservedState) {
+		return false
+	}
+	since, err := time.Parse(time.RFC3339, status.LastTransitionTime)
+	if err != nil {
+		return false
+	}
+	return eng.Clock.Since(since) > eng.settings().transitionTimeout
+}
+
+// updatePhase saves the phase of the namespace in its status annotations and
+// emits the related events. If err is not nil, the namespace is Degraded.
+func (eng *Engine) updatePhase(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, n corev1.Namespace, dState, phase, reason string, err error) {
+	status := eng.statusOf(n)
+	previous := status
+
+	if err != nil {
+		failedReason := ReasonResumeFailed
+		if dState == Suspended {
+			failedReason = ReasonSuspendFailed
+		}
+		eng.Recorder.Event(namespaceRef(n), corev1.EventTypeWarning, failedReason, err.Error())
+		status = status.transitionTo(eng.Clock.Now(), Degraded, reason)
+		status.LastError = err.Error()
+		eng.updateStatus(ctx, l, cs, n, status)
+		return
+	}
+
+	status = status.transitionTo(eng.Clock.Now(), phase, reason)
+	if phase != previous.ObservedState {
+		l.Info().Msgf("namespace phase changed from '%s' to '%s'", previous.ObservedState, phase)
+		if phase == dState {
+			eng.MetricsServ.Transitions.WithLabelValues(status.LastTransitionReason, phase).Inc()
+		}
+		switch phase {
+		case Suspended:
+			eng.Recorder.Event(namespaceRef(n), corev1.EventTypeNormal, ReasonSuspended, "namespace suspended")
+		case Running:
+			eng.Recorder.Event(namespaceRef(n), corev1.EventTypeNormal, ReasonResumed, "namespace resumed")
+		}
+	}
+
+	// the namespace has not moved since the last time we saw it, so we flag
+	// it if it has been transitioning for too long
+	if phase == previous.ObservedState && eng.isStuck(status) {
+		status.LastError = fmt.Sprintf("namespace stuck in phase '%s' since %s", phase, status.LastTransitionTime)
+		if status.LastError != previous.LastError {
+			l.Warn().Msg(status.LastError)
+			eng.Recorder.Event(namespaceRef(n), corev1.EventTypeWarning, ReasonTransitionStuck, status.LastError)
+		}
+	}
+	eng.updateStatus(ctx, l, cs, n, status)
+}
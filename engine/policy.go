@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/govirtuo/kube-ns-suspender/notify"
+	"github.com/govirtuo/kube-ns-suspender/policy"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// PolicyLister lists the SuspendPolicy resources. It is implemented by
+// *policy.Client.
+type PolicyLister interface {
+	List(ctx context.Context) ([]policy.SuspendPolicy, error)
+}
+
+// suspendPolicy is a parsed SuspendPolicy
+type suspendPolicy struct {
+	name            string
+	priority        int
+	selector        labels.Selector
+	schedules       []schedule
+	runningDuration time.Duration
+	excludedKinds   map[string]bool
+	notifier        *notify.Notifier
+	preSuspend      *hook
+	postResume      *hook
+}
+
+// newSuspendPolicy parses a policy
+func newSuspendPolicy(p policy.SuspendPolicy) (suspendPolicy, error) {
+	sp := suspendPolicy{name: p.Name, priority: p.Spec.Priority, excludedKinds: make(map[string]bool)}
+	var err error
+
+	if sp.selector, err = metav1.LabelSelectorAsSelector(&p.Spec.NamespaceSelector); err != nil {
+		return sp, fmt.Errorf("invalid namespace selector: %w", err)
+	}
+	for i, c := range p.Spec.Schedules {
+		sch, err := newSchedule(c)
+		if err != nil {
+			return sp, fmt.Errorf("invalid schedule %d: %w", i, err)
+		}
+		sp.schedules = append(sp.schedules, sch)
+	}
+	if p.Spec.RunningDuration != "" {
+		if sp.runningDuration, err = time.ParseDuration(p.Spec.RunningDuration); err != nil {
+			return sp, fmt.Errorf("invalid running duration: %w", err)
+		}
+	}
+	for _, kind := range p.Spec.ExcludedKinds {
+		switch kind {
+		case config.KindDeployment, config.KindStatefulSet, config.KindCronJob, config.KindJob, config.KindScaledObject:
+			sp.excludedKinds[kind] = true
+		default:
+			return sp, fmt.Errorf("unsupported excluded kind '%s'", kind)
+		}
+	}
+	for i, n := range p.Spec.Notifications {
+		if n.URL == "" {
+			return sp, fmt.Errorf("notification %d has no URL", i)
+		}
+	}
+	if sp.notifier, err = notify.New(p.Spec.Notifications); err != nil {
+		return sp, err
+	}
+	if h := p.Spec.Hooks.PreSuspend; h != nil {
+		if sp.preSuspend, err = parseHook(*h); err != nil {
+			return sp, fmt.Errorf("invalid pre-suspend hook: %w", err)
+		}
+	}
+	if h := p.Spec.Hooks.PostResume; h != nil {
+		if sp.postResume, err = parseHook(*h); err != nil {
+			return sp, fmt.Errorf("invalid post-resume hook: %w", err)
+		}
+	}
+	return sp, nil
+}
+
+// loadPolicies lists the policies and makes them current. The invalid ones
+// are ignored, and reported once per generation. If the policies cannot be
+// listed, the previous ones are kept.
+func (eng *Engine) loadPolicies(ctx context.Context, l zerolog.Logger) {
+	if eng.Policies == nil {
+		return
+	}
+	list, err := eng.Policies.List(ctx)
+	if err != nil {
+		eng.observeError("", policy.Resource, "list")
+		l.Error().Err(err).Msg("cannot list policies, keeping the previous ones")
+		return
+	}
+
+	policies := make([]suspendPolicy, 0, len(list))
+	invalid := make(map[types.UID]int64)
+	for _, p := range list {
+		sp, err := newSuspendPolicy(p)
+		if err != nil {
+			invalid[p.UID] = p.Generation
+			if generation, ok := eng.invalidPolicies[p.UID]; ok && generation == p.Generation {
+				l.Debug().Err(err).Str("policy", p.Name).Msg("invalid policy, ignoring it")
+				continue
+			}
+			l.Error().Err(err).Str("policy", p.Name).Msg("invalid policy, ignoring it")
+			eng.Recorder.Eventf(objectRef(policy.Group+"/"+policy.Version, policy.Kind, "", p.Name, p.UID),
+				corev1.EventTypeWarning, ReasonInvalidPolicy, "policy ignored: %s", err)
+			continue
+		}
+		policies = append(policies, sp)
+	}
+	// the policies fixed or deleted are forgotten
+	eng.invalidPolicies = invalid
+	sort.SliceStable(policies, func(i, j int) bool {
+		if policies[i].priority != policies[j].priority {
+			return policies[i].priority > policies[j].priority
+		}
+		return policies[i].name < policies[j].name
+	})
+	l.Debug().Msgf("%d policies loaded", len(policies))
+
+	eng.settingsMu.Lock()
+	eng.current.policies = policies
+	eng.settingsMu.Unlock()
+}
+
+// policyOf returns the policy applying to the namespace, or nil if none
+// selects it
+func (s settings) policyOf(n corev1.Namespace) *suspendPolicy {
+	for i := range s.policies {
+		if s.policies[i].selector.Matches(labels.Set(n.Labels)) {
+			return &s.policies[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/govirtuo/kube-ns-suspender/policy"
+	"github.com/rs/zerolog"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakePolicies is a PolicyLister returning fixed policies
+type fakePolicies struct {
+	policies []policy.SuspendPolicy
+	err      error
+}
+
+func (f *fakePolicies) List(ctx context.Context) ([]policy.SuspendPolicy, error) {
+	return f.policies, f.err
+}
+
+func testPolicy(name string, priority int, selector map[string]string, spec policy.Spec) policy.SuspendPolicy {
+	spec.Priority = priority
+	spec.NamespaceSelector = metav1.LabelSelector{MatchLabels: selector}
+	return policy.SuspendPolicy{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+}
+
+func Test_loadPolicies(t *testing.T) {
+	eng := newTestEngine(t, time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local), false, false)
+	recorder := record.NewFakeRecorder(10)
+	eng.Recorder = recorder
+	lister := &fakePolicies{policies: []policy.SuspendPolicy{
+		testPolicy("all", 0, nil, policy.Spec{RunningDuration: "2h"}),
+		testPolicy("previews", 10, map[string]string{"env": "preview"}, policy.Spec{
+			Schedules:     []config.Schedule{{DailySuspendTime: "7:00PM", Days: []string{"Sat", "Sun"}}, {DailySuspendTime: "9:00PM"}},
+			ExcludedKinds: []string{config.KindStatefulSet},
+		}),
+		testPolicy("invalid", 20, nil, policy.Spec{RunningDuration: "forever"}),
+	}}
+	eng.Policies = lister
+	eng.loadPolicies(context.Background(), zerolog.Nop())
+
+	if got := len(recorder.Events); got != 1 {
+		t.Errorf("got %d events, want 1 for the invalid policy", got)
+	}
+
+	preview := *namespace(nil)
+	preview.Labels = map[string]string{"env": "preview"}
+	other := *namespace(nil)
+
+	s := eng.settings()
+	if p := s.policyOf(preview); p == nil || p.name != "previews" {
+		t.Errorf("policyOf(preview) = %v, want previews", p)
+	}
+	if p := s.policyOf(other); p == nil || p.name != "all" {
+		t.Errorf("policyOf(other) = %v, want all", p)
+	}
+
+	// the first schedule does not apply on Monday
+	if got, ok, err := s.dailySuspendTimeOf(preview, testPrefix, eng.Clock.Now()); err != nil || !ok || got != "9:00PM" {
+		t.Errorf("dailySuspendTimeOf(preview) = %s, %v, %v, want 9:00PM", got, ok, err)
+	}
+	preview.Annotations = map[string]string{testPrefix + DailySuspendTime: "8:00PM"}
+	if got, _, _ := s.dailySuspendTimeOf(preview, testPrefix, eng.Clock.Now()); got != "8:00PM" {
+		t.Errorf("dailySuspendTimeOf(preview) = %s, want the annotation 8:00PM", got)
+	}
+	if got := s.runningDurationOf(other, testPrefix); got != 2*time.Hour {
+		t.Errorf("runningDurationOf(other) = %s, want 2h", got)
+	}
+	if got := s.runningDurationOf(preview, testPrefix); got != 4*time.Hour {
+		t.Errorf("runningDurationOf(preview) = %s, want 4h", got)
+	}
+
+	statefulsets := &appsv1.StatefulSetList{Items: []appsv1.StatefulSet{*statefulset("db", 1, nil)}}
+	deployments := &appsv1.DeploymentList{Items: []appsv1.Deployment{*deployment("api", 1, nil)}}
+	s.filterResources(zerolog.Nop(), preview, deployments, statefulsets, nil, nil, nil)
+	if len(statefulsets.Items) != 0 || len(deployments.Items) != 1 {
+		t.Errorf("filterResources() kept %d statefulsets and %d deployments, want 0 and 1", len(statefulsets.Items), len(deployments.Items))
+	}
+
+	// the policies are kept when they cannot be listed, or when the
+	// configuration is reloaded
+	lister.err = errors.New("forbidden")
+	eng.loadPolicies(context.Background(), zerolog.Nop())
+	if _, err := eng.Reload(eng.Options); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(eng.settings().policies); got != 2 {
+		t.Errorf("got %d policies, want the 2 previous ones", got)
+	}
+}
+
+func Test_loadInvalidPolicies(t *testing.T) {
+	eng := newTestEngine(t, time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local), false, false)
+	recorder := record.NewFakeRecorder(10)
+	eng.Recorder = recorder
+	invalid := testPolicy("invalid", 0, nil, policy.Spec{RunningDuration: "forever"})
+	invalid.UID, invalid.Generation = "1234", 1
+	lister := &fakePolicies{policies: []policy.SuspendPolicy{invalid}}
+	eng.Policies = lister
+
+	steps := []struct {
+		name       string
+		generation int64
+		valid      bool
+		wantEvents int
+	}{
+		{name: "invalid policy", generation: 1, wantEvents: 1},
+		{name: "same generation", generation: 1},
+		{name: "new generation", generation: 2, wantEvents: 1},
+		{name: "fixed", generation: 3, valid: true},
+		{name: "invalid again", generation: 4, wantEvents: 1},
+	}
+	for _, step := range steps {
+		lister.policies[0].Generation = step.generation
+		lister.policies[0].Spec.RunningDuration = "forever"
+		if step.valid {
+			lister.policies[0].Spec.RunningDuration = "2h"
+		}
+		eng.loadPolicies(context.Background(), zerolog.Nop())
+		if got := len(recorder.Events); got != step.wantEvents {
+			t.Errorf("%s: got %d events, want %d", step.name, got, step.wantEvents)
+		}
+		for len(recorder.Events) > 0 {
+			<-recorder.Events
+		}
+	}
+}
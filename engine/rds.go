@@ -2,21 +2,36 @@ package engine
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/aws/aws-sdk-go-v2/service/rds"
 	"github.com/aws/aws-sdk-go-v2/service/rds/types"
 	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 
 	"strings"
 )
 
-func checkRunningRDSClustersConformity(ctx context.Context, l zerolog.Logger, rdsclusters []types.DBCluster, rdsclient *rds.Client, ns string) (bool, error) {
+// RDSAPI is the part of the AWS RDS API used by the engine. It is implemented
+// by *rds.Client.
+type RDSAPI interface {
+	DescribeDBClusters(ctx context.Context, params *rds.DescribeDBClustersInput, optFns ...func(*rds.Options)) (*rds.DescribeDBClustersOutput, error)
+	StartDBCluster(ctx context.Context, params *rds.StartDBClusterInput, optFns ...func(*rds.Options)) (*rds.StartDBClusterOutput, error)
+	StopDBCluster(ctx context.Context, params *rds.StopDBClusterInput, optFns ...func(*rds.Options)) (*rds.StopDBClusterOutput, error)
+}
+
+func checkRunningRDSClustersConformity(ctx context.Context, l zerolog.Logger, rec record.EventRecorder, dr *DryRun, reason string, nsRef *corev1.ObjectReference, rdsclusters []types.DBCluster, rdsclient RDSAPI, ns string) (bool, error) {
 	hasBeenPatched := false
 	for _, c := range rdsclusters {
 		l.Debug().Str("rdscluster", *c.DBClusterIdentifier).Msgf("running with status %v", *c.Status)
 		if c.Status != nil && strings.HasPrefix(*c.Status, "stop") {
 			l.Info().Str("rdscluster", *c.DBClusterIdentifier).Msgf("starting rds cluster")
-			if err := patchRDSClusterSuspend(ctx, rdsclient, ns, *c.DBClusterIdentifier, false, l); err != nil {
+			// RDS clusters are not Kubernetes objects, so the events are
+			// emitted on the namespace
+			err := patchRDSClusterSuspend(ctx, rdsclient, dr, ns, *c.DBClusterIdentifier, false, l)
+			patchEvent(rec, nsRef, reason, err, fmt.Sprintf("started rds cluster %s", *c.DBClusterIdentifier))
+			if err != nil {
 				return hasBeenPatched, err
 			}
 			hasBeenPatched = true
@@ -25,21 +40,28 @@ func checkRunningRDSClustersConformity(ctx context.Context, l zerolog.Logger, rd
 	return hasBeenPatched, nil
 }
 
-func checkSuspendedRDSClustersConformity(ctx context.Context, l zerolog.Logger, rdsclusters []types.DBCluster, rdsclient *rds.Client, ns string) error {
+func checkSuspendedRDSClustersConformity(ctx context.Context, l zerolog.Logger, rec record.EventRecorder, dr *DryRun, reason string, nsRef *corev1.ObjectReference, rdsclusters []types.DBCluster, rdsclient RDSAPI, ns string) (bool, error) {
+	hasBeenPatched := false
 	for _, c := range rdsclusters {
 		l.Debug().Str("rdscluster", *c.DBClusterIdentifier).Msgf("suspended with status %v", *c.Status)
 		if c.Status != nil && !strings.HasPrefix(*c.Status, "stop") {
 			l.Info().Str("rdscluster", *c.DBClusterIdentifier).Msgf("stopping rds cluster")
-			if err := patchRDSClusterSuspend(ctx, rdsclient, ns, *c.DBClusterIdentifier, true, l); err != nil {
-				return err
+			err := patchRDSClusterSuspend(ctx, rdsclient, dr, ns, *c.DBClusterIdentifier, true, l)
+			patchEvent(rec, nsRef, reason, err, fmt.Sprintf("stopped rds cluster %s", *c.DBClusterIdentifier))
+			if err != nil {
+				return hasBeenPatched, err
 			}
+			hasBeenPatched = true
 		}
 	}
-	return nil
+	return hasBeenPatched, nil
 }
 
 // patchRDSClusterSuspend updates the suspend state of a given rdscluster
-func patchRDSClusterSuspend(ctx context.Context, rdsclient *rds.Client, ns, c string, suspend bool, l zerolog.Logger) error {
+func patchRDSClusterSuspend(ctx context.Context, rdsclient RDSAPI, dr *DryRun, ns, c string, suspend bool, l zerolog.Logger) error {
+	if dr.intercept(Change{Namespace: ns, Kind: "DBCluster", Name: c, Action: suspendAction(suspend), Detail: fmt.Sprintf("stopped: %t", suspend)}) {
+		return nil
+	}
 	var err error
 	if suspend {
 		_, err = rdsclient.StopDBCluster(ctx, &rds.StopDBClusterInput{DBClusterIdentifier: &c})
@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/govirtuo/kube-ns-suspender/savings"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// bytesPerGiB is used to convert the memory requests to GiB
+const bytesPerGiB = 1 << 30
+
+// scaledAwayResources returns the resources that are released when the
+// namespace is suspended. The replicas of the workloads are read from their
+// originalReplicas annotation if they are already suspended.
+func (eng *Engine) scaledAwayResources(deployments []appsv1.Deployment, statefulsets []appsv1.StatefulSet, rdsclusters []types.DBCluster) savings.Resources {
+	var r savings.Resources
+	for _, d := range deployments {
+		addPodRequests(&r, d.Spec.Template.Spec, eng.replicasOf(d.Annotations, d.Spec.Replicas))
+	}
+	for _, ss := range statefulsets {
+		addPodRequests(&r, ss.Spec.Template.Spec, eng.replicasOf(ss.Annotations, ss.Spec.Replicas))
+	}
+	for _, c := range rdsclusters {
+		// only the Multi-AZ DB clusters expose their instance class
+		if c.DBClusterInstanceClass == nil {
+			continue
+		}
+		if r.RDSInstances == nil {
+			r.RDSInstances = make(map[string]int)
+		}
+		members := len(c.DBClusterMembers)
+		if members == 0 {
+			members = 1
+		}
+		r.RDSInstances[*c.DBClusterInstanceClass] += members
+	}
+	return r
+}
+
+// replicasOf returns the number of replicas of a workload before it has been
+// suspended
+func (eng *Engine) replicasOf(annotations map[string]string, replicas *int32) int {
+	if val, ok := annotations[eng.Options.Prefix+originalReplicas]; ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			return n
+		}
+	}
+	if replicas == nil {
+		return 0
+	}
+	return int(*replicas)
+}
+
+// addPodRequests adds the CPU and memory requests of the containers of a pod
+// to the resources, for each replica
+func addPodRequests(r *savings.Resources, pod corev1.PodSpec, replicas int) {
+	for _, c := range pod.Containers {
+		if cpu, ok := c.Resources.Requests[corev1.ResourceCPU]; ok {
+			r.CPU += cpu.AsApproximateFloat64() * float64(replicas)
+		}
+		if mem, ok := c.Resources.Requests[corev1.ResourceMemory]; ok {
+			r.MemoryGiB += mem.AsApproximateFloat64() / bytesPerGiB * float64(replicas)
+		}
+	}
+}
+
+// trackSavings tells the savings tracker the state of the namespace, and adds
+// what has been saved since the last loop to the metrics
+func (eng *Engine) trackSavings(ns, dState string, r savings.Resources) {
+	var s savings.Saving
+	if dState == Suspended {
+		s = eng.Savings.Suspended(ns, r, eng.Clock.Now())
+	} else {
+		s = eng.Savings.Running(ns, eng.Clock.Now())
+	}
+	if s.SuspendedSeconds == 0 {
+		return
+	}
+
+	eng.MetricsServ.SavedSeconds.WithLabelValues(ns).Add(s.SuspendedSeconds)
+	eng.MetricsServ.SavedCPUCoreHours.WithLabelValues(ns).Add(s.CPUCoreHours)
+	eng.MetricsServ.SavedMemoryGiBHours.WithLabelValues(ns).Add(s.MemoryGiBHours)
+	eng.MetricsServ.SavedCost.WithLabelValues(ns).Add(s.Cost)
+	for class, hours := range s.RDSInstanceHours {
+		eng.MetricsServ.SavedRDSInstanceHours.WithLabelValues(ns, class).Add(hours)
+	}
+}
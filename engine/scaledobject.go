@@ -2,17 +2,19 @@ package engine
 
 import (
 	"context"
+	"fmt"
 
 	kedav1alpha1 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
 	"github.com/kedacore/keda/v2/pkg/generated/clientset/versioned/typed/keda/v1alpha1"
 	"github.com/rs/zerolog"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 )
 
 const pauseAnnotation string = "autoscaling.keda.sh/paused-replicas"
 
-func checkRunningScaledObjectsConformity(ctx context.Context, l zerolog.Logger, scaledobjects []kedav1alpha1.ScaledObject, cs *v1alpha1.KedaV1alpha1Client, ns string) (bool, error) {
+func checkRunningScaledObjectsConformity(ctx context.Context, l zerolog.Logger, rec record.EventRecorder, dr *DryRun, reason string, scaledobjects []kedav1alpha1.ScaledObject, cs v1alpha1.KedaV1alpha1Interface, ns string) (bool, error) {
 	hasBeenPatched := false
 	for _, c := range scaledobjects {
 		l.Debug().Str("scaledobject", c.Name).Msgf("running with annotations %v", c.Annotations)
@@ -20,7 +22,9 @@ func checkRunningScaledObjectsConformity(ctx context.Context, l zerolog.Logger,
 			l.Debug().Str("scaledobject", c.Name).Msgf("found annotation %v", c.Annotations[pauseAnnotation])
 			if _, ok := c.Annotations[pauseAnnotation]; ok {
 				l.Info().Str("scaledobject", c.Name).Msgf("updating %s from paused to unpaused", c.Name)
-				if err := patchScaledObjectSuspend(ctx, cs, ns, c.Name, false, l); err != nil {
+				err := patchScaledObjectSuspend(ctx, cs, dr, ns, c.Name, false, l)
+				patchEvent(rec, objectRef("keda.sh/v1alpha1", "ScaledObject", ns, c.Name, c.UID), reason, err, "updated from paused to unpaused")
+				if err != nil {
 					return hasBeenPatched, err
 				}
 				hasBeenPatched = true
@@ -30,7 +34,8 @@ func checkRunningScaledObjectsConformity(ctx context.Context, l zerolog.Logger,
 	return hasBeenPatched, nil
 }
 
-func checkSuspendedScaledObjectsConformity(ctx context.Context, l zerolog.Logger, scaledobjects []kedav1alpha1.ScaledObject, cs *v1alpha1.KedaV1alpha1Client, ns string) error {
+func checkSuspendedScaledObjectsConformity(ctx context.Context, l zerolog.Logger, rec record.EventRecorder, dr *DryRun, reason string, scaledobjects []kedav1alpha1.ScaledObject, cs v1alpha1.KedaV1alpha1Interface, ns string) (bool, error) {
+	hasBeenPatched := false
 	for _, c := range scaledobjects {
 		l.Debug().Str("scaledobject", c.Name).Msgf("suspended with annotations %v", c.Annotations)
 		if c.Annotations != nil {
@@ -45,16 +50,22 @@ func checkSuspendedScaledObjectsConformity(ctx context.Context, l zerolog.Logger
 		l.Debug().Str("scaledobject", c.Name).Msgf("paused is %v", paused)
 		if !paused {
 			l.Info().Str("scaledobject", c.Name).Msgf("updating %s from unpaused to paused", c.Name)
-			if err := patchScaledObjectSuspend(ctx, cs, ns, c.Name, true, l); err != nil {
-				return err
+			err := patchScaledObjectSuspend(ctx, cs, dr, ns, c.Name, true, l)
+			patchEvent(rec, objectRef("keda.sh/v1alpha1", "ScaledObject", ns, c.Name, c.UID), reason, err, "updated from unpaused to paused")
+			if err != nil {
+				return hasBeenPatched, err
 			}
+			hasBeenPatched = true
 		}
 	}
-	return nil
+	return hasBeenPatched, nil
 }
 
 // patchScaledObjectSuspend updates the suspend state of a given scaledobject
-func patchScaledObjectSuspend(ctx context.Context, cs *v1alpha1.KedaV1alpha1Client, ns, c string, suspend bool, l zerolog.Logger) error {
+func patchScaledObjectSuspend(ctx context.Context, cs v1alpha1.KedaV1alpha1Interface, dr *DryRun, ns, c string, suspend bool, l zerolog.Logger) error {
+	if dr.intercept(Change{Namespace: ns, Kind: "ScaledObject", Name: c, Action: suspendAction(suspend), Detail: fmt.Sprintf("paused: %t", suspend)}) {
+		return nil
+	}
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		result, err := cs.ScaledObjects(ns).Get(ctx, c, metav1.GetOptions{})
 		if err != nil {
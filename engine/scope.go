@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// Scope selects the namespaces managed by the controller. The label selector
+// and the exact names are applied by the API server when the namespaces are
+// listed, the name patterns right after.
+type Scope struct {
+	// selector is the namespace selector, with the controllerName label
+	// requirement in opt-in label mode
+	selector labels.Selector
+	// listSelector is the selector given to the API server: selector, plus
+	// the exact names included and excluded, matched against the
+	// kubernetes.io/metadata.name label
+	listSelector labels.Selector
+	// include and exclude are name patterns (path.Match syntax)
+	include, exclude []string
+	// protected are the name patterns of the namespaces that can never be
+	// suspended, whatever their annotations
+	protected []string
+	// optInLabel tells that the namespaces are opted in with the
+	// controllerName label instead of the annotation
+	optInLabel bool
+	// key is the controllerName annotation or label key
+	key            string
+	controllerName string
+}
+
+// NewScope returns the scope of the controller. The prefix must end with a
+// slash.
+func NewScope(opt Options) (Scope, error) {
+	s := Scope{
+		include:        splitPatterns(opt.IncludeNamespaces),
+		exclude:        splitPatterns(opt.ExcludeNamespaces),
+		protected:      splitPatterns(opt.ProtectedNamespaces),
+		optInLabel:     opt.OptInLabel,
+		key:            opt.Prefix + ControllerName,
+		controllerName: opt.ControllerName,
+	}
+	for _, p := range append(append(append([]string{}, s.include...), s.exclude...), s.protected...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return s, fmt.Errorf("invalid namespace pattern '%s': %w", p, err)
+		}
+	}
+
+	var err error
+	if s.selector, err = labels.Parse(opt.NamespaceSelector); err != nil {
+		return s, fmt.Errorf("invalid namespace selector: %w", err)
+	}
+	if s.optInLabel {
+		req, err := labels.NewRequirement(s.key, selection.Equals, []string{s.controllerName})
+		if err != nil {
+			return s, fmt.Errorf("cannot opt namespaces in with label '%s=%s': %w", s.key, s.controllerName, err)
+		}
+		s.selector = s.selector.Add(*req)
+	}
+
+	// the included names can only be filtered by the API server if none of
+	// them is a pattern, while each excluded name can
+	s.listSelector = s.selector
+	var included, excluded []string
+	for _, p := range s.include {
+		if isPattern(p) {
+			included = nil
+			break
+		}
+		included = append(included, p)
+	}
+	for _, p := range s.exclude {
+		if !isPattern(p) {
+			excluded = append(excluded, p)
+		}
+	}
+	if len(included) > 0 {
+		req, err := labels.NewRequirement(v1.LabelMetadataName, selection.In, included)
+		if err != nil {
+			return s, fmt.Errorf("invalid included namespaces: %w", err)
+		}
+		s.listSelector = s.listSelector.Add(*req)
+	}
+	if len(excluded) > 0 {
+		req, err := labels.NewRequirement(v1.LabelMetadataName, selection.NotIn, excluded)
+		if err != nil {
+			return s, fmt.Errorf("invalid excluded namespaces: %w", err)
+		}
+		s.listSelector = s.listSelector.Add(*req)
+	}
+	return s, nil
+}
+
+// isPattern returns true if the name pattern is not an exact name
+func isPattern(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
+}
+
+// splitPatterns splits a comma separated list of patterns
+func splitPatterns(val string) []string {
+	var patterns []string
+	for _, p := range strings.Split(val, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// ListOptions returns the options to list the namespaces of the scope. Only
+// the label selector and the exact names can be applied by the API server.
+func (s Scope) ListOptions() metav1.ListOptions {
+	if s.listSelector == nil || s.listSelector.Empty() {
+		return metav1.ListOptions{}
+	}
+	return metav1.ListOptions{LabelSelector: s.listSelector.String()}
+}
+
+// Manages returns true if the namespace is managed by the controller: it is
+// selected by the scope, and opted in with the controllerName annotation (or
+// label) set to the name of the controller. The protected namespaces are
+// managed, so that they can be resumed, but never suspended.
+func (s Scope) Manages(n v1.Namespace) bool {
+	if s.selector != nil && !s.selector.Matches(labels.Set(n.Labels)) {
+		return false
+	}
+	if len(s.include) > 0 && !matchAny(s.include, n.Name) {
+		return false
+	}
+	if matchAny(s.exclude, n.Name) {
+		return false
+	}
+	return s.optedIn(n)
+}
+
+// Protected returns true if the namespace can never be suspended
+func (s Scope) Protected(name string) bool {
+	return matchAny(s.protected, name)
+}
+
+// optedIn returns true if the namespace has the controllerName annotation (or
+// label) set to the name of the controller
+func (s Scope) optedIn(n v1.Namespace) bool {
+	if s.optInLabel {
+		return n.Labels[s.key] == s.controllerName
+	}
+	value, ok := n.Annotations[s.key]
+	return ok && value == s.controllerName
+}
+
+// matchAny returns true if the name matches one of the patterns
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the scope
+func (s Scope) String() string {
+	var parts []string
+	if s.selector != nil && !s.selector.Empty() {
+		parts = append(parts, "selector "+s.selector.String())
+	}
+	if len(s.include) > 0 {
+		parts = append(parts, "including "+strings.Join(s.include, ","))
+	}
+	if len(s.exclude) > 0 {
+		parts = append(parts, "excluding "+strings.Join(s.exclude, ","))
+	}
+	if len(s.protected) > 0 {
+		parts = append(parts, "protecting "+strings.Join(s.protected, ","))
+	}
+	if len(parts) == 0 {
+		return "all namespaces"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestScope(t *testing.T) {
+	annotated := map[string]string{testPrefix + ControllerName: "kube-ns-suspender"}
+	ns := func(name string, labels, annotations map[string]string) corev1.Namespace {
+		// the API server sets the kubernetes.io/metadata.name label
+		lbls := map[string]string{corev1.LabelMetadataName: name}
+		for k, v := range labels {
+			lbls[k] = v
+		}
+		return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: lbls, Annotations: annotations}}
+	}
+	namespaces := []corev1.Namespace{
+		ns("preview-1", map[string]string{"env": "preview"}, annotated),
+		ns("preview-keep", map[string]string{"env": "preview"}, annotated),
+		ns("team-a", map[string]string{"env": "dev"}, annotated),
+		ns("team-b", map[string]string{"env": "dev", testPrefix + ControllerName: "kube-ns-suspender"}, nil),
+		ns("other", nil, map[string]string{testPrefix + ControllerName: "other"}),
+		ns("kube-system", nil, annotated),
+	}
+
+	tests := []struct {
+		name              string
+		opt               Options
+		wantLabelSelector string
+		// want is the names of the managed namespaces
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "default",
+			want: []string{"kube-system", "preview-1", "preview-keep", "team-a"},
+		},
+		{
+			// the protected namespaces are managed, so that they can be
+			// resumed, but never suspended
+			name: "protected",
+			opt:  Options{ProtectedNamespaces: "kube-*,preview-keep"},
+			want: []string{"kube-system", "preview-1", "preview-keep", "team-a"},
+		},
+		{
+			name:              "selector",
+			opt:               Options{NamespaceSelector: "env=preview"},
+			wantLabelSelector: "env=preview",
+			want:              []string{"preview-1", "preview-keep"},
+		},
+		{
+			name: "name patterns",
+			opt:  Options{IncludeNamespaces: "preview-*, team-?", ExcludeNamespaces: "*-keep"},
+			want: []string{"preview-1", "team-a"},
+		},
+		{
+			name:              "exact names",
+			opt:               Options{IncludeNamespaces: "team-a, preview-1"},
+			wantLabelSelector: corev1.LabelMetadataName + " in (preview-1,team-a)",
+			want:              []string{"preview-1", "team-a"},
+		},
+		{
+			name:              "exact excluded names",
+			opt:               Options{IncludeNamespaces: "*", ExcludeNamespaces: "kube-system,*-keep"},
+			wantLabelSelector: corev1.LabelMetadataName + " notin (kube-system)",
+			want:              []string{"preview-1", "team-a"},
+		},
+		{
+			name:              "opt-in label",
+			opt:               Options{NamespaceSelector: "env=dev", OptInLabel: true},
+			wantLabelSelector: "env=dev," + testPrefix + ControllerName + "=kube-ns-suspender",
+			want:              []string{"team-b"},
+		},
+		{
+			name:    "invalid selector",
+			opt:     Options{NamespaceSelector: "env in (dev"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid pattern",
+			opt:     Options{ExcludeNamespaces: "team-["},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opt.Prefix = testPrefix
+			tt.opt.ControllerName = "kube-ns-suspender"
+			s, err := NewScope(tt.opt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewScope() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := s.ListOptions().LabelSelector; got != tt.wantLabelSelector {
+				t.Errorf("label selector = %q, want %q", got, tt.wantLabelSelector)
+			}
+
+			// the namespaces are listed as the watcher does, from a
+			// fake clientset applying the label selector
+			cs := fake.NewSimpleClientset()
+			for i := range namespaces {
+				if _, err := cs.CoreV1().Namespaces().Create(context.Background(), &namespaces[i], metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			list, err := cs.CoreV1().Namespaces().List(context.Background(), s.ListOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, n := range list.Items {
+				if s.Manages(n) {
+					got = append(got, n.Name)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("managed namespaces = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("managed namespaces = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/govirtuo/kube-ns-suspender/notify"
+	kedav1alpha1 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
+	"github.com/rs/zerolog"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// reloadable are the options applied by Reload. The other ones are only read
+// when the engine starts.
+var reloadable = map[string]bool{
+	"LogLevel":          true,
+	"WatcherIdle":       true,
+	"RunningDuration":   true,
+	"TransitionTimeout": true,
+	"MaxHookTimeout":    true,
+	"MaxBackoff":        true,
+	"Schedules":         true,
+	"Profiles":          true,
+	"ResourceRules":     true,
+	"Notifications":     true,
+	// the circuit breaker can be overridden without restarting
+	"CircuitBreakerOverride": true,
+	"Budgets":                true,
+	"StaleAfterDays":         true,
+	"StaleWarningDays":       true,
+	"StaleGraceDays":         true,
+	"StaleAction":            true,
+	"JobsPolicy":             true,
+}
+
+// settings holds the options that can be changed while the engine runs, when
+// the configuration file is reloaded. A namespace is handled with the
+// settings that were current when its handling started.
+type settings struct {
+	logLevel          zerolog.Level
+	watcherIdle       time.Duration
+	runningDuration   time.Duration
+	transitionTimeout time.Duration
+	// maxHookTimeout caps the timeout of the hooks
+	maxHookTimeout time.Duration
+	maxBackoff     time.Duration
+	schedules      map[string]schedule
+	profiles       map[string]profile
+	resourceRules  []resourceRule
+	notifier       *notify.Notifier
+	// breakerOverride lets the automatic suspensions through while the
+	// circuit breaker is open
+	breakerOverride bool
+	// staleAfter is the time after which a suspended namespace is stale,
+	// zero if the stale namespaces are not cleaned up. The owners are warned
+	// staleWarning before, and it is deleted or archived according to
+	// staleAction staleGrace after.
+	staleAfter   time.Duration
+	staleWarning time.Duration
+	staleGrace   time.Duration
+	staleAction  string
+	// jobsPolicy tells what is done with the Jobs running in the namespaces
+	// being suspended, unless their jobsPolicy annotation says otherwise
+	jobsPolicy string
+	// policies are the SuspendPolicy resources, by decreasing priority. They
+	// are not read from the configuration file but listed at each inventory.
+	policies []suspendPolicy
+}
+
+type schedule struct {
+	dailySuspendTime string
+	// days are the days the namespaces are suspended on, all of them if empty
+	days map[time.Weekday]bool
+}
+
+// newSchedule parses a schedule of the configuration file or of a policy
+func newSchedule(c config.Schedule) (schedule, error) {
+	if _, err := ParseDailySuspendTime(c.DailySuspendTime); err != nil {
+		return schedule{}, fmt.Errorf("invalid daily suspend time: %w", err)
+	}
+	sch := schedule{dailySuspendTime: c.DailySuspendTime, days: make(map[time.Weekday]bool)}
+	for _, d := range c.Days {
+		wd, ok := config.ParseWeekday(d)
+		if !ok {
+			return schedule{}, fmt.Errorf("invalid day '%s'", d)
+		}
+		sch.days[wd] = true
+	}
+	return sch, nil
+}
+
+// appliesOn returns true if the namespaces are suspended on the day of t
+func (sch schedule) appliesOn(t time.Time) bool {
+	return len(sch.days) == 0 || sch.days[t.Local().Weekday()]
+}
+
+type profile struct {
+	schedule string
+	// runningDuration is zero if the one of the engine is used
+	runningDuration time.Duration
+}
+
+type resourceRule struct {
+	kind     string
+	selector labels.Selector
+	// namespaces are the namespaces the rule applies to, all of them if empty
+	namespaces map[string]bool
+}
+
+// newSettings parses the reloadable options
+func newSettings(opt Options) (settings, error) {
+	var s settings
+	var err error
+
+	s.logLevel, err = zerolog.ParseLevel(opt.LogLevel)
+	if err != nil {
+		return s, fmt.Errorf("invalid log level '%s': %w", opt.LogLevel, err)
+	}
+	s.watcherIdle = time.Duration(opt.WatcherIdle) * time.Second
+	s.breakerOverride = opt.CircuitBreakerOverride
+	if opt.StaleAfterDays < 0 || opt.StaleWarningDays < 0 || opt.StaleGraceDays < 0 {
+		return s, fmt.Errorf("the stale namespaces days cannot be negative")
+	}
+	s.staleAfter = time.Duration(opt.StaleAfterDays) * 24 * time.Hour
+	s.staleWarning = time.Duration(opt.StaleWarningDays) * 24 * time.Hour
+	s.staleGrace = time.Duration(opt.StaleGraceDays) * 24 * time.Hour
+	if opt.JobsPolicy == "" {
+		s.jobsPolicy = JobsPolicyWait
+	} else if s.jobsPolicy, err = parseJobsPolicy(opt.JobsPolicy); err != nil {
+		return s, err
+	}
+	switch opt.StaleAction {
+	case "":
+		s.staleAction = StaleActionNone
+	case StaleActionNone, StaleActionDelete, StaleActionArchive:
+		s.staleAction = opt.StaleAction
+	default:
+		return s, fmt.Errorf("invalid stale action '%s', expected %s, %s or %s", opt.StaleAction, StaleActionNone, StaleActionDelete, StaleActionArchive)
+	}
+	if s.runningDuration, err = time.ParseDuration(opt.RunningDuration); err != nil {
+		return s, fmt.Errorf("invalid running duration: %w", err)
+	}
+	if s.transitionTimeout, err = time.ParseDuration(opt.TransitionTimeout); err != nil {
+		return s, fmt.Errorf("invalid transition timeout: %w", err)
+	}
+	if opt.MaxHookTimeout == "" {
+		s.maxHookTimeout = defaultMaxHookTimeout
+	} else if s.maxHookTimeout, err = time.ParseDuration(opt.MaxHookTimeout); err != nil || s.maxHookTimeout <= 0 {
+		return s, fmt.Errorf("invalid max hook timeout '%s'", opt.MaxHookTimeout)
+	}
+	if s.maxBackoff, err = time.ParseDuration(opt.MaxBackoff); err != nil {
+		return s, fmt.Errorf("invalid max backoff: %w", err)
+	}
+
+	s.schedules = make(map[string]schedule, len(opt.Schedules))
+	for name, c := range opt.Schedules {
+		if s.schedules[name], err = newSchedule(c); err != nil {
+			return s, fmt.Errorf("invalid schedule '%s': %w", name, err)
+		}
+	}
+
+	s.profiles = make(map[string]profile, len(opt.Profiles))
+	for name, c := range opt.Profiles {
+		p := profile{schedule: c.Schedule}
+		if c.RunningDuration != "" {
+			if p.runningDuration, err = time.ParseDuration(c.RunningDuration); err != nil {
+				return s, fmt.Errorf("invalid running duration of profile '%s': %w", name, err)
+			}
+		}
+		s.profiles[name] = p
+	}
+
+	for i, c := range opt.ResourceRules {
+		r := resourceRule{kind: c.Kind, namespaces: make(map[string]bool)}
+		if r.selector, err = labels.Parse(c.Selector); err != nil {
+			return s, fmt.Errorf("invalid selector of resource rule %d: %w", i, err)
+		}
+		for _, ns := range c.Namespaces {
+			r.namespaces[ns] = true
+		}
+		s.resourceRules = append(s.resourceRules, r)
+	}
+
+	if s.notifier, err = notify.New(opt.Notifications); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// settings returns the current settings of the engine
+func (eng *Engine) settings() settings {
+	eng.settingsMu.RLock()
+	defer eng.settingsMu.RUnlock()
+	return eng.current
+}
+
+// Reload applies the reloadable options to the running engine: the log level,
+// the watcher idle duration, the running duration, the transition timeout,
+// the max hook timeout, the max backoff, the circuit breaker override, the cleanup of the stale
+// namespaces, and the schedules, profiles, resource rules, notification sinks
+// and budgets. It returns the names of the other options that differ
+// from the ones the engine was started with, which need a restart to be
+// applied.
+func (eng *Engine) Reload(opt Options) ([]string, error) {
+	s, err := newSettings(opt)
+	if err != nil {
+		return nil, err
+	}
+	// the log level is global, so that it can be changed without replacing
+	// the loggers
+	zerolog.SetGlobalLevel(s.logLevel)
+	eng.settingsMu.Lock()
+	s.policies = eng.current.policies
+	eng.current = s
+	eng.settingsMu.Unlock()
+	eng.Budgets.setLimits(opt.Budgets)
+
+	if opt.Prefix != "" && !strings.HasSuffix(opt.Prefix, "/") {
+		opt.Prefix += "/"
+	}
+	var changed []string
+	started := reflect.ValueOf(eng.Options)
+	reloaded := reflect.ValueOf(opt)
+	for i := 0; i < started.NumField(); i++ {
+		name := started.Type().Field(i).Name
+		if reloadable[name] {
+			continue
+		}
+		if !reflect.DeepEqual(started.Field(i).Interface(), reloaded.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed, nil
+}
+
+// dailySuspendTimeOf returns the daily suspend time of the namespace: its
+// dailySuspendTime annotation, or the one of its schedule, given directly or
+// through its profile, or else the one of the policy selecting it. ok is false
+// if the namespace has no daily suspend time, or if its schedule does not
+// apply on the day of now.
+func (s settings) dailySuspendTimeOf(n corev1.Namespace, prefix string, now time.Time) (string, bool, error) {
+	if val, ok := n.Annotations[prefix+DailySuspendTime]; ok {
+		return val, true, nil
+	}
+
+	name := n.Annotations[prefix+Schedule]
+	if p, ok := n.Annotations[prefix+Profile]; ok && name == "" {
+		prof, ok := s.profiles[p]
+		if !ok {
+			return "", false, fmt.Errorf("unknown profile '%s'", p)
+		}
+		name = prof.schedule
+	}
+	if name == "" {
+		if p := s.policyOf(n); p != nil {
+			for _, sch := range p.schedules {
+				if sch.appliesOn(now) {
+					return sch.dailySuspendTime, true, nil
+				}
+			}
+		}
+		return "", false, nil
+	}
+
+	sch, ok := s.schedules[name]
+	if !ok {
+		return "", false, fmt.Errorf("unknown schedule '%s'", name)
+	}
+	if !sch.appliesOn(now) {
+		return "", false, nil
+	}
+	return sch.dailySuspendTime, true, nil
+}
+
+// dueForSuspension returns true if the namespace, when Running, would be
+// suspended by the controller at now: its daily suspend time or its
+// nextSuspendTime annotation is past
+func (s settings) dueForSuspension(n corev1.Namespace, prefix string, now time.Time) bool {
+	if val, ok, err := s.dailySuspendTimeOf(n, prefix, now); err == nil && ok {
+		if nowMin, suspendAt, err := getTimes(now, val); err == nil && suspendAt <= nowMin {
+			return true
+		}
+	}
+	if val, ok := n.Annotations[prefix+NextSuspendTime]; ok {
+		if nextSuspendAt, err := ParseNextSuspendTime(val); err == nil && now.After(nextSuspendAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// runningDurationOf returns the duration a namespace unsuspended manually
+// keeps running: the one of its profile if it has one, else the one of the
+// policy selecting it, or the one of the engine
+func (s settings) runningDurationOf(n corev1.Namespace, prefix string) time.Duration {
+	if p, ok := s.profiles[n.Annotations[prefix+Profile]]; ok && p.runningDuration > 0 {
+		return p.runningDuration
+	}
+	if p := s.policyOf(n); p != nil && p.runningDuration > 0 {
+		return p.runningDuration
+	}
+	return s.runningDuration
+}
+
+// jobsPolicyOf returns the jobs policy of the namespace: the one of its
+// annotation if it has one, else the one of the engine
+func (s settings) jobsPolicyOf(n corev1.Namespace, prefix string) (string, error) {
+	if val, ok := n.Annotations[prefix+JobsPolicy]; ok {
+		return parseJobsPolicy(val)
+	}
+	return s.jobsPolicy, nil
+}
+
+// ignores returns true if a resource rule excludes the resource of the given
+// kind from the suspension
+func (s settings) ignores(kind, namespace string, lbls map[string]string) bool {
+	for _, r := range s.resourceRules {
+		if r.kind != kind {
+			continue
+		}
+		if len(r.namespaces) > 0 && !r.namespaces[namespace] {
+			continue
+		}
+		if r.selector.Matches(labels.Set(lbls)) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludes returns true if the resource of the namespace is excluded by the
+// resource rules, or by the policy p selecting the namespace
+func (s settings) excludes(l zerolog.Logger, n corev1.Namespace, p *suspendPolicy, kind, name string, lbls map[string]string) bool {
+	if p != nil && p.excludedKinds[kind] {
+		l.Debug().Str("kind", kind).Str("name", name).Msgf("resource excluded by policy '%s'", p.name)
+		return true
+	}
+	if s.ignores(kind, n.Name, lbls) {
+		l.Debug().Str("kind", kind).Str("name", name).Msg("resource excluded by a resource rule")
+		return true
+	}
+	return false
+}
+
+// filterResources removes the resources excluded by the resource rules, or
+// by the policy selecting the namespace, from the lists. The lists can be nil.
+func (s settings) filterResources(l zerolog.Logger, n corev1.Namespace, deployments *appsv1.DeploymentList, statefulsets *appsv1.StatefulSetList,
+	cronjobs *batchv1.CronJobList, cronjobsBeta *batchv1beta1.CronJobList, scaledobjects *kedav1alpha1.ScaledObjectList) {
+	p := s.policyOf(n)
+	if len(s.resourceRules) == 0 && (p == nil || len(p.excludedKinds) == 0) {
+		return
+	}
+	ignored := func(kind, name string, lbls map[string]string) bool {
+		return s.excludes(l, n, p, kind, name, lbls)
+	}
+
+	if deployments != nil {
+		var kept []appsv1.Deployment
+		for _, d := range deployments.Items {
+			if !ignored(config.KindDeployment, d.Name, d.Labels) {
+				kept = append(kept, d)
+			}
+		}
+		deployments.Items = kept
+	}
+	if statefulsets != nil {
+		var kept []appsv1.StatefulSet
+		for _, ss := range statefulsets.Items {
+			if !ignored(config.KindStatefulSet, ss.Name, ss.Labels) {
+				kept = append(kept, ss)
+			}
+		}
+		statefulsets.Items = kept
+	}
+	if cronjobs != nil {
+		var kept []batchv1.CronJob
+		for _, c := range cronjobs.Items {
+			if !ignored(config.KindCronJob, c.Name, c.Labels) {
+				kept = append(kept, c)
+			}
+		}
+		cronjobs.Items = kept
+	}
+	if cronjobsBeta != nil {
+		var kept []batchv1beta1.CronJob
+		for _, c := range cronjobsBeta.Items {
+			if !ignored(config.KindCronJob, c.Name, c.Labels) {
+				kept = append(kept, c)
+			}
+		}
+		cronjobsBeta.Items = kept
+	}
+	if scaledobjects != nil {
+		var kept []kedav1alpha1.ScaledObject
+		for _, so := range scaledobjects.Items {
+			if !ignored(config.KindScaledObject, so.Name, so.Labels) {
+				kept = append(kept, so)
+			}
+		}
+		scaledobjects.Items = kept
+	}
+}
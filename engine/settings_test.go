@@ -0,0 +1,166 @@
+package engine
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// testOptions returns options with schedules, profiles and resource rules
+func testOptions() Options {
+	return Options{
+		WatcherIdle:          15,
+		WatchListSize:        1,
+		RunningDuration:      "4h",
+		UIMaxRunningDuration: "12h",
+		TransitionTimeout:    "15m",
+		StallTimeout:         "5m",
+		ShutdownTimeout:      "30s",
+		MaxBackoff:           "10m",
+		LogLevel:             "disabled",
+		Prefix:               testPrefix,
+		ControllerName:       "kube-ns-suspender",
+		Schedules: map[string]config.Schedule{
+			"evening":  {DailySuspendTime: "8:00PM"},
+			"weekdays": {DailySuspendTime: "7:00PM", Days: []string{"Mon", "Tue", "Wed", "Thu", "Fri"}},
+		},
+		Profiles: map[string]config.Profile{
+			"dev":     {Schedule: "weekdays", RunningDuration: "1h"},
+			"nightly": {},
+		},
+		ResourceRules: []config.ResourceRule{
+			{Kind: config.KindStatefulSet, Selector: "app=db"},
+			{Kind: config.KindDeployment, Namespaces: []string{"other"}},
+			{Kind: config.KindJob, Selector: "app=migration"},
+		},
+	}
+}
+
+func Test_dailySuspendTimeOf(t *testing.T) {
+	s, err := newSettings(testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	monday := time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local)
+	saturday := time.Date(2024, time.March, 16, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		now         time.Time
+		want        string
+		wantOk      bool
+		wantErr     bool
+	}{
+		{"annotation", map[string]string{DailySuspendTime: "9:00PM", Schedule: "evening"}, monday, "9:00PM", true, false},
+		{"schedule", map[string]string{Schedule: "evening"}, saturday, "8:00PM", true, false},
+		{"profile schedule", map[string]string{Profile: "dev"}, monday, "7:00PM", true, false},
+		{"schedule not applying today", map[string]string{Profile: "dev"}, saturday, "", false, false},
+		{"schedule over profile", map[string]string{Profile: "dev", Schedule: "evening"}, saturday, "8:00PM", true, false},
+		{"profile without schedule", map[string]string{Profile: "nightly"}, monday, "", false, false},
+		{"nothing", nil, monday, "", false, false},
+		{"unknown schedule", map[string]string{Schedule: "never"}, monday, "", false, true},
+		{"unknown profile", map[string]string{Profile: "prod"}, monday, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := s.dailySuspendTimeOf(*namespace(tt.annotations), testPrefix, tt.now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dailySuspendTimeOf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("dailySuspendTimeOf() = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_reconcileWithSettings(t *testing.T) {
+	// a Monday, after the time of the weekdays schedule
+	now := time.Date(2024, time.March, 11, 20, 0, 0, 0, time.Local)
+	eng := newTestEngine(t, now, false, false)
+	if _, err := eng.Reload(testOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	db := statefulset("db", 1, nil)
+	db.Labels = map[string]string{"app": "db"}
+	n := namespace(map[string]string{DesiredState: Running, Profile: "dev", JobsPolicy: JobsPolicySuspend})
+	c := clients{cs: fake.NewSimpleClientset(n, deployment("api", 2, nil), statefulset("cache", 1, nil), db,
+		job("import", nil, nil), job("migrate", map[string]string{"app": "migration"}, nil))}
+
+	if err := eng.reconcile(context.Background(), c.cs, nil, nil, *n); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.namespace(t).Annotations[testPrefix+DesiredState]; got != Suspended {
+		t.Errorf("desiredState = %s, want %s", got, Suspended)
+	}
+	if got := *c.deployment(t, "api").Spec.Replicas; got != 0 {
+		t.Errorf("api replicas = %d, want 0", got)
+	}
+	for name, want := range map[string]int32{"cache": 0, "db": 1} {
+		ss, err := c.cs.AppsV1().StatefulSets(testNamespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := *ss.Spec.Replicas; got != want {
+			t.Errorf("%s replicas = %d, want %d", name, got, want)
+		}
+	}
+	for name, want := range map[string]bool{"import": true, "migrate": false} {
+		if got := *c.job(t, name).Spec.Suspend; got != want {
+			t.Errorf("%s suspended = %v, want %v", name, got, want)
+		}
+	}
+
+	// on Saturday the schedule does not apply, and the namespace unsuspended
+	// manually runs for the duration of its profile
+	saturday := now.AddDate(0, 0, 5)
+	eng.Clock = clocktesting.NewFakePassiveClock(saturday)
+	n = namespace(map[string]string{DesiredState: Running, Profile: "dev"})
+	c = clients{cs: fake.NewSimpleClientset(n, deployment("api", 0, map[string]string{testPrefix + originalReplicas: "2"}))}
+	if err := eng.reconcile(context.Background(), c.cs, nil, nil, *n); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.namespace(t).Annotations[testPrefix+DesiredState]; got != Running {
+		t.Errorf("desiredState = %s on Saturday, want %s", got, Running)
+	}
+	want := saturday.Add(time.Hour).Format(time.RFC822Z)
+	if got := c.namespace(t).Annotations[testPrefix+NextSuspendTime]; got != want {
+		t.Errorf("nextSuspendTime = %s, want %s", got, want)
+	}
+}
+
+func TestReload(t *testing.T) {
+	eng := newTestEngine(t, time.Now(), false, false)
+
+	opt := testOptions()
+	opt.MaxBackoff = "1m"
+	opt.DryRun = true
+	opt.Prefix = "kube-ns-suspender"
+	opt.AwsRdsNamespaceTag = "Namespace"
+	changed, err := eng.Reload(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"DryRun"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("Reload() changed = %v, want %v", changed, want)
+	}
+	if got := eng.backoffDelay(10); got != time.Minute {
+		t.Errorf("backoffDelay() = %s after reload, want 1m", got)
+	}
+
+	opt.RunningDuration = "forever"
+	if _, err := eng.Reload(opt); err == nil {
+		t.Error("Reload() expected an error with an invalid running duration")
+	}
+	if got := eng.settings().maxBackoff; got != time.Minute {
+		t.Errorf("settings changed by an invalid reload, maxBackoff = %s", got)
+	}
+}
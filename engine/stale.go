@@ -0,0 +1,427 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/audit"
+	kedav1alpha1 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
+	"github.com/kedacore/keda/v2/pkg/generated/clientset/versioned/typed/keda/v1alpha1"
+	"github.com/rs/zerolog"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// actions done on the stale namespaces once their grace period is over
+const (
+	StaleActionNone    = "none"
+	StaleActionDelete  = "delete"
+	StaleActionArchive = "archive"
+)
+
+// annotations and label used to clean up the namespaces suspended for too
+// long
+const (
+	// Keep protects a namespace from the cleanup when set to "true"
+	Keep = "keep"
+	// Stale is the label set to "true" on the stale namespaces
+	Stale = "stale"
+
+	// staleWarningTime is the time the namespace owners have been warned
+	staleWarningTime = "staleWarningTime"
+	// staleSince is the time the namespace has been labelled stale
+	staleSince = "staleSince"
+	// archiveTime is the time the workloads of the namespace have been
+	// archived
+	archiveTime = "archiveTime"
+)
+
+// ArchiveConfigMap is the name of the ConfigMap holding the manifests of the
+// workloads of an archived namespace
+const ArchiveConfigMap = "kube-ns-suspender-archive"
+
+// maxArchiveSize is the maximum size of the data of the archive ConfigMap,
+// enforced by the API server
+const maxArchiveSize = 1024 * 1024
+
+// ErrArchiveTooLarge is returned when the manifests of the workloads of a
+// namespace do not fit in the archive ConfigMap
+var ErrArchiveTooLarge = errors.New("archive too large")
+
+// cleanupStale moves the namespaces suspended for too long through the stale
+// lifecycle: their owners are warned, then they are labelled stale, and they
+// are finally deleted or archived after the grace period. Each step is done
+// at most once per inventory, and a resumed namespace starts again from the
+// beginning.
+func (eng *Engine) cleanupStale(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, kedacs v1alpha1.KedaV1alpha1Interface, namespaces []corev1.Namespace) {
+	cur := eng.settings()
+	if cur.staleAfter == 0 {
+		return
+	}
+	now := eng.Clock.Now()
+
+	tooLarge := make(map[string]string)
+	for _, n := range namespaces {
+		nLogger := l.With().Str("namespace", n.Name).Logger()
+		if n.Annotations[eng.Options.Prefix+Keep] == "true" || eng.Scope.Protected(n.Name) {
+			continue
+		}
+		if n.Annotations[eng.Options.Prefix+DesiredState] != Suspended {
+			eng.clearStale(ctx, nLogger, cs, n)
+			continue
+		}
+		// the namespace has not been observed suspended yet
+		since, err := time.Parse(time.RFC3339, n.Annotations[eng.Options.Prefix+SuspendedSince])
+		if err != nil {
+			continue
+		}
+		if err := eng.advanceStale(ctx, nLogger, cs, kedacs, n, cur, since, now); err != nil {
+			eng.observeError(n.Name, "namespaces", "cleanup")
+			nLogger.Error().Err(err).Msg("cannot clean up stale namespace")
+			// retrying does not help until the workloads or the action
+			// change, the archive too large is reported once
+			if errors.Is(err, ErrArchiveTooLarge) {
+				tooLarge[n.Name] = err.Error()
+				if eng.archivesTooLarge[n.Name] != err.Error() {
+					eng.Recorder.Event(namespaceRef(n), corev1.EventTypeWarning, ReasonArchiveTooLarge, err.Error())
+				}
+			}
+		}
+	}
+	eng.archivesTooLarge = tooLarge
+}
+
+// advanceStale does the next step of the stale lifecycle of a namespace
+// suspended since the given time, if it is due
+func (eng *Engine) advanceStale(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, kedacs v1alpha1.KedaV1alpha1Interface, n corev1.Namespace, cur settings, since, now time.Time) error {
+	prefix := eng.Options.Prefix
+	warnedAt, errWarned := time.Parse(time.RFC3339, n.Annotations[prefix+staleWarningTime])
+	staleAt, errStale := time.Parse(time.RFC3339, n.Annotations[prefix+staleSince])
+
+	switch {
+	case errWarned != nil:
+		if now.Sub(since) < cur.staleAfter-cur.staleWarning {
+			return nil
+		}
+		// the namespace is labelled stale once the owners have had the
+		// time to react to the warning
+		willBeStale := since.Add(cur.staleAfter)
+		if w := now.Add(cur.staleWarning); w.After(willBeStale) {
+			willBeStale = w
+		}
+		if err := patchNamespaceMetadata(ctx, cs, eng.DryRun, n.Name, nil, map[string]string{prefix + staleWarningTime: now.Local().Format(time.RFC3339)}); err != nil {
+			return err
+		}
+		msg := fmt.Sprintf("suspended since %s, it will be labelled stale on %s", since.Local().Format(time.RFC3339), willBeStale.Local().Format(time.RFC3339))
+		l.Info().Msg(msg)
+		eng.notifyStale(ctx, l, n, msg)
+
+	case errStale != nil:
+		due := since.Add(cur.staleAfter)
+		if w := warnedAt.Add(cur.staleWarning); w.After(due) {
+			due = w
+		}
+		if now.Before(due) {
+			return nil
+		}
+		if err := patchNamespaceMetadata(ctx, cs, eng.DryRun, n.Name, map[string]string{prefix + Stale: "true"},
+			map[string]string{prefix + staleSince: now.Local().Format(time.RFC3339)}); err != nil {
+			return err
+		}
+		msg := fmt.Sprintf("suspended since %s, labelled stale", since.Local().Format(time.RFC3339))
+		if cur.staleAction != StaleActionNone {
+			msg += fmt.Sprintf(", it will be %sd on %s", cur.staleAction, now.Add(cur.staleGrace).Local().Format(time.RFC3339))
+		}
+		l.Warn().Msg(msg)
+		eng.Recorder.Event(namespaceRef(n), corev1.EventTypeWarning, ReasonStale, msg)
+		eng.notifyStale(ctx, l, n, msg)
+
+	default:
+		if cur.staleAction == StaleActionNone || n.Annotations[prefix+archiveTime] != "" || now.Before(staleAt.Add(cur.staleGrace)) {
+			return nil
+		}
+		switch cur.staleAction {
+		case StaleActionDelete:
+			if !eng.DryRun.intercept(Change{Namespace: n.Name, Kind: "Namespace", Name: n.Name, Action: ActionDelete, Detail: "stale"}) {
+				// the namespace is only deleted if it has not changed since the
+				// inventory, e.g. resumed or kept meanwhile. Otherwise, it is
+				// checked again by the next inventory.
+				err := cs.CoreV1().Namespaces().Delete(ctx, n.Name, metav1.DeleteOptions{
+					Preconditions: &metav1.Preconditions{UID: &n.UID, ResourceVersion: &n.ResourceVersion},
+				})
+				if apierrors.IsConflict(err) {
+					l.Info().Msg("namespace changed since the inventory, not deleting it")
+					return nil
+				}
+				if err != nil && !apierrors.IsNotFound(err) {
+					return err
+				}
+			}
+		case StaleActionArchive:
+			if err := eng.archiveWorkloads(ctx, cs, kedacs, n.Name); err != nil {
+				return err
+			}
+			if err := patchNamespaceMetadata(ctx, cs, eng.DryRun, n.Name, nil, map[string]string{prefix + archiveTime: now.Local().Format(time.RFC3339)}); err != nil {
+				return err
+			}
+		}
+		msg := fmt.Sprintf("stale since %s, %sd", staleAt.Local().Format(time.RFC3339), cur.staleAction)
+		l.Warn().Msg(msg)
+		eng.Recorder.Event(namespaceRef(n), corev1.EventTypeWarning, ReasonStaleCleanup, msg)
+		eng.notifyStale(ctx, l, n, msg)
+	}
+	return nil
+}
+
+// clearStale removes the stale label and annotations of a namespace that has
+// been resumed
+func (eng *Engine) clearStale(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, n corev1.Namespace) {
+	prefix := eng.Options.Prefix
+	labels := make(map[string]string)
+	if _, ok := n.Labels[prefix+Stale]; ok {
+		labels[prefix+Stale] = ""
+	}
+	annotations := make(map[string]string)
+	for _, a := range []string{staleWarningTime, staleSince, archiveTime} {
+		if _, ok := n.Annotations[prefix+a]; ok {
+			annotations[prefix+a] = ""
+		}
+	}
+	if len(labels) == 0 && len(annotations) == 0 {
+		return
+	}
+	l.Info().Msg("namespace resumed, it is not stale anymore")
+	if err := patchNamespaceMetadata(ctx, cs, eng.DryRun, n.Name, labels, annotations); err != nil {
+		eng.observeError(n.Name, "namespaces", "update")
+		l.Error().Err(err).Msg("cannot remove the stale label and annotations")
+	}
+}
+
+// notifyStale sends a step of the stale lifecycle of a namespace to the
+// notification sinks, as a notification whose state does not change
+func (eng *Engine) notifyStale(ctx context.Context, l zerolog.Logger, n corev1.Namespace, msg string) {
+	eng.notifyTransition(ctx, l, n, audit.Record{Time: eng.Clock.Now().Local(), Namespace: n.Name, From: Suspended, To: Suspended,
+		Origin: audit.OriginStale, Message: msg})
+}
+
+// archiveWorkloads saves the manifests of the workloads the suspender handles
+// in the archive ConfigMap, then deletes them: the deployments, statefulsets,
+// cronjobs, unfinished jobs, and scaledobjects if Keda is enabled. The jobs
+// created by another resource, such as a cronjob, are left to their owner.
+// Nothing is written nor deleted if the manifests do not fit in the
+// ConfigMap: the returned error then wraps ErrArchiveTooLarge.
+func (eng *Engine) archiveWorkloads(ctx context.Context, cs kubernetes.Interface, kedacs v1alpha1.KedaV1alpha1Interface, ns string) error {
+	data := make(map[string]string)
+	var deletes []func() error
+	// the pods of the jobs and cronjobs are not deleted with them by default
+	background := metav1.DeletePropagationBackground
+
+	deployments, err := cs.AppsV1().Deployments(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("cannot list deployments: %w", err)
+	}
+	for i := range deployments.Items {
+		d := deployments.Items[i]
+		d.TypeMeta = metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"}
+		d.ObjectMeta = archivedMeta(d.ObjectMeta)
+		d.Status = appsv1.DeploymentStatus{}
+		if err := archive(data, "Deployment", d.Name, d); err != nil {
+			return err
+		}
+		deletes = append(deletes, func() error {
+			return cs.AppsV1().Deployments(ns).Delete(ctx, d.Name, metav1.DeleteOptions{})
+		})
+	}
+
+	statefulsets, err := cs.AppsV1().StatefulSets(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("cannot list statefulsets: %w", err)
+	}
+	for i := range statefulsets.Items {
+		ss := statefulsets.Items[i]
+		ss.TypeMeta = metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"}
+		ss.ObjectMeta = archivedMeta(ss.ObjectMeta)
+		ss.Status = appsv1.StatefulSetStatus{}
+		if err := archive(data, "StatefulSet", ss.Name, ss); err != nil {
+			return err
+		}
+		deletes = append(deletes, func() error {
+			return cs.AppsV1().StatefulSets(ns).Delete(ctx, ss.Name, metav1.DeleteOptions{})
+		})
+	}
+
+	// as for the suspension, the cronjobs are read with the batchv1beta API
+	// on the clusters that do not serve them with batchv1
+	cronjobs, err := cs.BatchV1().CronJobs(ns).List(ctx, metav1.ListOptions{})
+	if err == nil {
+		for i := range cronjobs.Items {
+			c := cronjobs.Items[i]
+			c.TypeMeta = metav1.TypeMeta{APIVersion: "batch/v1", Kind: "CronJob"}
+			c.ObjectMeta = archivedMeta(c.ObjectMeta)
+			c.Status = batchv1.CronJobStatus{}
+			if err := archive(data, "CronJob", c.Name, c); err != nil {
+				return err
+			}
+			deletes = append(deletes, func() error {
+				return cs.BatchV1().CronJobs(ns).Delete(ctx, c.Name, metav1.DeleteOptions{PropagationPolicy: &background})
+			})
+		}
+	} else {
+		cronjobsBeta, errBeta := cs.BatchV1beta1().CronJobs(ns).List(ctx, metav1.ListOptions{})
+		if errBeta != nil {
+			return fmt.Errorf("cannot list cronjobs: %w", errBeta)
+		}
+		for i := range cronjobsBeta.Items {
+			c := cronjobsBeta.Items[i]
+			c.TypeMeta = metav1.TypeMeta{APIVersion: "batch/v1beta1", Kind: "CronJob"}
+			c.ObjectMeta = archivedMeta(c.ObjectMeta)
+			c.Status = batchv1beta1.CronJobStatus{}
+			if err := archive(data, "CronJob", c.Name, c); err != nil {
+				return err
+			}
+			deletes = append(deletes, func() error {
+				return cs.BatchV1beta1().CronJobs(ns).Delete(ctx, c.Name, metav1.DeleteOptions{PropagationPolicy: &background})
+			})
+		}
+	}
+
+	jobs, err := cs.BatchV1().Jobs(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("cannot list jobs: %w", err)
+	}
+	for i := range jobs.Items {
+		j := jobs.Items[i]
+		if jobFinished(j) || metav1.GetControllerOf(&j) != nil {
+			continue
+		}
+		j.TypeMeta = metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"}
+		j.ObjectMeta = archivedMeta(j.ObjectMeta)
+		j.Spec = archivedJobSpec(j.Spec)
+		j.Status = batchv1.JobStatus{}
+		if err := archive(data, "Job", j.Name, j); err != nil {
+			return err
+		}
+		deletes = append(deletes, func() error {
+			return cs.BatchV1().Jobs(ns).Delete(ctx, j.Name, metav1.DeleteOptions{PropagationPolicy: &background})
+		})
+	}
+
+	// the scaledobjects are deleted after the workloads they scale, so that
+	// KEDA does not restore their replicas meanwhile
+	if eng.Options.KedaEnabled {
+		scaledobjects, err := kedacs.ScaledObjects(ns).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("cannot list scaledobjects: %w", err)
+		}
+		for i := range scaledobjects.Items {
+			so := scaledobjects.Items[i]
+			so.TypeMeta = metav1.TypeMeta{APIVersion: "keda.sh/v1alpha1", Kind: "ScaledObject"}
+			so.ObjectMeta = archivedMeta(so.ObjectMeta)
+			so.Status = kedav1alpha1.ScaledObjectStatus{}
+			if err := archive(data, "ScaledObject", so.Name, so); err != nil {
+				return err
+			}
+			deletes = append(deletes, func() error {
+				return kedacs.ScaledObjects(ns).Delete(ctx, so.Name, metav1.DeleteOptions{})
+			})
+		}
+	}
+
+	if err := checkArchiveSize(data); err != nil {
+		return err
+	}
+	if eng.DryRun.intercept(Change{Namespace: ns, Kind: "ConfigMap", Name: ArchiveConfigMap, Action: ActionArchive,
+		Detail: fmt.Sprintf("%d workload(s) archived and deleted", len(data))}) {
+		return nil
+	}
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := cs.CoreV1().ConfigMaps(ns).Get(ctx, ArchiveConfigMap, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: ArchiveConfigMap, Namespace: ns}, Data: data}
+			_, err = cs.CoreV1().ConfigMaps(ns).Create(ctx, cm, metav1.CreateOptions{FieldManager: FieldManager})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		for k, v := range data {
+			cm.Data[k] = v
+		}
+		// the manifests archived before are kept
+		if err := checkArchiveSize(cm.Data); err != nil {
+			return err
+		}
+		_, err = cs.CoreV1().ConfigMaps(ns).Update(ctx, cm, metav1.UpdateOptions{FieldManager: FieldManager})
+		return err
+	}); err != nil {
+		if errors.Is(err, ErrArchiveTooLarge) {
+			return err
+		}
+		return fmt.Errorf("cannot save archive: %w", err)
+	}
+
+	// the workloads are only deleted once they have been saved
+	for _, del := range deletes {
+		if err := del(); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("cannot delete archived workload: %w", err)
+		}
+	}
+	return nil
+}
+
+// archivedMeta returns the metadata of an object without the fields set by
+// the API server, so that it can be applied again
+func archivedMeta(m metav1.ObjectMeta) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Name: m.Name, Namespace: m.Namespace, Labels: m.Labels, Annotations: m.Annotations}
+}
+
+// archivedJobSpec returns the spec of a Job without the selector and labels
+// generated by the API server, which are refused when the Job is created
+// again
+func archivedJobSpec(spec batchv1.JobSpec) batchv1.JobSpec {
+	spec = *spec.DeepCopy()
+	if spec.ManualSelector != nil && *spec.ManualSelector {
+		return spec
+	}
+	spec.Selector = nil
+	for _, l := range []string{"controller-uid", "job-name", "batch.kubernetes.io/controller-uid", "batch.kubernetes.io/job-name"} {
+		delete(spec.Template.Labels, l)
+	}
+	return spec
+}
+
+// checkArchiveSize returns an error wrapping ErrArchiveTooLarge if the data
+// does not fit in a ConfigMap
+func checkArchiveSize(data map[string]string) error {
+	size := 0
+	for k, v := range data {
+		size += len(k) + len(v)
+	}
+	if size > maxArchiveSize {
+		return fmt.Errorf("%w: the manifests of the workloads take %d bytes, more than the %d bytes a ConfigMap can hold, use '--stale-action delete' or clean up the namespace by hand",
+			ErrArchiveTooLarge, size, maxArchiveSize)
+	}
+	return nil
+}
+
+// archive saves the manifest of a workload in data, keyed by kind and name
+func archive(data map[string]string, kind, name string, obj interface{}) error {
+	b, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode %s %s: %w", kind, name, err)
+	}
+	data[fmt.Sprintf("%s.%s.json", kind, name)] = string(b)
+	return nil
+}
@@ -0,0 +1,319 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func Test_cleanupStale(t *testing.T) {
+	ctx := context.Background()
+	since := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.Local)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name        string
+		action      string
+		annotations map[string]string
+		// days elapsed since the suspension at each inventory
+		days          []int
+		wantWarned    bool
+		wantStale     bool
+		wantDeleted   bool
+		wantArchived  bool
+		wantResources bool
+		// changed makes the namespace change between the inventory and its
+		// deletion
+		changed bool
+	}{
+		{name: "recently suspended", action: StaleActionDelete, days: []int{10}, wantResources: true},
+		{name: "warned", action: StaleActionDelete, days: []int{25}, wantWarned: true, wantResources: true},
+		{name: "warned then stale", action: StaleActionDelete, days: []int{25, 32}, wantWarned: true, wantStale: true, wantResources: true},
+		{name: "stale before the end of the warning", action: StaleActionDelete, days: []int{40, 41}, wantWarned: true, wantResources: true},
+		{name: "deleted after the grace period", action: StaleActionDelete, days: []int{25, 32, 47}, wantDeleted: true},
+		{name: "changed before the deletion", action: StaleActionDelete, days: []int{25, 32, 47}, changed: true, wantWarned: true, wantStale: true, wantResources: true},
+		{name: "archived after the grace period", action: StaleActionArchive, days: []int{25, 32, 47}, wantWarned: true, wantStale: true, wantArchived: true},
+		{name: "no action", action: StaleActionNone, days: []int{25, 32, 47}, wantWarned: true, wantStale: true, wantResources: true},
+		{name: "kept", action: StaleActionDelete, annotations: map[string]string{Keep: "true"}, days: []int{25, 32, 47}, wantResources: true},
+		{
+			name:   "resumed",
+			action: StaleActionDelete,
+			annotations: map[string]string{DesiredState: Running, staleWarningTime: since.Format(time.RFC3339),
+				staleSince: since.Format(time.RFC3339)},
+			days:          []int{47},
+			wantResources: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eng := newTestEngine(t, since, false, false)
+			opt := eng.Options
+			opt.StaleAfterDays = 30
+			opt.StaleWarningDays = 7
+			opt.StaleGraceDays = 14
+			opt.StaleAction = tt.action
+			if _, err := eng.Reload(opt); err != nil {
+				t.Fatal(err)
+			}
+
+			annotations := map[string]string{DesiredState: Suspended, SuspendedSince: since.Format(time.RFC3339)}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+			ns := namespace(annotations)
+			if _, ok := tt.annotations[staleSince]; ok {
+				ns.Labels = map[string]string{testPrefix + Stale: "true"}
+			}
+			cs := fake.NewSimpleClientset(ns, deployment("api", 0, nil))
+			cs.PrependReactor("delete", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if p := action.(k8stesting.DeleteAction).GetDeleteOptions().Preconditions; p == nil || p.UID == nil || p.ResourceVersion == nil {
+					t.Errorf("namespace deleted without preconditions")
+				}
+				if tt.changed {
+					return true, nil, apierrors.NewConflict(corev1.Resource("namespaces"), testNamespace, errors.New("the object has been modified"))
+				}
+				return false, nil, nil
+			})
+
+			for _, d := range tt.days {
+				eng.Clock = clocktesting.NewFakePassiveClock(since.Add(time.Duration(d) * day))
+				namespaces, err := cs.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				eng.cleanupStale(ctx, zerolog.Nop(), cs, nil, namespaces.Items)
+			}
+
+			res, err := cs.CoreV1().Namespaces().Get(ctx, testNamespace, metav1.GetOptions{})
+			if tt.wantDeleted {
+				if err == nil {
+					t.Error("namespace not deleted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := res.Annotations[testPrefix+staleWarningTime]; ok != tt.wantWarned {
+				t.Errorf("warned = %v, want %v", ok, tt.wantWarned)
+			}
+			if got := res.Labels[testPrefix+Stale] == "true"; got != tt.wantStale {
+				t.Errorf("stale label = %v, want %v", got, tt.wantStale)
+			}
+			if _, ok := res.Annotations[testPrefix+archiveTime]; ok != tt.wantArchived {
+				t.Errorf("archived = %v, want %v", ok, tt.wantArchived)
+			}
+			deployments, err := cs.AppsV1().Deployments(testNamespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(deployments.Items) > 0; got != tt.wantResources {
+				t.Errorf("deployments kept = %v, want %v", got, tt.wantResources)
+			}
+			cm, err := cs.CoreV1().ConfigMaps(testNamespace).Get(ctx, ArchiveConfigMap, metav1.GetOptions{})
+			if (err == nil) != tt.wantArchived {
+				t.Fatalf("archive ConfigMap error = %v, want archived %v", err, tt.wantArchived)
+			}
+			if tt.wantArchived && cm.Data["Deployment.api.json"] == "" {
+				t.Errorf("archive ConfigMap data = %v, want the deployment manifest", cm.Data)
+			}
+		})
+	}
+}
+
+func Test_archiveWorkloads(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.Local)
+
+	finished := job("finished", nil, nil)
+	finished.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	owned := job("nightly-28500000", nil, nil)
+	isController := true
+	owned.OwnerReferences = []metav1.OwnerReference{{APIVersion: "batch/v1", Kind: "CronJob", Name: "nightly", UID: "1234", Controller: &isController}}
+	migration := job("migration", nil, nil)
+	migration.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"controller-uid": "5678"}}
+	migration.Spec.Template.Labels = map[string]string{"app": "migration", "controller-uid": "5678", "job-name": "migration"}
+
+	tests := []struct {
+		name string
+		keda bool
+		// beta serves the cronjobs with batchv1beta1 only
+		beta        bool
+		wantArchive []string
+		wantKept    []string
+	}{
+		{
+			name:        "workloads",
+			wantArchive: []string{"Deployment.api.json", "CronJob.nightly.json", "Job.migration.json"},
+			wantKept:    []string{"Job.finished", "Job.nightly-28500000", "ScaledObject.api"},
+		},
+		{
+			name:        "batchv1beta1 cronjobs",
+			beta:        true,
+			wantArchive: []string{"Deployment.api.json", "CronJob.nightly-beta.json", "Job.migration.json"},
+			wantKept:    []string{"Job.finished", "Job.nightly-28500000", "ScaledObject.api"},
+		},
+		{
+			name:        "keda",
+			keda:        true,
+			wantArchive: []string{"Deployment.api.json", "CronJob.nightly.json", "Job.migration.json", "ScaledObject.api.json"},
+			wantKept:    []string{"Job.finished", "Job.nightly-28500000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eng := newTestEngine(t, now, tt.keda, false)
+			suspend := false
+			cs := fake.NewSimpleClientset(deployment("api", 0, nil), cronjob("nightly", false), finished, owned, migration,
+				&batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "nightly-beta", Namespace: testNamespace},
+					Spec: batchv1beta1.CronJobSpec{Suspend: &suspend}})
+			if tt.beta {
+				cs.PrependReactor("list", "cronjobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					if action.GetResource().Version == "v1" {
+						return true, nil, apierrors.NewNotFound(batchv1.Resource("cronjobs"), "")
+					}
+					return false, nil, nil
+				})
+			}
+			keda := newFakeKeda(scaledobject("api", nil))
+
+			if err := eng.archiveWorkloads(ctx, cs, keda, testNamespace); err != nil {
+				t.Fatal(err)
+			}
+
+			cm, err := cs.CoreV1().ConfigMaps(testNamespace).Get(ctx, ArchiveConfigMap, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for k := range cm.Data {
+				got = append(got, k)
+			}
+			sort.Strings(got)
+			want := append([]string(nil), tt.wantArchive...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("archived = %v, want %v", got, want)
+			}
+			if m := cm.Data["Job.migration.json"]; strings.Contains(m, "controller-uid") || !strings.Contains(m, `"app": "migration"`) {
+				t.Errorf("archived job = %s, want it without the generated selector and labels", m)
+			}
+
+			exists := map[string]bool{}
+			deployments, _ := cs.AppsV1().Deployments(testNamespace).List(ctx, metav1.ListOptions{})
+			for _, d := range deployments.Items {
+				exists["Deployment."+d.Name] = true
+			}
+			if cronjobs, err := cs.BatchV1().CronJobs(testNamespace).List(ctx, metav1.ListOptions{}); err == nil {
+				for _, c := range cronjobs.Items {
+					exists["CronJob."+c.Name] = true
+				}
+			}
+			cronjobsBeta, _ := cs.BatchV1beta1().CronJobs(testNamespace).List(ctx, metav1.ListOptions{})
+			for _, c := range cronjobsBeta.Items {
+				exists["CronJob."+c.Name] = true
+			}
+			jobs, _ := cs.BatchV1().Jobs(testNamespace).List(ctx, metav1.ListOptions{})
+			for _, j := range jobs.Items {
+				exists["Job."+j.Name] = true
+			}
+			for name := range keda.scaledobjects {
+				exists["ScaledObject."+name] = true
+			}
+			for _, a := range tt.wantArchive {
+				if name := strings.TrimSuffix(a, ".json"); exists[name] {
+					t.Errorf("%s archived but not deleted", name)
+				}
+			}
+			for _, k := range tt.wantKept {
+				if !exists[k] {
+					t.Errorf("%s deleted, want it kept", k)
+				}
+			}
+		})
+	}
+}
+
+func Test_namespaceStatus_transitionTo(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.Local)
+	s := namespaceStatus{ObservedState: Running}.transitionTo(now, Suspended, TransitionDailySuspendTime)
+	if s.SuspendedSince != now.Format(time.RFC3339) {
+		t.Fatalf("SuspendedSince = %q, want %q", s.SuspendedSince, now.Format(time.RFC3339))
+	}
+	if s = s.transitionTo(now.Add(time.Hour), Degraded, ""); s.SuspendedSince != now.Format(time.RFC3339) {
+		t.Errorf("SuspendedSince = %q, want it kept when degraded", s.SuspendedSince)
+	}
+	if s = s.transitionTo(now.Add(2*time.Hour), Running, TransitionDesiredStateChanged); s.SuspendedSince != "" {
+		t.Errorf("SuspendedSince = %q, want it cleared when running", s.SuspendedSince)
+	}
+}
+
+func Test_archiveTooLarge(t *testing.T) {
+	ctx := context.Background()
+	since := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.Local)
+	eng := newTestEngine(t, since, false, false)
+	recorder := record.NewFakeRecorder(10)
+	eng.Recorder = recorder
+	opt := eng.Options
+	opt.StaleAfterDays = 30
+	opt.StaleWarningDays = 7
+	opt.StaleGraceDays = 14
+	opt.StaleAction = StaleActionArchive
+	if _, err := eng.Reload(opt); err != nil {
+		t.Fatal(err)
+	}
+
+	// the annotations of the deployment alone exceed the size of a ConfigMap
+	ns := namespace(map[string]string{DesiredState: Suspended, SuspendedSince: since.Format(time.RFC3339),
+		staleWarningTime: since.Format(time.RFC3339), staleSince: since.Format(time.RFC3339)})
+	ns.Labels = map[string]string{testPrefix + Stale: "true"}
+	cs := fake.NewSimpleClientset(ns, deployment("api", 0, map[string]string{"config": strings.Repeat("x", maxArchiveSize)}))
+	eng.Clock = clocktesting.NewFakePassiveClock(since.Add(47 * 24 * time.Hour))
+
+	for i := 0; i < 2; i++ {
+		namespaces, err := cs.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		eng.cleanupStale(ctx, zerolog.Nop(), cs, nil, namespaces.Items)
+	}
+
+	if _, err := cs.AppsV1().Deployments(testNamespace).Get(ctx, "api", metav1.GetOptions{}); err != nil {
+		t.Errorf("deployment not kept: %v", err)
+	}
+	if _, err := cs.CoreV1().ConfigMaps(testNamespace).Get(ctx, ArchiveConfigMap, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("archive ConfigMap error = %v, want it not written", err)
+	}
+	res, err := cs.CoreV1().Namespaces().Get(ctx, testNamespace, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.Annotations[testPrefix+archiveTime]; ok {
+		t.Error("namespace marked archived")
+	}
+	// the failure is reported once
+	if len(recorder.Events) != 1 {
+		t.Fatalf("%d events emitted, want 1", len(recorder.Events))
+	}
+	if e := <-recorder.Events; !strings.HasPrefix(e, "Warning ArchiveTooLarge archive too large:") || !strings.Contains(e, "--stale-action delete") {
+		t.Errorf("event = %q, want an ArchiveTooLarge warning suggesting the delete action", e)
+	}
+}
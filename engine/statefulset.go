@@ -2,16 +2,18 @@ package engine
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 
 	"github.com/rs/zerolog"
 	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 )
 
-func checkRunningStatefulsetsConformity(ctx context.Context, l zerolog.Logger, statefulsets []appsv1.StatefulSet, cs *kubernetes.Clientset, ns, prefix string) (bool, error) {
+func checkRunningStatefulsetsConformity(ctx context.Context, l zerolog.Logger, rec record.EventRecorder, dr *DryRun, reason string, statefulsets []appsv1.StatefulSet, cs kubernetes.Interface, ns, prefix string) (bool, error) {
 	hasBeenPatched := false
 	for _, ss := range statefulsets {
 		repl := int(*ss.Spec.Replicas)
@@ -32,7 +34,10 @@ func checkRunningStatefulsetsConformity(ctx context.Context, l zerolog.Logger, s
 			if desiredRepl != 0 {
 				l.Info().Str("statefulset", ss.Name).Msgf("scaling %s from 0 to %d replicas", ss.Name, desiredRepl)
 				// patch the statefulset
-				if err := patchStatefulsetReplicas(ctx, cs, ns, ss.Name, prefix, desiredRepl); err != nil {
+				err := patchStatefulsetReplicas(ctx, cs, dr, ns, ss.Name, prefix, desiredRepl)
+				patchEvent(rec, objectRef("apps/v1", "StatefulSet", ns, ss.Name, ss.UID), reason, err,
+					fmt.Sprintf("scaled from 0 to %d replicas", desiredRepl))
+				if err != nil {
 					return hasBeenPatched, err
 				}
 				hasBeenPatched = true
@@ -42,23 +47,31 @@ func checkRunningStatefulsetsConformity(ctx context.Context, l zerolog.Logger, s
 	return hasBeenPatched, nil
 }
 
-func checkSuspendedStatefulsetsConformity(ctx context.Context, l zerolog.Logger, statefulsets []appsv1.StatefulSet, cs *kubernetes.Clientset, ns, prefix string) error {
+func checkSuspendedStatefulsetsConformity(ctx context.Context, l zerolog.Logger, rec record.EventRecorder, dr *DryRun, reason string, statefulsets []appsv1.StatefulSet, cs kubernetes.Interface, ns, prefix string) (bool, error) {
+	hasBeenPatched := false
 	for _, ss := range statefulsets {
 		repl := int(*ss.Spec.Replicas)
 		if repl != 0 {
 			// TODO: what about fixing the annotation original Replicas here ?
 			l.Info().Str("statefulset", ss.Name).Msgf("scaling %s from %d to 0 replicas", ss.Name, repl)
 			// patch the deployment
-			if err := patchStatefulsetReplicas(ctx, cs, ns, ss.Name, prefix, 0); err != nil {
-				return err
+			err := patchStatefulsetReplicas(ctx, cs, dr, ns, ss.Name, prefix, 0)
+			patchEvent(rec, objectRef("apps/v1", "StatefulSet", ns, ss.Name, ss.UID), reason, err,
+				fmt.Sprintf("scaled from %d to 0 replicas", repl))
+			if err != nil {
+				return hasBeenPatched, err
 			}
+			hasBeenPatched = true
 		}
 	}
-	return nil
+	return hasBeenPatched, nil
 }
 
 // patchStatefulsetSuspend updates the number of replicas of a given statefulset
-func patchStatefulsetReplicas(ctx context.Context, cs *kubernetes.Clientset, ns, ss, prefix string, repl int) error {
+func patchStatefulsetReplicas(ctx context.Context, cs kubernetes.Interface, dr *DryRun, ns, ss, prefix string, repl int) error {
+	if dr.intercept(Change{Namespace: ns, Kind: "StatefulSet", Name: ss, Action: ActionScale, Detail: fmt.Sprintf("replicas: %d", repl)}) {
+		return nil
+	}
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		result, err := cs.AppsV1().StatefulSets(ns).Get(ctx, ss, metav1.GetOptions{})
 		if err != nil {
@@ -3,11 +3,19 @@ package engine
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/govirtuo/kube-ns-suspender/audit"
+	"github.com/govirtuo/kube-ns-suspender/savings"
+	"github.com/govirtuo/kube-ns-suspender/tracing"
 	kedav1alpha1 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
 	"github.com/kedacore/keda/v2/pkg/generated/clientset/versioned/typed/keda/v1alpha1"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/retry"
@@ -17,519 +25,858 @@ import (
 )
 
 // Suspender receives namespaces from Watcher and handles them. It means that
-// it will read and write namespaces' annotations, and scale resources.
-func (eng *Engine) Suspender(ctx context.Context, cs *kubernetes.Clientset, kedacs *v1alpha1.KedaV1alpha1Client, rdsclient *rds.Client) {
+// it will read and write namespaces' annotations, and scale resources. It
+// returns when ctx is cancelled, once the namespace being handled is done.
+func (eng *Engine) Suspender(ctx context.Context, cs kubernetes.Interface, kedacs v1alpha1.KedaV1alpha1Interface, rdsclient RDSAPI) {
 	eng.Logger.Info().Str("routine", "suspender").Msg("suspender started")
 	defer func() {
-		eng.Logger.Fatal().Str("routine", "suspender").Msg("suspender exited")
+		eng.Logger.Info().Str("routine", "suspender").Msg("suspender stopped")
 	}()
 
-	var stepName string
-	for {
+	// a namespace must not be left half handled, so the reconciliations are
+	// not interrupted when ctx is cancelled. They are only aborted if they
+	// last longer than the shutdown timeout.
+	rctx, abort := context.WithCancel(context.Background())
+	defer abort()
+	go func() {
+		<-ctx.Done()
+		select {
+		case <-time.After(eng.ShutdownTimeout):
+			eng.Logger.Warn().Str("routine", "suspender").Msgf("shutdown timeout of %s reached, aborting", eng.ShutdownTimeout)
+			abort()
+		case <-rctx.Done():
+		}
+	}()
 
+	for {
 		// wait for the next namespace to check
-		n := <-eng.Wl
-		start := time.Now()
-
-		// we create a sublogger to avoid "namespace" field duplication at each loop
-		sLogger := eng.Logger.With().Str("routine", "suspender").Str("namespace", n.Name).Logger()
-		sLogger.Debug().Msg("namespace received from watcher")
-
-		/*
-			Step 1
-
-			This first switch-case statement will ensure that the namespace has a state set.
-
-			- if dState is empty, it means that it is the first time we see this namespace, so we
-			add the annotation with the state 'Running'
-
-			- if dState is equal to Running:
-				* check if the namespace should be suspended, based on the `dailySuspendTime`` annotation. If it should:
-					1. update dState to Suspended
-					2. update the namespace annotation to Suspended
-
-				* check if the namespace should be suspended, based on the `nextSuspendTime`` annotation. If it should:
-					1. we do the same as for dailySuspendTime annotation
-
-			- if dState is equal to Suspended, the switch-case will do nothing yet and go to the next step.
-			- if dState ends in the default case, it means that the state has not been recognised, so
-			we have to error
-		*/
-
-		stepName = "1/3 - define namespace state from annotation"
-		sLogger.Debug().Str("step", stepName).Msg("starting step")
+		var n corev1.Namespace
+		select {
+		case n = <-eng.Wl:
+		case <-ctx.Done():
+			return
+		}
+		eng.namespaceReceived()
+		err := eng.reconcile(rctx, cs, kedacs, rdsclient, n)
+		eng.observeDryRun(n.Name)
+		if err != nil {
+			// the namespace is retried later, without preventing the other
+			// ones from being handled
+			delay := eng.reconcileFailed(n.Name)
+			eng.Logger.Error().Err(err).Str("routine", "suspender").Str("namespace", n.Name).
+				Msgf("cannot handle namespace, retrying in %s", delay)
+			continue
+		}
+		eng.reconcileSucceeded(n.Name)
+	}
+}
 
-		dState := n.Annotations[eng.Options.Prefix+DesiredState]
-		switch dState {
-		case "":
-			sLogger.Debug().Str("step", stepName).Msgf("namespace has no '%s' annotation, it is probably the first time I see it", eng.Options.Prefix+DesiredState)
-			if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-				sLogger.Trace().Int("step", 1).Msg("get namespace")
-				res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
-				if err != nil {
-					return err
-				}
-				// we set the annotation to running
-				sLogger.Trace().Str("step", stepName).Msgf("setting namespace annotation '%s=%s'", eng.Options.Prefix+DesiredState, Running)
-				res.Annotations[eng.Options.Prefix+DesiredState] = Running
+// reconcile handles a namespace received from the Watcher: it defines its
+// desired state, lists its resources and makes them conform to the state. It
+// returns an error if the namespace must be retried later.
+func (eng *Engine) reconcile(ctx context.Context, cs kubernetes.Interface, kedacs v1alpha1.KedaV1alpha1Interface, rdsclient RDSAPI, n corev1.Namespace) error {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "reconcile", attribute.String("namespace", n.Name))
+	defer span.End()
+	// rctx is the context of the reconciliation, parent of the context of
+	// each step
+	rctx := ctx
+
+	// we create a sublogger to avoid "namespace" field duplication at each loop
+	sLogger := tracing.Logger(ctx, eng.Logger.With().Str("routine", "suspender").Str("namespace", n.Name).Logger())
+	sLogger.Debug().Msg("namespace received from watcher")
+
+	// the settings can be reloaded meanwhile, the namespace is handled with
+	// the current ones
+	cur := eng.settings()
+
+	// the current step is ended when returning, whatever the step is
+	var stepName string
+	var st *step
+	defer func() {
+		if st != nil {
+			eng.endStep(st)
+		}
+	}()
 
-				sLogger.Trace().Str("step", stepName).Msg("updating namespace")
-				_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{})
+	/*
+		Step 1
+
+		This first switch-case statement will ensure that the namespace has a state set.
+
+		- if dState is empty, it means that it is the first time we see this namespace, so we
+		add the annotation with the state 'Running'
+
+		- if dState is equal to Running:
+			* check if the namespace should be suspended, based on the `dailySuspendTime`` annotation. If it should:
+				1. update dState to Suspended
+				2. update the namespace annotation to Suspended
+
+			* check if the namespace should be suspended, based on the `nextSuspendTime`` annotation. If it should:
+				1. we do the same as for dailySuspendTime annotation
+
+		- if dState is equal to Suspended, the switch-case will do nothing yet and go to the next step.
+		- if dState ends in the default case, it means that the state has not been recognised, so
+		we have to error
+	*/
+
+	stepName = "1/3 - define namespace state from annotation"
+	ctx, st = eng.startStep(rctx, stepName)
+	sLogger.Debug().Str("step", stepName).Msg("starting step")
+
+	// transitionReason is set when the desired state is changed by the
+	// controller itself
+	var transitionReason string
+	dState := n.Annotations[eng.Options.Prefix+DesiredState]
+	switch dState {
+	case "":
+		sLogger.Debug().Str("step", stepName).Msgf("namespace has no '%s' annotation, it is probably the first time I see it", eng.Options.Prefix+DesiredState)
+		if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			if eng.DryRun.intercept(Change{Namespace: n.Name, Kind: "Namespace", Name: n.Name, Action: ActionAnnotate, Detail: DesiredState + ": " + Running}) {
+				return nil
+			}
+			sLogger.Trace().Int("step", 1).Msg("get namespace")
+			res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
+			if err != nil {
 				return err
-			}); err != nil {
-				sLogger.Error().Err(err).Msg("cannot update namespace object")
-				// we give up and handle the next namespace
-				sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
-				continue
 			}
-			sLogger.Debug().Str("step", stepName).Msgf("added annotation '%s=%s' to namespace", eng.Options.Prefix+DesiredState, Running)
+			// we set the annotation to running
+			sLogger.Trace().Str("step", stepName).Msgf("setting namespace annotation '%s=%s'", eng.Options.Prefix+DesiredState, Running)
+			res.Annotations[eng.Options.Prefix+DesiredState] = Running
+
+			sLogger.Trace().Str("step", stepName).Msg("updating namespace")
+			_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{FieldManager: FieldManager})
+			return err
+		}); err != nil {
+			sLogger.Error().Err(err).Msg("cannot update namespace object")
+			err = fmt.Errorf("cannot set '%s' annotation: %w", DesiredState, err)
+			eng.reportFailure(ctx, sLogger, cs, n, ReasonUpdateFailed, err)
+			// we give up and handle the next namespace
+			sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
+			return err
+		}
+		sLogger.Debug().Str("step", stepName).Msgf("added annotation '%s=%s' to namespace", eng.Options.Prefix+DesiredState, Running)
+		eng.recordTransition(ctx, sLogger, n, "", Running, audit.OriginController, "", "namespace seen for the first time")
+
+		// we now update the value of dState to match the new namespace annotation
+		sLogger.Debug().Str("step", stepName).Msgf("updating internal state to '%s'", Running)
+		dState = Running
+		transitionReason = TransitionFirstSeen
+	case Running:
+		sLogger.Debug().Str("step", stepName).Msgf("found annotation '%s=%s'", eng.Options.Prefix+DesiredState, dState)
+
+		// a protected namespace is never suspended by its schedule
+		if eng.Scope.Protected(n.Name) {
+			sLogger.Debug().Str("step", stepName).Msg("namespace protected, not checking its schedule")
+			break
+		}
 
-			// we now update the value of dState to match the new namespace annotation
-			sLogger.Debug().Str("step", stepName).Msgf("updating internal state to '%s'", Running)
-			dState = Running
-		case Running:
-			sLogger.Debug().Str("step", stepName).Msgf("found annotation '%s=%s'", eng.Options.Prefix+DesiredState, dState)
+		// the namespace is not suspended by its schedule while the circuit
+		// breaker is open
+		if eng.Breaker.paused(cur.breakerOverride) {
+			sLogger.Warn().Str("step", stepName).Msg("circuit breaker open, automatic suspension paused")
+			break
+		}
 
-			// check if dailySuspendTime is set and past
-			sLogger.Debug().Str("step", stepName).Msgf("checking annotation '%s'", eng.Options.Prefix+DailySuspendTime)
-			if val, ok := n.Annotations[eng.Options.Prefix+DailySuspendTime]; ok {
-				sLogger.Info().Str("step", stepName).Msgf("found annotation '%s'='%s'", eng.Options.Prefix+DailySuspendTime, val)
+		// check if dailySuspendTime is set and past. It can come from the
+		// schedule or the profile of the namespace.
+		sLogger.Debug().Str("step", stepName).Msgf("checking annotation '%s'", eng.Options.Prefix+DailySuspendTime)
+		val, ok, err := cur.dailySuspendTimeOf(n, eng.Options.Prefix, eng.Clock.Now())
+		if err != nil {
+			sLogger.Warn().Err(err).Msg("cannot find the daily suspend time of the namespace")
+		}
+		if ok {
+			sLogger.Info().Str("step", stepName).Msgf("found annotation '%s'='%s'", eng.Options.Prefix+DailySuspendTime, val)
 
-				now, suspendAt, err := getTimes(val)
-				if err != nil {
-					sLogger.Warn().Err(err).Msgf("cannot parse '%s' annotation on namespace", eng.Options.Prefix+DailySuspendTime)
-				}
+			now, suspendAt, err := getTimes(eng.Clock.Now(), val)
+			if err != nil {
+				sLogger.Warn().Err(err).Msgf("cannot parse '%s' annotation on namespace", eng.Options.Prefix+DailySuspendTime)
+			}
 
-				if err == nil && suspendAt <= now {
-					sLogger.Debug().
-						Str("step", stepName).
-						Msgf("%s is less or equal to now (value: %d, now: %d), updating annotation '%s' to '%s'", eng.Options.Prefix+DailySuspendTime, suspendAt, now, eng.Options.Prefix+DesiredState, Suspended)
-
-					// NOTICE: Seems same content than L51-L69
-					if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-						sLogger.Trace().Str("step", stepName).Msgf("get namespace")
-						res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
-						if err != nil {
-							return err
-						}
-						// we set the annotation to suspended
-						sLogger.Trace().Str("step", stepName).Msgf("setting namespace annotation '%s=%s'", eng.Options.Prefix+DesiredState, Suspended)
-						res.Annotations[eng.Options.Prefix+DesiredState] = Suspended
+			if err == nil && suspendAt <= now {
+				sLogger.Debug().
+					Str("step", stepName).
+					Msgf("%s is less or equal to now (value: %d, now: %d), updating annotation '%s' to '%s'", eng.Options.Prefix+DailySuspendTime, suspendAt, now, eng.Options.Prefix+DesiredState, Suspended)
 
-						sLogger.Trace().Str("step", stepName).Msgf("updating namespace")
-						_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{})
+				// NOTICE: Seems same content than L51-L69
+				if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+					if eng.DryRun.intercept(Change{Namespace: n.Name, Kind: "Namespace", Name: n.Name, Action: ActionAnnotate, Detail: DesiredState + ": " + Suspended}) {
+						return nil
+					}
+					sLogger.Trace().Str("step", stepName).Msgf("get namespace")
+					res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
+					if err != nil {
 						return err
-					}); err != nil {
-						sLogger.Error().Err(err).Msgf("cannot update namespace object")
-						// we give up and handle the next namespace
-						sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
-						continue
-					} else {
-						sLogger.Debug().Str("step", stepName).Msgf("added annotation '%s=%s' to namespace, going back to the start of the switch-case", DesiredState, Suspended)
-
-						// we now update the value of dState to match the new namespace annotation
-						dState = Suspended
-						break
 					}
+					// we set the annotation to suspended
+					sLogger.Trace().Str("step", stepName).Msgf("setting namespace annotation '%s=%s'", eng.Options.Prefix+DesiredState, Suspended)
+					res.Annotations[eng.Options.Prefix+DesiredState] = Suspended
+
+					sLogger.Trace().Str("step", stepName).Msgf("updating namespace")
+					_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{FieldManager: FieldManager})
+					return err
+				}); err != nil {
+					sLogger.Error().Err(err).Msgf("cannot update namespace object")
+					err = fmt.Errorf("cannot set '%s' annotation: %w", DesiredState, err)
+					eng.reportFailure(ctx, sLogger, cs, n, ReasonUpdateFailed, err)
+					// we give up and handle the next namespace
+					sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
+					return err
 				} else {
-					sLogger.Debug().Str("step", stepName).Msgf("%s is not yet past (value: %d, now: %d), not doing anything", eng.Options.Prefix+DailySuspendTime, suspendAt, now)
+					sLogger.Debug().Str("step", stepName).Msgf("added annotation '%s=%s' to namespace, going back to the start of the switch-case", DesiredState, Suspended)
+					eng.recordTransition(ctx, sLogger, n, Running, Suspended, audit.OriginSchedule, "",
+						fmt.Sprintf("%s '%s' is past", DailySuspendTime, val))
+
+					// we now update the value of dState to match the new namespace annotation
+					dState = Suspended
+					transitionReason = TransitionDailySuspendTime
+					break
 				}
 			} else {
-				sLogger.Warn().Msgf("'%s' annotation not found on namespace", eng.Options.Prefix+DailySuspendTime)
+				sLogger.Debug().Str("step", stepName).Msgf("%s is not yet past (value: %d, now: %d), not doing anything", eng.Options.Prefix+DailySuspendTime, suspendAt, now)
 			}
+		} else {
+			sLogger.Warn().Msgf("'%s' annotation not found on namespace", eng.Options.Prefix+DailySuspendTime)
+		}
 
-			// check if nextSuspendTime exists and is past
-			sLogger.Debug().Str("step", stepName).Msgf("checking annotation '%s'", eng.Options.Prefix+NextSuspendTime)
-			if val, ok := n.Annotations[eng.Options.Prefix+NextSuspendTime]; ok {
-				sLogger.Info().Str("step", stepName).Msgf("found annotation '%s'='%s'", eng.Options.Prefix+NextSuspendTime, val)
-
-				nextSuspendAt, err := time.Parse(time.RFC822Z, val)
-				if err != nil {
-					sLogger.Error().Err(err).Msgf("cannot parse '%s' value '%s' in time format '%s'", eng.Options.Prefix+NextSuspendTime, val, time.RFC822Z)
-					continue
-				}
+		// check if nextSuspendTime exists and is past
+		sLogger.Debug().Str("step", stepName).Msgf("checking annotation '%s'", eng.Options.Prefix+NextSuspendTime)
+		if val, ok := n.Annotations[eng.Options.Prefix+NextSuspendTime]; ok {
+			sLogger.Info().Str("step", stepName).Msgf("found annotation '%s'='%s'", eng.Options.Prefix+NextSuspendTime, val)
 
-				if time.Now().Local().After(nextSuspendAt) {
-					sLogger.Debug().Str("step", stepName).
-						Msgf("%s is past, updating annotation '%s' to '%s'", eng.Options.Prefix+NextSuspendTime, eng.Options.Prefix+DesiredState, Suspended)
-					if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-						sLogger.Trace().Str("step", stepName).Msgf("get namespace")
-						res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
-						if err != nil {
-							return err
-						}
-						// we set the annotation to suspended
-						sLogger.Trace().Str("step", stepName).Msgf("setting namespace annotation '%s=%s'", eng.Options.Prefix+DesiredState, Suspended)
-						res.Annotations[eng.Options.Prefix+DesiredState] = Suspended
+			nextSuspendAt, err := ParseNextSuspendTime(val)
+			if err != nil {
+				sLogger.Error().Err(err).Msgf("cannot parse '%s' value '%s' in time format '%s'", eng.Options.Prefix+NextSuspendTime, val, time.RFC822Z)
+				eng.reportFailure(ctx, sLogger, cs, n, ReasonInvalidAnnotation, fmt.Errorf("cannot parse '%s' value '%s': %w", NextSuspendTime, val, err))
+				// retrying sooner would not help, the annotation must be fixed
+				return nil
+			}
 
-						sLogger.Trace().Str("step", stepName).Msgf("updating namespace")
-						_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{})
+			if eng.Clock.Now().After(nextSuspendAt) {
+				sLogger.Debug().Str("step", stepName).
+					Msgf("%s is past, updating annotation '%s' to '%s'", eng.Options.Prefix+NextSuspendTime, eng.Options.Prefix+DesiredState, Suspended)
+				if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+					if eng.DryRun.intercept(Change{Namespace: n.Name, Kind: "Namespace", Name: n.Name, Action: ActionAnnotate, Detail: DesiredState + ": " + Suspended}) {
+						return nil
+					}
+					sLogger.Trace().Str("step", stepName).Msgf("get namespace")
+					res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
+					if err != nil {
 						return err
-					}); err != nil {
-						sLogger.Error().Err(err).Msgf("cannot update namespace object")
-						// we give up and handle the next namespace
-						sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
-						continue
-					} else {
-						sLogger.Debug().Str("step", stepName).Msgf("added annotation '%s=%s' to namespace, going back to the start of the switch-case", DesiredState, Suspended)
-
-						// we now update the value of dState to match the new namespace annotation
-						dState = Suspended
-						break
 					}
+					// we set the annotation to suspended
+					sLogger.Trace().Str("step", stepName).Msgf("setting namespace annotation '%s=%s'", eng.Options.Prefix+DesiredState, Suspended)
+					res.Annotations[eng.Options.Prefix+DesiredState] = Suspended
+
+					sLogger.Trace().Str("step", stepName).Msgf("updating namespace")
+					_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{FieldManager: FieldManager})
+					return err
+				}); err != nil {
+					sLogger.Error().Err(err).Msgf("cannot update namespace object")
+					err = fmt.Errorf("cannot set '%s' annotation: %w", DesiredState, err)
+					eng.reportFailure(ctx, sLogger, cs, n, ReasonUpdateFailed, err)
+					// we give up and handle the next namespace
+					sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
+					return err
 				} else {
-					sLogger.Debug().Str("step", stepName).Msgf("%s is not yet past (value: %s, now: %s), not doing anything", NextSuspendTime+DailySuspendTime, nextSuspendAt, time.Now().Local())
+					sLogger.Debug().Str("step", stepName).Msgf("added annotation '%s=%s' to namespace, going back to the start of the switch-case", DesiredState, Suspended)
+					eng.recordTransition(ctx, sLogger, n, Running, Suspended, audit.OriginNextSuspendTime, "",
+						fmt.Sprintf("%s '%s' is past", NextSuspendTime, val))
+
+					// we now update the value of dState to match the new namespace annotation
+					dState = Suspended
+					transitionReason = TransitionNextSuspendTime
+					break
 				}
 			} else {
-				sLogger.Warn().Msgf("'%s' annotation not found on namespace", eng.Options.Prefix+NextSuspendTime)
+				sLogger.Debug().Str("step", stepName).Msgf("%s is not yet past (value: %s, now: %s), not doing anything", NextSuspendTime+DailySuspendTime, nextSuspendAt, eng.Clock.Now().Local())
+			}
+		} else {
+			sLogger.Warn().Msgf("'%s' annotation not found on namespace", eng.Options.Prefix+NextSuspendTime)
+		}
+	case Suspended:
+		sLogger.Debug().Str("step", stepName).Msgf("found annotation '%s=%s'", eng.Options.Prefix+DesiredState, dState)
+
+		// a protected namespace is left as is: it is not suspended, but can
+		// still be resumed if it was suspended before being protected. The
+		// refusal is reported once, and kept in the lastError annotation.
+		if eng.Scope.Protected(n.Name) {
+			err := fmt.Errorf("namespace is protected and cannot be suspended, set '%s' to '%s' to resume it", DesiredState, Running)
+			sLogger.Warn().Str("step", stepName).Err(err).Msg("refusing to suspend namespace")
+			if eng.statusOf(n).LastError != err.Error() {
+				eng.reportFailure(ctx, sLogger, cs, n, ReasonProtected, err)
 			}
-		case Suspended:
-			sLogger.Debug().Str("step", stepName).Msgf("found annotation '%s=%s'", eng.Options.Prefix+DesiredState, dState)
-		default:
-			sLogger.Error().Err(errors.New("state not recognised: "+dState)).Msgf("state %s is not recognised", dState)
-			// we give up and handle the next namespace
 			sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
-			continue
+			return nil
 		}
 
-		/*
-			Step 2
-
-			In order to be able to edit the resources, we first need to get all of them from
-			the namespace.
-		*/
-		stepName = "2/3 - get namespace resources"
-		// get deployments of the namespace
-		sLogger.Debug().Str("step", stepName).Msg("getting namespace resources to manage")
-		sLogger.Debug().Str("step", stepName).Str("resource", "deployments").Msg("get resource from k8s")
-		deployments, err := cs.AppsV1().Deployments(n.Name).List(ctx, metav1.ListOptions{})
-		if err != nil {
-			sLogger.Fatal().Err(err).Msg("cannot list deployments")
+		// a namespace set to Suspended along with too many others is left as
+		// is until the circuit breaker is reset
+		if eng.Breaker.holds(n.Name) && eng.Breaker.paused(cur.breakerOverride) {
+			sLogger.Warn().Str("step", stepName).Msg("circuit breaker open, suspension paused")
+			sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
+			return nil
 		}
+	default:
+		sLogger.Error().Err(errors.New("state not recognised: "+dState)).Msgf("state %s is not recognised", dState)
+		eng.reportFailure(ctx, sLogger, cs, n, ReasonInvalidAnnotation, fmt.Errorf("'%s' value '%s' is not recognised", DesiredState, dState))
+		// we give up and handle the next namespace
+		sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
+		return nil
+	}
 
-		// get cronjobs of the namespace
-		// we need to support both batchv1 and batchv1beta
-		sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Str("apiVersion", "batchv1").Msg("get resource from k8s")
-		cronjobs, err := cs.BatchV1().CronJobs(n.Name).List(ctx, metav1.ListOptions{})
-		if err != nil {
-			sLogger.Warn().Err(err).Msg("cannot list cronjobs with API version batchv1")
-		}
+	/*
+		Step 2
+
+		In order to be able to edit the resources, we first need to get all of them from
+		the namespace.
+	*/
+	eng.endStep(st)
+	stepName = "2/3 - get namespace resources"
+	ctx, st = eng.startStep(rctx, stepName)
+	// get deployments of the namespace
+	sLogger.Debug().Str("step", stepName).Msg("getting namespace resources to manage")
+	sLogger.Debug().Str("step", stepName).Str("resource", "deployments").Msg("get resource from k8s")
+	deployments, err := cs.AppsV1().Deployments(n.Name).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		eng.observeError(n.Name, "deployments", "list")
+		return eng.listFailed(ctx, sLogger, cs, n, fmt.Errorf("cannot list deployments: %w", err))
+	}
 
-		sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Str("apiVersion", "batchv1beta").Msg("get resource from k8s")
-		cronjobsBeta, err := cs.BatchV1beta1().CronJobs(n.Name).List(ctx, metav1.ListOptions{})
-		if err != nil {
-			sLogger.Warn().Err(err).Msg("cannot list cronjobs with API version batchv1beta")
-		}
+	// get cronjobs of the namespace
+	// we need to support both batchv1 and batchv1beta
+	sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Str("apiVersion", "batchv1").Msg("get resource from k8s")
+	cronjobs, err := cs.BatchV1().CronJobs(n.Name).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		sLogger.Warn().Err(err).Msg("cannot list cronjobs with API version batchv1")
+	}
 
-		// get statefulsets of the namespace
-		sLogger.Debug().Str("step", stepName).Str("resource", "statefulsets").Msg("get resource from k8s")
-		statefulsets, err := cs.AppsV1().StatefulSets(n.Name).List(ctx, metav1.ListOptions{})
+	sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Str("apiVersion", "batchv1beta").Msg("get resource from k8s")
+	cronjobsBeta, err := cs.BatchV1beta1().CronJobs(n.Name).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		sLogger.Warn().Err(err).Msg("cannot list cronjobs with API version batchv1beta")
+	}
+
+	// get jobs of the namespace. As the controller only touches them
+	// depending on the jobs policy, they are not retried if they cannot be
+	// listed.
+	sLogger.Debug().Str("step", stepName).Str("resource", "jobs").Msg("get resource from k8s")
+	jobs, err := cs.BatchV1().Jobs(n.Name).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		eng.observeError(n.Name, "jobs", "list")
+		sLogger.Warn().Err(err).Msg("cannot list jobs")
+		jobs = &batchv1.JobList{}
+	}
+
+	// get statefulsets of the namespace
+	sLogger.Debug().Str("step", stepName).Str("resource", "statefulsets").Msg("get resource from k8s")
+	statefulsets, err := cs.AppsV1().StatefulSets(n.Name).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		eng.observeError(n.Name, "statefulsets", "list")
+		return eng.listFailed(ctx, sLogger, cs, n, fmt.Errorf("cannot list statefulsets: %w", err))
+	}
+
+	scaledobjects := &kedav1alpha1.ScaledObjectList{}
+	if eng.Options.KedaEnabled {
+		sLogger.Debug().Str("step", stepName).Str("resource", "scaledobjects").Msg("get resource from k8s")
+		// get scaledobjects of the namespace
+		scaledobjects, err = kedacs.ScaledObjects(n.Name).List(ctx, metav1.ListOptions{})
 		if err != nil {
-			sLogger.Fatal().Err(err).Msg("cannot list statefulsets")
+			eng.observeError(n.Name, "scaledobjects", "list")
+			return eng.listFailed(ctx, sLogger, cs, n, fmt.Errorf("cannot list scaledobjects: %w", err))
 		}
+	}
 
-		scaledobjects := &kedav1alpha1.ScaledObjectList{}
-		if eng.Options.KedaEnabled {
-			sLogger.Debug().Str("step", stepName).Str("resource", "scaledobjects").Msg("get resource from k8s")
-			// get scaledobjects of the namespace
-			scaledobjects, err = kedacs.ScaledObjects(n.Name).List(ctx, metav1.ListOptions{})
+	var rdsclusters []types.DBCluster
+	if eng.Options.AwsRdsEnabled {
+		sLogger.Debug().Str("step", stepName).Str("resource", "rds").Msg("get resource from AWS")
+		var marker *string
+		for {
+			// get rds clusters associated with the namespace
+			result, err := rdsclient.DescribeDBClusters(ctx, &rds.DescribeDBClustersInput{Marker: marker})
 			if err != nil {
-				sLogger.Fatal().Err(err).Msg("cannot list scaledobjects")
+				eng.observeError(n.Name, "rdsclusters", "list")
+				return eng.listFailed(ctx, sLogger, cs, n, fmt.Errorf("cannot describe rdsclusters: %w", err))
 			}
-		}
-
-		var rdsclusters []types.DBCluster
-		if eng.Options.AwsRdsEnabled {
-			sLogger.Debug().Str("step", stepName).Str("resource", "rds").Msg("get resource from AWS")
-			var marker *string
-			for {
-				// get rds clusters associated with the namespace
-				result, err := rdsclient.DescribeDBClusters(ctx, &rds.DescribeDBClustersInput{Marker: marker})
-				if err != nil {
-					sLogger.Fatal().Err(err).Msg("cannot describe rdsclusters")
-				}
 
-				// iterate through the clusters and find any tagged for this namespace
-				for i := range result.DBClusters {
-					// exclude serverless v1 clusters since they cannot be stopped
-					if result.DBClusters[i].EngineMode != nil && *result.DBClusters[i].EngineMode != "serverless" {
-						for t := range result.DBClusters[i].TagList {
-							tag := result.DBClusters[i].TagList[t]
-							if tag.Key != nil && tag.Value != nil && *tag.Key == eng.Options.AwsRdsNamespaceTag && n.Name == *tag.Value {
-								rdsclusters = append(rdsclusters, result.DBClusters[i])
-							}
+			// iterate through the clusters and find any tagged for this namespace
+			for i := range result.DBClusters {
+				// exclude serverless v1 clusters since they cannot be stopped
+				if result.DBClusters[i].EngineMode != nil && *result.DBClusters[i].EngineMode != "serverless" {
+					for t := range result.DBClusters[i].TagList {
+						tag := result.DBClusters[i].TagList[t]
+						if tag.Key != nil && tag.Value != nil && *tag.Key == eng.Options.AwsRdsNamespaceTag && n.Name == *tag.Value {
+							rdsclusters = append(rdsclusters, result.DBClusters[i])
 						}
 					}
 				}
+			}
 
-				marker = result.Marker
-				if marker == nil {
-					break
-				}
+			marker = result.Marker
+			if marker == nil {
+				break
 			}
 		}
+	}
 
-		/*
-			Step 3
-
-			If we end up here, it means that:
-			- the namespace has a desiredState annotation
-			- the annotation is valid
+	// the resources selected by the resource rules, or excluded by the policy of
+	// the namespace, are left untouched
+	cur.filterResources(sLogger, n, deployments, statefulsets, cronjobs, cronjobsBeta, scaledobjects)
+	jobs.Items = cur.managedJobs(sLogger, n, jobs.Items, cronjobs.Items, cronjobsBeta.Items, eng.Options.Prefix)
+	eng.recordResources(n.Name, deployments, statefulsets, cronjobs, cronjobsBeta, scaledobjects, rdsclusters)
+
+	/*
+		Step 3
+
+		If we end up here, it means that:
+		- the namespace has a desiredState annotation
+		- the annotation is valid
+
+		Now, we have to do another switch-case statement to manage the behavior of
+		the underlying replicas.
+		This switch-case will match dState again, with different behaviors:
+		- if dState == Suspended:
+			* be sure that the underlying resources are suspended. If not, downscale them
+
+		- if dState == Running:
+			* check if the namespace is correctly Running, as the annotation might have been set manually. If not,
+			  upscale everything
+	*/
+	eng.endStep(st)
+	stepName = "3/3 - handle desiredState"
+	ctx, st = eng.startStep(rctx, stepName)
+	sLogger.Debug().Str("step", stepName).Msgf("namespace is seen as being '%s'", dState)
+
+	// the namespace is transitioning as long as its observed phase does not
+	// match its desired state. Otherwise, the resources patched below are
+	// conformity fixes.
+	// reconcileErr is the error of the conformity checks. The namespace is
+	// retried later if some resources could not be patched.
+	var reconcileErr error
+	status := eng.statusOf(n)
+	transitioning := status.ObservedState != dState
+	// the namespaces without observed state have not been handled since the
+	// controller was upgraded, and may have been suspended for long: the
+	// pre-suspend hook only runs for them if they are being suspended now
+	preSuspend := transitioning && status.ObservedState != Suspending && (status.ObservedState != "" || transitionReason != "")
+	// the cronjobs of the namespaces suspended by a version of the controller
+	// that did not record them are all recorded as suspended by the
+	// controller, so that they are resumed with the namespace. From then on,
+	// only the cronjobs suspended by the controller are recorded.
+	if status.ObservedState == "" && status.CronjobsTracked == "" {
+		if dState == Suspended && transitionReason == "" {
+			err := adoptSuspendedCronjobs(ctx, sLogger, eng.DryRun, cronjobs.Items, cs, n.Name, eng.Options.Prefix)
+			if err == nil {
+				err = adoptSuspendedCronjobsBeta(ctx, sLogger, eng.DryRun, cronjobsBeta.Items, cs, n.Name, eng.Options.Prefix)
+			}
+			if err != nil {
+				eng.observeError(n.Name, "cronjobs", "update")
+				eng.reportFailure(ctx, sLogger, cs, n, ReasonUpdateFailed, err)
+				sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
+				return err
+			}
+		}
+		status.CronjobsTracked = "true"
+		eng.setStatus(ctx, sLogger, cs, &n, status)
+	}
+	if transitionReason == "" {
+		transitionReason = TransitionDesiredStateChanged
+		// a transition started during a previous loop keeps its reason
+		if IsTransitional(status.ObservedState) && status.LastTransitionReason != "" {
+			transitionReason = status.LastTransitionReason
+		}
+	}
 
-			Now, we have to do another switch-case statement to manage the behavior of
-			the underlying replicas.
-			This switch-case will match dState again, with different behaviors:
-			- if dState == Suspended:
-				* be sure that the underlying resources are suspended. If not, downscale them
+	switch dState {
+	case Suspended:
+		reason := ReasonConformityFix
+		if transitioning {
+			reason = ReasonSuspended
+		}
 
-			- if dState == Running:
-				* check if the namespace is correctly Running, as the annotation might have been set manually. If not,
-				  upscale everything
-		*/
-		stepName = "3/3 - handle desiredState"
-		sLogger.Debug().Str("step", stepName).Msgf("namespace is seen as being '%s'", dState)
-		switch dState {
-		case Suspended:
-			sLogger.Debug().Str("step", stepName).Msg("checking suspended Conformity")
-			// the checks will be done concurrently to optimise verification duration
-			var wg sync.WaitGroup
-			wg.Add(4)
-
-			// check and patch deployments
-			sLogger.Debug().Str("step", stepName).Str("resource", "deployments").Msg("checking suspended Conformity")
-			go func() {
-				if err := checkSuspendedDeploymentsConformity(ctx, sLogger, deployments.Items, cs, n.Name, eng.Options.Prefix); err != nil {
-					sLogger.Error().Err(err).Str("object", "deployment").Msg("suspended conformity checks failed")
-				}
-				wg.Done()
-			}()
+		// the pre-suspend hook runs once, before the resources start being
+		// scaled down. The namespace is left as is while it runs, and retried
+		// later if it fails.
+		if preSuspend {
+			done, err := eng.runHook(ctx, sLogger, cs, cur, &n, PreSuspendHook)
+			if err != nil {
+				failed := eng.statusOf(n)
+				failed.LastError = err.Error()
+				eng.updateStatus(ctx, sLogger, cs, n, failed)
+				sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
+				return err
+			}
+			if !done {
+				sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, waiting for the pre-suspend hook, duration: %s", time.Since(start))
+				return nil
+			}
+		}
 
-			// check and patch cronjobs
-			sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Msg("checking suspended Conformity")
-			go func() {
-				if err := checkSuspendedCronjobsConformity(ctx, sLogger, cronjobs.Items, cs, n.Name); err != nil {
-					sLogger.Error().Err(err).Str("object", "cronjob").Msg("suspended cronjobs conformity checks failed")
-				}
-				wg.Done()
-			}()
+		sLogger.Debug().Str("step", stepName).Msg("checking suspended Conformity")
+		// the checks will be done concurrently to optimise verification duration
+		var wg sync.WaitGroup
+		var results conformityResults
+		wg.Add(4)
+
+		// check and patch deployments
+		sLogger.Debug().Str("step", stepName).Str("resource", "deployments").Msg("checking suspended Conformity")
+		go func() {
+			ctx, span := tracing.Start(ctx, "check deployments")
+			hasBeenPatched, err := checkSuspendedDeploymentsConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, deployments.Items, cs, n.Name, eng.Options.Prefix)
+			if err != nil {
+				sLogger.Error().Err(err).Str("object", "deployment").Msg("suspended conformity checks failed")
+			}
+			results.add("deployments", hasBeenPatched, err)
+			tracing.End(span, err)
+			wg.Done()
+		}()
+
+		// check and patch cronjobs
+		sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Msg("checking suspended Conformity")
+		go func() {
+			ctx, span := tracing.Start(ctx, "check cronjobs")
+			hasBeenPatched, err := checkSuspendedCronjobsConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, cronjobs.Items, cs, n.Name, eng.Options.Prefix)
+			if err != nil {
+				sLogger.Error().Err(err).Str("object", "cronjob").Msg("suspended cronjobs conformity checks failed")
+			}
+			results.add("cronjobs", hasBeenPatched, err)
+			tracing.End(span, err)
+			wg.Done()
+		}()
+
+		sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Msg("checking suspended Conformity")
+		go func() {
+			ctx, span := tracing.Start(ctx, "check cronjobs")
+			hasBeenPatched, err := checkSuspendedCronjobsBetaConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, cronjobsBeta.Items, cs, n.Name, eng.Options.Prefix)
+			if err != nil {
+				sLogger.Error().Err(err).Str("object", "cronjob").Msg("suspended cronjobs conformity checks failed")
+			}
+			results.add("cronjobs", hasBeenPatched, err)
+			tracing.End(span, err)
+			wg.Done()
+		}()
+
+		// check and patch jobs, according to the jobs policy of the namespace
+		jobsPolicy := eng.jobsPolicyOf(sLogger, cur, n)
+		wg.Add(1)
+		sLogger.Debug().Str("step", stepName).Str("resource", "jobs").Str("policy", jobsPolicy).Msg("checking suspended Conformity")
+		go func() {
+			ctx, span := tracing.Start(ctx, "check jobs")
+			hasBeenPatched, err := checkSuspendedJobsConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, jobsPolicy, jobs.Items, cs, n.Name, eng.Options.Prefix)
+			if err != nil {
+				sLogger.Error().Err(err).Str("object", "job").Msg("suspended jobs conformity checks failed")
+			}
+			results.add("jobs", hasBeenPatched, err)
+			tracing.End(span, err)
+			wg.Done()
+		}()
+
+		// check and patch statefulsets
+		sLogger.Debug().Str("step", stepName).Str("resource", "statefulsets").Msg("checking suspended Conformity")
+		go func() {
+			ctx, span := tracing.Start(ctx, "check statefulsets")
+			hasBeenPatched, err := checkSuspendedStatefulsetsConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, statefulsets.Items, cs, n.Name, eng.Options.Prefix)
+			if err != nil {
+				sLogger.Error().Err(err).Str("object", "statefulset").Msg("suspended statefulsets conformity checks failed")
+			}
+			results.add("statefulsets", hasBeenPatched, err)
+			tracing.End(span, err)
+			wg.Done()
+		}()
 
-			sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Msg("checking suspended Conformity")
+		if eng.Options.KedaEnabled {
+			wg.Add(1)
+			// check and patch scaledobjects
+			sLogger.Debug().Str("step", stepName).Str("resource", "scaledobjects").Msg("checking suspended Conformity")
 			go func() {
-				if err := checkSuspendedCronjobsBetaConformity(ctx, sLogger, cronjobsBeta.Items, cs, n.Name); err != nil {
-					sLogger.Error().Err(err).Str("object", "cronjob").Msg("suspended cronjobs conformity checks failed")
+				ctx, span := tracing.Start(ctx, "check scaledobjects")
+				hasBeenPatched, err := checkSuspendedScaledObjectsConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, scaledobjects.Items, kedacs, n.Name)
+				if err != nil {
+					sLogger.Error().Err(err).Str("object", "scaledobjects").Msg("suspended scaledobjects conformity checks failed")
 				}
+				results.add("scaledobjects", hasBeenPatched, err)
+				tracing.End(span, err)
 				wg.Done()
 			}()
+		}
 
-			// check and patch statefulsets
-			sLogger.Debug().Str("step", stepName).Str("resource", "statefulsets").Msg("checking suspended Conformity")
+		if eng.Options.AwsRdsEnabled {
+			wg.Add(1)
+			// check and patch rdsclusters
+			sLogger.Debug().Str("step", stepName).Str("resource", "rdsclusters").Msg("checking suspended Conformity")
 			go func() {
-				if err := checkSuspendedStatefulsetsConformity(ctx, sLogger, statefulsets.Items, cs, n.Name, eng.Options.Prefix); err != nil {
-					sLogger.Error().Err(err).Str("object", "statefulset").Msg("suspended statefulsets conformity checks failed")
+				ctx, span := tracing.Start(ctx, "check rdsclusters")
+				hasBeenPatched, err := checkSuspendedRDSClustersConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, namespaceRef(n), rdsclusters, rdsclient, n.Name)
+				if err != nil {
+					sLogger.Error().Err(err).Str("object", "rdsclusters").Msg("suspended rdsclusters conformity checks failed")
 				}
+				results.add("rdsclusters", hasBeenPatched, err)
+				tracing.End(span, err)
 				wg.Done()
 			}()
+		}
 
-			if eng.Options.KedaEnabled {
-				wg.Add(1)
-				// check and patch scaledobjects
-				sLogger.Debug().Str("step", stepName).Str("resource", "scaledobjects").Msg("checking suspended Conformity")
-				go func() {
-					if err := checkSuspendedScaledObjectsConformity(ctx, sLogger, scaledobjects.Items, kedacs, n.Name); err != nil {
-						sLogger.Error().Err(err).Str("object", "scaledobjects").Msg("suspended scaledobjects conformity checks failed")
-					}
-					wg.Done()
-				}()
-			}
-
-			if eng.Options.AwsRdsEnabled {
-				wg.Add(1)
-				// check and patch rdsclusters
-				sLogger.Debug().Str("step", stepName).Str("resource", "rdsclusters").Msg("checking suspended Conformity")
-				go func() {
-					if err := checkSuspendedRDSClustersConformity(ctx, sLogger, rdsclusters, rdsclient, n.Name); err != nil {
-						sLogger.Error().Err(err).Str("object", "rdsclusters").Msg("suspended rdsclusters conformity checks failed")
-					}
-					wg.Done()
-				}()
-			}
-
-			// we wait for all the checks to be done
-			wg.Wait()
-			sLogger.Debug().Str("step", stepName).Msg("checking suspended Conformity done")
-
-			// Cleaning-up annotations
-			sLogger.Debug().Str("step", stepName).Msgf("checking annotation '%s'", eng.Options.Prefix+NextSuspendTime)
-			if _, ok := n.Annotations[eng.Options.Prefix+NextSuspendTime]; ok {
-				sLogger.Debug().Str("step", stepName).Msgf("found annotation '%s', cleanning-up", eng.Options.Prefix+NextSuspendTime)
-				if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-					sLogger.Trace().Str("step", stepName).Msgf("get namespace")
-					res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
-					if err != nil {
-						return err
-					}
-
-					sLogger.Trace().Str("step", stepName).Msgf("removing namespace annotation '%s'", eng.Options.Prefix+NextSuspendTime)
-					delete(res.Annotations, eng.Options.Prefix+NextSuspendTime)
+		// we wait for all the checks to be done
+		wg.Wait()
+		sLogger.Debug().Str("step", stepName).Msg("checking suspended Conformity done")
+		eng.observeConformity(n.Name, &results)
 
-					sLogger.Trace().Str("step", stepName).Msgf("updating namespace")
-					_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{})
+		// report the outcome of the checks on the namespace
+		if !transitioning && results.patched > 0 {
+			eng.Recorder.Eventf(namespaceRef(n), corev1.EventTypeNormal, ReasonConformityFix, "%d resource kind(s) patched to match the desired state '%s'", results.patched, dState)
+		}
+		phase := observePhase(Suspended, results.patched, deployments.Items, statefulsets.Items, rdsclusters)
+		reconcileErr = results.err()
+		eng.updatePhase(ctx, sLogger, cs, n, Suspended, phase, transitionReason, reconcileErr)
+		eng.trackSavings(n.Name, Suspended, eng.scaledAwayResources(deployments.Items, statefulsets.Items, rdsclusters))
+
+		// Cleaning-up annotations
+		sLogger.Debug().Str("step", stepName).Msgf("checking annotation '%s'", eng.Options.Prefix+NextSuspendTime)
+		if _, ok := n.Annotations[eng.Options.Prefix+NextSuspendTime]; ok {
+			sLogger.Debug().Str("step", stepName).Msgf("found annotation '%s', cleanning-up", eng.Options.Prefix+NextSuspendTime)
+			if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+				if eng.DryRun.intercept(Change{Namespace: n.Name, Kind: "Namespace", Name: n.Name, Action: ActionAnnotate, Detail: "remove " + NextSuspendTime}) {
+					return nil
+				}
+				sLogger.Trace().Str("step", stepName).Msgf("get namespace")
+				res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
+				if err != nil {
 					return err
-				}); err != nil {
-					sLogger.Error().Err(err).Msgf("cannot update namespace object")
-					// we give up and handle the next namespace
-					sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
-					continue
-				} else {
-					sLogger.Debug().Str("step", stepName).Msgf("removed annotation '%s'", eng.Options.Prefix+NextSuspendTime)
 				}
+
+				sLogger.Trace().Str("step", stepName).Msgf("removing namespace annotation '%s'", eng.Options.Prefix+NextSuspendTime)
+				delete(res.Annotations, eng.Options.Prefix+NextSuspendTime)
+
+				sLogger.Trace().Str("step", stepName).Msgf("updating namespace")
+				_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{FieldManager: FieldManager})
+				return err
+			}); err != nil {
+				sLogger.Error().Err(err).Msgf("cannot update namespace object")
+				eng.observeError(n.Name, "namespaces", "update")
+				// we give up and handle the next namespace
+				sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
+				return fmt.Errorf("cannot remove '%s' annotation: %w", NextSuspendTime, err)
 			} else {
-				sLogger.Debug().Str("step", stepName).Msgf("annotation '%s' not found, nothing to do", eng.Options.Prefix+NextSuspendTime)
+				sLogger.Debug().Str("step", stepName).Msgf("removed annotation '%s'", eng.Options.Prefix+NextSuspendTime)
 			}
+		} else {
+			sLogger.Debug().Str("step", stepName).Msgf("annotation '%s' not found, nothing to do", eng.Options.Prefix+NextSuspendTime)
+		}
 
-		case Running:
-			var wg sync.WaitGroup
-			var patchedResourcesCounter int
-
-			sLogger.Debug().Str("step", stepName).Msgf("namespace is seen as being '%s'", dState)
-			wg.Add(4)
+	case Running:
+		reason := ReasonConformityFix
+		if transitioning {
+			reason = ReasonResumed
+		}
+		var wg sync.WaitGroup
+		var results conformityResults
 
-			sLogger.Debug().Str("step", stepName).Msg("checking running conformity")
+		sLogger.Debug().Str("step", stepName).Msgf("namespace is seen as being '%s'", dState)
+		wg.Add(4)
 
-			// check and patch deployments
-			sLogger.Debug().Str("step", stepName).Str("resource", "deployments").Msg("checking running conformity")
-			go func() {
-				hasBeenPatched, err := checkRunningDeploymentsConformity(ctx, sLogger, deployments.Items, cs, n.Name, eng.Options.Prefix)
-				if err != nil {
-					sLogger.Error().Err(err).Msg("running deployments conformity checks failed")
-				}
-				if hasBeenPatched {
-					sLogger.Debug().Str("step", stepName).Str("resource", "deployments").Msg("resource has been patched")
-					patchedResourcesCounter++
-				}
-				wg.Done()
-			}()
+		sLogger.Debug().Str("step", stepName).Msg("checking running conformity")
 
-			// check and patch cronjobs
-			sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Msg("checking running conformity")
-			go func() {
-				hasBeenPatched, err := checkRunningCronjobsConformity(ctx, sLogger, cronjobs.Items, cs, n.Name)
-				if err != nil {
-					sLogger.Error().Err(err).Msg("running cronjobs conformity checks failed")
-				}
-				if hasBeenPatched {
-					sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Msg("resource has been patched")
-					patchedResourcesCounter++
-				}
-				wg.Done()
-			}()
+		// check and patch deployments
+		sLogger.Debug().Str("step", stepName).Str("resource", "deployments").Msg("checking running conformity")
+		go func() {
+			ctx, span := tracing.Start(ctx, "check deployments")
+			hasBeenPatched, err := checkRunningDeploymentsConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, deployments.Items, cs, n.Name, eng.Options.Prefix)
+			if err != nil {
+				sLogger.Error().Err(err).Msg("running deployments conformity checks failed")
+			}
+			if hasBeenPatched {
+				sLogger.Debug().Str("step", stepName).Str("resource", "deployments").Msg("resource has been patched")
+			}
+			results.add("deployments", hasBeenPatched, err)
+			tracing.End(span, err)
+			wg.Done()
+		}()
+
+		// check and patch cronjobs
+		sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Msg("checking running conformity")
+		go func() {
+			ctx, span := tracing.Start(ctx, "check cronjobs")
+			hasBeenPatched, err := checkRunningCronjobsConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, cronjobs.Items, cs, n.Name, eng.Options.Prefix)
+			if err != nil {
+				sLogger.Error().Err(err).Msg("running cronjobs conformity checks failed")
+			}
+			if hasBeenPatched {
+				sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Msg("resource has been patched")
+			}
+			results.add("cronjobs", hasBeenPatched, err)
+			tracing.End(span, err)
+			wg.Done()
+		}()
+
+		sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Msg("checking running conformity")
+		go func() {
+			ctx, span := tracing.Start(ctx, "check cronjobs")
+			hasBeenPatched, err := checkRunningCronjobsBetaConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, cronjobsBeta.Items, cs, n.Name, eng.Options.Prefix)
+			if err != nil {
+				sLogger.Error().Err(err).Msg("running cronjobs conformity checks failed")
+			}
+			if hasBeenPatched {
+				sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Msg("resource has been patched")
+			}
+			results.add("cronjobs", hasBeenPatched, err)
+			tracing.End(span, err)
+			wg.Done()
+		}()
+
+		// check and patch jobs
+		wg.Add(1)
+		sLogger.Debug().Str("step", stepName).Str("resource", "jobs").Msg("checking running conformity")
+		go func() {
+			ctx, span := tracing.Start(ctx, "check jobs")
+			hasBeenPatched, err := checkRunningJobsConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, jobs.Items, cs, n.Name, eng.Options.Prefix)
+			if err != nil {
+				sLogger.Error().Err(err).Msg("running jobs conformity checks failed")
+			}
+			if hasBeenPatched {
+				sLogger.Debug().Str("step", stepName).Str("resource", "jobs").Msg("resource has been patched")
+			}
+			results.add("jobs", hasBeenPatched, err)
+			tracing.End(span, err)
+			wg.Done()
+		}()
+
+		// check and patch statefulsets
+		sLogger.Debug().Str("step", stepName).Str("resource", "statefulsets").Msg("checking running conformity")
+		go func() {
+			ctx, span := tracing.Start(ctx, "check statefulsets")
+			hasBeenPatched, err := checkRunningStatefulsetsConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, statefulsets.Items, cs, n.Name, eng.Options.Prefix)
+			if err != nil {
+				sLogger.Error().Err(err).Msg("running statefulsets conformity checks failed")
+			}
+			if hasBeenPatched {
+				sLogger.Debug().Str("step", stepName).Str("resource", "statefulsets").Msg("resource has been patched")
+			}
+			results.add("statefulsets", hasBeenPatched, err)
+			tracing.End(span, err)
+			wg.Done()
+		}()
 
-			sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Msg("checking running conformity")
+		if eng.Options.KedaEnabled {
+			wg.Add(1)
+			// check and patch scaledobjects
+			sLogger.Debug().Str("step", stepName).Str("resource", "scaledobjects").Msg("checking running conformity")
 			go func() {
-				hasBeenPatched, err := checkRunningCronjobsBetaConformity(ctx, sLogger, cronjobsBeta.Items, cs, n.Name)
+				ctx, span := tracing.Start(ctx, "check scaledobjects")
+				hasBeenPatched, err := checkRunningScaledObjectsConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, scaledobjects.Items, kedacs, n.Name)
 				if err != nil {
-					sLogger.Error().Err(err).Msg("running cronjobs conformity checks failed")
+					sLogger.Error().Err(err).Msg("running scaledobjects conformity checks failed")
 				}
 				if hasBeenPatched {
-					sLogger.Debug().Str("step", stepName).Str("resource", "cronjobs").Msg("resource has been patched")
-					patchedResourcesCounter++
+					sLogger.Debug().Str("step", stepName).Str("resource", "scaledobjects").Msg("resource has been patched")
 				}
+				results.add("scaledobjects", hasBeenPatched, err)
+				tracing.End(span, err)
 				wg.Done()
 			}()
+		}
 
-			// check and patch statefulsets
-			sLogger.Debug().Str("step", stepName).Str("resource", "statefulsets").Msg("checking running conformity")
+		if eng.Options.AwsRdsEnabled {
+			wg.Add(1)
+			// check and patch rdsclusters
+			sLogger.Debug().Str("step", stepName).Str("resource", "rdsclusters").Msg("checking running conformity")
 			go func() {
-				hasBeenPatched, err := checkRunningStatefulsetsConformity(ctx, sLogger, statefulsets.Items, cs, n.Name, eng.Options.Prefix)
+				ctx, span := tracing.Start(ctx, "check rdsclusters")
+				hasBeenPatched, err := checkRunningRDSClustersConformity(ctx, sLogger, eng.Recorder, eng.DryRun, reason, namespaceRef(n), rdsclusters, rdsclient, n.Name)
 				if err != nil {
-					sLogger.Error().Err(err).Msg("running statefulsets conformity checks failed")
+					sLogger.Error().Err(err).Msg("running rdsclusters conformity checks failed")
 				}
 				if hasBeenPatched {
-					sLogger.Debug().Str("step", stepName).Str("resource", "statefulsets").Msg("resource has been patched")
-					patchedResourcesCounter++
+					sLogger.Debug().Str("step", stepName).Str("resource", "rdsclusters").Msg("resource has been patched")
 				}
+				results.add("rdsclusters", hasBeenPatched, err)
+				tracing.End(span, err)
 				wg.Done()
 			}()
+		}
 
-			if eng.Options.KedaEnabled {
-				wg.Add(1)
-				// check and patch scaledobjects
-				sLogger.Debug().Str("step", stepName).Str("resource", "scaledobjects").Msg("checking running conformity")
-				go func() {
-					hasBeenPatched, err := checkRunningScaledObjectsConformity(ctx, sLogger, scaledobjects.Items, kedacs, n.Name)
-					if err != nil {
-						sLogger.Error().Err(err).Msg("running scaledobjects conformity checks failed")
-					}
-					if hasBeenPatched {
-						sLogger.Debug().Str("step", stepName).Str("resource", "scaledobjects").Msg("resource has been patched")
-						patchedResourcesCounter++
-					}
-					wg.Done()
-				}()
-			}
+		// we wait for all the checks to be done
+		wg.Wait()
+		sLogger.Debug().Str("step", stepName).Msg("checking running conformity done")
+		eng.observeConformity(n.Name, &results)
 
-			if eng.Options.AwsRdsEnabled {
-				wg.Add(1)
-				// check and patch rdsclusters
-				sLogger.Debug().Str("step", stepName).Str("resource", "rdsclusters").Msg("checking running conformity")
-				go func() {
-					hasBeenPatched, err := checkRunningRDSClustersConformity(ctx, sLogger, rdsclusters, rdsclient, n.Name)
-					if err != nil {
-						sLogger.Error().Err(err).Msg("running rdsclusters conformity checks failed")
-					}
-					if hasBeenPatched {
-						sLogger.Debug().Str("step", stepName).Str("resource", "rdsclusters").Msg("resource has been patched")
-						patchedResourcesCounter++
-					}
-					wg.Done()
-				}()
+		// report the outcome of the checks on the namespace
+		if !transitioning && results.patched > 0 {
+			eng.Recorder.Eventf(namespaceRef(n), corev1.EventTypeNormal, ReasonConformityFix, "%d resource kind(s) patched to match the desired state '%s'", results.patched, dState)
+		}
+		phase := observePhase(Running, results.patched, deployments.Items, statefulsets.Items, rdsclusters)
+		reconcileErr = results.err()
+		// the post-resume hook runs once the resources are ready, and the
+		// namespace is still resuming while it runs. If it fails, the
+		// namespace is Degraded and the hook is run again by the next loops,
+		// until it succeeds.
+		if reconcileErr == nil && phase == Running && status.ObservedState != Running && status.ObservedState != "" {
+			var done bool
+			done, reconcileErr = eng.runHook(ctx, sLogger, cs, cur, &n, PostResumeHook)
+			if reconcileErr == nil && !done {
+				phase = Resuming
 			}
+		}
+		eng.updatePhase(ctx, sLogger, cs, n, Running, phase, transitionReason, reconcileErr)
+		eng.trackSavings(n.Name, Running, savings.Resources{})
 
-			// we wait for all the checks to be done
-			wg.Wait()
-			sLogger.Debug().Str("step", stepName).Msg("checking running conformity done")
+		// now we can check if some resources have been patched and add nextSuspendTime depending of the result
+		if results.patched-results.jobsPatched > 0 {
+			sLogger.Debug().Str("step", stepName).Msg("namespace has been unsuspended manually")
 
-			// now we can check if patchedResourcesCounter is > 0 and add nextSuspendTime depending of the result
-			if patchedResourcesCounter > 0 {
-				sLogger.Debug().Str("step", stepName).Msg("namespace has been unsuspended manually")
+			sLogger.Debug().Str("step", stepName).Msgf("checking annotation '%s'", eng.Options.Prefix+NextSuspendTime)
+			if val, ok := n.Annotations[eng.Options.Prefix+NextSuspendTime]; ok {
+				sLogger.Info().Str("step", stepName).Msgf("found annotation '%s'='%s', not updating it", eng.Options.Prefix+NextSuspendTime, val)
+				sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
+				return reconcileErr
+			}
 
-				sLogger.Debug().Str("step", stepName).Msgf("checking annotation '%s'", eng.Options.Prefix+NextSuspendTime)
-				if val, ok := n.Annotations[eng.Options.Prefix+NextSuspendTime]; ok {
-					sLogger.Info().Str("step", stepName).Msgf("found annotation '%s'='%s', not updating it", eng.Options.Prefix+NextSuspendTime, val)
-					sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
-					continue
+			runningDuration := cur.runningDurationOf(n, eng.Options.Prefix)
+			sLogger.Info().Msgf("'%s' annotation not found on namespace", eng.Options.Prefix+NextSuspendTime)
+			sLogger.Info().Msgf("adding the annotation '%s' to namespace (configured duration: '%s'", eng.Options.Prefix+NextSuspendTime, runningDuration)
+			if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+				if eng.DryRun.intercept(Change{Namespace: n.Name, Kind: "Namespace", Name: n.Name, Action: ActionAnnotate,
+					Detail: NextSuspendTime + ": " + eng.Clock.Now().Local().Add(runningDuration).Format(time.RFC822Z)}) {
+					return nil
+				}
+				sLogger.Trace().Str("step", stepName).Msg("get namespace")
+				res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
+				if err != nil {
+					return err
 				}
 
-				sLogger.Info().Msgf("'%s' annotation not found on namespace", eng.Options.Prefix+NextSuspendTime)
-				sLogger.Info().Msgf("adding the annotation '%s' to namespace (engine configured duration: '%s'", eng.Options.Prefix+NextSuspendTime, eng.RunningDuration)
-				if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-					sLogger.Trace().Str("step", stepName).Msg("get namespace")
-					res, err := cs.CoreV1().Namespaces().Get(ctx, n.Name, metav1.GetOptions{})
-					if err != nil {
-						return err
-					}
-
-					/*
-						The time format used for this annotation is RFC822Z:
-							02 Jan 06 15:04 -0700
+				/*
+					The time format used for this annotation is RFC822Z:
+						02 Jan 06 15:04 -0700
 
-						No need to use a kitchen format as this date should not be manually edited.
-						However, it makes it easier to detect if the date is passed, as it returns
-						a complete date, not only the hours and minutes of the day.
-					*/
-					nextSuspendTimeValue := time.Now().Local().Add(eng.RunningDuration).Format(time.RFC822Z)
-					sLogger.Trace().Str("step", stepName).Msgf("setting namespace annotation '%s=%s'", eng.Options.Prefix+NextSuspendTime, nextSuspendTimeValue)
-					res.Annotations[eng.Options.Prefix+NextSuspendTime] = nextSuspendTimeValue
+					No need to use a kitchen format as this date should not be manually edited.
+					However, it makes it easier to detect if the date is passed, as it returns
+					a complete date, not only the hours and minutes of the day.
+				*/
+				nextSuspendTimeValue := eng.Clock.Now().Local().Add(runningDuration).Format(time.RFC822Z)
+				sLogger.Trace().Str("step", stepName).Msgf("setting namespace annotation '%s=%s'", eng.Options.Prefix+NextSuspendTime, nextSuspendTimeValue)
+				res.Annotations[eng.Options.Prefix+NextSuspendTime] = nextSuspendTimeValue
 
-					sLogger.Trace().Str("step", stepName).Msg("update namespace")
-					_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{})
-					return err
-				}); err != nil {
-					sLogger.Error().Err(err).Msgf("cannot add annotation '%s' to namespace", eng.Options.Prefix+NextSuspendTime)
+				sLogger.Trace().Str("step", stepName).Msg("update namespace")
+				_, err = cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{FieldManager: FieldManager})
+				return err
+			}); err != nil {
+				sLogger.Error().Err(err).Msgf("cannot add annotation '%s' to namespace", eng.Options.Prefix+NextSuspendTime)
+				eng.observeError(n.Name, "namespaces", "update")
+				if reconcileErr == nil {
+					reconcileErr = fmt.Errorf("cannot add '%s' annotation: %w", NextSuspendTime, err)
 				}
 			}
 		}
-
-		sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
 	}
+
+	sLogger.Debug().Str("step", stepName).Msgf("suspender loop ended, duration: %s", time.Since(start))
+	return reconcileErr
+}
+
+// listFailed reports that the resources of the namespace cannot be listed, and
+// returns the error so the namespace is retried later
+func (eng *Engine) listFailed(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, n corev1.Namespace, err error) error {
+	l.Error().Err(err).Msg("cannot get namespace resources")
+	eng.reportFailure(ctx, l, cs, n, ReasonListFailed, err)
+	return err
 }
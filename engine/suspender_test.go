@@ -0,0 +1,862 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/govirtuo/kube-ns-suspender/metrics"
+	kedav1alpha1 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
+	"github.com/kedacore/keda/v2/pkg/generated/clientset/versioned/typed/keda/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+const (
+	testNamespace = "team-a"
+	testPrefix    = "kube-ns-suspender/"
+)
+
+// fakeRDS is an in-memory AWS RDS API
+type fakeRDS struct {
+	clusters []types.DBCluster
+	started  []string
+	stopped  []string
+}
+
+func (f *fakeRDS) DescribeDBClusters(ctx context.Context, params *rds.DescribeDBClustersInput, optFns ...func(*rds.Options)) (*rds.DescribeDBClustersOutput, error) {
+	return &rds.DescribeDBClustersOutput{DBClusters: f.clusters}, nil
+}
+
+func (f *fakeRDS) StartDBCluster(ctx context.Context, params *rds.StartDBClusterInput, optFns ...func(*rds.Options)) (*rds.StartDBClusterOutput, error) {
+	f.started = append(f.started, *params.DBClusterIdentifier)
+	return &rds.StartDBClusterOutput{}, nil
+}
+
+func (f *fakeRDS) StopDBCluster(ctx context.Context, params *rds.StopDBClusterInput, optFns ...func(*rds.Options)) (*rds.StopDBClusterOutput, error) {
+	f.stopped = append(f.stopped, *params.DBClusterIdentifier)
+	return &rds.StopDBClusterOutput{}, nil
+}
+
+// fakeKeda is an in-memory Keda API, holding the scaledobjects of the test
+// namespace. The fake clientset generated by Keda cannot be used, as it does
+// not register the scaledobjects under the right API group.
+type fakeKeda struct {
+	v1alpha1.KedaV1alpha1Interface
+	scaledobjects map[string]*kedav1alpha1.ScaledObject
+}
+
+func newFakeKeda(objects ...*kedav1alpha1.ScaledObject) *fakeKeda {
+	f := &fakeKeda{scaledobjects: make(map[string]*kedav1alpha1.ScaledObject)}
+	for _, so := range objects {
+		f.scaledobjects[so.Name] = so.DeepCopy()
+	}
+	return f
+}
+
+func (f *fakeKeda) ScaledObjects(namespace string) v1alpha1.ScaledObjectInterface {
+	return fakeScaledObjects{f: f}
+}
+
+type fakeScaledObjects struct {
+	v1alpha1.ScaledObjectInterface
+	f *fakeKeda
+}
+
+func (s fakeScaledObjects) List(ctx context.Context, opts metav1.ListOptions) (*kedav1alpha1.ScaledObjectList, error) {
+	list := &kedav1alpha1.ScaledObjectList{}
+	for _, so := range s.f.scaledobjects {
+		list.Items = append(list.Items, *so.DeepCopy())
+	}
+	return list, nil
+}
+
+func (s fakeScaledObjects) Get(ctx context.Context, name string, opts metav1.GetOptions) (*kedav1alpha1.ScaledObject, error) {
+	so, ok := s.f.scaledobjects[name]
+	if !ok {
+		return nil, fmt.Errorf("scaledobject %s not found", name)
+	}
+	return so.DeepCopy(), nil
+}
+
+func (s fakeScaledObjects) Update(ctx context.Context, so *kedav1alpha1.ScaledObject, opts metav1.UpdateOptions) (*kedav1alpha1.ScaledObject, error) {
+	s.f.scaledobjects[so.Name] = so.DeepCopy()
+	return so, nil
+}
+
+func (s fakeScaledObjects) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	if _, ok := s.f.scaledobjects[name]; !ok {
+		return fmt.Errorf("scaledobject %s not found", name)
+	}
+	delete(s.f.scaledobjects, name)
+	return nil
+}
+
+// newTestEngine returns an engine whose clock is set to now
+func newTestEngine(t *testing.T, now time.Time, keda, rds bool) *Engine {
+	t.Helper()
+	eng, err := New(Options{
+		WatcherIdle:          15,
+		WatchListSize:        1,
+		RunningDuration:      "4h",
+		UIMaxRunningDuration: "12h",
+		TransitionTimeout:    "15m",
+		StallTimeout:         "5m",
+		ShutdownTimeout:      "30s",
+		MaxBackoff:           "10m",
+		LogLevel:             "disabled",
+		Prefix:               testPrefix,
+		ControllerName:       "kube-ns-suspender",
+		KedaEnabled:          keda,
+		AwsRdsEnabled:        rds,
+		AwsRdsNamespaceTag:   "Namespace",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eng.MetricsServ = *metrics.New()
+	eng.Clock = clocktesting.NewFakePassiveClock(now)
+	return eng
+}
+
+func namespace(annotations map[string]string) *corev1.Namespace {
+	a := map[string]string{testPrefix + ControllerName: "kube-ns-suspender"}
+	for k, v := range annotations {
+		a[testPrefix+k] = v
+	}
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace, Annotations: a}}
+}
+
+func deployment(name string, replicas int32, annotations map[string]string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Annotations: annotations},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+	}
+}
+
+func statefulset(name string, replicas int32, annotations map[string]string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Annotations: annotations},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+	}
+}
+
+func cronjob(name string, suspend bool) *batchv1.CronJob {
+	return &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Spec:       batchv1.CronJobSpec{Suspend: &suspend},
+	}
+}
+
+// job returns a running job with the given labels and annotations
+func job(name string, lbls, annotations map[string]string) *batchv1.Job {
+	suspend := false
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Labels: lbls, Annotations: annotations},
+		Spec:       batchv1.JobSpec{Suspend: &suspend},
+	}
+}
+
+// suspendedCronjob returns a suspended cronjob with the given annotations
+func suspendedCronjob(name string, annotations map[string]string) *batchv1.CronJob {
+	c := cronjob(name, true)
+	c.Annotations = annotations
+	return c
+}
+
+func scaledobject(name string, annotations map[string]string) *kedav1alpha1.ScaledObject {
+	return &kedav1alpha1.ScaledObject{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Annotations: annotations},
+	}
+}
+
+func rdscluster(id, status string) types.DBCluster {
+	return types.DBCluster{
+		DBClusterIdentifier: aws.String(id),
+		EngineMode:          aws.String("provisioned"),
+		Status:              aws.String(status),
+		TagList:             []types.Tag{{Key: aws.String("Namespace"), Value: aws.String(testNamespace)}},
+	}
+}
+
+// clients holds the fake clients used by a test case
+type clients struct {
+	cs     *fake.Clientset
+	kedacs *fakeKeda
+	rds    *fakeRDS
+}
+
+func (c clients) namespace(t *testing.T) *corev1.Namespace {
+	t.Helper()
+	n, err := c.cs.CoreV1().Namespaces().Get(context.Background(), testNamespace, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func (c clients) job(t *testing.T, name string) *batchv1.Job {
+	t.Helper()
+	j, err := c.cs.BatchV1().Jobs(testNamespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func (c clients) deployment(t *testing.T, name string) *appsv1.Deployment {
+	t.Helper()
+	d, err := c.cs.AppsV1().Deployments(testNamespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func Test_reconcile(t *testing.T) {
+	// 9:00PM, after the daily suspend time of the namespaces below
+	now := time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name        string
+		now         time.Time
+		namespace   *corev1.Namespace
+		objects     []runtime.Object
+		scaled      []*kedav1alpha1.ScaledObject
+		rdsclusters []types.DBCluster
+		// listError makes the listing of the deployments fail
+		listError bool
+		wantErr   bool
+		check     func(t *testing.T, c clients)
+	}{
+		{
+			name:      "first sight",
+			namespace: namespace(nil),
+			objects:   []runtime.Object{deployment("api", 2, nil)},
+			check: func(t *testing.T, c clients) {
+				if got := c.namespace(t).Annotations[testPrefix+DesiredState]; got != Running {
+					t.Errorf("desiredState = %s, want %s", got, Running)
+				}
+				if got := *c.deployment(t, "api").Spec.Replicas; got != 2 {
+					t.Errorf("replicas = %d, want 2", got)
+				}
+			},
+		},
+		{
+			name:      "daily suspend time past",
+			namespace: namespace(map[string]string{DesiredState: Running, DailySuspendTime: "8:00PM"}),
+			objects:   []runtime.Object{deployment("api", 2, nil)},
+			check: func(t *testing.T, c clients) {
+				if got := c.namespace(t).Annotations[testPrefix+DesiredState]; got != Suspended {
+					t.Errorf("desiredState = %s, want %s", got, Suspended)
+				}
+				d := c.deployment(t, "api")
+				if got := *d.Spec.Replicas; got != 0 {
+					t.Errorf("replicas = %d, want 0", got)
+				}
+				if got := d.Annotations[testPrefix+originalReplicas]; got != "2" {
+					t.Errorf("originalReplicas = %s, want 2", got)
+				}
+			},
+		},
+		{
+			name:      "daily suspend time not past",
+			now:       now.Add(-2 * time.Hour),
+			namespace: namespace(map[string]string{DesiredState: Running, DailySuspendTime: "8:00PM"}),
+			objects:   []runtime.Object{deployment("api", 2, nil)},
+			check: func(t *testing.T, c clients) {
+				if got := c.namespace(t).Annotations[testPrefix+DesiredState]; got != Running {
+					t.Errorf("desiredState = %s, want %s", got, Running)
+				}
+				if got := *c.deployment(t, "api").Spec.Replicas; got != 2 {
+					t.Errorf("replicas = %d, want 2", got)
+				}
+			},
+		},
+		{
+			name: "next suspend time expired",
+			namespace: namespace(map[string]string{DesiredState: Running,
+				NextSuspendTime: now.Add(-time.Hour).Format(time.RFC822Z)}),
+			objects: []runtime.Object{deployment("api", 2, nil)},
+			check: func(t *testing.T, c clients) {
+				n := c.namespace(t)
+				if got := n.Annotations[testPrefix+DesiredState]; got != Suspended {
+					t.Errorf("desiredState = %s, want %s", got, Suspended)
+				}
+				if got, ok := n.Annotations[testPrefix+NextSuspendTime]; ok {
+					t.Errorf("nextSuspendTime = %s, want it removed", got)
+				}
+				if got := *c.deployment(t, "api").Spec.Replicas; got != 0 {
+					t.Errorf("replicas = %d, want 0", got)
+				}
+			},
+		},
+		{
+			name:      "manual unsuspend",
+			namespace: namespace(map[string]string{DesiredState: Running}),
+			objects:   []runtime.Object{deployment("api", 0, map[string]string{testPrefix + originalReplicas: "3"})},
+			check: func(t *testing.T, c clients) {
+				n := c.namespace(t)
+				want := now.Add(4 * time.Hour).Format(time.RFC822Z)
+				if got := n.Annotations[testPrefix+NextSuspendTime]; got != want {
+					t.Errorf("nextSuspendTime = %s, want %s", got, want)
+				}
+				if got := n.Annotations[testPrefix+ObservedState]; got != Resuming {
+					t.Errorf("observedState = %s, want %s", got, Resuming)
+				}
+				d := c.deployment(t, "api")
+				if got := *d.Spec.Replicas; got != 3 {
+					t.Errorf("replicas = %d, want 3", got)
+				}
+				if _, ok := d.Annotations[testPrefix+originalReplicas]; ok {
+					t.Error("originalReplicas annotation not removed")
+				}
+			},
+		},
+		{
+			name:      "suspended statefulset",
+			namespace: namespace(map[string]string{DesiredState: Suspended}),
+			objects:   []runtime.Object{statefulset("db", 1, nil)},
+			check: func(t *testing.T, c clients) {
+				ss, err := c.cs.AppsV1().StatefulSets(testNamespace).Get(context.Background(), "db", metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := *ss.Spec.Replicas; got != 0 {
+					t.Errorf("replicas = %d, want 0", got)
+				}
+				if got := ss.Annotations[testPrefix+originalReplicas]; got != "1" {
+					t.Errorf("originalReplicas = %s, want 1", got)
+				}
+			},
+		},
+		{
+			name:      "running statefulset",
+			namespace: namespace(map[string]string{DesiredState: Running}),
+			objects:   []runtime.Object{statefulset("db", 0, map[string]string{testPrefix + originalReplicas: "2"})},
+			check: func(t *testing.T, c clients) {
+				ss, err := c.cs.AppsV1().StatefulSets(testNamespace).Get(context.Background(), "db", metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := *ss.Spec.Replicas; got != 2 {
+					t.Errorf("replicas = %d, want 2", got)
+				}
+			},
+		},
+		{
+			name:      "suspended cronjob",
+			namespace: namespace(map[string]string{DesiredState: Suspended}),
+			objects:   []runtime.Object{cronjob("backup", false)},
+			check: func(t *testing.T, c clients) {
+				cj, err := c.cs.BatchV1().CronJobs(testNamespace).Get(context.Background(), "backup", metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !*cj.Spec.Suspend {
+					t.Error("cronjob not suspended")
+				}
+				if cj.Annotations[testPrefix+suspendedByController] != "true" {
+					t.Error("suspension by the controller not recorded")
+				}
+			},
+		},
+		{
+			name:      "running cronjob",
+			namespace: namespace(map[string]string{DesiredState: Running}),
+			objects:   []runtime.Object{suspendedCronjob("backup", map[string]string{testPrefix + suspendedByController: "true"})},
+			check: func(t *testing.T, c clients) {
+				cj, err := c.cs.BatchV1().CronJobs(testNamespace).Get(context.Background(), "backup", metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if *cj.Spec.Suspend {
+					t.Error("cronjob still suspended")
+				}
+				if _, ok := cj.Annotations[testPrefix+suspendedByController]; ok {
+					t.Error("suspendedByController annotation not removed")
+				}
+			},
+		},
+		{
+			name:      "cronjob suspended by its owner",
+			namespace: namespace(map[string]string{DesiredState: Running}),
+			objects:   []runtime.Object{suspendedCronjob("backup", nil)},
+			check: func(t *testing.T, c clients) {
+				cj, err := c.cs.BatchV1().CronJobs(testNamespace).Get(context.Background(), "backup", metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !*cj.Spec.Suspend {
+					t.Error("cronjob resumed, want it left suspended")
+				}
+				if c.namespace(t).Annotations[testPrefix+CronjobsTracked] != "true" {
+					t.Error("running namespace not flagged as tracking its cronjobs")
+				}
+			},
+		},
+		{
+			name:      "cronjob suspended by its owner, namespace never observed running",
+			namespace: namespace(map[string]string{DesiredState: Running, ObservedState: Suspended}),
+			objects:   []runtime.Object{suspendedCronjob("backup", nil)},
+			check: func(t *testing.T, c clients) {
+				cj, err := c.cs.BatchV1().CronJobs(testNamespace).Get(context.Background(), "backup", metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !*cj.Spec.Suspend {
+					t.Error("cronjob resumed, want it left suspended")
+				}
+			},
+		},
+		{
+			name:      "cronjob suspended by its owner since the upgrade",
+			namespace: namespace(map[string]string{DesiredState: Running, ObservedState: Suspended, CronjobsTracked: "true"}),
+			objects:   []runtime.Object{suspendedCronjob("backup", nil)},
+			check: func(t *testing.T, c clients) {
+				cj, err := c.cs.BatchV1().CronJobs(testNamespace).Get(context.Background(), "backup", metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !*cj.Spec.Suspend {
+					t.Error("cronjob resumed, want it left suspended")
+				}
+			},
+		},
+		{
+			name:      "jobs left running",
+			namespace: namespace(map[string]string{DesiredState: Suspended}),
+			objects:   []runtime.Object{job("import", nil, nil)},
+			check: func(t *testing.T, c clients) {
+				if *c.job(t, "import").Spec.Suspend {
+					t.Error("job suspended, want it left running")
+				}
+			},
+		},
+		{
+			name:      "suspended jobs",
+			namespace: namespace(map[string]string{DesiredState: Suspended, JobsPolicy: JobsPolicySuspend}),
+			objects:   []runtime.Object{job("import", nil, nil), job("dump", map[string]string{testPrefix + HookLabel: PreSuspendHook}, nil)},
+			check: func(t *testing.T, c clients) {
+				j := c.job(t, "import")
+				if !*j.Spec.Suspend || j.Annotations[testPrefix+suspendedByController] != "true" {
+					t.Errorf("job suspend = %t, annotations = %v, want it suspended by the controller", *j.Spec.Suspend, j.Annotations)
+				}
+				if *c.job(t, "dump").Spec.Suspend {
+					t.Error("hook job suspended")
+				}
+			},
+		},
+		{
+			name:      "deleted jobs",
+			namespace: namespace(map[string]string{DesiredState: Suspended, JobsPolicy: JobsPolicyDelete}),
+			objects: []runtime.Object{job("import", nil, nil), func() *batchv1.Job {
+				j := job("migration", nil, nil)
+				j.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+				return j
+			}()},
+			check: func(t *testing.T, c clients) {
+				jobs, err := c.cs.BatchV1().Jobs(testNamespace).List(context.Background(), metav1.ListOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(jobs.Items) != 1 || jobs.Items[0].Name != "migration" {
+					t.Errorf("jobs = %v, want only the finished one kept", jobs.Items)
+				}
+			},
+		},
+		{
+			name:      "suspended jobs not deleted",
+			namespace: namespace(map[string]string{DesiredState: Suspended, JobsPolicy: JobsPolicyDelete}),
+			objects: []runtime.Object{job("import", nil, nil), func() *batchv1.Job {
+				j := job("manual", nil, nil)
+				*j.Spec.Suspend = true
+				return j
+			}()},
+			check: func(t *testing.T, c clients) {
+				jobs, err := c.cs.BatchV1().Jobs(testNamespace).List(context.Background(), metav1.ListOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(jobs.Items) != 1 || jobs.Items[0].Name != "manual" {
+					t.Errorf("jobs = %v, want only the suspended one kept", jobs.Items)
+				}
+			},
+		},
+		{
+			name:      "invalid jobs policy",
+			namespace: namespace(map[string]string{DesiredState: Suspended, JobsPolicy: "kill"}),
+			objects:   []runtime.Object{job("import", nil, nil)},
+			check: func(t *testing.T, c clients) {
+				if *c.job(t, "import").Spec.Suspend {
+					t.Error("job suspended, want it left running")
+				}
+			},
+		},
+		{
+			name:      "resumed jobs",
+			namespace: namespace(map[string]string{DesiredState: Running}),
+			objects: []runtime.Object{
+				func() *batchv1.Job {
+					j := job("import", nil, map[string]string{testPrefix + suspendedByController: "true"})
+					*j.Spec.Suspend = true
+					return j
+				}(),
+				func() *batchv1.Job {
+					j := job("manual", nil, nil)
+					*j.Spec.Suspend = true
+					return j
+				}(),
+			},
+			check: func(t *testing.T, c clients) {
+				if *c.job(t, "import").Spec.Suspend {
+					t.Error("job suspended by the controller not resumed")
+				}
+				if !*c.job(t, "manual").Spec.Suspend {
+					t.Error("job suspended by its owner resumed")
+				}
+				// resuming the jobs alone is not a manual unsuspension
+				if _, ok := c.namespace(t).Annotations[testPrefix+NextSuspendTime]; ok {
+					t.Error("nextSuspendTime set, want none")
+				}
+			},
+		},
+		{
+			name:      "suspended scaledobject",
+			namespace: namespace(map[string]string{DesiredState: Suspended}),
+			scaled:    []*kedav1alpha1.ScaledObject{scaledobject("worker", nil)},
+			check: func(t *testing.T, c clients) {
+				so, err := c.kedacs.ScaledObjects(testNamespace).Get(context.Background(), "worker", metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := so.Annotations[pauseAnnotation]; !ok {
+					t.Error("scaledobject not paused")
+				}
+			},
+		},
+		{
+			name:      "running scaledobject",
+			namespace: namespace(map[string]string{DesiredState: Running}),
+			scaled:    []*kedav1alpha1.ScaledObject{scaledobject("worker", map[string]string{pauseAnnotation: "0"})},
+			check: func(t *testing.T, c clients) {
+				so, err := c.kedacs.ScaledObjects(testNamespace).Get(context.Background(), "worker", metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := so.Annotations[pauseAnnotation]; ok {
+					t.Error("scaledobject still paused")
+				}
+			},
+		},
+		{
+			name:        "suspended rds cluster",
+			namespace:   namespace(map[string]string{DesiredState: Suspended}),
+			rdsclusters: []types.DBCluster{rdscluster("db-a", rdsStatusAvailable), rdscluster("db-b", rdsStatusStopped)},
+			check: func(t *testing.T, c clients) {
+				if len(c.rds.stopped) != 1 || c.rds.stopped[0] != "db-a" {
+					t.Errorf("stopped clusters = %v, want [db-a]", c.rds.stopped)
+				}
+			},
+		},
+		{
+			name:        "running rds cluster",
+			namespace:   namespace(map[string]string{DesiredState: Running}),
+			rdsclusters: []types.DBCluster{rdscluster("db-a", rdsStatusStopped)},
+			check: func(t *testing.T, c clients) {
+				if len(c.rds.started) != 1 || c.rds.started[0] != "db-a" {
+					t.Errorf("started clusters = %v, want [db-a]", c.rds.started)
+				}
+			},
+		},
+		{
+			name:      "invalid desired state",
+			namespace: namespace(map[string]string{DesiredState: "Sleeping"}),
+			objects:   []runtime.Object{deployment("api", 2, nil)},
+			check: func(t *testing.T, c clients) {
+				if c.namespace(t).Annotations[testPrefix+LastError] == "" {
+					t.Error("lastError not set")
+				}
+				if got := *c.deployment(t, "api").Spec.Replicas; got != 2 {
+					t.Errorf("replicas = %d, want 2", got)
+				}
+			},
+		},
+		{
+			name:      "list failure",
+			namespace: namespace(map[string]string{DesiredState: Suspended}),
+			listError: true,
+			wantErr:   true,
+			check: func(t *testing.T, c clients) {
+				if c.namespace(t).Annotations[testPrefix+LastError] == "" {
+					t.Error("lastError not set")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := now
+			if !tt.now.IsZero() {
+				at = tt.now
+			}
+			eng := newTestEngine(t, at, tt.scaled != nil, tt.rdsclusters != nil)
+
+			c := clients{
+				cs:     fake.NewSimpleClientset(append(tt.objects, tt.namespace)...),
+				kedacs: newFakeKeda(tt.scaled...),
+				rds:    &fakeRDS{clusters: tt.rdsclusters},
+			}
+			if tt.listError {
+				c.cs.PrependReactor("list", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("connection refused")
+				})
+			}
+
+			err := eng.reconcile(context.Background(), c.cs, c.kedacs, c.rds, *tt.namespace)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reconcile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			tt.check(t, c)
+		})
+	}
+}
+
+func Test_reconcileProtected(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local)
+	eng := newTestEngine(t, now, false, false)
+	opt := eng.Options
+	opt.ProtectedNamespaces = testNamespace
+	var err error
+	if eng.Scope, err = NewScope(opt); err != nil {
+		t.Fatal(err)
+	}
+
+	// the schedule of a protected namespace is ignored
+	n := namespace(map[string]string{DesiredState: Running, DailySuspendTime: "8:00PM"})
+	c := clients{cs: fake.NewSimpleClientset(n, deployment("api", 2, nil))}
+	if err := eng.reconcile(ctx, c.cs, nil, nil, *n); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.namespace(t).Annotations[testPrefix+DesiredState]; got != Running {
+		t.Errorf("desiredState = %s, want %s", got, Running)
+	}
+
+	// nor is it suspended when its desired state is set by hand
+	res := c.namespace(t)
+	res.Annotations[testPrefix+DesiredState] = Suspended
+	if _, err := c.cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+		t.Fatal(err)
+	}
+	if got := *c.deployment(t, "api").Spec.Replicas; got != 2 {
+		t.Errorf("replicas = %d, want them unchanged", got)
+	}
+	if c.namespace(t).Annotations[testPrefix+LastError] == "" {
+		t.Error("lastError not set")
+	}
+
+	// but it is resumed if it was suspended before being protected
+	d := c.deployment(t, "api")
+	d.Spec.Replicas = new(int32)
+	d.Annotations = map[string]string{testPrefix + originalReplicas: "2"}
+	if _, err := c.cs.AppsV1().Deployments(testNamespace).Update(ctx, d, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	res = c.namespace(t)
+	res.Annotations[testPrefix+DesiredState] = Running
+	if _, err := c.cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+		t.Fatal(err)
+	}
+	if got := *c.deployment(t, "api").Spec.Replicas; got != 2 {
+		t.Errorf("replicas = %d, want 2", got)
+	}
+}
+
+func Test_reconcileLegacyCronjobs(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local)
+	cronjobSuspended := func(t *testing.T, c clients, name string) bool {
+		t.Helper()
+		cj, err := c.cs.BatchV1().CronJobs(testNamespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *cj.Spec.Suspend
+	}
+	resume := func(t *testing.T, eng *Engine, c clients) {
+		t.Helper()
+		res := c.namespace(t)
+		res.Annotations[testPrefix+DesiredState] = Running
+		if _, err := c.cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a namespace suspended by a version of the controller without status
+	// annotations has no observed state, and its cronjobs are not recorded
+	t.Run("suspended before the upgrade", func(t *testing.T) {
+		eng := newTestEngine(t, now, false, false)
+		n := namespace(map[string]string{DesiredState: Suspended})
+		c := clients{cs: fake.NewSimpleClientset(n, suspendedCronjob("backup", nil))}
+		if err := eng.reconcile(ctx, c.cs, nil, nil, *n); err != nil {
+			t.Fatal(err)
+		}
+		if c.namespace(t).Annotations[testPrefix+CronjobsTracked] != "true" {
+			t.Error("namespace not flagged as tracking its cronjobs")
+		}
+		resume(t, eng, c)
+		if cronjobSuspended(t, c, "backup") {
+			t.Error("cronjob suspended before the upgrade still suspended")
+		}
+	})
+
+	// a namespace first seen suspended, without status annotations either,
+	// tracks the cronjobs suspended from then on
+	t.Run("suspended since the upgrade", func(t *testing.T) {
+		eng := newTestEngine(t, now, false, false)
+		n := namespace(map[string]string{DesiredState: Suspended})
+		c := clients{cs: fake.NewSimpleClientset(n, cronjob("backup", false))}
+		if err := eng.reconcile(ctx, c.cs, nil, nil, *n); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.cs.BatchV1().CronJobs(testNamespace).Create(ctx, suspendedCronjob("report", nil), metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+			t.Fatal(err)
+		}
+		resume(t, eng, c)
+		if cronjobSuspended(t, c, "backup") {
+			t.Error("cronjob suspended by the controller still suspended")
+		}
+		if !cronjobSuspended(t, c, "report") {
+			t.Error("cronjob suspended by its owner resumed, want it left suspended")
+		}
+	})
+}
+
+func Test_reconcileInvalidJobsPolicy(t *testing.T) {
+	ctx := context.Background()
+	eng := newTestEngine(t, time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local), false, false)
+	recorder := record.NewFakeRecorder(100)
+	eng.Recorder = recorder
+	n := namespace(map[string]string{DesiredState: Suspended, JobsPolicy: "kill"})
+	c := clients{cs: fake.NewSimpleClientset(n, job("import", nil, nil))}
+
+	invalidEvents := func() int {
+		count := 0
+		for len(recorder.Events) > 0 {
+			if strings.Contains(<-recorder.Events, ReasonInvalidAnnotation) {
+				count++
+			}
+		}
+		return count
+	}
+
+	// the invalid annotation is reported once, not at each loop
+	for i := 0; i < 2; i++ {
+		if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := invalidEvents(); got != 1 {
+		t.Errorf("got %d %s events, want 1", got, ReasonInvalidAnnotation)
+	}
+
+	// and again when its value changes
+	res := c.namespace(t)
+	res.Annotations[testPrefix+JobsPolicy] = "stop"
+	if _, err := c.cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+		t.Fatal(err)
+	}
+	if got := invalidEvents(); got != 1 {
+		t.Errorf("got %d %s events after the change, want 1", got, ReasonInvalidAnnotation)
+	}
+
+	// the reported value is forgotten once the annotation is fixed
+	res = c.namespace(t)
+	res.Annotations[testPrefix+JobsPolicy] = JobsPolicyWait
+	if _, err := c.cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := eng.invalidJobsPolicies.values[testNamespace]; ok {
+		t.Errorf("invalid jobs policy '%s' still recorded", got)
+	}
+
+	// or once the namespace is not managed anymore
+	res.Annotations[testPrefix+JobsPolicy] = "kill"
+	if _, err := c.cs.CoreV1().Namespaces().Update(ctx, res, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.reconcile(ctx, c.cs, nil, nil, *c.namespace(t)); err != nil {
+		t.Fatal(err)
+	}
+	eng.knownStates[testNamespace] = Suspended
+	eng.observeNamespaces(nil)
+	if got, ok := eng.invalidJobsPolicies.values[testNamespace]; ok {
+		t.Errorf("invalid jobs policy '%s' of the namespace gone still recorded", got)
+	}
+}
+
+func Test_reconcileDryRun(t *testing.T) {
+	now := time.Date(2024, time.March, 11, 21, 0, 0, 0, time.Local)
+	eng := newTestEngine(t, now, false, false)
+	eng.DryRun = NewDryRun(eng.Logger)
+
+	n := namespace(map[string]string{DesiredState: Running, DailySuspendTime: "8:00PM"})
+	c := clients{cs: fake.NewSimpleClientset(n, deployment("api", 2, nil), cronjob("backup", false))}
+	if err := eng.reconcile(context.Background(), c.cs, nil, nil, *n); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.namespace(t).Annotations[testPrefix+DesiredState]; got != Running {
+		t.Errorf("desiredState = %s, want it unchanged", got)
+	}
+	if got := *c.deployment(t, "api").Spec.Replicas; got != 2 {
+		t.Errorf("replicas = %d, want them unchanged", got)
+	}
+
+	want := map[string]string{
+		"Namespace/" + testNamespace: ActionAnnotate,
+		"Deployment/api":             ActionScale,
+		"CronJob/backup":             ActionSuspend,
+	}
+	got := make(map[string]string)
+	for _, ch := range eng.DryRun.Changes() {
+		got[ch.Kind+"/"+ch.Name] = ch.Action
+	}
+	for k, action := range want {
+		if got[k] != action {
+			t.Errorf("change of %s = %q, want %q", k, got[k], action)
+		}
+	}
+}
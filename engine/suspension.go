@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/govirtuo/kube-ns-suspender/audit"
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/govirtuo/kube-ns-suspender/suspension"
+	kedav1alpha1 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
+	"github.com/rs/zerolog"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// KindRDSCluster is the kind of the RDS clusters in the resources of the
+// suspensions
+const KindRDSCluster = "RDSCluster"
+
+// SuspensionClient reads and updates the NamespaceSuspension resources. It is
+// implemented by *suspension.Client.
+type SuspensionClient interface {
+	List(ctx context.Context) ([]suspension.NamespaceSuspension, error)
+	UpdateStatus(ctx context.Context, s *suspension.NamespaceSuspension, fieldManager string) error
+}
+
+// managedSuspension is the suspension of a managed namespace during an
+// inventory
+type managedSuspension struct {
+	suspension.NamespaceSuspension
+	// observedGeneration is the generation of the last spec applied
+	observedGeneration int64
+	// specError tells why the spec cannot be applied
+	specError error
+	// rejection tells why the resume asked by the spec has been rejected
+	rejection error
+}
+
+// resumeRejected prefixes the error of the status of a suspension whose resume
+// has been rejected
+const resumeRejected = "resume rejected: "
+
+// listSuspensions returns the suspensions of the namespaces, by namespace.
+// A namespace holding several suspensions uses the first one by name. It
+// returns nil if the suspensions are disabled or cannot be listed.
+func (eng *Engine) listSuspensions(ctx context.Context, l zerolog.Logger) map[string]*managedSuspension {
+	if eng.Suspensions == nil {
+		return nil
+	}
+	list, err := eng.Suspensions.List(ctx)
+	if err != nil {
+		eng.observeError("", suspension.Resource, "list")
+		l.Error().Err(err).Msg("cannot list suspensions")
+		return nil
+	}
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	suspensions := make(map[string]*managedSuspension, len(list))
+	for _, s := range list {
+		if other, ok := suspensions[s.Namespace]; ok {
+			l.Warn().Str("namespace", s.Namespace).Msgf("several suspensions in namespace, using '%s' and ignoring '%s'", other.Name, s.Name)
+			continue
+		}
+		suspensions[s.Namespace] = &managedSuspension{NamespaceSuspension: s, observedGeneration: s.Status.ObservedGeneration}
+	}
+	return suspensions
+}
+
+// applySuspensions writes the spec of the suspensions that changed since
+// they were last applied to the annotations of their namespace. A change of
+// desired state is recorded as a transition. A resume is checked against the
+// budget of the team of the namespace, as the actor is the one who last set
+// the desired state of the spec: when rejected, the rest of the spec is
+// applied nonetheless. The namespaces in the slice are updated in place.
+func (eng *Engine) applySuspensions(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, namespaces []corev1.Namespace, suspensions map[string]*managedSuspension) {
+	for i := range namespaces {
+		n := &namespaces[i]
+		s, ok := suspensions[n.Name]
+		if !ok || s.Generation == s.observedGeneration {
+			continue
+		}
+		sLogger := l.With().Str("namespace", n.Name).Str("suspension", s.Name).Logger()
+
+		if s.specError = validateSuspensionSpec(s.Spec); s.specError != nil {
+			sLogger.Error().Err(s.specError).Msg("invalid suspension spec, not applying it")
+			eng.Recorder.Eventf(objectRef(suspension.Group+"/"+suspension.Version, suspension.Kind, n.Name, s.Name, s.UID),
+				corev1.EventTypeWarning, ReasonInvalidSuspension, "spec not applied: %s", s.specError)
+			continue
+		}
+
+		desiredState := s.Spec.DesiredState
+		resumed := desiredState == Running && n.Annotations[eng.Options.Prefix+DesiredState] != Running
+		if resumed {
+			actor, _ := lastFieldUpdate(s.ManagedFields, "f:spec", "f:desiredState")
+			// as for the annotations, the admin field managers are always
+			// allowed to override the budgets
+			if s.rejection = eng.Budgets.admit([]corev1.Namespace{*n}, actor, true); s.rejection != nil {
+				sLogger.Warn().Err(s.rejection).Msgf("resume by '%s' rejected, applying the rest of the spec", actor)
+				eng.Recorder.Eventf(objectRef(suspension.Group+"/"+suspension.Version, suspension.Kind, n.Name, s.Name, s.UID),
+					corev1.EventTypeWarning, ReasonBudgetExceeded, "resume rejected: %s", s.rejection)
+				desiredState = ""
+				resumed = false
+			}
+		}
+
+		values := make(map[string]string)
+		for key, val := range map[string]string{
+			DesiredState:     desiredState,
+			DailySuspendTime: s.Spec.DailySuspendTime,
+			Schedule:         s.Spec.Schedule,
+			Profile:          s.Spec.Profile,
+		} {
+			if val != "" && n.Annotations[eng.Options.Prefix+key] != val {
+				values[eng.Options.Prefix+key] = val
+			}
+		}
+		if len(values) > 0 {
+			sLogger.Info().Msgf("applying suspension spec to %d annotation(s)", len(values))
+			if err := patchNamespaceAnnotations(ctx, cs, eng.DryRun, n.Name, values); err != nil {
+				// the spec is applied again at the next inventory
+				eng.observeError(n.Name, "namespaces", "update")
+				sLogger.Error().Err(err).Msg("cannot apply suspension spec to namespace")
+				if resumed {
+					eng.Budgets.release(*n)
+				}
+				continue
+			}
+			previous := n.Annotations[eng.Options.Prefix+DesiredState]
+			if n.Annotations == nil {
+				n.Annotations = make(map[string]string)
+			}
+			for key, val := range values {
+				n.Annotations[key] = val
+			}
+			if desiredState != previous && values[eng.Options.Prefix+DesiredState] != "" {
+				eng.recordTransition(ctx, sLogger, *n, previous, desiredState, audit.OriginSuspension, "",
+					fmt.Sprintf("desiredState of %s '%s' changed", suspension.Kind, s.Name))
+			}
+		}
+		s.observedGeneration = s.Generation
+	}
+}
+
+// validateSuspensionSpec checks the values of a suspension spec
+func validateSuspensionSpec(spec suspension.Spec) error {
+	switch spec.DesiredState {
+	case "", Running, Suspended:
+	default:
+		return fmt.Errorf("'%s' is not a valid desired state, expected %s or %s", spec.DesiredState, Running, Suspended)
+	}
+	if spec.DailySuspendTime != "" {
+		if _, err := ParseDailySuspendTime(spec.DailySuspendTime); err != nil {
+			return fmt.Errorf("invalid daily suspend time: %w", err)
+		}
+	}
+	return nil
+}
+
+// updateSuspensions saves the state of the namespaces in the status of their
+// suspension, when it changed. The resources of the namespaces that are not
+// managed anymore are forgotten.
+func (eng *Engine) updateSuspensions(ctx context.Context, l zerolog.Logger, namespaces []corev1.Namespace, suspensions map[string]*managedSuspension) {
+	managed := make(map[string]bool, len(namespaces))
+	for _, n := range namespaces {
+		managed[n.Name] = true
+	}
+	eng.resourcesMu.Lock()
+	for ns := range eng.resources {
+		if !managed[ns] {
+			delete(eng.resources, ns)
+		}
+	}
+	eng.resourcesMu.Unlock()
+
+	for _, n := range namespaces {
+		s, ok := suspensions[n.Name]
+		if !ok {
+			continue
+		}
+
+		status := eng.statusOf(n)
+		next := suspension.Status{
+			ObservedGeneration:   s.observedGeneration,
+			DesiredState:         n.Annotations[eng.Options.Prefix+DesiredState],
+			ObservedState:        status.ObservedState,
+			LastTransitionTime:   status.LastTransitionTime,
+			LastTransitionReason: status.LastTransitionReason,
+			LastError:            status.LastError,
+			Resources:            eng.resourcesOf(n.Name),
+		}
+		switch {
+		case s.specError != nil:
+			next.LastError = "invalid spec: " + s.specError.Error()
+		case s.rejection != nil:
+			next.LastError = resumeRejected + s.rejection.Error()
+		case s.observedGeneration == s.Status.ObservedGeneration && strings.HasPrefix(s.Status.LastError, resumeRejected) && next.DesiredState != Running:
+			// the rejection is reported until the spec changes or the
+			// namespace is resumed otherwise
+			next.LastError = s.Status.LastError
+		}
+		if reflect.DeepEqual(next, s.Status) {
+			continue
+		}
+
+		if eng.DryRun.intercept(Change{Namespace: n.Name, Kind: suspension.Kind, Name: s.Name, Action: ActionUpdateStatus,
+			Detail: fmt.Sprintf("%s: %s, %s: %s", ObservedState, next.ObservedState, LastError, next.LastError)}) {
+			continue
+		}
+		s.Status = next
+		if err := eng.Suspensions.UpdateStatus(ctx, &s.NamespaceSuspension, FieldManager); err != nil {
+			// the status is updated again at the next inventory
+			eng.observeError(n.Name, suspension.Resource, "update")
+			l.Error().Err(err).Str("namespace", n.Name).Str("suspension", s.Name).Msg("cannot update suspension status")
+		}
+	}
+}
+
+// recordResources saves the resources of the namespace managed by the
+// controller, reported in the status of its suspension. The lists can be nil.
+func (eng *Engine) recordResources(ns string, deployments *appsv1.DeploymentList, statefulsets *appsv1.StatefulSetList, cronjobs *batchv1.CronJobList,
+	cronjobsBeta *batchv1beta1.CronJobList, scaledobjects *kedav1alpha1.ScaledObjectList, rdsclusters []types.DBCluster) {
+	if eng.Suspensions == nil {
+		return
+	}
+
+	var resources []suspension.ManagedResource
+	if deployments != nil {
+		for _, d := range deployments.Items {
+			resources = append(resources, suspension.ManagedResource{Kind: config.KindDeployment, Name: d.Name})
+		}
+	}
+	if statefulsets != nil {
+		for _, ss := range statefulsets.Items {
+			resources = append(resources, suspension.ManagedResource{Kind: config.KindStatefulSet, Name: ss.Name})
+		}
+	}
+	if cronjobs != nil {
+		for _, c := range cronjobs.Items {
+			resources = append(resources, suspension.ManagedResource{Kind: config.KindCronJob, Name: c.Name})
+		}
+	}
+	if cronjobsBeta != nil {
+		for _, c := range cronjobsBeta.Items {
+			resources = append(resources, suspension.ManagedResource{Kind: config.KindCronJob, Name: c.Name})
+		}
+	}
+	if scaledobjects != nil {
+		for _, so := range scaledobjects.Items {
+			resources = append(resources, suspension.ManagedResource{Kind: config.KindScaledObject, Name: so.Name})
+		}
+	}
+	for _, c := range rdsclusters {
+		if c.DBClusterIdentifier != nil {
+			resources = append(resources, suspension.ManagedResource{Kind: KindRDSCluster, Name: *c.DBClusterIdentifier})
+		}
+	}
+	sort.SliceStable(resources, func(i, j int) bool {
+		if resources[i].Kind != resources[j].Kind {
+			return resources[i].Kind < resources[j].Kind
+		}
+		return resources[i].Name < resources[j].Name
+	})
+
+	eng.resourcesMu.Lock()
+	eng.resources[ns] = resources
+	eng.resourcesMu.Unlock()
+}
+
+// resourcesOf returns the resources of the namespace seen during its last
+// handling
+func (eng *Engine) resourcesOf(ns string) []suspension.ManagedResource {
+	eng.resourcesMu.Lock()
+	defer eng.resourcesMu.Unlock()
+	return eng.resources[ns]
+}
@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/govirtuo/kube-ns-suspender/suspension"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// newSuspension returns a suspension of the test namespace, whose spec has
+// not been applied yet
+func newSuspension(t *testing.T, name string, spec suspension.Spec) *unstructured.Unstructured {
+	t.Helper()
+	s := &suspension.NamespaceSuspension{
+		TypeMeta:   metav1.TypeMeta{APIVersion: suspension.Group + "/" + suspension.Version, Kind: suspension.Kind},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Generation: 1},
+		Spec:       spec,
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &unstructured.Unstructured{Object: obj}
+}
+
+func Test_inventorySuspensions(t *testing.T) {
+	tests := []struct {
+		name string
+		// spec of the suspension of the namespace, which is Suspended
+		spec      suspension.Spec
+		wantState string
+		// wantError is the beginning of the error of the status
+		wantError string
+		wantEvent bool
+	}{
+		{
+			name:      "desired state applied",
+			spec:      suspension.Spec{DesiredState: Running, DailySuspendTime: "9:00PM"},
+			wantState: Running,
+		},
+		{
+			name:      "empty spec",
+			wantState: Suspended,
+		},
+		{
+			name:      "invalid spec",
+			spec:      suspension.Spec{DesiredState: Running, DailySuspendTime: "21:00"},
+			wantState: Suspended,
+			wantError: "invalid spec: invalid daily suspend time",
+			wantEvent: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			eng := newTestEngine(t, time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local), false, false)
+			recorder := record.NewFakeRecorder(10)
+			eng.Recorder = recorder
+			listKinds := map[schema.GroupVersionResource]string{suspension.GroupVersionResource: suspension.Kind + "List"}
+			dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, newSuspension(t, "team-a", tt.spec))
+			eng.Suspensions = suspension.NewClient(dyn)
+
+			n := namespace(map[string]string{ControllerName: "kube-ns-suspender", DesiredState: Suspended, ObservedState: Suspended})
+			cs := fake.NewSimpleClientset(n, deployment("api", 0, nil))
+			if err := eng.reconcile(ctx, cs, nil, nil, *n); err != nil {
+				t.Fatal(err)
+			}
+			managed := eng.inventory(ctx, zerolog.Nop(), cs, nil, []corev1.Namespace{*n})
+
+			if got := managed[0].Annotations[testPrefix+DesiredState]; got != tt.wantState {
+				t.Errorf("inventoried desiredState = %s, want %s", got, tt.wantState)
+			}
+			c := clients{cs: cs}
+			if got := c.namespace(t).Annotations[testPrefix+DesiredState]; got != tt.wantState {
+				t.Errorf("desiredState = %s, want %s", got, tt.wantState)
+			}
+			if tt.spec.DailySuspendTime != "" && tt.wantError == "" {
+				if got := c.namespace(t).Annotations[testPrefix+DailySuspendTime]; got != tt.spec.DailySuspendTime {
+					t.Errorf("dailySuspendTime = %s, want %s", got, tt.spec.DailySuspendTime)
+				}
+			}
+			if got := len(recorder.Events) > 0; got != tt.wantEvent {
+				t.Errorf("event emitted = %v, want %v", got, tt.wantEvent)
+			}
+
+			list, err := eng.Suspensions.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status := list[0].Status
+			wantGeneration := int64(1)
+			if tt.wantError != "" {
+				wantGeneration = 0
+			}
+			if status.ObservedGeneration != wantGeneration {
+				t.Errorf("observedGeneration = %d, want %d", status.ObservedGeneration, wantGeneration)
+			}
+			if status.DesiredState != tt.wantState || status.ObservedState != Suspended {
+				t.Errorf("status desiredState = %s, observedState = %s, want %s and %s", status.DesiredState, status.ObservedState, tt.wantState, Suspended)
+			}
+			if !strings.HasPrefix(status.LastError, tt.wantError) || (tt.wantError == "") != (status.LastError == "") {
+				t.Errorf("status lastError = %q, want %q", status.LastError, tt.wantError)
+			}
+			if len(status.Resources) != 1 || status.Resources[0] != (suspension.ManagedResource{Kind: "Deployment", Name: "api"}) {
+				t.Errorf("status resources = %v, want the api deployment", status.Resources)
+			}
+
+			// the spec is not applied again once observed, so the namespace
+			// can be suspended meanwhile
+			if err := patchNamespaceAnnotations(ctx, cs, nil, testNamespace, map[string]string{testPrefix + DesiredState: Suspended}); err != nil {
+				t.Fatal(err)
+			}
+			managed = eng.inventory(ctx, zerolog.Nop(), cs, nil, []corev1.Namespace{*c.namespace(t)})
+			if tt.wantError == "" {
+				if got := managed[0].Annotations[testPrefix+DesiredState]; got != Suspended {
+					t.Errorf("desiredState = %s after the second inventory, want %s", got, Suspended)
+				}
+			}
+		})
+	}
+}
+
+func Test_inventorySuspensionsBudget(t *testing.T) {
+	ctx := context.Background()
+	eng := newTestEngine(t, time.Date(2024, time.March, 11, 12, 0, 0, 0, time.Local), false, false)
+	recorder := record.NewFakeRecorder(10)
+	eng.Recorder = recorder
+	eng.Budgets = NewBudgets("team", nil, nil)
+	eng.Budgets.setLimits(map[string]config.Budget{"a": {MaxRunning: 1}})
+
+	// the desired state of the spec has last been set by kubectl, while the
+	// team already has a running namespace
+	s := newSuspension(t, "team-a", suspension.Spec{DesiredState: Running, DailySuspendTime: "9:00PM"})
+	s.SetManagedFields([]metav1.ManagedFieldsEntry{{
+		Manager:    "kubectl-edit",
+		Operation:  metav1.ManagedFieldsOperationUpdate,
+		Time:       &metav1.Time{Time: eng.Clock.Now()},
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:desiredState":{}}}`)},
+	}})
+	listKinds := map[schema.GroupVersionResource]string{suspension.GroupVersionResource: suspension.Kind + "List"}
+	eng.Suspensions = suspension.NewClient(dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, s))
+
+	running := teamNamespace("a-1", "a", Running)
+	suspended := teamNamespace(testNamespace, "a", Suspended)
+	cs := fake.NewSimpleClientset(&running, &suspended)
+	eng.knownStates = map[string]string{"a-1": Running, testNamespace: Suspended}
+
+	c := clients{cs: cs}
+	for i := 0; i < 2; i++ {
+		eng.inventory(ctx, zerolog.Nop(), cs, nil, []corev1.Namespace{running, *c.namespace(t)})
+
+		n := c.namespace(t)
+		if got := n.Annotations[testPrefix+DesiredState]; got != Suspended {
+			t.Errorf("inventory %d: desiredState = %s, want the resume to be rejected", i, got)
+		}
+		if got := n.Annotations[testPrefix+DailySuspendTime]; got != "9:00PM" {
+			t.Errorf("inventory %d: dailySuspendTime = %s, want the rest of the spec applied", i, got)
+		}
+		list, err := eng.Suspensions.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := list[0].Status
+		if status.ObservedGeneration != 1 || !strings.HasPrefix(status.LastError, "resume rejected: namespace team-a cannot be resumed: budget exceeded") {
+			t.Errorf("inventory %d: status observedGeneration = %d, lastError = %q, want the rejection reported", i, status.ObservedGeneration, status.LastError)
+		}
+		// the spec is not applied again until it changes
+		if usage := eng.Budgets.Usage(); len(usage) != 1 || usage[0].Rejections != 1 {
+			t.Errorf("inventory %d: Usage() = %+v, want 1 rejection", i, usage)
+		}
+	}
+
+	if len(recorder.Events) != 1 {
+		t.Fatalf("%d events emitted, want 1", len(recorder.Events))
+	}
+	if e := <-recorder.Events; !strings.HasPrefix(e, "Warning BudgetExceeded resume rejected:") {
+		t.Errorf("event = %q, want a BudgetExceeded warning", e)
+	}
+}
@@ -2,65 +2,99 @@ package engine
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"github.com/govirtuo/kube-ns-suspender/tracing"
+	"github.com/kedacore/keda/v2/pkg/generated/clientset/versioned/typed/keda/v1alpha1"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
 // Watcher periodically watches the namespaces, and add them to the engine
-// watchlist if they have the 'kube-ns-suspender/DesiredState' set.
-func (eng *Engine) Watcher(ctx context.Context, cs *kubernetes.Clientset) {
+// watchlist if they have the 'kube-ns-suspender/DesiredState' set. It returns
+// when ctx is cancelled.
+func (eng *Engine) Watcher(ctx context.Context, cs kubernetes.Interface, kedacs v1alpha1.KedaV1alpha1Interface) {
 	eng.Logger.Info().Str("routine", "watcher").Msg("watcher started")
 	defer func() {
-		eng.Logger.Fatal().Str("routine", "watcher").Msg("watcher exited")
+		eng.Logger.Info().Str("routine", "watcher").Msg("watcher stopped")
 	}()
 
 	var id int
 	for {
-		wLogger := eng.Logger.With().Str("routine", "watcher").Int("inventory_id", id).Logger()
+		ctx, span := tracing.Start(ctx, "inventory", attribute.Int("inventory_id", id))
+		wLogger := tracing.Logger(ctx, eng.Logger.With().Str("routine", "watcher").Int("inventory_id", id).Logger())
 
 		start := time.Now()
+		eng.inventoryStarted()
 		wLogger.Debug().Msg("starting new namespaces inventory")
 
-		ns, err := cs.CoreV1().Namespaces().List(ctx, metav1.ListOptions{}) // TODO: think about adding a label to filter here
+		ns, err := cs.CoreV1().Namespaces().List(ctx, eng.Scope.ListOptions())
 		if err != nil {
-			wLogger.Fatal().Err(err).Msg("cannot list namespaces")
+			tracing.End(span, err)
+			if ctx.Err() != nil {
+				return
+			}
+			// the inventory is retried after the idle duration. If the API
+			// server stays unreachable, the inventory readiness check fails,
+			// while the watcher liveness check passes as it keeps trying.
+			eng.observeError("", "namespaces", "list")
+			wLogger.Error().Err(err).Msg("cannot list namespaces, retrying later")
+			id++
+			if !eng.idle(ctx) {
+				return
+			}
+			continue
 		}
 
 		// create fresh new variables for metrics
-		var wllen, runningNs, suspendedNs, unknownNs int
-
-		wLogger.Debug().Msgf("iterating over namespaces list")
-		for _, n := range ns.Items {
-			if value, ok := n.Annotations[eng.Options.Prefix+ControllerName]; ok {
-				// this new sublogger will contain the namespace name in a string field, as this info is
-				// currently missing but is useful
-				watcherSubLogger := wLogger.With().Str("namespace", n.Name).Logger()
-
-				watcherSubLogger.Debug().Msgf("found annotation '%s'", eng.Options.Prefix+ControllerName)
-				if value == eng.Options.ControllerName {
-					watcherSubLogger.Debug().Msgf("annotation '%s: %s' matches controller name (%s)",
-						eng.Options.Prefix+ControllerName, value, eng.Options.ControllerName)
-					eng.Wl <- n
-					watcherSubLogger.Debug().Msgf("namespace %s sent to suspender", n.Name)
-					wllen++
-
-					// try to get the desiredState annotation
-					if state, ok := n.Annotations[eng.Options.Prefix+DesiredState]; ok {
-						// increment variables for metrics
-						switch state {
-						case Running:
-							runningNs++
-						case Suspended:
-							suspendedNs++
-						default:
-							unknownNs++
-						}
-					} else {
-						watcherSubLogger.Warn().Msgf("annotation '%s' not found", eng.Options.Prefix+DesiredState)
-					}
+		var wllen, runningNs, suspendedNs, unknownNs, stuckNs, backoffNs int
+		phases := make(map[string]int)
+
+		managed := eng.inventory(ctx, wLogger, cs, kedacs, ns.Items)
+
+		for _, n := range managed {
+			watcherSubLogger := wLogger.With().Str("namespace", n.Name).Logger()
+			// namespaces whose last reconciliation failed wait for their
+			// retry time
+			if retryAt, ok := eng.backingOff(n.Name); ok {
+				watcherSubLogger.Debug().Msgf("namespace %s is backing off until %s", n.Name, retryAt.Format(time.RFC3339))
+				backoffNs++
+			} else {
+				select {
+				case eng.Wl <- n:
+				case <-ctx.Done():
+					span.End()
+					return
+				}
+				watcherSubLogger.Debug().Msgf("namespace %s sent to suspender", n.Name)
+				wllen++
+			}
+
+			// try to get the desiredState annotation
+			if state, ok := n.Annotations[eng.Options.Prefix+DesiredState]; ok {
+				// increment variables for metrics
+				switch state {
+				case Running:
+					runningNs++
+				case Suspended:
+					suspendedNs++
+				default:
+					unknownNs++
 				}
+			} else {
+				watcherSubLogger.Warn().Msgf("annotation '%s' not found", eng.Options.Prefix+DesiredState)
+			}
+
+			status := eng.statusOf(n)
+			if status.ObservedState != "" {
+				phases[status.ObservedState]++
+			}
+			if eng.isStuck(status) {
+				stuckNs++
 			}
 		}
 
@@ -77,11 +111,113 @@ func (eng *Engine) Watcher(ctx context.Context, cs *kubernetes.Clientset) {
 		wLogger.Debug().Msgf("Metric - unknown namespaces: %d", unknownNs)
 		eng.MetricsServ.NumUnknownNamespaces.Set(float64(unknownNs))
 
+		for _, phase := range []string{Suspending, Suspended, Resuming, Running, Degraded} {
+			wLogger.Debug().Msgf("Metric - %s namespaces: %d", strings.ToLower(phase), phases[phase])
+			eng.MetricsServ.NamespacesPhase.WithLabelValues(phase).Set(float64(phases[phase]))
+		}
+
+		wLogger.Debug().Msgf("Metric - stuck namespaces: %d", stuckNs)
+		eng.MetricsServ.NumStuckNamespaces.Set(float64(stuckNs))
+
+		wLogger.Debug().Msgf("Metric - backing off namespaces: %d", backoffNs)
+		eng.MetricsServ.NumBackoffNamespaces.Set(float64(backoffNs))
+
+		eng.inventoryDone()
+		span.End()
+
 		// Question: Why not add `Int("inventory_id", id)` to every log line ?
 		wLogger.Debug().Msg("namespaces inventory ended")
 		wLogger.Debug().Msgf("inventory duration: %s", time.Since(start))
 
 		id++
-		time.Sleep(time.Duration(eng.Options.WatcherIdle) * time.Second)
+		if !eng.idle(ctx) {
+			return
+		}
+	}
+}
+
+// inventory returns the namespaces managed by the controller among the given
+// ones, once their groups have been synchronized and the manual changes of
+// state recorded
+func (eng *Engine) inventory(ctx context.Context, l zerolog.Logger, cs kubernetes.Interface, kedacs v1alpha1.KedaV1alpha1Interface, namespaces []v1.Namespace) []v1.Namespace {
+	// the policies are read once per inventory, and used until the next one
+	eng.loadPolicies(ctx, l)
+
+	l.Debug().Msgf("iterating over namespaces list")
+	var managed []v1.Namespace
+	for _, n := range namespaces {
+		// the label selector has been applied by the API server, but not the
+		// name patterns nor the opt-in annotation
+		if eng.Scope.Manages(n) {
+			l.Debug().Str("namespace", n.Name).Msgf("namespace managed by controller '%s'", eng.Options.ControllerName)
+			managed = append(managed, n)
+		}
+	}
+
+	// in dry-run mode, the changes recorded for the namespaces are the
+	// ones of the current inventory
+	for _, n := range managed {
+		eng.DryRun.reset(n.Name)
+	}
+
+	// the resumes of the teams over budget are reverted before being
+	// recorded
+	eng.enforceBudgets(ctx, l, cs, managed)
+
+	// record the changes of state that have been done outside of the
+	// controller since the last inventory
+	eng.detectManualTransitions(ctx, l, managed)
+
+	// the changes of the suspensions specs are applied to the annotations,
+	// so they are propagated to the groups like any other change
+	suspensions := eng.listSuspensions(ctx, l)
+	eng.applySuspensions(ctx, l, cs, managed, suspensions)
+
+	// groups members must share the same state, so we align them before
+	// sending them to the suspender
+	l.Debug().Msg("synchronizing namespaces groups")
+	eng.syncGroups(ctx, l, cs, managed)
+	// the suspensions due are counted once the groups are aligned, before
+	// the namespaces are reconciled
+	eng.checkBreaker(l, managed)
+	eng.cleanupStale(ctx, l, cs, kedacs, managed)
+	eng.updateSuspensions(ctx, l, managed, suspensions)
+	eng.observeNamespaces(managed)
+	eng.updateKnownStates(managed)
+	return managed
+}
+
+// ReconcileOnce does a single inventory of the namespaces and reconciles the
+// managed ones right away, instead of sending them to the Suspender. The
+// namespaces backing off are skipped. It is used by the simulation, where the
+// time is driven by the engine clock.
+func (eng *Engine) ReconcileOnce(ctx context.Context, cs kubernetes.Interface, kedacs v1alpha1.KedaV1alpha1Interface, rdsclient RDSAPI) error {
+	ns, err := cs.CoreV1().Namespaces().List(ctx, eng.Scope.ListOptions())
+	if err != nil {
+		return fmt.Errorf("cannot list namespaces: %w", err)
+	}
+
+	for _, n := range eng.inventory(ctx, eng.Logger, cs, kedacs, ns.Items) {
+		if _, ok := eng.backingOff(n.Name); ok {
+			continue
+		}
+		if err := eng.reconcile(ctx, cs, kedacs, rdsclient, n); err != nil {
+			delay := eng.reconcileFailed(n.Name)
+			eng.Logger.Error().Err(err).Str("namespace", n.Name).Msgf("cannot handle namespace, retrying in %s", delay)
+			continue
+		}
+		eng.reconcileSucceeded(n.Name)
+	}
+	return nil
+}
+
+// idle waits for the watcher idle duration. It returns false if ctx has been
+// cancelled meanwhile.
+func (eng *Engine) idle(ctx context.Context) bool {
+	select {
+	case <-time.After(eng.settings().watcherIdle):
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
@@ -9,10 +9,12 @@ import (
 )
 
 // HandleFunc fills the router.
-func HandleFunc() *mux.Router {
+func HandleFunc(h *Health) *mux.Router {
 	r := mux.NewRouter()
 	r.Handle("/metrics", promhttp.Handler())
 	r.Handle("/health", http.HandlerFunc(healthCheckPage))
+	r.Handle("/livez", http.HandlerFunc(h.livezPage))
+	r.Handle("/readyz", http.HandlerFunc(h.readyzPage))
 	r.NotFoundHandler = http.HandlerFunc(notFoundPage)
 
 	return r
@@ -24,12 +26,10 @@ func notFoundPage(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "<h1>404 page not found</h1>")
 }
 
-// healthCheckPage handles the /health page.
+// healthCheckPage handles the /health page. It only tells that the process
+// answers, /livez and /readyz should be used as probes.
 func healthCheckPage(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `
-{
-	"alive": "true",
-}`)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"alive": "true"}`)
 }
@@ -1,8 +1,12 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -51,4 +55,81 @@ func Test_healthCheckPage(t *testing.T) {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), healthStatus)
 	}
+
+	if !json.Valid(rr.Body.Bytes()) {
+		t.Errorf("handler returned invalid JSON: %v", rr.Body.String())
+	}
+}
+
+func Test_healthChecks(t *testing.T) {
+	failing := CheckerFunc(func(ctx context.Context) error { return errors.New("stalled") })
+	passing := CheckerFunc(func(ctx context.Context) error { return nil })
+
+	tests := []struct {
+		name       string
+		path       string
+		liveness   map[string]Checker
+		readiness  map[string]Checker
+		wantStatus int
+		wantBody   healthStatus
+	}{
+		{
+			name:       "livez without checks",
+			path:       "/livez",
+			wantStatus: http.StatusOK,
+			wantBody:   healthStatus{Status: "ok", Checks: map[string]string{}},
+		},
+		{
+			name:       "livez passing",
+			path:       "/livez",
+			liveness:   map[string]Checker{"watcher": passing, "suspender": passing},
+			readiness:  map[string]Checker{"apiserver": failing},
+			wantStatus: http.StatusOK,
+			wantBody:   healthStatus{Status: "ok", Checks: map[string]string{"watcher": "ok", "suspender": "ok"}},
+		},
+		{
+			name:       "livez failing",
+			path:       "/livez",
+			liveness:   map[string]Checker{"watcher": passing, "suspender": failing},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   healthStatus{Status: "failed", Checks: map[string]string{"watcher": "ok", "suspender": "stalled"}},
+		},
+		{
+			name:       "readyz failing",
+			path:       "/readyz",
+			liveness:   map[string]Checker{"watcher": passing},
+			readiness:  map[string]Checker{"apiserver": failing, "inventory": passing},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   healthStatus{Status: "failed", Checks: map[string]string{"apiserver": "stalled", "inventory": "ok"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHealth()
+			for name, c := range tt.liveness {
+				h.AddLivenessCheck(name, c)
+			}
+			for name, c := range tt.readiness {
+				h.AddReadinessCheck(name, c)
+			}
+
+			req, err := http.NewRequest("GET", tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			HandleFunc(h).ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.wantStatus)
+			}
+			var got healthStatus
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatalf("handler returned invalid JSON: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.wantBody) {
+				t.Errorf("handler returned unexpected body: got %v want %v", got, tt.wantBody)
+			}
+		})
+	}
 }
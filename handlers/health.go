@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// checkTimeout is the maximum duration of a single health check
+const checkTimeout = 5 * time.Second
+
+// Checker checks the health of a component. It returns an error describing
+// the problem if the component is not healthy.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc is an adapter to use ordinary functions as checkers.
+type CheckerFunc func(ctx context.Context) error
+
+// Check calls f(ctx).
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Health holds the checks run by the /livez and /readyz endpoints. Checks can
+// be added while the server is running.
+type Health struct {
+	mu        sync.RWMutex
+	liveness  map[string]Checker
+	readiness map[string]Checker
+}
+
+// healthStatus is the body returned by the health endpoints
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// NewHealth returns a new Health without any check.
+func NewHealth() *Health {
+	return &Health{
+		liveness:  make(map[string]Checker),
+		readiness: make(map[string]Checker),
+	}
+}
+
+// AddLivenessCheck adds a check to the /livez endpoint. A failing liveness
+// check means that the process is wedged and must be restarted.
+func (h *Health) AddLivenessCheck(name string, c Checker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.liveness[name] = c
+}
+
+// AddReadinessCheck adds a check to the /readyz endpoint. A failing readiness
+// check means that the process cannot do its job for now.
+func (h *Health) AddReadinessCheck(name string, c Checker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.readiness[name] = c
+}
+
+// livezPage handles the /livez page.
+func (h *Health) livezPage(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	checks := h.liveness
+	h.mu.RUnlock()
+	writeHealth(w, r, checks)
+}
+
+// readyzPage handles the /readyz page.
+func (h *Health) readyzPage(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	checks := h.readiness
+	h.mu.RUnlock()
+	writeHealth(w, r, checks)
+}
+
+// writeHealth runs the checks and writes their results. The status code is
+// 503 if any of them failed.
+func writeHealth(w http.ResponseWriter, r *http.Request, checks map[string]Checker) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	status := healthStatus{Status: "ok", Checks: make(map[string]string, len(checks))}
+	code := http.StatusOK
+	for _, name := range names {
+		if err := checks[name].Check(ctx); err != nil {
+			status.Checks[name] = err.Error()
+			status.Status = "failed"
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		status.Checks[name] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status)
+}
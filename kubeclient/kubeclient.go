@@ -0,0 +1,79 @@
+// Package kubeclient builds the configuration used by the controller and the
+// web UI to reach the Kubernetes API server, from inside or outside of the
+// cluster.
+package kubeclient
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Options are the options used to reach the API server
+type Options struct {
+	// Kubeconfig is the path of the kubeconfig file. If both Kubeconfig and
+	// Context are empty, the in-cluster configuration is used.
+	Kubeconfig string
+	// Context is the kubeconfig context to use instead of the current one.
+	// If Kubeconfig is empty, the kubeconfig is found using the $KUBECONFIG
+	// environment variable or ~/.kube/config.
+	Context string
+	// QPS and Burst limit the rate of the requests sent to the API server.
+	// The client-go defaults are used if they are not set.
+	QPS   float32
+	Burst int
+	// NoWarnings disables the warnings returned by the API server
+	NoWarnings bool
+}
+
+// InCluster tells if the in-cluster configuration is used
+func (opt Options) InCluster() bool {
+	return opt.Kubeconfig == "" && opt.Context == ""
+}
+
+// String describes where the configuration comes from
+func (opt Options) String() string {
+	if opt.InCluster() {
+		return "in-cluster"
+	}
+	s := "kubeconfig"
+	if opt.Kubeconfig != "" {
+		s += " " + opt.Kubeconfig
+	}
+	if opt.Context != "" {
+		s += fmt.Sprintf(" (context %s)", opt.Context)
+	}
+	return s
+}
+
+// Config returns the configuration to reach the API server
+func Config(opt Options) (*rest.Config, error) {
+	var config *rest.Config
+	var err error
+	if opt.InCluster() {
+		config, err = rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("cannot create in-cluster configuration: %w", err)
+		}
+	} else {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = opt.Kubeconfig
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: opt.Context}
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("cannot load %s: %w", opt, err)
+		}
+	}
+
+	if opt.QPS > 0 {
+		config.QPS = opt.QPS
+	}
+	if opt.Burst > 0 {
+		config.Burst = opt.Burst
+	}
+	if opt.NoWarnings {
+		config.WarningHandler = rest.NoWarnings{}
+	}
+	return config, nil
+}
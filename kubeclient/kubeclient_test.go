@@ -0,0 +1,113 @@
+package kubeclient
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const kubeconfig = `apiVersion: v1
+kind: Config
+current-context: kind
+clusters:
+- name: kind
+  cluster:
+    server: https://127.0.0.1:6443
+- name: staging
+  cluster:
+    server: https://staging.example.com
+contexts:
+- name: kind
+  context:
+    cluster: kind
+    user: dev
+- name: staging
+  context:
+    cluster: staging
+    user: dev
+users:
+- name: dev
+  user:
+    token: secret
+`
+
+func TestConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(kubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		opt       Options
+		wantHost  string
+		wantQPS   float32
+		wantBurst int
+		wantErr   bool
+	}{
+		{
+			name:     "current context",
+			opt:      Options{Kubeconfig: path},
+			wantHost: "https://127.0.0.1:6443",
+		},
+		{
+			name:     "other context",
+			opt:      Options{Kubeconfig: path, Context: "staging"},
+			wantHost: "https://staging.example.com",
+		},
+		{
+			name:      "rate limits",
+			opt:       Options{Kubeconfig: path, QPS: 50, Burst: 100},
+			wantHost:  "https://127.0.0.1:6443",
+			wantQPS:   50,
+			wantBurst: 100,
+		},
+		{
+			name:    "unknown context",
+			opt:     Options{Kubeconfig: path, Context: "prod"},
+			wantErr: true,
+		},
+		{
+			name:    "missing kubeconfig",
+			opt:     Options{Kubeconfig: filepath.Join(t.TempDir(), "missing")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := Config(tt.opt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Config() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if config.Host != tt.wantHost {
+				t.Errorf("Config() host = %s, want %s", config.Host, tt.wantHost)
+			}
+			if config.QPS != tt.wantQPS {
+				t.Errorf("Config() QPS = %v, want %v", config.QPS, tt.wantQPS)
+			}
+			if config.Burst != tt.wantBurst {
+				t.Errorf("Config() burst = %v, want %v", config.Burst, tt.wantBurst)
+			}
+		})
+	}
+}
+
+func TestOptionsString(t *testing.T) {
+	tests := []struct {
+		opt  Options
+		want string
+	}{
+		{Options{}, "in-cluster"},
+		{Options{Kubeconfig: "/tmp/config"}, "kubeconfig /tmp/config"},
+		{Options{Context: "kind"}, "kubeconfig (context kind)"},
+		{Options{Kubeconfig: "/tmp/config", Context: "kind"}, "kubeconfig /tmp/config (context kind)"},
+	}
+	for _, tt := range tests {
+		if got := tt.opt.String(); got != tt.want {
+			t.Errorf("Options.String() = %s, want %s", got, tt.want)
+		}
+	}
+}
@@ -2,19 +2,28 @@ package main
 
 import (
 	"context"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/namsral/flag"
-
+	"github.com/govirtuo/kube-ns-suspender/audit"
 	"github.com/govirtuo/kube-ns-suspender/engine"
+	"github.com/govirtuo/kube-ns-suspender/handlers"
+	"github.com/govirtuo/kube-ns-suspender/kubeclient"
 	"github.com/govirtuo/kube-ns-suspender/metrics"
+	"github.com/govirtuo/kube-ns-suspender/policy"
 	"github.com/govirtuo/kube-ns-suspender/pprof"
+	"github.com/govirtuo/kube-ns-suspender/savings"
+	"github.com/govirtuo/kube-ns-suspender/suspension"
+	"github.com/govirtuo/kube-ns-suspender/tracing"
 	"github.com/govirtuo/kube-ns-suspender/webui"
 	"github.com/kedacore/keda/v2/pkg/generated/clientset/versioned/typed/keda/v1alpha1"
 	"github.com/rs/zerolog/log"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/rds"
@@ -30,30 +39,14 @@ var (
 )
 
 func main() {
-	var opt engine.Options
-	var err error
-
-	fs := flag.NewFlagSetWithEnvPrefix(os.Args[0], "KUBE_NS_SUSPENDER", 0)
-	fs.StringVar(&opt.LogLevel, "log-level", "debug", "Log level")
-	fs.StringVar(&opt.TZ, "timezone", "Europe/Paris", "Timezone to use")
-	fs.StringVar(&opt.Prefix, "prefix", "kube-ns-suspender/", "Prefix to use for annotations")
-	fs.StringVar(&opt.ControllerName, "controller-name", "kube-ns-suspender", "Unique name of the controller")
-	fs.StringVar(&opt.RunningDuration, "running-duration", "4h", "Running duration")
-	fs.IntVar(&opt.WatcherIdle, "watcher-idle", 15, "Watcher idle duration (in seconds)")
-	fs.BoolVar(&opt.NoKubeWarnings, "no-kube-warnings", false, "Disable Kubernetes warnings")
-	fs.BoolVar(&opt.HumanLogs, "human", false, "Disable JSON logging")
-	fs.BoolVar(&opt.EmbeddedUI, "ui-embedded", false, "Start UI in background")
-	fs.BoolVar(&opt.WebUIOnly, "ui-only", false, "Start UI only")
-	fs.BoolVar(&opt.PProf, "pprof", false, "Start pprof server")
-	fs.StringVar(&opt.PProfAddr, "pprof-addr", ":4455", "Address and port to use with pprof")
-	fs.StringVar(&opt.SlackChannelName, "slack-channel-name", "", "Name of the help Slack channel in the UI bug page")
-	fs.StringVar(&opt.SlackChannelLink, "slack-channel-link", "", "Link of the helm Slack channel in the UI bug page")
-	fs.IntVar(&opt.WatchListSize, "watchlist-size", 512, "Size of the watchlist containing namespaces waiting to be handled")
-	fs.BoolVar(&opt.KedaEnabled, "keda-enabled", false, "Enable pausing of Keda.sh scaledobjects")
-	fs.BoolVar(&opt.AwsRdsEnabled, "rds-enabled", false, "Enable stop/start of associated AWS RDS clusters")
-	fs.StringVar(&opt.AwsRdsNamespaceTag, "rds-namespace-tag", "Namespace", "Tag key on AWS RDS clusters identifying associated namespace")
-	if err := fs.Parse(os.Args[1:]); err != nil {
-		log.Fatal().Err(err).Msg("cannot parse flags")
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		simulation(os.Args[2:])
+		return
+	}
+
+	opt, err := parseOptions(os.Args[1:])
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot parse options")
 	}
 
 	// set the local timezone
@@ -71,73 +64,199 @@ func main() {
 	eng.Logger.Info().Msgf("engine successfully created in %s", time.Since(start))
 	eng.Logger.Info().Msgf("kube-ns-suspender version '%s' (built %s)", Version, BuildDate)
 
+	// ctx is cancelled when a termination signal is received. Everything
+	// started below stops when it is, and wg waits for them to be done.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var wg sync.WaitGroup
+
 	if eng.Options.PProf {
 		s, err := pprof.New(eng.Options.PProfAddr)
 		if err != nil {
 			eng.Logger.Fatal().Err(err).Msg("cannot start pprof")
 		}
 		eng.Logger.Info().Msgf("starting pprof on %s", eng.Options.PProfAddr)
-		go s.Run()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Run(ctx)
+		}()
 	}
 
+	auditOpt := audit.Options{
+		Sink:           eng.Options.AuditSink,
+		File:           eng.Options.AuditFile,
+		WebhookURL:     eng.Options.AuditWebhookURL,
+		ControllerName: eng.Options.ControllerName,
+	}
+
+	// the savings are estimated and the dry-run changes are recorded by the
+	// controller, so they are only available in the web UI when it is embedded
+	pricing, err := savings.LoadPricing(eng.Options.PricingFile)
+	if err != nil {
+		eng.Logger.Fatal().Err(err).Msg("cannot load pricing")
+	}
+	eng.Savings = savings.NewTracker(pricing)
+	var tracker *savings.Tracker
+	var dryRun *engine.DryRun
+	var breaker *engine.Breaker
+	var budgets *engine.Budgets
+	if !eng.Options.WebUIOnly {
+		tracker = eng.Savings
+		dryRun = eng.DryRun
+		breaker = eng.Breaker
+		budgets = eng.Budgets
+	}
+
+	// set up tracing
+	tracingOpt := tracing.Options{
+		Endpoint:       eng.Options.TracingEndpoint,
+		Insecure:       eng.Options.TracingInsecure,
+		SampleRatio:    eng.Options.TracingSampleRatio,
+		ServiceName:    eng.Options.ControllerName,
+		ServiceVersion: Version,
+	}
+	shutdownTracing, err := tracing.Setup(ctx, tracingOpt)
+	if err != nil {
+		eng.Logger.Fatal().Err(err).Msg("cannot set up tracing")
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			eng.Logger.Error().Err(err).Msg("cannot flush traces")
+		}
+	}()
+	if tracingOpt.Enabled() {
+		eng.Logger.Info().Msgf("tracing enabled, sending traces to %s", tracingOpt.Endpoint)
+	}
+
+	// create the configuration to reach the API server, shared by the engine
+	// and the web UI
+	start = time.Now()
+	kubeOpt := kubeclient.Options{
+		Kubeconfig: eng.Options.Kubeconfig,
+		Context:    eng.Options.KubeContext,
+		QPS:        float32(eng.Options.KubeQPS),
+		Burst:      eng.Options.KubeBurst,
+		NoWarnings: eng.Options.NoKubeWarnings,
+	}
+	config, err := kubeclient.Config(kubeOpt)
+	if err != nil {
+		eng.Logger.Fatal().Err(err).Msg("cannot create the Kubernetes configuration")
+	}
+	eng.Logger.Info().Msgf("%s configuration successfully created in %s", kubeOpt, time.Since(start))
+
+	// trace the calls to the API server
+	if tracingOpt.Enabled() {
+		config.Wrap(tracing.Transport)
+	}
+
+	if eng.Options.NoKubeWarnings {
+		eng.Logger.Info().Msgf("Kubernetes warnings disabled")
+	}
+
+	// create the clientset
+	start = time.Now()
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		eng.Logger.Fatal().Err(err).Msg("cannot create the clientset")
+	}
+	eng.Logger.Info().Msgf("clientset successfully created in %s", time.Since(start))
+
 	// start web ui
 	if eng.Options.EmbeddedUI || eng.Options.WebUIOnly {
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			uiLogger := eng.Logger.With().Str("routine", "webui").Logger()
-			if err := webui.Start(uiLogger, "8080",
-				eng.Options.Prefix, eng.Options.ControllerName, Version, BuildDate, opt.SlackChannelName, opt.SlackChannelLink); err != nil {
+			if err := webui.Start(ctx, uiLogger, clientset, webui.Options{
+				Port:               "8080",
+				Prefix:             eng.Options.Prefix,
+				ControllerName:     eng.Options.ControllerName,
+				Scope:              eng.Scope,
+				Version:            Version,
+				BuildDate:          BuildDate,
+				SlackChannelName:   opt.SlackChannelName,
+				SlackChannelLink:   opt.SlackChannelLink,
+				MaxRunningDuration: eng.UIMaxRunningDuration,
+				Audit:              auditOpt,
+				Savings:            tracker,
+				DryRun:             dryRun,
+				Breaker:            breaker,
+				Budgets:            budgets,
+				Clock:              eng.Clock,
+				TrustedProxies:     eng.Options.UITrustedProxies,
+			}); err != nil {
 				uiLogger.Fatal().Err(err).Msg("web UI failed")
 			}
 		}()
 		eng.Logger.Info().Msg("web UI successfully created")
 		if eng.Options.WebUIOnly {
 			eng.Logger.Info().Msg("starting web UI only")
-			// if we want only the webui, we have to wait here forever after the creation
-			select {}
+			// if we want only the webui, we have to wait here until we are
+			// asked to stop
+			<-ctx.Done()
+			eng.Logger.Info().Msg("shutting down")
+			wg.Wait()
+			eng.Logger.Info().Msg("shutdown complete")
+			return
 		}
 	}
 
 	eng.Logger.Debug().Msgf("timezone: %s", time.Local.String())
 	eng.Logger.Debug().Msgf("watcher idle: %s", time.Duration(eng.Options.WatcherIdle)*time.Second)
 	eng.Logger.Debug().Msgf("watchlist size: %d", eng.Options.WatchListSize)
-	eng.Logger.Debug().Msgf("running duration: %s", eng.RunningDuration)
+	eng.Logger.Debug().Msgf("running duration: %s", eng.Options.RunningDuration)
+	eng.Logger.Debug().Msgf("web UI max running duration: %s", eng.UIMaxRunningDuration)
+	eng.Logger.Debug().Msgf("transition timeout: %s", eng.Options.TransitionTimeout)
+	eng.Logger.Debug().Msgf("stall timeout: %s", eng.StallTimeout)
+	eng.Logger.Debug().Msgf("shutdown timeout: %s", eng.ShutdownTimeout)
+	eng.Logger.Debug().Msgf("max backoff: %s", eng.Options.MaxBackoff)
+	eng.Logger.Debug().Msgf("max hook timeout: %s", eng.Options.MaxHookTimeout)
+	eng.Logger.Debug().Msgf("hook annotations enabled: %v", eng.Options.HookAnnotationsEnabled)
+	eng.Logger.Debug().Msgf("dry run: %v", eng.Options.DryRun)
 	eng.Logger.Debug().Msgf("log level: %s", eng.Options.LogLevel)
 	eng.Logger.Debug().Msgf("json logging: %v", !eng.Options.HumanLogs)
 	eng.Logger.Debug().Msgf("controller name: %v", eng.Options.ControllerName)
 	eng.Logger.Debug().Msgf("annotations prefix: %v", eng.Options.Prefix)
+	eng.Logger.Debug().Msgf("namespaces scope: %s", eng.Scope)
+	eng.Logger.Debug().Msgf("configuration file: %s", eng.Options.ConfigFile)
 
 	// create metrics server
 	start = time.Now()
 	eng.MetricsServ = *metrics.Init()
+	eng.MetricsServ.Health.AddLivenessCheck("watcher", handlers.CheckerFunc(eng.CheckWatcher))
+	eng.MetricsServ.Health.AddLivenessCheck("suspender", handlers.CheckerFunc(eng.CheckSuspender))
+	eng.MetricsServ.Health.AddReadinessCheck("inventory", handlers.CheckerFunc(eng.CheckInventory))
 	// start metrics server
+	wg.Add(1)
 	go func() {
-		if err := eng.MetricsServ.Start(); err != nil {
+		defer wg.Done()
+		if err := eng.MetricsServ.Start(ctx); err != nil {
 			eng.Logger.Fatal().Err(err).Msg("metrics server failed")
 		}
 	}()
 	eng.Logger.Info().Msgf("metrics server successfully created in %s", time.Since(start))
 
-	// create the in-cluster config
-	start = time.Now()
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		eng.Logger.Fatal().Err(err).Msg("cannot create in-cluster configuration")
-	}
-	eng.Logger.Info().Msgf("in-cluster configuration successfully created in %s", time.Since(start))
+	eng.MetricsServ.Health.AddReadinessCheck("apiserver", handlers.CheckerFunc(engine.APIServerCheck(clientset)))
 
-	// disable k8s warnings
-	if eng.Options.NoKubeWarnings {
-		config.WarningHandler = rest.NoWarnings{}
-		eng.Logger.Info().Msgf("Kubernetes warnings disabled")
-	}
+	// in dry-run mode, nothing is written to the cluster: the transitions are
+	// not audited and the events are dropped, as they would describe changes
+	// that have not been done
+	if eng.DryRun != nil {
+		eng.Logger.Warn().Msg("dry-run mode enabled, the changes are only recorded")
+	} else {
+		// create the audit sink
+		eng.Audit, err = audit.New(auditOpt, clientset)
+		if err != nil {
+			eng.Logger.Fatal().Err(err).Msg("cannot create the audit sink")
+		}
+		if eng.Options.AuditSink != audit.SinkNone {
+			eng.Logger.Info().Msgf("audit sink '%s' successfully created", eng.Options.AuditSink)
+		}
 
-	// create the clientset
-	start = time.Now()
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		eng.Logger.Fatal().Err(err).Msg("cannot create the clientset")
+		// create the events recorder
+		eng.Recorder = engine.NewEventRecorder(clientset, eng.Options.ControllerName)
 	}
-	eng.Logger.Info().Msgf("clientset successfully created in %s", time.Since(start))
 
 	// create the keda client
 	kedaclient := &v1alpha1.KedaV1alpha1Client{}
@@ -148,27 +267,75 @@ func main() {
 			eng.Logger.Fatal().Err(err).Msg("cannot create the keda client")
 		}
 		eng.Logger.Info().Msgf("keda client successfully created in %s", time.Since(start))
+		eng.MetricsServ.Health.AddReadinessCheck("keda", handlers.CheckerFunc(engine.KedaCheck(kedaclient)))
 	} else {
 		eng.Logger.Info().Msg("keda is disabled")
 	}
 
+	// create the dynamic client, used for the custom resources of the
+	// controller
+	if eng.Options.PoliciesEnabled || eng.Options.SuspensionsEnabled {
+		start = time.Now()
+		dynclient, err := dynamic.NewForConfig(config)
+		if err != nil {
+			eng.Logger.Fatal().Err(err).Msg("cannot create the dynamic client")
+		}
+		eng.Logger.Info().Msgf("dynamic client successfully created in %s", time.Since(start))
+		if eng.Options.PoliciesEnabled {
+			eng.Policies = policy.NewClient(dynclient)
+		}
+		if eng.Options.SuspensionsEnabled {
+			eng.Suspensions = suspension.NewClient(dynclient)
+		}
+	}
+	if !eng.Options.PoliciesEnabled {
+		eng.Logger.Info().Msg("policies are disabled")
+	}
+	if !eng.Options.SuspensionsEnabled {
+		eng.Logger.Info().Msg("suspensions are disabled")
+	}
+
 	// create the AWS SDK client
 	var rdsclient *rds.Client
 	if eng.Options.AwsRdsEnabled {
 		// Load the Shared AWS Configuration (~/.aws/config)
-		cfg, err := awsconfig.LoadDefaultConfig(context.TODO())
+		var awsOpts []func(*awsconfig.LoadOptions) error
+		if tracingOpt.Enabled() {
+			awsOpts = append(awsOpts, awsconfig.WithHTTPClient(&http.Client{Transport: tracing.Transport(http.DefaultTransport)}))
+		}
+		cfg, err := awsconfig.LoadDefaultConfig(ctx, awsOpts...)
 		if err != nil {
 			eng.Logger.Fatal().Err(err).Msg("failed to load aws config")
 		}
 
 		rdsclient = rds.NewFromConfig(cfg)
+		eng.MetricsServ.Health.AddReadinessCheck("rds", handlers.CheckerFunc(engine.RDSCheck(rdsclient)))
 	}
 
 	eng.Logger.Info().Msgf("starting 'Watcher' and 'Suspender' routines")
-	ctx := context.Background()
-	go eng.Watcher(ctx, clientset)
-	go eng.Suspender(ctx, clientset, kedaclient, rdsclient)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		eng.Watcher(ctx, clientset, kedaclient)
+	}()
+	go func() {
+		defer wg.Done()
+		eng.Suspender(ctx, clientset, kedaclient, rdsclient)
+	}()
+
+	// the reloadable settings are applied when the configuration file changes
+	if eng.Options.ConfigFile != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchConfig(ctx, eng, os.Args[1:])
+		}()
+	}
 
-	// wait forever
-	select {}
+	// wait until we are asked to stop, then let the namespace being handled
+	// and the servers finish
+	<-ctx.Done()
+	eng.Logger.Info().Msgf("shutting down, waiting up to %s for the namespace being handled", eng.ShutdownTimeout)
+	wg.Wait()
+	eng.Logger.Info().Msg("shutdown complete")
 }
@@ -1,27 +1,53 @@
 package metrics
 
 import (
+	"context"
 	"net/http"
 	"time"
 
 	"github.com/govirtuo/kube-ns-suspender/handlers"
+	"github.com/govirtuo/kube-ns-suspender/server"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Server is the metrics server. It contains all the Prometheus metrics
 type Server struct {
-	Addr                  string
-	NotRespondingList     map[string]bool
-	WatchlistLength       prometheus.Gauge
-	Uptime                prometheus.Gauge
-	NumRunningNamspaces   prometheus.Gauge
-	NumSuspendedNamspaces prometheus.Gauge
-	NumUnknownNamespaces  prometheus.Gauge
+	Addr                       string
+	Health                     *handlers.Health
+	NotRespondingList          map[string]bool
+	WatchlistLength            prometheus.Gauge
+	Uptime                     prometheus.Gauge
+	NumRunningNamspaces        prometheus.Gauge
+	NumSuspendedNamspaces      prometheus.Gauge
+	NumUnknownNamespaces       prometheus.Gauge
+	NamespacesPhase            *prometheus.GaugeVec
+	NumStuckNamespaces         prometheus.Gauge
+	NamespaceState             *prometheus.GaugeVec
+	NamespacePhase             *prometheus.GaugeVec
+	Transitions                *prometheus.CounterVec
+	ConformityPatches          *prometheus.CounterVec
+	Errors                     *prometheus.CounterVec
+	ReconcileDuration          *prometheus.HistogramVec
+	NamespaceFailures          *prometheus.GaugeVec
+	NumBackoffNamespaces       prometheus.Gauge
+	DryRunChanges              *prometheus.GaugeVec
+	CircuitBreakerOpen         prometheus.Gauge
+	BudgetRunningNamespaces    *prometheus.GaugeVec
+	BudgetMaxRunningNamespaces *prometheus.GaugeVec
+	BudgetRunningHours         *prometheus.GaugeVec
+	BudgetMonthlyRunningHours  *prometheus.GaugeVec
+	BudgetRejections           *prometheus.GaugeVec
+	SavedSeconds               *prometheus.CounterVec
+	SavedCPUCoreHours          *prometheus.CounterVec
+	SavedMemoryGiBHours        *prometheus.CounterVec
+	SavedRDSInstanceHours      *prometheus.CounterVec
+	SavedCost                  *prometheus.CounterVec
 }
 
-// Init initializes the metrics
-func Init() *Server {
-	s := Server{
+// New returns the metrics, without registering them
+func New() *Server {
+	return &Server{
+		Health: handlers.NewHealth(),
 		Uptime: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "kube_ns_suspender_uptime_sec",
 			Help: "kube-ns-suspender uptime, in seconds.",
@@ -42,30 +68,147 @@ func Init() *Server {
 			Name: "kube_ns_suspender_unknown_namespaces",
 			Help: "Number of namespaces that have an unknown state",
 		}),
+		NamespacesPhase: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_namespaces_phase",
+			Help: "Number of namespaces observed in each phase",
+		}, []string{"phase"}),
+		NumStuckNamespaces: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_stuck_namespaces",
+			Help: "Number of namespaces suspending or resuming for longer than the transition timeout",
+		}),
+		NamespaceState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_namespace_state",
+			Help: "Desired state of each managed namespace, set to 1 for the current state",
+		}, []string{"namespace", "state"}),
+		NamespacePhase: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_namespace_phase",
+			Help: "Observed phase of each managed namespace, set to 1 for the current phase",
+		}, []string{"namespace", "phase"}),
+		Transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kube_ns_suspender_transitions_total",
+			Help: "Number of namespaces that reached their desired state, by reason of the transition",
+		}, []string{"reason", "state"}),
+		ConformityPatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kube_ns_suspender_conformity_patches_total",
+			Help: "Number of conformity checks that patched resources, by kind of resource",
+		}, []string{"kind"}),
+		Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kube_ns_suspender_errors_total",
+			Help: "Number of errors encountered while handling the namespaces, by kind of resource and operation",
+		}, []string{"namespace", "kind", "operation"}),
+		ReconcileDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kube_ns_suspender_reconcile_duration_seconds",
+			Help:    "Duration of each step of the handling of a namespace by the suspender",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"step"}),
+		NamespaceFailures: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_namespace_consecutive_failures",
+			Help: "Number of consecutive failed reconciliations of each managed namespace",
+		}, []string{"namespace"}),
+		NumBackoffNamespaces: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_backoff_namespaces",
+			Help: "Number of namespaces not reconciled until their retry time because their last reconciliation failed",
+		}),
+		DryRunChanges: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_dry_run_changes",
+			Help: "Number of changes that would have been done during the last handling of each namespace, in dry-run mode",
+		}, []string{"namespace", "kind", "action"}),
+		CircuitBreakerOpen: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_circuit_breaker_open",
+			Help: "1 if the circuit breaker is open and the automatic suspensions are paused, 0 otherwise",
+		}),
+		BudgetRunningNamespaces: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_budget_running_namespaces",
+			Help: "Number of namespaces of each team with a budget with the desired state Running",
+		}, []string{"team"}),
+		BudgetMaxRunningNamespaces: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_budget_max_running_namespaces",
+			Help: "Maximum number of running namespaces of each team, 0 if there is no limit",
+		}, []string{"team"}),
+		BudgetRunningHours: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_budget_running_hours",
+			Help: "Time spent running by the namespaces of each team with a budget during the current month, in hours",
+		}, []string{"team"}),
+		BudgetMonthlyRunningHours: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_budget_monthly_running_hours",
+			Help: "Monthly running hours budget of each team, 0 if there is no limit",
+		}, []string{"team"}),
+		BudgetRejections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kube_ns_suspender_budget_rejections",
+			Help: "Number of resumes rejected during the current month because the team of the namespace was over budget",
+		}, []string{"team"}),
+		SavedSeconds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kube_ns_suspender_savings_suspended_seconds_total",
+			Help: "Time spent suspended by each namespace, in seconds",
+		}, []string{"namespace"}),
+		SavedCPUCoreHours: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kube_ns_suspender_savings_cpu_core_hours_total",
+			Help: "CPU requests scaled away while the namespace was suspended, in core-hours",
+		}, []string{"namespace"}),
+		SavedMemoryGiBHours: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kube_ns_suspender_savings_memory_gib_hours_total",
+			Help: "Memory requests scaled away while the namespace was suspended, in GiB-hours",
+		}, []string{"namespace"}),
+		SavedRDSInstanceHours: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kube_ns_suspender_savings_rds_instance_hours_total",
+			Help: "RDS instances stopped while the namespace was suspended, in instance-hours",
+		}, []string{"namespace", "instance_class"}),
+		SavedCost: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kube_ns_suspender_savings_cost_total",
+			Help: "Estimated cost saved by suspending the namespace, using the configured pricing",
+		}, []string{"namespace"}),
 	}
+}
+
+// Init initializes the metrics and registers them
+func Init() *Server {
+	s := New()
 
 	prometheus.MustRegister(
 		s.Uptime,
 		s.WatchlistLength,
 		s.NumRunningNamspaces,
 		s.NumSuspendedNamspaces,
+		s.NumUnknownNamespaces,
+		s.NamespacesPhase,
+		s.NumStuckNamespaces,
+		s.NamespaceState,
+		s.NamespacePhase,
+		s.Transitions,
+		s.ConformityPatches,
+		s.Errors,
+		s.ReconcileDuration,
+		s.NamespaceFailures,
+		s.NumBackoffNamespaces,
+		s.DryRunChanges,
+		s.CircuitBreakerOpen,
+		s.BudgetRunningNamespaces,
+		s.BudgetMaxRunningNamespaces,
+		s.BudgetRunningHours,
+		s.BudgetMonthlyRunningHours,
+		s.BudgetRejections,
+		s.SavedSeconds,
+		s.SavedCPUCoreHours,
+		s.SavedMemoryGiBHours,
+		s.SavedRDSInstanceHours,
+		s.SavedCost,
 	)
 
 	// Start uptime counter
 	go s.uptimeCounter()
 
-	return &s
+	return s
 }
 
-// Start starts the prometheus server
-func (s *Server) Start() error {
+// Start starts the prometheus server. It is stopped when ctx is cancelled.
+func (s *Server) Start(ctx context.Context) error {
 	srv := &http.Server{
 		Addr:         ":2112",
-		Handler:      handlers.HandleFunc(),
+		Handler:      handlers.HandleFunc(s.Health),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
-	return srv.ListenAndServe()
+	return server.Serve(ctx, srv)
 }
 
 // goroutine to update the Uptime metric
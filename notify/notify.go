@@ -0,0 +1,166 @@
+// Package notify sends the changes of state of the namespaces to the
+// notification sinks of the configuration file (webhooks, Slack...).
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+)
+
+// Notification is a change of desired state of a namespace
+type Notification struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Origin    string    `json:"origin"`
+	Actor     string    `json:"actor,omitempty"`
+	Message   string    `json:"message,omitempty"`
+}
+
+// Text returns the notification as a sentence
+func (n Notification) Text() string {
+	s := fmt.Sprintf("Namespace %s changed from '%s' to '%s' (%s", n.Namespace, n.From, n.To, n.Origin)
+	if n.From == n.To {
+		s = fmt.Sprintf("Namespace %s is '%s' (%s", n.Namespace, n.To, n.Origin)
+	}
+	if n.Actor != "" {
+		s += " by " + n.Actor
+	}
+	s += ")"
+	if n.Message != "" {
+		s += ": " + n.Message
+	}
+	return s
+}
+
+// Sink is a destination of the notifications
+type Sink interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Notifier sends the notifications to all its sinks. The zero value has no
+// sink and drops them.
+type Notifier struct {
+	sinks []filtered
+}
+
+// filtered is a sink only receiving the transitions to some states
+type filtered struct {
+	name   string
+	states map[string]bool
+	sink   Sink
+}
+
+// New returns a notifier sending the notifications to the given sinks
+func New(sinks []config.Notification) (*Notifier, error) {
+	n := &Notifier{}
+	for _, c := range sinks {
+		f := filtered{name: c.Name, states: make(map[string]bool)}
+		for _, s := range c.States {
+			f.states[s] = true
+		}
+		switch c.Kind {
+		case config.NotificationWebhook:
+			f.sink = NewWebhookSink(c.URL)
+		case config.NotificationSlack:
+			f.sink = NewSlackSink(c.URL)
+		default:
+			return nil, fmt.Errorf("unknown notification sink kind '%s'", c.Kind)
+		}
+		n.sinks = append(n.sinks, f)
+	}
+	return n, nil
+}
+
+// Notify sends the notification to the sinks interested in it. All of them
+// are tried, and the errors are returned together.
+func (n *Notifier) Notify(ctx context.Context, notif Notification) error {
+	if n == nil {
+		return nil
+	}
+	var errs []string
+	for _, f := range n.sinks {
+		if len(f.states) > 0 && !f.states[notif.To] {
+			continue
+		}
+		if err := f.sink.Notify(ctx, notif); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", f.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// WebhookSink sends each notification as a JSON document to an HTTP endpoint
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink returns a sink posting the notifications to url
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify posts the notification to the webhook
+func (s *WebhookSink) Notify(ctx context.Context, n Notification) error {
+	return post(ctx, s.client, s.url, n)
+}
+
+// SlackSink sends the notifications as messages to a Slack incoming webhook
+type SlackSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewSlackSink returns a sink posting the notifications to the Slack incoming
+// webhook at url
+func NewSlackSink(url string) *SlackSink {
+	return &SlackSink{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify posts the notification to Slack
+func (s *SlackSink) Notify(ctx context.Context, n Notification) error {
+	return post(ctx, s.client, s.url, map[string]string{"text": n.Text()})
+}
+
+// post sends v as JSON to url
+func post(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+)
+
+func TestNotifier(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string][]map[string]interface{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		received[r.URL.Path] = append(received[r.URL.Path], body)
+		mu.Unlock()
+		if r.URL.Path == "/failing" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	n, err := New([]config.Notification{
+		{Name: "all", Kind: config.NotificationWebhook, URL: srv.URL + "/webhook"},
+		{Name: "suspended", Kind: config.NotificationSlack, URL: srv.URL + "/slack", States: []string{"Suspended"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := n.Notify(ctx, Notification{Namespace: "team-a", From: "Running", To: "Suspended", Origin: "schedule"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(ctx, Notification{Namespace: "team-a", From: "Suspended", To: "Running", Origin: "webui", Actor: "jane"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(received["/webhook"]); got != 2 {
+		t.Errorf("webhook received %d notifications, want 2", got)
+	}
+	if got := len(received["/slack"]); got != 1 {
+		t.Fatalf("slack received %d notifications, want 1", got)
+	}
+	if got, want := received["/slack"][0]["text"], "Namespace team-a changed from 'Running' to 'Suspended' (schedule)"; got != want {
+		t.Errorf("slack text = %q, want %q", got, want)
+	}
+
+	failing, err := New([]config.Notification{{Name: "failing", Kind: config.NotificationWebhook, URL: srv.URL + "/failing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := failing.Notify(ctx, Notification{Namespace: "team-a", To: "Running"}); err == nil {
+		t.Error("expected an error from a failing sink")
+	}
+
+	// a nil notifier drops the notifications
+	var none *Notifier
+	if err := none.Notify(ctx, Notification{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNotification_Text(t *testing.T) {
+	tests := []struct {
+		n    Notification
+		want string
+	}{
+		{
+			n:    Notification{Namespace: "team-a", From: "Suspended", To: "Running", Origin: "webui", Actor: "jane", Message: "demo"},
+			want: "Namespace team-a changed from 'Suspended' to 'Running' (webui by jane): demo",
+		},
+		{
+			n:    Notification{Namespace: "team-a", From: "Suspended", To: "Suspended", Origin: "stale", Message: "labelled stale"},
+			want: "Namespace team-a is 'Suspended' (stale): labelled stale",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.n.Text(); got != tt.want {
+			t.Errorf("Text() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/namsral/flag"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/govirtuo/kube-ns-suspender/engine"
+)
+
+// newFlagSet returns the flags of the controller, bound to opt
+func newFlagSet(opt *engine.Options) *flag.FlagSet {
+	fs := flag.NewFlagSetWithEnvPrefix(os.Args[0], "KUBE_NS_SUSPENDER", 0)
+	fs.StringVar(&opt.LogLevel, "log-level", "debug", "Log level")
+	fs.StringVar(&opt.TZ, "timezone", "Europe/Paris", "Timezone to use")
+	fs.StringVar(&opt.Prefix, "prefix", "kube-ns-suspender/", "Prefix to use for annotations")
+	fs.StringVar(&opt.ControllerName, "controller-name", "kube-ns-suspender", "Unique name of the controller")
+	fs.StringVar(&opt.RunningDuration, "running-duration", "4h", "Running duration")
+	fs.IntVar(&opt.WatcherIdle, "watcher-idle", 15, "Watcher idle duration (in seconds)")
+	fs.BoolVar(&opt.NoKubeWarnings, "no-kube-warnings", false, "Disable Kubernetes warnings")
+	fs.BoolVar(&opt.HumanLogs, "human", false, "Disable JSON logging")
+	fs.BoolVar(&opt.EmbeddedUI, "ui-embedded", false, "Start UI in background")
+	fs.BoolVar(&opt.WebUIOnly, "ui-only", false, "Start UI only")
+	fs.BoolVar(&opt.PProf, "pprof", false, "Start pprof server")
+	fs.StringVar(&opt.PProfAddr, "pprof-addr", ":4455", "Address and port to use with pprof")
+	fs.StringVar(&opt.SlackChannelName, "slack-channel-name", "", "Name of the help Slack channel in the UI bug page")
+	fs.StringVar(&opt.SlackChannelLink, "slack-channel-link", "", "Link of the helm Slack channel in the UI bug page")
+	fs.IntVar(&opt.WatchListSize, "watchlist-size", 512, "Size of the watchlist containing namespaces waiting to be handled")
+	fs.BoolVar(&opt.KedaEnabled, "keda-enabled", false, "Enable pausing of Keda.sh scaledobjects")
+	fs.BoolVar(&opt.AwsRdsEnabled, "rds-enabled", false, "Enable stop/start of associated AWS RDS clusters")
+	fs.StringVar(&opt.AwsRdsNamespaceTag, "rds-namespace-tag", "Namespace", "Tag key on AWS RDS clusters identifying associated namespace")
+	fs.StringVar(&opt.JobsPolicy, "jobs-policy", "wait", "What is done with the Jobs running in a namespace being suspended: wait (let them finish), suspend or delete")
+	fs.StringVar(&opt.AuditSink, "audit-sink", "", "Audit sink recording the state transitions (file, events or webhook)")
+	fs.StringVar(&opt.AuditFile, "audit-file", "/var/log/kube-ns-suspender/audit.jsonl", "Path of the audit file, used with the file audit sink")
+	fs.StringVar(&opt.AuditWebhookURL, "audit-webhook-url", "", "URL of the audit webhook, used with the webhook audit sink")
+	fs.StringVar(&opt.UIMaxRunningDuration, "ui-max-running-duration", "12h", "Maximum running duration that can be set from the web UI")
+	fs.StringVar(&opt.UITrustedProxies, "ui-trusted-proxies", "", "Comma separated IP addresses or networks of the authenticating proxies in front of the web UI, whose user headers are trusted")
+	fs.StringVar(&opt.PricingFile, "pricing-file", "", "Path of the YAML or JSON file holding the unit prices used to estimate the savings")
+	fs.StringVar(&opt.TracingEndpoint, "tracing-endpoint", "", "OTLP/HTTP endpoint (host:port) the traces are sent to. Tracing is disabled if empty")
+	fs.BoolVar(&opt.TracingInsecure, "tracing-insecure", false, "Send the traces without TLS")
+	fs.Float64Var(&opt.TracingSampleRatio, "tracing-sample-ratio", 1, "Ratio of the traces that are sampled, between 0 and 1")
+	fs.StringVar(&opt.ShutdownTimeout, "shutdown-timeout", "30s", "Maximum duration given to the namespace being handled to complete when stopping")
+	fs.StringVar(&opt.StallTimeout, "stall-timeout", "5m", "Duration without progress after which the watcher or the suspender are reported as stalled by /livez")
+	fs.StringVar(&opt.TransitionTimeout, "transition-timeout", "15m", "Duration after which a namespace still suspending or resuming is flagged as stuck")
+	fs.StringVar(&opt.MaxHookTimeout, "max-hook-timeout", "15m", "Maximum timeout of the pre-suspend and post-resume hooks")
+	fs.BoolVar(&opt.HookAnnotationsEnabled, "hook-annotations-enabled", false, "Let the namespaces declare their own pre-suspend and post-resume hooks with annotations")
+	fs.StringVar(&opt.Kubeconfig, "kubeconfig", "", "Path of the kubeconfig file. The in-cluster configuration is used if both --kubeconfig and --context are empty")
+	fs.StringVar(&opt.KubeContext, "context", "", "Kubeconfig context to use instead of the current one")
+	fs.Float64Var(&opt.KubeQPS, "kube-qps", 5, "Maximum number of requests per second sent to the API server")
+	fs.IntVar(&opt.KubeBurst, "kube-burst", 10, "Maximum burst of requests sent to the API server")
+	fs.BoolVar(&opt.DryRun, "dry-run", false, "Record the changes that would be done instead of doing them")
+	fs.StringVar(&opt.MaxBackoff, "max-backoff", "10m", "Maximum delay before retrying a namespace whose handling failed")
+	fs.BoolVar(&opt.PoliciesEnabled, "policies-enabled", false, "Apply the SuspendPolicy resources to the namespaces they select")
+	fs.BoolVar(&opt.SuspensionsEnabled, "suspensions-enabled", false, "Apply the NamespaceSuspension resources of the namespaces and report their state in them")
+	fs.StringVar(&opt.NamespaceSelector, "namespace-selector", "", "Label selector of the namespaces considered by the controller, applied by the API server")
+	fs.StringVar(&opt.IncludeNamespaces, "include-namespaces", "", "Comma separated name patterns of the namespaces considered by the controller. All of them if empty")
+	fs.StringVar(&opt.ExcludeNamespaces, "exclude-namespaces", "", "Comma separated name patterns of the namespaces ignored by the controller")
+	fs.BoolVar(&opt.OptInLabel, "opt-in-label", false, "Opt the namespaces in with the controllerName label instead of the annotation")
+	fs.StringVar(&opt.ProtectedNamespaces, "protected-namespaces", "kube-system,kube-public,kube-node-lease", "Comma separated name patterns of the namespaces that can never be suspended")
+	fs.IntVar(&opt.MaxSuspensions, "max-suspensions", 0, "Maximum number of namespaces suspended automatically within one inventory before the circuit breaker opens. No limit if 0")
+	fs.Float64Var(&opt.MaxSuspensionsPercent, "max-suspensions-percent", 0, "Maximum percentage of the managed namespaces suspended automatically within one inventory before the circuit breaker opens. No limit if 0")
+	fs.BoolVar(&opt.CircuitBreakerOverride, "circuit-breaker-override", false, "Do the automatic suspensions even if the circuit breaker is open")
+	fs.StringVar(&opt.TeamLabel, "team-label", "team", "Label of the namespaces holding the name of their team, used to apply the budgets")
+	fs.StringVar(&opt.BudgetAdmins, "budget-admins", "", "Comma separated web UI users, authenticated by the trusted proxies, allowed to resume a namespace whose team is over budget")
+	fs.StringVar(&opt.BudgetAdminFieldManagers, "budget-admin-field-managers", "", "Comma separated field managers allowed to resume a namespace whose team is over budget by editing its desiredState annotation")
+	fs.IntVar(&opt.StaleAfterDays, "stale-after-days", 0, "Number of days after which a suspended namespace is labelled stale. The stale namespaces are not cleaned up if 0")
+	fs.IntVar(&opt.StaleWarningDays, "stale-warning-days", 7, "Number of days before being labelled stale that the owners of a namespace are notified")
+	fs.IntVar(&opt.StaleGraceDays, "stale-grace-days", 14, "Number of days between the stale label and the stale action")
+	fs.StringVar(&opt.StaleAction, "stale-action", "none", "Action done on the stale namespaces after the grace period: none, delete or archive")
+	// it cannot be named "config", as the flag package would read the file
+	// as a list of flags
+	fs.StringVar(&opt.ConfigFile, "config-file", "", "Path of the YAML configuration file. The flags and environment variables take precedence over it")
+	return fs
+}
+
+// parseOptions reads the options from the arguments, the environment and the
+// configuration file, in this order of precedence
+func parseOptions(args []string) (engine.Options, error) {
+	var opt engine.Options
+	fs := newFlagSet(&opt)
+	if err := fs.Parse(args); err != nil {
+		return opt, err
+	}
+	if opt.ConfigFile == "" {
+		return opt, nil
+	}
+
+	cfg, err := config.Load(opt.ConfigFile)
+	if err != nil {
+		return opt, err
+	}
+	if err := cfg.Apply(fs); err != nil {
+		return opt, fmt.Errorf("%s: %w", opt.ConfigFile, err)
+	}
+	opt.Schedules = cfg.Schedules
+	opt.Profiles = cfg.Profiles
+	opt.ResourceRules = cfg.ResourceRules
+	opt.Notifications = cfg.Notifications
+	opt.Budgets = cfg.Budgets
+	return opt, nil
+}
+
+// watchConfig reloads the options each time the configuration file changes,
+// until ctx is cancelled. An invalid file is reported and ignored: the
+// engine keeps its current settings.
+func watchConfig(ctx context.Context, eng *engine.Engine, args []string) {
+	l := eng.Logger.With().Str("routine", "config").Logger()
+	err := config.Watch(ctx, l, eng.Options.ConfigFile, func() {
+		opt, err := parseOptions(args)
+		if err != nil {
+			l.Error().Err(err).Msg("cannot reload configuration, keeping the current one")
+			return
+		}
+		changed, err := eng.Reload(opt)
+		if err != nil {
+			l.Error().Err(err).Msg("cannot reload configuration, keeping the current one")
+			return
+		}
+		l.Info().Msg("configuration reloaded")
+		if len(changed) > 0 {
+			l.Warn().Msgf("options %s changed but are only applied after a restart", strings.Join(changed, ", "))
+		}
+	})
+	if err != nil {
+		l.Error().Err(err).Msg("configuration file changes will not be applied")
+	}
+}
@@ -0,0 +1,117 @@
+// Package policy holds the SuspendPolicy custom resource, which applies
+// schedules and settings to all the namespaces matching a label selector,
+// instead of annotating each of them.
+package policy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// those identify the SuspendPolicy custom resource
+const (
+	Group    = "kube-ns-suspender.govirtuo.com"
+	Version  = "v1alpha1"
+	Resource = "suspendpolicies"
+	Kind     = "SuspendPolicy"
+)
+
+// GroupVersionResource is the resource of the policies, used with the dynamic
+// client
+var GroupVersionResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: Resource}
+
+// SuspendPolicy applies settings to the namespaces matching its selector. It
+// is cluster scoped.
+type SuspendPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec Spec `json:"spec"`
+}
+
+// Spec is the specification of a policy. The annotations of a namespace take
+// precedence over it.
+type Spec struct {
+	// NamespaceSelector selects the namespaces the policy applies to. An
+	// empty selector selects all of them.
+	NamespaceSelector metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Priority orders the policies selecting the same namespace: the one with
+	// the highest priority applies, then the first one by name
+	Priority int `json:"priority,omitempty"`
+	// Schedules tell when the namespaces are suspended. The first one
+	// applying on the current day is used.
+	Schedules []config.Schedule `json:"schedules,omitempty"`
+	// RunningDuration replaces the running duration of the controller for
+	// the namespaces unsuspended manually
+	RunningDuration string `json:"runningDuration,omitempty"`
+	// ExcludedKinds are the kinds of resources (Deployment, StatefulSet,
+	// CronJob, Job or ScaledObject) left untouched in the namespaces
+	ExcludedKinds []string `json:"excludedKinds,omitempty"`
+	// Notifications are sinks notified of the changes of state of the
+	// namespaces, in addition to the ones of the configuration file
+	Notifications []config.Notification `json:"notifications,omitempty"`
+	// Hooks are run before the namespaces are suspended and after they are
+	// resumed
+	Hooks Hooks `json:"hooks,omitempty"`
+}
+
+// Hooks are run at fixed points of the suspension and the resume of a
+// namespace
+type Hooks struct {
+	// PreSuspend is run before the resources of the namespace are scaled
+	// down. The namespace is not suspended until it succeeds.
+	PreSuspend *Hook `json:"preSuspend,omitempty"`
+	// PostResume is run once the resources of the namespace are ready again
+	PostResume *Hook `json:"postResume,omitempty"`
+}
+
+// Hook is either a Job run in the namespace or an HTTP endpoint called by the
+// controller. The namespace is not suspended, or not reported running, until
+// it completes.
+type Hook struct {
+	// URL is called with a POST request. The hook succeeds if it answers
+	// with a 2xx status code.
+	URL string `json:"url,omitempty"`
+	// Job is the template of the Job created in the namespace. The hook
+	// succeeds once the Job has completed.
+	Job *batchv1.JobTemplateSpec `json:"job,omitempty"`
+	// Timeout is the maximum duration of the hook (e.g. 10m). It is 5m if
+	// empty, and capped by the --max-hook-timeout flag of the controller.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// Client lists the policies using the dynamic client, as the resource has no
+// generated clientset
+type Client struct {
+	client dynamic.Interface
+}
+
+// NewClient returns a client listing the policies
+func NewClient(client dynamic.Interface) *Client {
+	return &Client{client: client}
+}
+
+// List returns all the policies of the cluster
+func (c *Client) List(ctx context.Context) ([]SuspendPolicy, error) {
+	list, err := c.client.Resource(GroupVersionResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]SuspendPolicy, 0, len(list.Items))
+	for _, item := range list.Items {
+		var p SuspendPolicy
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &p); err != nil {
+			return nil, fmt.Errorf("cannot decode %s '%s': %w", Kind, item.GetName(), err)
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
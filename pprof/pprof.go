@@ -1,9 +1,11 @@
 package pprof
 
 import (
+	"context"
 	"net/http"
 	"time"
 
+	"github.com/govirtuo/kube-ns-suspender/server"
 	"github.com/rs/zerolog/log"
 
 	_ "net/http/pprof"
@@ -22,9 +24,9 @@ func New(addr string) (*Server, error) {
 	return &s, nil
 }
 
-// Run the pprof server
-func (p *Server) Run() {
-	if err := p.ListenAndServe(); err != nil {
+// Run the pprof server until ctx is cancelled
+func (p *Server) Run(ctx context.Context) {
+	if err := server.Serve(ctx, &p.Server); err != nil {
 		log.Fatal().Err(err).Msg("error running pprof server")
 	}
 }
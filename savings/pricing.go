@@ -0,0 +1,51 @@
+package savings
+
+import (
+	"fmt"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Pricing holds the unit prices used to convert the resources that have been
+// scaled away into a cost
+type Pricing struct {
+	// Currency is only used for display
+	Currency string `json:"currency"`
+	// CPUCoreHour is the price of one CPU core requested during one hour
+	CPUCoreHour float64 `json:"cpuCoreHour"`
+	// MemoryGiBHour is the price of one GiB of memory requested during one
+	// hour
+	MemoryGiBHour float64 `json:"memoryGiBHour"`
+	// RDSInstanceClassHour holds the price of one hour of each RDS instance
+	// class (db.r5.large...)
+	RDSInstanceClassHour map[string]float64 `json:"rdsInstanceClassHour"`
+}
+
+// LoadPricing reads the pricing from a YAML or JSON file. If path is empty,
+// all the prices are zero: the resources are still accounted, but without
+// cost.
+func LoadPricing(path string) (Pricing, error) {
+	var p Pricing
+	if path == "" {
+		return p, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return p, fmt.Errorf("cannot read pricing file: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(b, &p); err != nil {
+		return p, fmt.Errorf("cannot parse pricing file: %w", err)
+	}
+	return p, nil
+}
+
+// costOf returns the cost of a saving with the given pricing
+func (p Pricing) costOf(s Saving) float64 {
+	cost := s.CPUCoreHours*p.CPUCoreHour + s.MemoryGiBHours*p.MemoryGiBHour
+	for class, hours := range s.RDSInstanceHours {
+		cost += hours * p.RDSInstanceClassHour[class]
+	}
+	return cost
+}
@@ -0,0 +1,182 @@
+package savings
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Resources are the resources that are scaled away while a namespace is
+// suspended
+type Resources struct {
+	// CPU is the number of CPU cores requested by the pods
+	CPU float64 `json:"cpu"`
+	// MemoryGiB is the memory requested by the pods, in GiB
+	MemoryGiB float64 `json:"memoryGiB"`
+	// RDSInstances holds the number of stopped RDS instances of each class
+	RDSInstances map[string]int `json:"rdsInstances,omitempty"`
+}
+
+// Saving is what has been saved by suspending a namespace
+type Saving struct {
+	SuspendedSeconds float64            `json:"suspendedSeconds"`
+	CPUCoreHours     float64            `json:"cpuCoreHours"`
+	MemoryGiBHours   float64            `json:"memoryGiBHours"`
+	RDSInstanceHours map[string]float64 `json:"rdsInstanceHours,omitempty"`
+	Cost             float64            `json:"cost"`
+}
+
+// SuspendedHours returns the time spent suspended, in hours
+func (s Saving) SuspendedHours() float64 {
+	return s.SuspendedSeconds / 3600
+}
+
+// add adds the savings of o to s
+func (s *Saving) add(o Saving) {
+	s.SuspendedSeconds += o.SuspendedSeconds
+	s.CPUCoreHours += o.CPUCoreHours
+	s.MemoryGiBHours += o.MemoryGiBHours
+	s.Cost += o.Cost
+	for class, hours := range o.RDSInstanceHours {
+		if s.RDSInstanceHours == nil {
+			s.RDSInstanceHours = make(map[string]float64)
+		}
+		s.RDSInstanceHours[class] += hours
+	}
+}
+
+// NamespaceSaving is the saving of a namespace, as reported by the tracker
+type NamespaceSaving struct {
+	Namespace string    `json:"namespace"`
+	Suspended bool      `json:"suspended"`
+	Resources Resources `json:"resources"`
+	Saving
+}
+
+// Report is the savings of all the namespaces seen by the tracker
+type Report struct {
+	Currency   string            `json:"currency"`
+	Since      time.Time         `json:"since"`
+	Total      Saving            `json:"total"`
+	Namespaces []NamespaceSaving `json:"namespaces"`
+}
+
+// Tracker accounts the resources scaled away from the namespaces for as long
+// as they are suspended. It is safe for concurrent use.
+type Tracker struct {
+	mu         sync.Mutex
+	pricing    Pricing
+	since      time.Time
+	namespaces map[string]*entry
+}
+
+type entry struct {
+	suspended bool
+	resources Resources
+	last      time.Time
+	total     Saving
+}
+
+// NewTracker returns a new tracker using the given pricing
+func NewTracker(p Pricing) *Tracker {
+	return &Tracker{
+		pricing:    p,
+		since:      time.Now(),
+		namespaces: make(map[string]*entry),
+	}
+}
+
+// Suspended tells the tracker that the namespace is suspended and that the
+// given resources are scaled away. It returns what has been saved since the
+// last observation of the namespace.
+func (t *Tracker) Suspended(ns string, r Resources, now time.Time) Saving {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.entryOf(ns)
+	s := t.account(e, now)
+	e.suspended = true
+	e.resources = r
+	return s
+}
+
+// Running tells the tracker that the namespace is running. It returns what
+// has been saved since the last observation of the namespace.
+func (t *Tracker) Running(ns string, now time.Time) Saving {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.entryOf(ns)
+	s := t.account(e, now)
+	e.suspended = false
+	e.resources = Resources{}
+	return s
+}
+
+// Forget removes a namespace from the tracker
+func (t *Tracker) Forget(ns string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.namespaces, ns)
+}
+
+// Report returns the savings of all the namespaces, the most expensive ones
+// first
+func (t *Tracker) Report() Report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r := Report{
+		Currency:   t.pricing.Currency,
+		Since:      t.since,
+		Namespaces: make([]NamespaceSaving, 0, len(t.namespaces)),
+	}
+	for name, e := range t.namespaces {
+		r.Total.add(e.total)
+		r.Namespaces = append(r.Namespaces, NamespaceSaving{
+			Namespace: name,
+			Suspended: e.suspended,
+			Resources: e.resources,
+			Saving:    e.total,
+		})
+	}
+	sort.Slice(r.Namespaces, func(i, j int) bool {
+		if r.Namespaces[i].Cost != r.Namespaces[j].Cost {
+			return r.Namespaces[i].Cost > r.Namespaces[j].Cost
+		}
+		return r.Namespaces[i].Namespace < r.Namespaces[j].Namespace
+	})
+	return r
+}
+
+func (t *Tracker) entryOf(ns string) *entry {
+	e, ok := t.namespaces[ns]
+	if !ok {
+		e = &entry{}
+		t.namespaces[ns] = e
+	}
+	return e
+}
+
+// account adds to the entry what has been saved since its last observation,
+// and returns it
+func (t *Tracker) account(e *entry, now time.Time) Saving {
+	var s Saving
+	if e.suspended && now.After(e.last) {
+		elapsed := now.Sub(e.last)
+		hours := elapsed.Hours()
+		s.SuspendedSeconds = elapsed.Seconds()
+		s.CPUCoreHours = e.resources.CPU * hours
+		s.MemoryGiBHours = e.resources.MemoryGiB * hours
+		for class, count := range e.resources.RDSInstances {
+			if s.RDSInstanceHours == nil {
+				s.RDSInstanceHours = make(map[string]float64)
+			}
+			s.RDSInstanceHours[class] = float64(count) * hours
+		}
+		s.Cost = t.pricing.costOf(s)
+		e.total.add(s)
+	}
+	e.last = now
+	return s
+}
@@ -0,0 +1,165 @@
+package savings
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var pricing = Pricing{
+	Currency:             "EUR",
+	CPUCoreHour:          0.5,
+	MemoryGiBHour:        0.1,
+	RDSInstanceClassHour: map[string]float64{"db.r5.large": 2},
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestTracker(t *testing.T) {
+	start := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	r := Resources{CPU: 2, MemoryGiB: 4, RDSInstances: map[string]int{"db.r5.large": 1}}
+	tr := NewTracker(pricing)
+
+	if s := tr.Suspended("team-a", r, start); s.SuspendedSeconds != 0 || s.Cost != 0 {
+		t.Errorf("first observation saved %+v, want nothing", s)
+	}
+	// 2h suspended: 4 core-hours, 8 GiB-hours and 2 instance-hours
+	s := tr.Suspended("team-a", r, start.Add(2*time.Hour))
+	if s.SuspendedHours() != 2 || s.CPUCoreHours != 4 || s.MemoryGiBHours != 8 || s.RDSInstanceHours["db.r5.large"] != 2 {
+		t.Errorf("saved %+v, want 2h of the resources", s)
+	}
+	if want := 4*0.5 + 8*0.1 + 2*2.0; !almostEqual(s.Cost, want) {
+		t.Errorf("cost = %v, want %v", s.Cost, want)
+	}
+	// the time before the clock goes backwards is not accounted
+	if s := tr.Suspended("team-a", r, start.Add(time.Hour)); s.SuspendedSeconds != 0 {
+		t.Errorf("saved %+v when going back in time, want nothing", s)
+	}
+	// resumed 1h later: the hour is accounted, then nothing while running
+	if s := tr.Running("team-a", start.Add(2*time.Hour)); s.SuspendedHours() != 1 {
+		t.Errorf("saved %v hours when resumed, want 1", s.SuspendedHours())
+	}
+	if s := tr.Running("team-a", start.Add(5*time.Hour)); s.SuspendedSeconds != 0 {
+		t.Errorf("saved %+v while running, want nothing", s)
+	}
+
+	rep := tr.Report()
+	if len(rep.Namespaces) != 1 || rep.Namespaces[0].Suspended || rep.Namespaces[0].SuspendedHours() != 3 {
+		t.Fatalf("report = %+v, want team-a running after 3h suspended", rep.Namespaces)
+	}
+	if !reflect.DeepEqual(rep.Namespaces[0].Resources, Resources{}) {
+		t.Errorf("resources = %+v, want none while running", rep.Namespaces[0].Resources)
+	}
+
+	tr.Forget("team-a")
+	if rep := tr.Report(); len(rep.Namespaces) != 0 || rep.Total.SuspendedSeconds != 0 {
+		t.Errorf("report = %+v, want nothing once forgotten", rep)
+	}
+}
+
+func TestTracker_Report(t *testing.T) {
+	start := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	tr := NewTracker(pricing)
+	for name, cpu := range map[string]float64{"team-a": 1, "team-b": 4, "team-c": 1, "team-d": 0} {
+		tr.Suspended(name, Resources{CPU: cpu}, start)
+		tr.Suspended(name, Resources{CPU: cpu}, start.Add(time.Hour))
+	}
+	tr.Running("team-e", start)
+
+	rep := tr.Report()
+	if rep.Currency != "EUR" {
+		t.Errorf("currency = %q, want EUR", rep.Currency)
+	}
+	var names []string
+	for _, n := range rep.Namespaces {
+		names = append(names, n.Namespace)
+	}
+	// the most expensive first, then by name
+	if want := []string{"team-b", "team-a", "team-c", "team-d", "team-e"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("namespaces = %v, want %v", names, want)
+	}
+	if rep.Total.SuspendedHours() != 4 || rep.Total.CPUCoreHours != 6 || !almostEqual(rep.Total.Cost, 3) {
+		t.Errorf("total = %+v, want 4h suspended, 6 core-hours and a cost of 3", rep.Total)
+	}
+}
+
+func TestPricing_costOf(t *testing.T) {
+	tests := []struct {
+		name string
+		s    Saving
+		want float64
+	}{
+		{name: "nothing", want: 0},
+		{name: "cpu and memory", s: Saving{CPUCoreHours: 10, MemoryGiBHours: 20}, want: 7},
+		{name: "rds", s: Saving{RDSInstanceHours: map[string]float64{"db.r5.large": 3}}, want: 6},
+		{name: "unknown instance class", s: Saving{RDSInstanceHours: map[string]float64{"db.m6gd.large": 3}}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pricing.costOf(tt.s); !almostEqual(got, tt.want) {
+				t.Errorf("costOf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPricing(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Pricing
+		wantErr string
+	}{
+		{
+			name: "yaml",
+			content: `currency: EUR
+cpuCoreHour: 0.5
+memoryGiBHour: 0.1
+rdsInstanceClassHour:
+  db.r5.large: 2
+`,
+			want: pricing,
+		},
+		{
+			name:    "json",
+			content: `{"currency": "EUR", "cpuCoreHour": 0.5, "memoryGiBHour": 0.1, "rdsInstanceClassHour": {"db.r5.large": 2}}`,
+			want:    pricing,
+		},
+		{name: "unknown field", content: "cpuCoreHours: 0.5\n", wantErr: "cannot parse pricing file"},
+		{name: "invalid", content: "cpuCoreHour: [0.5\n", wantErr: "cannot parse pricing file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pricing")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadPricing(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadPricing() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadPricing() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if p, err := LoadPricing(""); err != nil || !reflect.DeepEqual(p, Pricing{}) {
+		t.Errorf("LoadPricing(\"\") = %+v, %v, want no prices", p, err)
+	}
+	if _, err := LoadPricing(filepath.Join(t.TempDir(), "missing")); err == nil || !strings.Contains(err.Error(), "cannot read pricing file") {
+		t.Errorf("LoadPricing() of a missing file error = %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+// Package server runs the HTTP servers of kube-ns-suspender (metrics, pprof
+// and web UI) until their context is cancelled.
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout is the maximum duration given to the active connections to
+// complete when the server is stopped
+const shutdownTimeout = 10 * time.Second
+
+// Serve runs the server until ctx is cancelled. It then stops accepting new
+// connections and waits for the active ones to complete before returning. It
+// returns nil if the server has been stopped this way.
+func Serve(ctx context.Context, srv *http.Server) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
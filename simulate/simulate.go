@@ -0,0 +1,302 @@
+// Package simulate replays the controller over a range of time against a set
+// of manifests, without any cluster. The engine runs against a fake clientset
+// and a fake clock that is moved forward step by step, and the transitions it
+// makes are returned as a timeline. It allows to validate schedule
+// annotations before applying them.
+package simulate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/audit"
+	"github.com/govirtuo/kube-ns-suspender/engine"
+	"github.com/govirtuo/kube-ns-suspender/metrics"
+	"github.com/govirtuo/kube-ns-suspender/policy"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// Actor is the user reported in the transitions done by the simulated users
+const Actor = "simulation"
+
+// TimeLayout is the layout of the times of the printed timeline. The timezone
+// abbreviation shows the DST changes.
+const TimeLayout = "Mon 2006-01-02 15:04 MST"
+
+// Options holds the configuration of a simulation
+type Options struct {
+	// From and To bound the simulated time range
+	From, To time.Time
+	// Step is the simulated duration between two inventories
+	Step time.Duration
+	// Resumes are the namespaces unsuspended by a user during the simulation
+	Resumes []Resume
+}
+
+// Resume is a namespace unsuspended by a user at a given time, as it would be
+// done from the web UI
+type Resume struct {
+	Namespace string
+	At        time.Time
+}
+
+// ParseResume parses a resume given as namespace@time. The time is parsed in
+// the local timezone with the given layout.
+func ParseResume(val, layout string) (Resume, error) {
+	i := strings.LastIndex(val, "@")
+	if i < 1 {
+		return Resume{}, fmt.Errorf("'%s' is not a valid resume, expected format is namespace@time", val)
+	}
+	at, err := time.ParseInLocation(layout, val[i+1:], time.Local)
+	if err != nil {
+		return Resume{}, fmt.Errorf("'%s' is not a valid resume time: %w", val, err)
+	}
+	return Resume{Namespace: val[:i], At: at}, nil
+}
+
+// Load decodes the YAML or JSON manifests read from r. A stream can hold
+// several documents. The SuspendPolicy resources are returned as unstructured
+// objects. The other objects that are not known by the Kubernetes client (like
+// KEDA scaledobjects) are ignored, as they are not simulated.
+func Load(r io.Reader) ([]runtime.Object, error) {
+	var objects []runtime.Object
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var raw runtime.RawExtension
+		if err := decoder.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return objects, nil
+			}
+			return nil, fmt.Errorf("cannot read manifest: %w", err)
+		}
+		raw.Raw = bytes.TrimSpace(raw.Raw)
+		if len(raw.Raw) == 0 || bytes.Equal(raw.Raw, []byte("null")) {
+			continue
+		}
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(raw.Raw, nil, nil)
+		if err != nil {
+			if runtime.IsNotRegisteredError(err) {
+				u := &unstructured.Unstructured{}
+				if err := u.UnmarshalJSON(raw.Raw); err == nil && u.GroupVersionKind() == policy.GroupVersionResource.GroupVersion().WithKind(policy.Kind) {
+					objects = append(objects, u)
+				}
+				continue
+			}
+			return nil, fmt.Errorf("cannot decode manifest: %w", err)
+		}
+		objects = append(objects, obj)
+	}
+}
+
+// Run replays the engine from opt.From to opt.To against the objects and
+// returns the transitions of desired state it made, in order. The engine
+// clock, audit sink and metrics are replaced by the simulation ones, and the
+// SuspendPolicy resources among the objects are applied without their
+// notifications. The hooks of the policies are not run.
+func Run(ctx context.Context, eng *engine.Engine, objects []runtime.Object, opt Options) ([]audit.Record, error) {
+	if opt.Step <= 0 {
+		return nil, errors.New("the simulation step must be positive")
+	}
+	if opt.To.Before(opt.From) {
+		return nil, errors.New("the end of the simulation cannot be before its start")
+	}
+
+	var policies, others []runtime.Object
+	for _, obj := range objects {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			u = u.DeepCopy()
+			unstructured.RemoveNestedField(u.Object, "spec", "notifications")
+			unstructured.RemoveNestedField(u.Object, "spec", "hooks")
+			policies = append(policies, u)
+			continue
+		}
+		others = append(others, obj)
+	}
+	if len(policies) > 0 {
+		listKinds := map[schema.GroupVersionResource]string{policy.GroupVersionResource: policy.Kind + "List"}
+		eng.Policies = policy.NewClient(dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, policies...))
+	}
+
+	clk := clocktesting.NewFakePassiveClock(opt.From)
+	timeline := &timeline{}
+	eng.Clock = clk
+	eng.Audit = timeline
+	eng.MetricsServ = *metrics.New()
+	sim := &simulation{
+		eng:     eng,
+		clock:   clk,
+		cs:      fake.NewSimpleClientset(others...),
+		manager: engine.FieldManager,
+	}
+	sim.cs.PrependReactor("update", "namespaces", sim.trackManagedFields)
+
+	resumes := make([]Resume, len(opt.Resumes))
+	copy(resumes, opt.Resumes)
+	sort.SliceStable(resumes, func(i, j int) bool { return resumes[i].At.Before(resumes[j].At) })
+
+	for now := opt.From; !now.After(opt.To); now = now.Add(opt.Step) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		clk.SetTime(now)
+
+		for len(resumes) > 0 && !resumes[0].At.After(now) {
+			if err := sim.resume(ctx, resumes[0].Namespace); err != nil {
+				return nil, err
+			}
+			resumes = resumes[1:]
+		}
+
+		// KEDA and RDS are not simulated, so their clients are never used
+		if err := eng.ReconcileOnce(ctx, sim.cs, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+	return timeline.records, nil
+}
+
+// simulation holds the state of a running simulation
+type simulation struct {
+	eng   *engine.Engine
+	clock *clocktesting.FakePassiveClock
+	cs    *fake.Clientset
+	// manager is the field manager of the namespaces updates. The fake
+	// clientset does not track them, while the engine relies on them to
+	// tell its own changes from the manual ones.
+	manager string
+}
+
+// resume sets the desired state of the namespace to Running on behalf of a
+// simulated user, as it would be done from the web UI
+func (sim *simulation) resume(ctx context.Context, name string) error {
+	n, err := sim.cs.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("cannot resume namespace %s: %w", name, err)
+	}
+	prefix := sim.eng.Options.Prefix
+	previous := n.Annotations[prefix+engine.DesiredState]
+	if previous == engine.Running {
+		return nil
+	}
+	if n.Annotations == nil {
+		n.Annotations = make(map[string]string)
+	}
+	n.Annotations[prefix+engine.DesiredState] = engine.Running
+
+	sim.manager = engine.WebUIFieldManager
+	_, err = sim.cs.CoreV1().Namespaces().Update(ctx, n, metav1.UpdateOptions{FieldManager: engine.WebUIFieldManager})
+	sim.manager = engine.FieldManager
+	if err != nil {
+		return fmt.Errorf("cannot resume namespace %s: %w", name, err)
+	}
+
+	return sim.eng.Audit.Write(ctx, audit.Record{
+		Time:      sim.clock.Now().Local(),
+		Namespace: name,
+		From:      previous,
+		To:        engine.Running,
+		Origin:    audit.OriginWebUI,
+		Actor:     Actor,
+	})
+}
+
+// trackManagedFields is a reactor recording the current field manager as the
+// manager of the annotations changed by a namespace update. It lets the
+// default reactor store the namespace.
+func (sim *simulation) trackManagedFields(action k8stesting.Action) (bool, runtime.Object, error) {
+	n, ok := action.(k8stesting.UpdateAction).GetObject().(*v1.Namespace)
+	if !ok {
+		return false, nil, nil
+	}
+	current, err := sim.cs.Tracker().Get(action.GetResource(), "", n.Name)
+	if err != nil {
+		return false, nil, nil
+	}
+	old := current.(*v1.Namespace).Annotations
+
+	fields := make(map[string]struct{})
+	for k, v := range n.Annotations {
+		if ov, ok := old[k]; !ok || ov != v {
+			fields["f:"+k] = struct{}{}
+		}
+	}
+	if len(fields) == 0 {
+		return false, nil, nil
+	}
+	raw, err := json.Marshal(map[string]map[string]map[string]struct{}{"f:metadata": {"f:annotations": fields}})
+	if err != nil {
+		return false, nil, nil
+	}
+	n.ManagedFields = append(n.ManagedFields, metav1.ManagedFieldsEntry{
+		Manager:    sim.manager,
+		Operation:  metav1.ManagedFieldsOperationUpdate,
+		Time:       &metav1.Time{Time: sim.clock.Now()},
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: raw},
+	})
+	return false, nil, nil
+}
+
+// Print writes the timeline as a table
+func Print(w io.Writer, records []audit.Record) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tNAMESPACE\tFROM\tTO\tORIGIN\tMESSAGE")
+	for _, r := range records {
+		from := r.From
+		if from == "" {
+			from = "-"
+		}
+		msg := r.Message
+		if r.Actor != "" {
+			msg = strings.TrimSpace(fmt.Sprintf("%s (by %s)", msg, r.Actor))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.Local().Format(TimeLayout), r.Namespace, from, r.To, r.Origin, msg)
+	}
+	return tw.Flush()
+}
+
+// timeline is an audit sink keeping the records in memory
+type timeline struct {
+	mu      sync.Mutex
+	records []audit.Record
+}
+
+// Write appends the record to the timeline
+func (t *timeline) Write(_ context.Context, r audit.Record) error {
+	t.mu.Lock()
+	t.records = append(t.records, r)
+	t.mu.Unlock()
+	return nil
+}
+
+// History returns the records of the namespace, the most recent first
+func (t *timeline) History(_ context.Context, namespace string, limit int) ([]audit.Record, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var records []audit.Record
+	for i := len(t.records) - 1; i >= 0 && len(records) < limit; i-- {
+		if t.records[i].Namespace == namespace {
+			records = append(records, t.records[i])
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,341 @@
+package simulate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/audit"
+	"github.com/govirtuo/kube-ns-suspender/engine"
+
+	_ "time/tzdata"
+)
+
+const manifests = `apiVersion: v1
+kind: Namespace
+metadata:
+  name: team-a
+  annotations:
+    kube-ns-suspender/controllerName: kube-ns-suspender
+    kube-ns-suspender/dailySuspendTime: "2:30AM"
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: team-b
+  annotations:
+    kube-ns-suspender/controllerName: kube-ns-suspender
+    kube-ns-suspender/desiredState: Suspended
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  namespace: team-b
+  annotations:
+    kube-ns-suspender/originalReplicas: "2"
+spec:
+  replicas: 0
+  selector:
+    matchLabels:
+      app: api
+  template:
+    metadata:
+      labels:
+        app: api
+    spec:
+      containers:
+      - name: api
+        image: nginx
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: other
+  annotations:
+    kube-ns-suspender/controllerName: another-controller
+---
+apiVersion: keda.sh/v1alpha1
+kind: ScaledObject
+metadata:
+  name: worker
+  namespace: team-b
+`
+
+func TestLoad(t *testing.T) {
+	objects, err := Load(strings.NewReader(manifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the scaledobject is not known by the Kubernetes client
+	if len(objects) != 4 {
+		t.Errorf("got %d objects, want 4", len(objects))
+	}
+
+	if _, err := Load(strings.NewReader("kind: [")); err == nil {
+		t.Error("expected an error with an invalid manifest")
+	}
+}
+
+func TestRun(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := time.Local
+	time.Local = loc
+	t.Cleanup(func() { time.Local = local })
+
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02T15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	tests := []struct {
+		name    string
+		opt     Options
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "daily suspend time",
+			opt:  Options{From: at("2024-03-20T01:00"), To: at("2024-03-20T04:00"), Step: time.Minute},
+			want: []string{
+				"Wed 2024-03-20 01:00 CET team-a - Running controller",
+				"Wed 2024-03-20 02:30 CET team-a Running Suspended schedule",
+			},
+		},
+		{
+			// the clock jumps from 2:00 to 3:00, so 2:30 never happens and
+			// the namespace is suspended as soon as it is past
+			name: "daily suspend time skipped by DST",
+			opt:  Options{From: at("2024-03-31T01:00"), To: at("2024-03-31T04:00"), Step: time.Minute},
+			want: []string{
+				"Sun 2024-03-31 01:00 CET team-a - Running controller",
+				"Sun 2024-03-31 03:00 CEST team-a Running Suspended schedule",
+			},
+		},
+		{
+			// the running duration is added to the time of the resume, so it
+			// ends after midnight
+			name: "next suspend time after midnight",
+			opt: Options{From: at("2024-03-20T21:00"), To: at("2024-03-21T03:00"), Step: time.Minute,
+				Resumes: []Resume{{Namespace: "team-b", At: at("2024-03-20T22:00")}}},
+			want: []string{
+				"Wed 2024-03-20 21:00 CET team-a - Running controller",
+				"Wed 2024-03-20 21:01 CET team-a Running Suspended schedule",
+				"Wed 2024-03-20 22:00 CET team-b Suspended Running webui",
+				"Thu 2024-03-21 02:01 CET team-b Running Suspended nextSuspendTime",
+			},
+		},
+		{
+			// 4h of running duration end 5 hours later on the wall clock
+			name: "next suspend time over DST",
+			opt: Options{From: at("2024-03-30T23:00"), To: at("2024-03-31T06:00"), Step: time.Minute,
+				Resumes: []Resume{{Namespace: "team-b", At: at("2024-03-31T00:30")}}},
+			want: []string{
+				"Sat 2024-03-30 23:00 CET team-a - Running controller",
+				"Sat 2024-03-30 23:01 CET team-a Running Suspended schedule",
+				"Sun 2024-03-31 00:30 CET team-b Suspended Running webui",
+				"Sun 2024-03-31 05:31 CEST team-b Running Suspended nextSuspendTime",
+			},
+		},
+		{
+			name:    "invalid range",
+			opt:     Options{From: at("2024-03-20T02:00"), To: at("2024-03-20T01:00"), Step: time.Minute},
+			wantErr: true,
+		},
+		{
+			name:    "invalid step",
+			opt:     Options{From: at("2024-03-20T01:00"), To: at("2024-03-20T02:00")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, err := Load(strings.NewReader(manifests))
+			if err != nil {
+				t.Fatal(err)
+			}
+			eng, err := engine.New(engine.Options{
+				WatchListSize:        1,
+				LogLevel:             "disabled",
+				Prefix:               "kube-ns-suspender/",
+				ControllerName:       "kube-ns-suspender",
+				RunningDuration:      "4h",
+				UIMaxRunningDuration: "0s",
+				TransitionTimeout:    "15m",
+				StallTimeout:         "0s",
+				ShutdownTimeout:      "0s",
+				MaxBackoff:           "10m",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records, err := Run(context.Background(), eng, objects, tt.opt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got := make([]string, 0, len(records))
+			for _, r := range records {
+				got = append(got, format(r))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Run() timeline:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+const policyManifests = `apiVersion: kube-ns-suspender.govirtuo.com/v1alpha1
+kind: SuspendPolicy
+metadata:
+  name: previews
+spec:
+  namespaceSelector:
+    matchLabels:
+      env: preview
+  schedules:
+  - dailySuspendTime: 9:00PM
+    days: [Mon, Tue, Wed, Thu, Fri]
+  runningDuration: 1h
+  notifications:
+  - name: unreachable
+    kind: webhook
+    url: http://127.0.0.1:1
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: preview-1
+  labels:
+    env: preview
+  annotations:
+    kube-ns-suspender/controllerName: kube-ns-suspender
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  namespace: preview-1
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: api
+  template:
+    metadata:
+      labels:
+        app: api
+    spec:
+      containers:
+      - name: api
+        image: nginx
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: preview-2
+  labels:
+    env: preview
+  annotations:
+    kube-ns-suspender/controllerName: kube-ns-suspender
+    kube-ns-suspender/dailySuspendTime: 8:00PM
+`
+
+func TestRunWithPolicy(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := time.Local
+	time.Local = loc
+	t.Cleanup(func() { time.Local = local })
+
+	objects, err := Load(strings.NewReader(policyManifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 4 {
+		t.Fatalf("got %d objects, want 4", len(objects))
+	}
+	eng, err := engine.New(engine.Options{
+		WatchListSize:        1,
+		LogLevel:             "disabled",
+		Prefix:               "kube-ns-suspender/",
+		ControllerName:       "kube-ns-suspender",
+		RunningDuration:      "4h",
+		UIMaxRunningDuration: "0s",
+		TransitionTimeout:    "15m",
+		StallTimeout:         "0s",
+		ShutdownTimeout:      "0s",
+		MaxBackoff:           "10m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// from a Friday evening to the Saturday evening, when the schedule of the
+	// policy does not apply
+	opt := Options{
+		From:    time.Date(2024, time.March, 22, 19, 0, 0, 0, loc),
+		To:      time.Date(2024, time.March, 23, 22, 0, 0, 0, loc),
+		Step:    time.Minute,
+		Resumes: []Resume{{Namespace: "preview-1", At: time.Date(2024, time.March, 23, 10, 0, 0, 0, loc)}},
+	}
+	records, err := Run(context.Background(), eng, objects, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"Fri 2024-03-22 19:00 CET preview-1 - Running controller",
+		"Fri 2024-03-22 19:00 CET preview-2 - Running controller",
+		"Fri 2024-03-22 20:00 CET preview-2 Running Suspended schedule",
+		"Fri 2024-03-22 21:00 CET preview-1 Running Suspended schedule",
+		"Sat 2024-03-23 10:00 CET preview-1 Suspended Running webui",
+		"Sat 2024-03-23 11:01 CET preview-1 Running Suspended nextSuspendTime",
+	}
+	got := make([]string, 0, len(records))
+	for _, r := range records {
+		got = append(got, format(r))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Run() timeline:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseResume(t *testing.T) {
+	r, err := ParseResume("team-a@2024-03-20T22:00", "2006-01-02T15:04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Namespace != "team-a" || r.At.Hour() != 22 {
+		t.Errorf("ParseResume() = %+v", r)
+	}
+
+	for _, val := range []string{"team-a", "@2024-03-20T22:00", "team-a@tomorrow"} {
+		if _, err := ParseResume(val, "2006-01-02T15:04"); err == nil {
+			t.Errorf("ParseResume(%s) expected an error", val)
+		}
+	}
+}
+
+func format(r audit.Record) string {
+	from := r.From
+	if from == "" {
+		from = "-"
+	}
+	return fmt.Sprintf("%s %s %s %s %s", r.Time.Local().Format(TimeLayout), r.Namespace, from, r.To, r.Origin)
+}
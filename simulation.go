@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/namsral/flag"
+
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/govirtuo/kube-ns-suspender/engine"
+	"github.com/govirtuo/kube-ns-suspender/simulate"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// simulationTimeLayout is the layout of the times given to the simulate
+// subcommand, in the simulated timezone
+const simulationTimeLayout = "2006-01-02T15:04"
+
+// resumes holds the values of the repeatable --resume flag
+type resumes []string
+
+func (r *resumes) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *resumes) Set(val string) error {
+	*r = append(*r, val)
+	return nil
+}
+
+// simulation runs the simulate subcommand: the namespaces of the manifests
+// given as arguments are replayed over a time range, and the timeline of the
+// transitions the controller would make is printed
+func simulation(args []string) {
+	var opt engine.Options
+	var from, to, step string
+	var res resumes
+
+	fs := flag.NewFlagSetWithEnvPrefix(os.Args[0]+" simulate", "KUBE_NS_SUSPENDER", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s simulate [flags] manifest.yaml [manifest.yaml...]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opt.LogLevel, "log-level", "disabled", "Log level of the simulated controller")
+	fs.StringVar(&opt.TZ, "timezone", "Europe/Paris", "Timezone to use")
+	fs.StringVar(&opt.Prefix, "prefix", "kube-ns-suspender/", "Prefix to use for annotations")
+	fs.StringVar(&opt.ControllerName, "controller-name", "kube-ns-suspender", "Unique name of the controller")
+	fs.StringVar(&opt.NamespaceSelector, "namespace-selector", "", "Label selector of the namespaces considered by the controller")
+	fs.StringVar(&opt.IncludeNamespaces, "include-namespaces", "", "Comma separated name patterns of the namespaces considered by the controller. All of them if empty")
+	fs.StringVar(&opt.ExcludeNamespaces, "exclude-namespaces", "", "Comma separated name patterns of the namespaces ignored by the controller")
+	fs.BoolVar(&opt.OptInLabel, "opt-in-label", false, "Opt the namespaces in with the controllerName label instead of the annotation")
+	fs.StringVar(&opt.RunningDuration, "running-duration", "4h", "Running duration")
+	fs.StringVar(&opt.TransitionTimeout, "transition-timeout", "15m", "Duration after which a namespace still suspending or resuming is flagged as stuck")
+	fs.StringVar(&opt.MaxBackoff, "max-backoff", "10m", "Maximum delay before retrying a namespace whose handling failed")
+	fs.StringVar(&from, "from", "", "Start of the simulation ("+simulationTimeLayout+"), now if empty")
+	fs.StringVar(&to, "to", "", "End of the simulation ("+simulationTimeLayout+"), 48h after the start if empty")
+	fs.StringVar(&step, "step", "1m", "Simulated duration between two inventories")
+	fs.StringVar(&opt.ConfigFile, "config-file", "", "Path of the YAML configuration file holding the schedules, profiles and resource rules. Its options are ignored")
+	fs.Var(&res, "resume", "Namespace unsuspended by a user, as namespace@"+simulationTimeLayout+". Can be repeated")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal().Err(err).Msg("cannot parse flags")
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// those are not used by the simulation but are required by the engine
+	opt.WatchListSize = 1
+	opt.UIMaxRunningDuration = "0s"
+	opt.StallTimeout = "0s"
+	opt.ShutdownTimeout = "0s"
+
+	var err error
+	time.Local, err = time.LoadLocation(opt.TZ)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot load timezone")
+	}
+
+	simOpt := simulate.Options{From: time.Now().Truncate(time.Minute)}
+	if from != "" {
+		if simOpt.From, err = time.ParseInLocation(simulationTimeLayout, from, time.Local); err != nil {
+			log.Fatal().Err(err).Msg("cannot parse simulation start")
+		}
+	}
+	simOpt.To = simOpt.From.Add(48 * time.Hour)
+	if to != "" {
+		if simOpt.To, err = time.ParseInLocation(simulationTimeLayout, to, time.Local); err != nil {
+			log.Fatal().Err(err).Msg("cannot parse simulation end")
+		}
+	}
+	if simOpt.Step, err = time.ParseDuration(step); err != nil {
+		log.Fatal().Err(err).Msg("cannot parse simulation step")
+	}
+	for _, val := range res {
+		r, err := simulate.ParseResume(val, simulationTimeLayout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("cannot parse resume")
+		}
+		simOpt.Resumes = append(simOpt.Resumes, r)
+	}
+
+	// only the structures of the configuration file are used, its options
+	// are the ones of the controller
+	if opt.ConfigFile != "" {
+		cfg, err := config.Load(opt.ConfigFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("cannot load configuration file")
+		}
+		opt.Schedules = cfg.Schedules
+		opt.Profiles = cfg.Profiles
+		opt.ResourceRules = cfg.ResourceRules
+	}
+
+	var objects []runtime.Object
+	for _, path := range fs.Args() {
+		objs, err := loadManifests(path)
+		if err != nil {
+			log.Fatal().Err(err).Str("manifest", path).Msg("cannot load manifest")
+		}
+		objects = append(objects, objs...)
+	}
+
+	eng, err := engine.New(opt)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot create new engine")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	records, err := simulate.Run(ctx, eng, objects, simOpt)
+	if err != nil {
+		log.Fatal().Err(err).Msg("simulation failed")
+	}
+	if err := simulate.Print(os.Stdout, records); err != nil {
+		log.Fatal().Err(err).Msg("cannot print timeline")
+	}
+}
+
+// loadManifests reads the manifests of the given file, or of the standard
+// input if path is "-"
+func loadManifests(path string) ([]runtime.Object, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return simulate.Load(r)
+}
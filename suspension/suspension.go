@@ -0,0 +1,117 @@
+// Package suspension holds the NamespaceSuspension custom resource, a typed
+// alternative to the annotations of the namespaces. A managed namespace can
+// hold one NamespaceSuspension: its spec is applied to the annotations of the
+// namespace when it changes, and its status reports the state of the
+// namespace as seen by the controller.
+package suspension
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/govirtuo/kube-ns-suspender/policy"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// those identify the NamespaceSuspension custom resource. It belongs to the
+// same group as the policies.
+const (
+	Group    = policy.Group
+	Version  = "v1alpha1"
+	Resource = "namespacesuspensions"
+	Kind     = "NamespaceSuspension"
+)
+
+// GroupVersionResource is the resource of the suspensions, used with the
+// dynamic client
+var GroupVersionResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: Resource}
+
+// NamespaceSuspension describes the suspension of the namespace it belongs to
+type NamespaceSuspension struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   Spec   `json:"spec,omitempty"`
+	Status Status `json:"status,omitempty"`
+}
+
+// Spec holds the values of the annotations of the namespace. The empty fields
+// leave the annotations as they are.
+type Spec struct {
+	// DesiredState is the state requested for the namespace, Running or
+	// Suspended. It is applied when the spec changes, and the namespace
+	// can then be suspended by its schedule as usual: the current desired
+	// state is in the status.
+	DesiredState string `json:"desiredState,omitempty"`
+	// DailySuspendTime follows the format of the dailySuspendTime annotation
+	// (e.g. 8:15PM)
+	DailySuspendTime string `json:"dailySuspendTime,omitempty"`
+	// Schedule and Profile refer to the schedules and profiles of the
+	// configuration file, as the schedule and profile annotations
+	Schedule string `json:"schedule,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+}
+
+// Status is the state of the namespace, maintained by the controller
+type Status struct {
+	// ObservedGeneration is the generation of the last spec applied to the
+	// namespace
+	ObservedGeneration   int64             `json:"observedGeneration,omitempty"`
+	DesiredState         string            `json:"desiredState,omitempty"`
+	ObservedState        string            `json:"observedState,omitempty"`
+	LastTransitionTime   string            `json:"lastTransitionTime,omitempty"`
+	LastTransitionReason string            `json:"lastTransitionReason,omitempty"`
+	LastError            string            `json:"lastError,omitempty"`
+	Resources            []ManagedResource `json:"resources,omitempty"`
+}
+
+// ManagedResource is a resource of the namespace managed by the controller
+type ManagedResource struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// Client reads and updates the suspensions using the dynamic client, as the
+// resource has no generated clientset
+type Client struct {
+	client dynamic.Interface
+}
+
+// NewClient returns a client of the suspensions
+func NewClient(client dynamic.Interface) *Client {
+	return &Client{client: client}
+}
+
+// List returns the suspensions of all the namespaces
+func (c *Client) List(ctx context.Context) ([]NamespaceSuspension, error) {
+	list, err := c.client.Resource(GroupVersionResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	suspensions := make([]NamespaceSuspension, 0, len(list.Items))
+	for _, item := range list.Items {
+		var s NamespaceSuspension
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &s); err != nil {
+			return nil, fmt.Errorf("cannot decode %s '%s/%s': %w", Kind, item.GetNamespace(), item.GetName(), err)
+		}
+		suspensions = append(suspensions, s)
+	}
+	return suspensions, nil
+}
+
+// UpdateStatus saves the status of the suspension
+func (c *Client) UpdateStatus(ctx context.Context, s *NamespaceSuspension, fieldManager string) error {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(s)
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{Object: obj}
+	u.SetGroupVersionKind(GroupVersionResource.GroupVersion().WithKind(Kind))
+	_, err = c.client.Resource(GroupVersionResource).Namespace(s.Namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{FieldManager: fieldManager})
+	return err
+}
@@ -0,0 +1,108 @@
+// Package tracing sets up the OpenTelemetry tracing of kube-ns-suspender and
+// provides helpers to create spans. Tracing is disabled unless an OTLP
+// endpoint is configured, in which case the helpers do nothing.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the tracer used by kube-ns-suspender
+const instrumentationName = "github.com/govirtuo/kube-ns-suspender"
+
+// Options holds the tracing configuration
+type Options struct {
+	// Endpoint is the host:port of the OTLP/HTTP collector. Tracing is
+	// disabled if it is empty.
+	Endpoint string
+	// Insecure disables TLS when sending the spans to the collector
+	Insecure bool
+	// SampleRatio is the ratio of the traces that are sampled, between 0 and
+	// 1
+	SampleRatio    float64
+	ServiceName    string
+	ServiceVersion string
+}
+
+// Enabled returns true if the tracing is configured
+func (opt Options) Enabled() bool {
+	return opt.Endpoint != ""
+}
+
+// Setup configures the global tracer provider to export the spans to the OTLP
+// endpoint. The returned function flushes the pending spans and must be called
+// before exiting.
+func Setup(ctx context.Context, opt Options) (func(context.Context) error, error) {
+	if !opt.Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	clientOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opt.Endpoint)}
+	if opt.Insecure {
+		clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String(opt.ServiceName),
+		semconv.ServiceVersionKey.String(opt.ServiceVersion),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opt.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// Start starts a new span, child of the span of the context if any
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends the span, recording the error if it is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Logger adds the trace and span IDs of the context to the logger, so the
+// logs can be correlated with the traces
+func Logger(ctx context.Context, l zerolog.Logger) zerolog.Logger {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return l
+	}
+	return l.With().Str("trace_id", sc.TraceID().String()).Str("span_id", sc.SpanID().String()).Logger()
+}
+
+// Transport wraps an HTTP transport to create a span for each request. It is
+// used to trace the calls to the Kubernetes and AWS APIs.
+func Transport(rt http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(rt)
+}
@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func Test_spans(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+
+	ctx, parent := Start(context.Background(), "reconcile", attribute.String("namespace", "foo"))
+	_, child := Start(ctx, "check deployments")
+	End(child, errors.New("cannot patch"))
+	End(parent, nil)
+
+	spans := sr.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d ended spans, want 2", len(spans))
+	}
+	gotChild, gotParent := spans[0], spans[1]
+
+	if gotChild.Name() != "check deployments" || gotParent.Name() != "reconcile" {
+		t.Errorf("unexpected span names: got %s and %s", gotChild.Name(), gotParent.Name())
+	}
+	if gotChild.Parent().SpanID() != gotParent.SpanContext().SpanID() {
+		t.Errorf("child span is not a child of the parent span")
+	}
+	if gotChild.Status().Code != codes.Error || gotChild.Status().Description != "cannot patch" {
+		t.Errorf("unexpected child span status: %v", gotChild.Status())
+	}
+	if len(gotChild.Events()) != 1 {
+		t.Errorf("error has not been recorded on the child span")
+	}
+	if gotParent.Status().Code != codes.Unset {
+		t.Errorf("unexpected parent span status: %v", gotParent.Status())
+	}
+	if attrs := gotParent.Attributes(); len(attrs) != 1 || attrs[0] != attribute.String("namespace", "foo") {
+		t.Errorf("unexpected parent span attributes: %v", attrs)
+	}
+}
+
+func Test_Logger(t *testing.T) {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	var buf bytes.Buffer
+	l := zerolog.New(&buf)
+
+	withoutSpan := Logger(context.Background(), l)
+	withoutSpan.Info().Msg("without span")
+	if strings.Contains(buf.String(), "trace_id") {
+		t.Errorf("trace_id added without span: %s", buf.String())
+	}
+
+	buf.Reset()
+	ctx, span := Start(context.Background(), "inventory")
+	defer span.End()
+	withSpan := Logger(ctx, l)
+	withSpan.Info().Msg("with span")
+	want := `"trace_id":"` + span.SpanContext().TraceID().String() + `"`
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("got %s, want it to contain %s", buf.String(), want)
+	}
+}
+
+func Test_SetupDisabled(t *testing.T) {
+	shutdown, err := Setup(context.Background(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown failed: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/govirtuo/kube-ns-suspender/audit"
+	"github.com/govirtuo/kube-ns-suspender/engine"
+	"github.com/rs/zerolog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// apiResponse is the body returned by the API actions
+type apiResponse struct {
+	Namespaces []string `json:"namespaces,omitempty"`
+	State      string   `json:"state,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// apiListNamespaces returns the list of the namespaces managed by the
+// controller
+func (h handler) apiListNamespaces(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	namespaces, err := h.listManagedNamespaces(l.With().Str("page", "/api/v1/namespaces").Logger())
+	if err != nil {
+		l.Error().Err(err).Str("page", "/api/v1/namespaces").Msg("cannot list namespaces")
+		writeJSON(w, l, http.StatusInternalServerError, apiResponse{Error: err.Error()})
+		return
+	}
+	if namespaces == nil {
+		namespaces = []Namespace{}
+	}
+	writeJSON(w, l, http.StatusOK, namespaces)
+}
+
+// apiNamespaceAction suspends or unsuspends a single namespace
+func (h handler) apiNamespaceAction(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	vars := mux.Vars(r)
+	state, _ := actionToState(vars["action"])
+
+	if err := h.setState(r, l, vars["name"], state, audit.OriginAPI); err != nil {
+		l.Error().Err(err).Str("page", "/api/v1/namespaces").Str("namespace", vars["name"]).Msgf("cannot set namespace state to %s", state)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errNotManaged), apierrors.IsNotFound(err):
+			status = http.StatusNotFound
+		case errors.Is(err, errProtected), errors.Is(err, engine.ErrBudgetExceeded):
+			status = http.StatusForbidden
+		}
+		writeJSON(w, l, status, apiResponse{Error: err.Error()})
+		return
+	}
+	l.Info().Str("page", "/api/v1/namespaces").Str("namespace", vars["name"]).Msgf("namespace state set to %s using api", state)
+	writeJSON(w, l, http.StatusOK, apiResponse{Namespaces: []string{vars["name"]}, State: state})
+}
+
+// apiGroupAction suspends or unsuspends all the namespaces of a group
+func (h handler) apiGroupAction(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	vars := mux.Vars(r)
+	state, _ := actionToState(vars["action"])
+	gLogger := l.With().Str("page", "/api/v1/groups").Str("group", vars["group"]).Logger()
+
+	names, err := h.groupMembers(gLogger, vars["group"], state)
+	if err != nil {
+		gLogger.Error().Err(err).Msg("cannot list group members")
+		writeJSON(w, l, http.StatusInternalServerError, apiResponse{Error: err.Error()})
+		return
+	}
+	if len(names) == 0 {
+		writeJSON(w, l, http.StatusNotFound, apiResponse{Error: "group has no members"})
+		return
+	}
+
+	p, err := h.setNamespacesState(r, gLogger, names, state, audit.OriginAPI)
+	if errors.Is(err, engine.ErrBudgetExceeded) {
+		writeJSON(w, l, http.StatusForbidden, apiResponse{Namespaces: names, State: state, Error: p.ErrMsg})
+		return
+	}
+	if p.Error {
+		writeJSON(w, l, http.StatusInternalServerError, apiResponse{Namespaces: names, State: state, Error: p.ErrMsg})
+		return
+	}
+	writeJSON(w, l, http.StatusOK, apiResponse{Namespaces: names, State: state})
+}
+
+// apiNamespaceHistory returns the recorded state transitions of a namespace
+func (h handler) apiNamespaceHistory(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	name := mux.Vars(r)["name"]
+	records, err := h.audit.History(r.Context(), name, historyLimit)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, audit.ErrHistoryNotSupported) {
+			status = http.StatusNotImplemented
+		}
+		writeJSON(w, l, status, apiResponse{Error: err.Error()})
+		return
+	}
+	if records == nil {
+		records = []audit.Record{}
+	}
+	writeJSON(w, l, http.StatusOK, records)
+}
+
+// apiSavings returns the estimated savings of the namespaces. They are only
+// available when the web UI runs alongside the controller.
+func (h handler) apiSavings(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	if h.savings == nil {
+		writeJSON(w, l, http.StatusNotImplemented, apiResponse{Error: errSavingsNotAvailable.Error()})
+		return
+	}
+	writeJSON(w, l, http.StatusOK, h.savings.Report())
+}
+
+// errDryRunNotEnabled is returned when the changes recorded in dry-run mode are
+// requested while the controller is not in this mode
+var errDryRunNotEnabled = errors.New("dry-run mode is only available when the web UI is embedded in a controller started with --dry-run")
+
+// apiDryRun returns the changes that the controller would have done during the
+// last handling of each namespace, in dry-run mode
+func (h handler) apiDryRun(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	if h.dryRun == nil {
+		writeJSON(w, l, http.StatusNotImplemented, apiResponse{Error: errDryRunNotEnabled.Error()})
+		return
+	}
+	writeJSON(w, l, http.StatusOK, h.dryRun.Changes())
+}
+
+// errBreakerNotEnabled is returned when the circuit breaker is used while it
+// is not enabled
+var errBreakerNotEnabled = errors.New("the circuit breaker is only available when the web UI is embedded in a controller started with --max-suspensions or --max-suspensions-percent")
+
+// apiCircuitBreaker returns the state of the circuit breaker
+func (h handler) apiCircuitBreaker(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	if h.breaker == nil {
+		writeJSON(w, l, http.StatusNotImplemented, apiResponse{Error: errBreakerNotEnabled.Error()})
+		return
+	}
+	writeJSON(w, l, http.StatusOK, h.breaker.Status())
+}
+
+// errNotAuthenticated is returned when an action restricted to the
+// authenticated users is requested by an anonymous one
+var errNotAuthenticated = errors.New("this action requires a user authenticated by a trusted proxy")
+
+// apiCircuitBreakerReset closes the circuit breaker, letting the automatic
+// suspensions that opened it through
+func (h handler) apiCircuitBreakerReset(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	if h.breaker == nil {
+		writeJSON(w, l, http.StatusNotImplemented, apiResponse{Error: errBreakerNotEnabled.Error()})
+		return
+	}
+	actor, authenticated := h.actorOf(r)
+	if !authenticated {
+		writeJSON(w, l, http.StatusForbidden, apiResponse{Error: errNotAuthenticated.Error()})
+		return
+	}
+	h.breaker.Reset()
+	l.Warn().Str("page", "/api/v1/circuit-breaker/reset").Str("actor", actor).Msg("circuit breaker reset")
+	writeJSON(w, l, http.StatusOK, h.breaker.Status())
+}
+
+// apiBudgets returns the consumption of the teams with a budget
+func (h handler) apiBudgets(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	if h.budgets == nil {
+		writeJSON(w, l, http.StatusNotImplemented, apiResponse{Error: errBudgetsNotEnabled.Error()})
+		return
+	}
+	writeJSON(w, l, http.StatusOK, h.budgets.Usage())
+}
+
+// errBudgetsNotEnabled is returned when the budgets are read from a web UI
+// that is not embedded in the controller, which tracks them
+var errBudgetsNotEnabled = errors.New("the budgets are only available when the web UI is embedded in the controller")
+
+// writeJSON writes v as the JSON body of the response
+func writeJSON(w http.ResponseWriter, l zerolog.Logger, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		l.Error().Err(err).Msg("cannot encode JSON response")
+	}
+}
@@ -0,0 +1,211 @@
+package webui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/engine"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// editPage displays the forms used to edit the schedule of a given namespace
+func (h handler) editPage(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	p := Page{
+		Version:            h.version,
+		BuildDate:          h.builddate,
+		MaxRunningDuration: h.maxRunningDuration.String(),
+	}
+
+	tmpl, err := template.ParseFS(assets, "assets/edit.html", "assets/_head.html",
+		"assets/_style.html", "assets/_navbar.html")
+	if err != nil {
+		l.Error().Err(err).Str("page", "/edit").Msg("cannot parse files")
+		http.Error(w, "cannot parse template files", http.StatusInternalServerError)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		p.Error = true
+		p.ErrMsg = "One 'name' parameter is accepted."
+	} else {
+		n, err := cs.CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			p.Error = true
+			p.ErrMsg = err.Error()
+		} else if !h.scope.Manages(*n) {
+			p.Error = true
+			p.ErrMsg = fmt.Sprintf("Namespace %s is not managed by %s.", name, h.controllerName)
+		} else {
+			p.CurrentNamespace = h.newNamespace(*n, l.With().Str("page", "/edit").Logger())
+		}
+	}
+
+	if err := tmpl.Execute(w, p); err != nil {
+		l.Error().Err(err).Str("page", "/edit").Msg("cannot execute template")
+	}
+}
+
+// editDailySuspendTime sets or clears the dailySuspendTime annotation of a
+// namespace
+func (h handler) editDailySuspendTime(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	h.handleEdit(w, r, l, "/edit/dailysuspendtime", func(n *v1.Namespace) (string, error) {
+		name := n.Name
+		if r.PostFormValue("action") == "clear" {
+			if _, err := patchNamespaceAnnotation(name, h.prefix+engine.DailySuspendTime, ""); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Daily suspend time of namespace %s successfully cleared.", name), nil
+		}
+
+		val := r.PostFormValue("dailySuspendTime")
+		dst, err := engine.ParseDailySuspendTime(val)
+		if err != nil {
+			return "", fmt.Errorf("'%s' is not a valid daily suspend time, expected format is '%s'", val, time.Kitchen)
+		}
+		if _, err := patchNamespaceAnnotation(name, h.prefix+engine.DailySuspendTime, dst.Format(time.Kitchen)); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Daily suspend time of namespace %s successfully set to %s.", name, dst.Format(time.Kitchen)), nil
+	})
+}
+
+// editExtend extends the running duration of a namespace by pushing its
+// nextSuspendTime annotation
+func (h handler) editExtend(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	h.handleEdit(w, r, l, "/edit/extend", func(n *v1.Namespace) (string, error) {
+		name := n.Name
+		d, err := time.ParseDuration(r.PostFormValue("duration"))
+		if err != nil || d <= 0 {
+			return "", fmt.Errorf("'%s' is not a valid duration", r.PostFormValue("duration"))
+		}
+
+		if n.Annotations[h.prefix+engine.DesiredState] != engine.Running {
+			return "", fmt.Errorf("namespace %s is not running", name)
+		}
+
+		// we extend from the current nextSuspendTime if it is still in the future,
+		// and from now otherwise
+		now := h.clock.Now().Local()
+		from := now
+		if val, ok := n.Annotations[h.prefix+engine.NextSuspendTime]; ok {
+			if nst, err := engine.ParseNextSuspendTime(val); err == nil && nst.After(now) {
+				from = nst
+			}
+		}
+
+		nst := from.Add(d)
+		if err := h.checkNextSuspendTime(nst, now); err != nil {
+			return "", err
+		}
+		if _, err := patchNamespaceAnnotation(name, h.prefix+engine.NextSuspendTime, nst.Format(time.RFC822Z)); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Namespace %s will now be suspended at %s.", name, nst.Format(time.RFC822)), nil
+	})
+}
+
+// editNextSuspendTime sets a one-off suspend time on a namespace
+func (h handler) editNextSuspendTime(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	h.handleEdit(w, r, l, "/edit/nextsuspendtime", func(n *v1.Namespace) (string, error) {
+		name := n.Name
+		val := r.PostFormValue("nextSuspendTime")
+		t, err := time.ParseInLocation(nextSuspendTimeInputLayout, val, time.Local)
+		if err != nil {
+			return "", fmt.Errorf("'%s' is not a valid date", val)
+		}
+
+		// the value is written using the same format as the one read by the
+		// engine, so we make sure that it can be parsed back
+		nst, err := engine.ParseNextSuspendTime(t.Format(time.RFC822Z))
+		if err != nil {
+			return "", err
+		}
+
+		if n.Annotations[h.prefix+engine.DesiredState] != engine.Running {
+			return "", fmt.Errorf("namespace %s is not running", name)
+		}
+
+		if err := h.checkNextSuspendTime(nst, h.clock.Now().Local()); err != nil {
+			return "", err
+		}
+		if _, err := patchNamespaceAnnotation(name, h.prefix+engine.NextSuspendTime, nst.Format(time.RFC822Z)); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Namespace %s will now be suspended at %s.", name, nst.Format(time.RFC822)), nil
+	})
+}
+
+// editNamespace runs the edit function on the namespace if the controller
+// manages it and it is not protected
+func (h handler) editNamespace(r *http.Request, name string, edit func(n *v1.Namespace) (string, error)) (string, error) {
+	n, err := cs.CoreV1().Namespaces().Get(r.Context(), name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if !h.scope.Manages(*n) {
+		return "", fmt.Errorf("%w: %s", errNotManaged, name)
+	}
+	if h.scope.Protected(name) {
+		return "", fmt.Errorf("%w: %s", errProtected, name)
+	}
+	return edit(n)
+}
+
+// checkNextSuspendTime ensures that nst is in the future and within the
+// maximum running duration allowed from the web UI
+func (h handler) checkNextSuspendTime(nst, now time.Time) error {
+	if !nst.After(now) {
+		return errors.New("the suspend time must be in the future")
+	}
+	if nst.Sub(now) > h.maxRunningDuration {
+		return fmt.Errorf("a namespace cannot be kept running for more than %s from now", h.maxRunningDuration)
+	}
+	return nil
+}
+
+// handleEdit contains the logic shared by all the edition forms: it checks the
+// 'name' form value, loads the namespace, runs the edit function and renders
+// the result page. The namespaces that are not managed by the controller, and
+// the protected ones, cannot be edited.
+func (h handler) handleEdit(w http.ResponseWriter, r *http.Request, l zerolog.Logger, page string, edit func(n *v1.Namespace) (string, error)) {
+	p := Page{
+		Version:   h.version,
+		BuildDate: h.builddate,
+	}
+
+	tmpl, err := template.ParseFS(assets, "assets/action.html", "assets/_head.html",
+		"assets/_style.html", "assets/_navbar.html")
+	if err != nil {
+		l.Error().Err(err).Str("page", page).Msg("cannot parse files")
+		http.Error(w, "cannot parse template files", http.StatusInternalServerError)
+		return
+	}
+
+	name := r.PostFormValue("name")
+	if name == "" {
+		p.Error = true
+		p.ErrMsg = "One 'name' parameter is accepted."
+	} else {
+		p.CurrentNamespace = Namespace{Name: name}
+		msg, err := h.editNamespace(r, name, edit)
+		if err != nil {
+			p.Error = true
+			p.ErrMsg = err.Error()
+		} else {
+			p.HasMessage = true
+			p.Message = msg
+			l.Info().Str("page", page).Str("namespace", name).Msg(msg)
+		}
+	}
+
+	if err := tmpl.Execute(w, p); err != nil {
+		l.Error().Err(err).Str("page", page).Msg("cannot execute template")
+	}
+}
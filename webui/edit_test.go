@@ -0,0 +1,174 @@
+package webui
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/govirtuo/kube-ns-suspender/engine"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+const testPrefix = "kube-ns-suspender/"
+
+func Test_editDailySuspendTime(t *testing.T) {
+	scope, err := engine.NewScope(engine.Options{Prefix: testPrefix, ControllerName: "kube-ns-suspender", ProtectedNamespaces: "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handler{prefix: testPrefix, controllerName: "kube-ns-suspender", scope: scope, maxRunningDuration: 12 * time.Hour}
+	managed := map[string]string{testPrefix + engine.ControllerName: "kube-ns-suspender"}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErr     string
+	}{
+		{name: "team-a", annotations: managed},
+		{name: "kube-system", wantErr: "not managed"},
+		{name: "prod", annotations: managed, wantErr: "protected"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs = fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: tt.name, Annotations: tt.annotations}})
+			form := url.Values{"name": {tt.name}, "dailySuspendTime": {"7:00PM"}}
+			r := httptest.NewRequest(http.MethodPost, "/edit/dailysuspendtime", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			h.editDailySuspendTime(w, r, zerolog.Nop())
+
+			n, err := cs.CoreV1().Namespaces().Get(context.Background(), tt.name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := n.Annotations[testPrefix+engine.DailySuspendTime]
+			if tt.wantErr == "" {
+				if got != "7:00PM" {
+					t.Errorf("dailySuspendTime = %q, want 7:00PM", got)
+				}
+				return
+			}
+			if got != "" {
+				t.Errorf("dailySuspendTime = %q, want the namespace left untouched", got)
+			}
+			if body := w.Body.String(); !strings.Contains(body, tt.wantErr) {
+				t.Errorf("page does not tell the namespace is %s:\n%s", tt.wantErr, body)
+			}
+		})
+	}
+}
+
+// editTest is a case of the tests of the edition forms of the suspend time
+type editTest struct {
+	name        string
+	namespace   string
+	annotations map[string]string
+	form        url.Values
+	// want is the nextSuspendTime expected, the namespace being left
+	// untouched if empty
+	want    time.Time
+	wantErr string
+}
+
+// runEditTests posts the form of each test to the edition handler, and checks
+// the nextSuspendTime annotation of the namespace
+func runEditTests(t *testing.T, page string, edit func(h handler) loggingHandlerFunc, now time.Time, tests []editTest) {
+	t.Helper()
+	scope, err := engine.NewScope(engine.Options{Prefix: testPrefix, ControllerName: "kube-ns-suspender", ProtectedNamespaces: "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handler{prefix: testPrefix, controllerName: "kube-ns-suspender", scope: scope, maxRunningDuration: 12 * time.Hour,
+		clock: clocktesting.NewFakePassiveClock(now)}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := tt.namespace
+			if name == "" {
+				name = "team-a"
+			}
+			annotations := map[string]string{}
+			if name != "kube-system" {
+				annotations[testPrefix+engine.ControllerName] = "kube-ns-suspender"
+			}
+			for k, v := range tt.annotations {
+				annotations[testPrefix+k] = v
+			}
+			cs = fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations}})
+			form := url.Values{"name": {name}}
+			for k, v := range tt.form {
+				form[k] = v
+			}
+			r := httptest.NewRequest(http.MethodPost, page, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			edit(h)(w, r, zerolog.Nop())
+
+			n, err := cs.CoreV1().Namespaces().Get(context.Background(), name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := n.Annotations[testPrefix+engine.NextSuspendTime]
+			if tt.wantErr == "" {
+				if want := tt.want.Format(time.RFC822Z); got != want {
+					t.Errorf("nextSuspendTime = %q, want %q", got, want)
+				}
+				return
+			}
+			if got != tt.annotations[engine.NextSuspendTime] {
+				t.Errorf("nextSuspendTime = %q, want the namespace left untouched", got)
+			}
+			if body := w.Body.String(); !strings.Contains(body, tt.wantErr) {
+				t.Errorf("page does not tell %q:\n%s", tt.wantErr, body)
+			}
+		})
+	}
+}
+
+func Test_editExtend(t *testing.T) {
+	now := time.Date(2024, time.March, 11, 18, 0, 0, 0, time.Local)
+	running := map[string]string{engine.DesiredState: engine.Running}
+	extend := func(d string) url.Values { return url.Values{"duration": {d}} }
+
+	runEditTests(t, "/edit/extend", func(h handler) loggingHandlerFunc { return h.editExtend }, now, []editTest{
+		{name: "from now", annotations: running, form: extend("2h"), want: now.Add(2 * time.Hour)},
+		{name: "from the next suspend time", form: extend("2h"), want: now.Add(5 * time.Hour),
+			annotations: map[string]string{engine.DesiredState: engine.Running, engine.NextSuspendTime: now.Add(3 * time.Hour).Format(time.RFC822Z)}},
+		{name: "from now once the next suspend time is past", form: extend("2h"), want: now.Add(2 * time.Hour),
+			annotations: map[string]string{engine.DesiredState: engine.Running, engine.NextSuspendTime: now.Add(-3 * time.Hour).Format(time.RFC822Z)}},
+		{name: "over the maximum", annotations: running, form: extend("13h"), wantErr: "more than 12h0m0s"},
+		{name: "over the maximum from the next suspend time", form: extend("2h"), wantErr: "more than 12h0m0s",
+			annotations: map[string]string{engine.DesiredState: engine.Running, engine.NextSuspendTime: now.Add(11 * time.Hour).Format(time.RFC822Z)}},
+		{name: "invalid duration", annotations: running, form: extend("-1h"), wantErr: "not a valid duration"},
+		{name: "not running", annotations: map[string]string{engine.DesiredState: engine.Suspended}, form: extend("2h"), wantErr: "not running"},
+		{name: "not managed", namespace: "kube-system", annotations: running, form: extend("2h"), wantErr: "not managed"},
+		{name: "protected", namespace: "prod", annotations: running, form: extend("2h"), wantErr: "protected"},
+	})
+}
+
+func Test_editNextSuspendTime(t *testing.T) {
+	now := time.Date(2024, time.March, 11, 18, 0, 0, 0, time.Local)
+	running := map[string]string{engine.DesiredState: engine.Running}
+	at := func(t time.Time) url.Values {
+		return url.Values{"nextSuspendTime": {t.Format(nextSuspendTimeInputLayout)}}
+	}
+
+	runEditTests(t, "/edit/nextsuspendtime", func(h handler) loggingHandlerFunc { return h.editNextSuspendTime }, now, []editTest{
+		{name: "within the maximum", annotations: running, form: at(now.Add(3 * time.Hour)), want: now.Add(3 * time.Hour)},
+		{name: "over the maximum", annotations: running, form: at(now.Add(13 * time.Hour)), wantErr: "more than 12h0m0s"},
+		{name: "in the past", annotations: running, form: at(now.Add(-time.Hour)), wantErr: "must be in the future"},
+		{name: "invalid date", annotations: running, form: url.Values{"nextSuspendTime": {"tomorrow"}}, wantErr: "not a valid date"},
+		{name: "not running", annotations: map[string]string{engine.DesiredState: engine.Suspended}, form: at(now.Add(3 * time.Hour)), wantErr: "not running"},
+		{name: "not managed", namespace: "kube-system", annotations: running, form: at(now.Add(3 * time.Hour)), wantErr: "not managed"},
+		{name: "protected", namespace: "prod", annotations: running, form: at(now.Add(3 * time.Hour)), wantErr: "protected"},
+	})
+}
@@ -0,0 +1,155 @@
+package webui
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/govirtuo/kube-ns-suspender/audit"
+	"github.com/govirtuo/kube-ns-suspender/engine"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
+)
+
+// bulkPage handles the POST requests done by users to suspend or unsuspend
+// all the namespaces selected on the home page
+func (h handler) bulkPage(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "cannot parse form", http.StatusBadRequest)
+		return
+	}
+
+	state, ok := actionToState(r.PostForm.Get("action"))
+	if !ok {
+		h.renderAction(w, l, "/bulk", Page{Error: true, ErrMsg: "Action must be either 'suspend' or 'unsuspend'."})
+		return
+	}
+
+	names := r.PostForm["names"]
+	if len(names) == 0 {
+		h.renderAction(w, l, "/bulk", Page{Error: true, ErrMsg: "You must select at least one namespace."})
+		return
+	}
+
+	p, _ := h.setNamespacesState(r, l.With().Str("page", "/bulk").Logger(), names, state, audit.OriginWebUI)
+	h.renderAction(w, l, "/bulk", p)
+}
+
+// groupPage handles the requests done by users to suspend or unsuspend all the
+// namespaces of a group
+func (h handler) groupPage(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	state, _ := actionToState(mux.Vars(r)["action"])
+
+	group := r.URL.Query().Get("name")
+	if group == "" {
+		h.renderAction(w, l, "/group", Page{Error: true, ErrMsg: "One 'name' parameter is accepted."})
+		return
+	}
+
+	names, err := h.groupMembers(l, group, state)
+	if err != nil {
+		h.renderAction(w, l, "/group", Page{Error: true, ErrMsg: err.Error()})
+		return
+	}
+	if len(names) == 0 {
+		h.renderAction(w, l, "/group", Page{Error: true, ErrMsg: fmt.Sprintf("Group %s has no members.", group)})
+		return
+	}
+
+	p, _ := h.setNamespacesState(r, l.With().Str("page", "/group").Str("group", group).Logger(), names, state, audit.OriginWebUI)
+	h.renderAction(w, l, "/group", p)
+}
+
+// setNamespacesState sets the desired state of all the given namespaces and
+// returns a page summarizing the results. The namespaces resumed together are
+// admitted at once: if they do not fit in the budgets of their teams, none is
+// resumed and the refusal is returned.
+func (h handler) setNamespacesState(r *http.Request, l zerolog.Logger, names []string, state string, origin audit.Origin) (Page, error) {
+	var p Page
+	var failed []string
+	var namespaces []v1.Namespace
+	for _, name := range names {
+		n, err := h.namespaceFor(r, name, state)
+		if err != nil {
+			l.Error().Err(err).Str("namespace", name).Msgf("cannot set namespace state to %s", state)
+			failed = append(failed, fmt.Sprintf("%s (%s)", name, err))
+			continue
+		}
+		namespaces = append(namespaces, *n)
+	}
+
+	if state == engine.Running {
+		if err := h.admit(r, namespaces); err != nil {
+			l.Error().Err(err).Msg("cannot resume namespaces")
+			return Page{Error: true, ErrMsg: "Cannot resume namespaces: " + err.Error()}, err
+		}
+	}
+	for _, n := range namespaces {
+		if err := h.writeState(r, l, n.Name, state, origin); err != nil {
+			h.release(n)
+			l.Error().Err(err).Str("namespace", n.Name).Msgf("cannot set namespace state to %s", state)
+			failed = append(failed, fmt.Sprintf("%s (%s)", n.Name, err))
+			continue
+		}
+		l.Info().Str("namespace", n.Name).Msgf("namespace state set to %s using %s", state, origin)
+	}
+
+	if len(failed) > 0 {
+		p.Error = true
+		p.ErrMsg = "Cannot update namespaces: " + strings.Join(failed, ", ")
+	}
+	if len(failed) < len(names) {
+		p.HasMessage = true
+		p.Message = fmt.Sprintf("%d namespace(s) successfully set to %s.", len(names)-len(failed), state)
+	}
+	return p, nil
+}
+
+// groupMembers returns the names of the managed namespaces that belong to the
+// given group and can be set to the given state: the protected members are
+// left out of the suspensions, as the controller does
+func (h handler) groupMembers(l zerolog.Logger, group, state string) ([]string, error) {
+	namespaces, err := h.listManagedNamespaces(l)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, n := range namespaces {
+		if n.Group == group && !(state == engine.Suspended && h.scope.Protected(n.Name)) {
+			names = append(names, n.Name)
+		}
+	}
+	return names, nil
+}
+
+// renderAction renders the action page with the given content
+func (h handler) renderAction(w http.ResponseWriter, l zerolog.Logger, page string, p Page) {
+	p.Version = h.version
+	p.BuildDate = h.builddate
+
+	tmpl, err := template.ParseFS(assets, "assets/action.html", "assets/_head.html",
+		"assets/_style.html", "assets/_navbar.html")
+	if err != nil {
+		l.Error().Err(err).Str("page", page).Msg("cannot parse files")
+		http.Error(w, "cannot parse template files", http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, p); err != nil {
+		l.Error().Err(err).Str("page", page).Msg("cannot execute template")
+	}
+}
+
+// actionToState converts an action as found in the URLs into a desired state
+func actionToState(action string) (string, bool) {
+	switch action {
+	case "suspend":
+		return engine.Suspended, true
+	case "unsuspend":
+		return engine.Running, true
+	default:
+		return "", false
+	}
+}
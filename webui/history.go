@@ -0,0 +1,51 @@
+package webui
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+
+	"github.com/govirtuo/kube-ns-suspender/audit"
+	"github.com/rs/zerolog"
+)
+
+// historyLimit is the maximum number of transitions displayed for a namespace
+const historyLimit = 100
+
+// historyPage displays the timeline of the state transitions of a namespace
+func (h handler) historyPage(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	p := Page{
+		Version:   h.version,
+		BuildDate: h.builddate,
+	}
+
+	tmpl, err := template.ParseFS(assets, "assets/history.html", "assets/_head.html",
+		"assets/_style.html", "assets/_navbar.html")
+	if err != nil {
+		l.Error().Err(err).Str("page", "/history").Msg("cannot parse files")
+		http.Error(w, "cannot parse template files", http.StatusInternalServerError)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		p.Error = true
+		p.ErrMsg = "One 'name' parameter is accepted."
+	} else {
+		p.CurrentNamespace = Namespace{Name: name}
+		p.History, err = h.audit.History(r.Context(), name, historyLimit)
+		if err != nil {
+			p.Error = true
+			if errors.Is(err, audit.ErrHistoryNotSupported) {
+				p.ErrMsg = "History is not available with the configured audit sink."
+			} else {
+				l.Error().Err(err).Str("page", "/history").Str("namespace", name).Msg("cannot read history")
+				p.ErrMsg = err.Error()
+			}
+		}
+	}
+
+	if err := tmpl.Execute(w, p); err != nil {
+		l.Error().Err(err).Str("page", "/history").Msg("cannot execute template")
+	}
+}
@@ -0,0 +1,41 @@
+package webui
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+
+	"github.com/rs/zerolog"
+)
+
+// errSavingsNotAvailable is returned when the web UI runs without the
+// controller, which is the one tracking the savings
+var errSavingsNotAvailable = errors.New("savings are only available when the web UI is embedded in the controller")
+
+// savingsPage displays the estimated savings of the namespaces
+func (h handler) savingsPage(w http.ResponseWriter, r *http.Request, l zerolog.Logger) {
+	p := Page{
+		Version:   h.version,
+		BuildDate: h.builddate,
+	}
+
+	tmpl, err := template.ParseFS(assets, "assets/savings.html", "assets/_head.html",
+		"assets/_style.html", "assets/_navbar.html")
+	if err != nil {
+		l.Error().Err(err).Str("page", "/savings").Msg("cannot parse files")
+		http.Error(w, "cannot parse template files", http.StatusInternalServerError)
+		return
+	}
+
+	if h.savings == nil {
+		p.Error = true
+		p.ErrMsg = errSavingsNotAvailable.Error()
+	} else {
+		report := h.savings.Report()
+		p.Savings = &report
+	}
+
+	if err := tmpl.Execute(w, p); err != nil {
+		l.Error().Err(err).Str("page", "/savings").Msg("cannot execute template")
+	}
+}
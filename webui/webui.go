@@ -3,33 +3,44 @@ package webui
 import (
 	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/govirtuo/kube-ns-suspender/audit"
 	"github.com/govirtuo/kube-ns-suspender/engine"
+	"github.com/govirtuo/kube-ns-suspender/savings"
+	"github.com/govirtuo/kube-ns-suspender/server"
 	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/clock"
 )
 
 // assets holds our static web server assets.
+//
 //go:embed assets/*
 var assets embed.FS
 
 type Page struct {
-	Error, HasMessage bool
-	ErrMsg, Message   string
-	NamespacesList    NamespacesList
-	CurrentNamespace  Namespace
-	Version           string
-	BuildDate         string
-	SlackChannelName  string
-	SlackChannelLink  string
+	History            []audit.Record
+	Savings            *savings.Report
+	Error, HasMessage  bool
+	ErrMsg, Message    string
+	NamespacesList     NamespacesList
+	CurrentNamespace   Namespace
+	Version            string
+	BuildDate          string
+	SlackChannelName   string
+	SlackChannelLink   string
+	MaxRunningDuration string
 }
 
 type NamespacesList struct {
@@ -42,12 +53,19 @@ type UnsuspendedNamespace struct {
 }
 
 type Namespace struct {
-	Name             string
-	State            string
-	DailySuspendTime string
-	NextSuspendTime  string
+	Name             string `json:"name"`
+	State            string `json:"state"`
+	Phase            string `json:"phase,omitempty"`
+	LastError        string `json:"lastError,omitempty"`
+	Group            string `json:"group,omitempty"`
+	DailySuspendTime string `json:"dailySuspendTime"`
+	NextSuspendTime  string `json:"nextSuspendTime"`
 }
 
+// nextSuspendTimeInputLayout is the layout used by the HTML datetime-local
+// inputs, which do not carry any timezone information
+const nextSuspendTimeInputLayout = "2006-01-02T15:04"
+
 type loggingHandlerFunc = func(w http.ResponseWriter, r *http.Request, l zerolog.Logger)
 
 type loggingHandler struct {
@@ -60,66 +78,138 @@ type loggingHandler struct {
 type handler struct {
 	prefix             string
 	controllerName     string
+	scope              engine.Scope
 	version, builddate string
 	slackChannelName   string
 	slackChannelLink   string
+	maxRunningDuration time.Duration
+	audit              audit.Sink
+	savings            *savings.Tracker
+	dryRun             *engine.DryRun
+	breaker            *engine.Breaker
+	budgets            *engine.Budgets
+	clock              clock.PassiveClock
+	// trustedProxies are the networks of the authenticating proxies whose
+	// user headers are trusted
+	trustedProxies []*net.IPNet
+}
+
+// Options holds the configuration of the web UI
+type Options struct {
+	Port               string
+	Prefix             string
+	ControllerName     string
+	Scope              engine.Scope
+	Version, BuildDate string
+	SlackChannelName   string
+	SlackChannelLink   string
+	// MaxRunningDuration is the maximum running duration that can be set
+	// from the web UI
+	MaxRunningDuration time.Duration
+	Audit              audit.Options
+	Savings            *savings.Tracker
+	DryRun             *engine.DryRun
+	Breaker            *engine.Breaker
+	Budgets            *engine.Budgets
+	// Clock tells the time the suspend times are set from, the real time if
+	// nil
+	Clock clock.PassiveClock
+	// TrustedProxies are the comma separated IP addresses or networks of the
+	// authenticating proxies whose user headers are trusted
+	TrustedProxies string
 }
 
-var cs *kubernetes.Clientset
+var cs kubernetes.Interface
+
+// Start starts the webui HTTP server, using the given clientset to reach the
+// API server. It is stopped when ctx is cancelled.
+func Start(ctx context.Context, l zerolog.Logger, clientset *kubernetes.Clientset, opt Options) error {
+	cs = clientset
 
-// Start starts the webui HTTP server
-func Start(l zerolog.Logger, port, prefix, cn, v, bd, slackname, slacklink string) error {
-	// create the in-cluster config
-	config, err := rest.InClusterConfig()
+	proxies, err := parseTrustedProxies(opt.TrustedProxies)
 	if err != nil {
 		return err
 	}
 
-	// create the clientset
-	cs, err = kubernetes.NewForConfig(config)
+	// the web UI writes its own audit records, and reads them back to display
+	// the history of the namespaces
+	auditSink, err := audit.New(opt.Audit, cs)
 	if err != nil {
 		return err
 	}
 
 	srv := http.Server{
-		Addr:    ":" + port,
-		Handler: createRouter(l, prefix, cn, v, bd, slackname, slacklink),
+		Addr:    ":" + opt.Port,
+		Handler: createRouter(l, opt, auditSink, proxies),
 	}
-	if err := srv.ListenAndServe(); err != nil {
-		return err
-	}
-	return nil
+	return server.Serve(ctx, &srv)
 }
 
 // createRouter creates the router with all the HTTP routes.
 // It also passes different common values to the handlers
-func createRouter(l zerolog.Logger, prefix, cn, v, bd, slackname, slacklink string) *mux.Router {
+func createRouter(l zerolog.Logger, opt Options, auditSink audit.Sink, trustedProxies []*net.IPNet) *mux.Router {
 	r := mux.NewRouter()
 
-	if v == "" {
-		v = "n/a"
+	if opt.Version == "" {
+		opt.Version = "n/a"
 	}
 
 	// add a # in front of the slack channel if not present. This is purely
 	// for esthetics
-	if slackname != "" && slackname[0] != '#' {
-		slackname = "#" + slackname
+	if opt.SlackChannelName != "" && opt.SlackChannelName[0] != '#' {
+		opt.SlackChannelName = "#" + opt.SlackChannelName
+	}
+
+	if opt.Clock == nil {
+		opt.Clock = clock.RealClock{}
 	}
 
 	h := handler{
-		prefix:           prefix,
-		controllerName:   cn,
-		version:          v,
-		builddate:        bd,
-		slackChannelName: slackname,
-		slackChannelLink: slacklink,
+		prefix:             opt.Prefix,
+		controllerName:     opt.ControllerName,
+		scope:              opt.Scope,
+		version:            opt.Version,
+		builddate:          opt.BuildDate,
+		slackChannelName:   opt.SlackChannelName,
+		slackChannelLink:   opt.SlackChannelLink,
+		maxRunningDuration: opt.MaxRunningDuration,
+		audit:              auditSink,
+		savings:            opt.Savings,
+		dryRun:             opt.DryRun,
+		breaker:            opt.Breaker,
+		budgets:            opt.Budgets,
+		clock:              opt.Clock,
+		trustedProxies:     trustedProxies,
 	}
 
 	withLogger := loggingHandlerFactory(l)
 	r.Handle("/", withLogger(h.homePage)).Methods(http.MethodGet)
 	r.Handle("/suspend", withLogger(h.suspendPage)).Methods(http.MethodGet)
 	r.Handle("/unsuspend", withLogger(h.unsuspendPage)).Methods(http.MethodGet)
+	r.Handle("/bulk", withLogger(h.bulkPage)).Methods(http.MethodPost)
+	r.Handle("/group/{action:suspend|unsuspend}", withLogger(h.groupPage)).Methods(http.MethodGet)
+	r.Handle("/history", withLogger(h.historyPage)).Methods(http.MethodGet)
+	r.Handle("/edit", withLogger(h.editPage)).Methods(http.MethodGet)
+	r.Handle("/edit/dailysuspendtime", withLogger(h.editDailySuspendTime)).Methods(http.MethodPost)
+	r.Handle("/edit/extend", withLogger(h.editExtend)).Methods(http.MethodPost)
+	r.Handle("/edit/nextsuspendtime", withLogger(h.editNextSuspendTime)).Methods(http.MethodPost)
+	r.Handle("/savings", withLogger(h.savingsPage)).Methods(http.MethodGet)
 	r.Handle("/bug", withLogger(h.bugPage)).Methods(http.MethodGet)
+
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.Handle("/namespaces", withLogger(h.apiListNamespaces)).Methods(http.MethodGet)
+	api.Handle("/namespaces/{name}/history", withLogger(h.apiNamespaceHistory)).Methods(http.MethodGet)
+	api.Handle("/namespaces/{name}/{action:suspend|unsuspend}", withLogger(h.apiNamespaceAction)).Methods(http.MethodPost)
+	api.Handle("/groups/{group}/{action:suspend|unsuspend}", withLogger(h.apiGroupAction)).Methods(http.MethodPost)
+	api.Handle("/savings", withLogger(h.apiSavings)).Methods(http.MethodGet)
+	api.Handle("/dry-run", withLogger(h.apiDryRun)).Methods(http.MethodGet)
+	api.Handle("/circuit-breaker", withLogger(h.apiCircuitBreaker)).Methods(http.MethodGet)
+	// resetting the circuit breaker lets many suspensions through, so it is
+	// only possible for the users authenticated by a trusted proxy
+	if len(trustedProxies) > 0 {
+		api.Handle("/circuit-breaker/reset", withLogger(h.apiCircuitBreakerReset)).Methods(http.MethodPost)
+	}
+	api.Handle("/budgets", withLogger(h.apiBudgets)).Methods(http.MethodGet)
 	r.NotFoundHandler = withLogger(h.errorPage)
 
 	return r
@@ -156,7 +246,7 @@ func (h handler) unsuspendPage(w http.ResponseWriter, r *http.Request, l zerolog
 		p.Error = false
 		p.ErrMsg = "you must select a namespace"
 	} else {
-		err := patchNamespace(p.CurrentNamespace.Name, h.prefix, engine.Running)
+		err := h.setState(r, l, p.CurrentNamespace.Name, engine.Running, audit.OriginWebUI)
 		if err != nil {
 			p.Error = true
 			p.ErrMsg = err.Error()
@@ -212,7 +302,7 @@ func (h handler) suspendPage(w http.ResponseWriter, r *http.Request, l zerolog.L
 		p.Error = false
 		p.ErrMsg = "you must select a namespace"
 	} else {
-		err := patchNamespace(p.CurrentNamespace.Name, h.prefix, engine.Suspended)
+		err := h.setState(r, l, p.CurrentNamespace.Name, engine.Suspended, audit.OriginWebUI)
 		if err != nil {
 			p.Error = true
 			p.ErrMsg = err.Error()
@@ -281,75 +371,266 @@ func (h handler) homePage(w http.ResponseWriter, r *http.Request, l zerolog.Logg
 		l.Error().Err(err).Str("page", "/").Msg("cannot parse files")
 	}
 
-	namespaces, err := cs.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+	p := Page{
+		Version:   h.version,
+		BuildDate: h.builddate,
+	}
+
+	namespaces, err := h.listManagedNamespaces(l.With().Str("page", "/").Logger())
 	if err != nil {
 		l.Error().Err(err).Str("page", "/").Msg("cannot list namespaces")
 	}
+	p.NamespacesList.Namespaces = namespaces
+	err = tmpl.Execute(w, p)
+	if err != nil {
+		l.Error().Err(err).Str("page", "/").Msg("cannot execute template")
+	}
+}
 
-	p := Page{
-		Version:   h.version,
-		BuildDate: h.builddate,
+// listManagedNamespaces returns the namespaces managed by the controller,
+// ignoring the ones being terminated
+func (h handler) listManagedNamespaces(l zerolog.Logger) ([]Namespace, error) {
+	namespaces, err := cs.CoreV1().Namespaces().List(context.TODO(), h.scope.ListOptions())
+	if err != nil {
+		return nil, err
 	}
-	// var nsList ListNamespacesAndStates
+
+	var res []Namespace
 	for _, n := range namespaces.Items {
-		phase := fmt.Sprint(n.Status.Phase)
-		if phase == "Terminating" {
+		if n.Status.Phase == v1.NamespaceTerminating {
 			continue
 		}
-		if a, ok := n.Annotations[h.prefix+engine.ControllerName]; ok && a == h.controllerName {
-			val := n.Annotations[h.prefix+engine.DesiredState]
-			ns := Namespace{
-				Name:             n.Name,
-				DailySuspendTime: "n/a",
-				NextSuspendTime:  "n/a",
-				State:            val,
-			}
+		if h.scope.Manages(n) {
+			res = append(res, h.newNamespace(n, l))
+		}
+	}
+	return res, nil
+}
 
-			// add dailySuspendTime if it exists
-			if dst, ok := n.Annotations[h.prefix+engine.DailySuspendTime]; ok {
-				dstTime, err := time.Parse(time.Kitchen, dst)
-				if err != nil {
-					l.Error().Err(err).Str("page", "/").Str("namespace", n.Name).Msgf("cannot parse %s", engine.DailySuspendTime)
-				} else {
-					ns.DailySuspendTime = dstTime.Format(time.Kitchen)
-				}
-			}
+// newNamespace converts a namespace object into the Namespace struct used in
+// the templates
+func (h handler) newNamespace(n v1.Namespace, l zerolog.Logger) Namespace {
+	ns := Namespace{
+		Name:             n.Name,
+		DailySuspendTime: "n/a",
+		NextSuspendTime:  "n/a",
+		State:            n.Annotations[h.prefix+engine.DesiredState],
+		Phase:            n.Annotations[h.prefix+engine.ObservedState],
+		LastError:        n.Annotations[h.prefix+engine.LastError],
+		Group:            engine.GroupOf(n, h.prefix),
+	}
+
+	// add dailySuspendTime if it exists
+	if dst, ok := n.Annotations[h.prefix+engine.DailySuspendTime]; ok {
+		dstTime, err := engine.ParseDailySuspendTime(dst)
+		if err != nil {
+			l.Error().Err(err).Str("namespace", n.Name).Msgf("cannot parse %s", engine.DailySuspendTime)
+		} else {
+			ns.DailySuspendTime = dstTime.Format(time.Kitchen)
+		}
+	}
 
-			// add nextSuspendTime if it exists
-			if nst, ok := n.Annotations[h.prefix+engine.NextSuspendTime]; ok {
-				nstTime, err := time.Parse(time.RFC822Z, nst)
-				if err != nil {
-					l.Error().Err(err).Str("page", "/").Str("namespace", n.Name).Msgf("cannot parse %s", engine.NextSuspendTime)
-				} else {
-					ns.NextSuspendTime = nstTime.Format(time.RFC822)
-				}
-			}
+	// add nextSuspendTime if it exists
+	if nst, ok := n.Annotations[h.prefix+engine.NextSuspendTime]; ok {
+		nstTime, err := engine.ParseNextSuspendTime(nst)
+		if err != nil {
+			l.Error().Err(err).Str("namespace", n.Name).Msgf("cannot parse %s", engine.NextSuspendTime)
+		} else {
+			ns.NextSuspendTime = nstTime.Format(time.RFC822)
+		}
+	}
+	return ns
+}
+
+// errNotManaged is returned when the state of a namespace that is not managed
+// by the controller is changed
+var errNotManaged = errors.New("namespace not managed by the controller")
+
+// errProtected is returned when a protected namespace is suspended
+var errProtected = errors.New("namespace protected, it cannot be suspended")
 
-			p.NamespacesList.Namespaces = append(p.NamespacesList.Namespaces, ns)
+// setState sets the desired state of a namespace and records the transition
+// in the audit sink
+func (h handler) setState(r *http.Request, l zerolog.Logger, name, state string, origin audit.Origin) error {
+	n, err := h.namespaceFor(r, name, state)
+	if err != nil {
+		return err
+	}
+	if state == engine.Running {
+		if err := h.admit(r, []v1.Namespace{*n}); err != nil {
+			return err
 		}
 	}
-	err = tmpl.Execute(w, p)
+	if err := h.writeState(r, l, name, state, origin); err != nil {
+		h.release(*n)
+		return err
+	}
+	return nil
+}
+
+// namespaceFor returns the namespace whose desired state is about to be set,
+// if it is managed by the controller and can be set to the given state
+func (h handler) namespaceFor(r *http.Request, name, state string) (*v1.Namespace, error) {
+	n, err := cs.CoreV1().Namespaces().Get(r.Context(), name, metav1.GetOptions{})
 	if err != nil {
-		l.Error().Err(err).Str("page", "/").Msg("cannot execute template")
+		return nil, err
+	}
+	if !h.scope.Manages(*n) {
+		return nil, fmt.Errorf("%w: %s", errNotManaged, name)
+	}
+	if state == engine.Suspended && h.scope.Protected(name) {
+		return nil, fmt.Errorf("%w: %s", errProtected, name)
 	}
+	return n, nil
 }
 
-func patchNamespace(name, prefix, state string) error {
+// admit checks that the namespaces can be resumed together by the user doing
+// the request, within the budgets of their teams. Either all of them are
+// admitted, or none. The namespaces already running are left out.
+func (h handler) admit(r *http.Request, namespaces []v1.Namespace) error {
+	if h.budgets == nil {
+		return nil
+	}
+	var resumed []v1.Namespace
+	for _, n := range namespaces {
+		if n.Annotations[h.prefix+engine.DesiredState] != engine.Running {
+			resumed = append(resumed, n)
+		}
+	}
+	if len(resumed) == 0 {
+		return nil
+	}
+	// an admin can resume namespaces over budget with override=true, which
+	// is ignored for the users that are not authenticated
+	actor, authenticated := h.actorOf(r)
+	return h.budgets.AdmitAll(resumed, actor, authenticated && r.FormValue("override") == "true")
+}
+
+// release cancels the admission of a namespace whose resume could not be
+// written
+func (h handler) release(n v1.Namespace) {
+	if h.budgets != nil {
+		h.budgets.Release(n)
+	}
+}
+
+// writeState sets the desired state of a namespace already checked, and
+// records the transition in the audit sink
+func (h handler) writeState(r *http.Request, l zerolog.Logger, name, state string, origin audit.Origin) error {
+	actor, _ := h.actorOf(r)
+	previous, err := patchNamespaceAnnotation(name, h.prefix+engine.DesiredState, state)
+	if err != nil {
+		return err
+	}
+	if previous == state {
+		return nil
+	}
+
+	rec := audit.Record{
+		Time:      h.clock.Now().Local(),
+		Namespace: name,
+		From:      previous,
+		To:        state,
+		Origin:    origin,
+		Actor:     actor,
+	}
+	if err := h.audit.Write(r.Context(), rec); err != nil {
+		l.Error().Err(err).Str("namespace", name).Msg("cannot write audit record")
+	}
+	return nil
+}
+
+// actorOf returns the user doing the request, and whether it has been
+// authenticated. The web UI has no authentication on its own, so we rely on
+// the headers set by the authenticating proxies. They can be set by any
+// client, so they are only read from the requests sent by the trusted
+// proxies. Otherwise, the caller is anonymous and identified by its address.
+func (h handler) actorOf(r *http.Request) (string, bool) {
+	if h.trustedProxy(r) {
+		for _, hdr := range []string{"X-Forwarded-User", "X-Forwarded-Email", "X-Auth-Request-User", "X-Auth-Request-Email", "X-Remote-User"} {
+			if v := r.Header.Get(hdr); v != "" {
+				return v, true
+			}
+		}
+	}
+	return r.RemoteAddr, false
+}
+
+// trustedProxy returns true if the request comes from a trusted proxy
+func (h handler) trustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a comma separated list of IP addresses and
+// networks (e.g. 10.0.0.0/8)
+func parseTrustedProxies(val string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, p := range strings.Split(val, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %w", p, err)
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+// patchNamespaceAnnotation sets the annotation key to value on the given
+// namespace and returns its previous value. If value is empty, the annotation
+// is removed.
+func patchNamespaceAnnotation(name, key, value string) (string, error) {
+	var previous string
 	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		result, err := cs.CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
-		result.Annotations[prefix+engine.DesiredState] = state
-		var updateOpts metav1.UpdateOptions
+		previous = result.Annotations[key]
+		if value == "" {
+			delete(result.Annotations, key)
+		} else {
+			if result.Annotations == nil {
+				result.Annotations = make(map[string]string)
+			}
+			result.Annotations[key] = value
+		}
+		updateOpts := metav1.UpdateOptions{FieldManager: engine.WebUIFieldManager}
 		_, err = cs.CoreV1().Namespaces().Update(context.TODO(), result, updateOpts)
 		return err
 	})
 
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return previous, nil
 }
 
 func (lh *loggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
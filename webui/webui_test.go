@@ -0,0 +1,64 @@
+package webui
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/govirtuo/kube-ns-suspender/audit"
+	"github.com/govirtuo/kube-ns-suspender/config"
+	"github.com/govirtuo/kube-ns-suspender/engine"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_setStateWriteFailed(t *testing.T) {
+	eng, err := engine.New(engine.Options{
+		WatchListSize:        1,
+		LogLevel:             "disabled",
+		RunningDuration:      "4h",
+		TransitionTimeout:    "15m",
+		MaxBackoff:           "10m",
+		UIMaxRunningDuration: "12h",
+		StallTimeout:         "5m",
+		ShutdownTimeout:      "30s",
+		Prefix:               testPrefix,
+		ControllerName:       "kube-ns-suspender",
+		TeamLabel:            "team",
+		Budgets:              map[string]config.Budget{"a": {MaxRunning: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	budgets := eng.Budgets
+	h := handler{prefix: testPrefix, scope: eng.Scope, budgets: budgets}
+	n := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "team-a",
+		Labels:      map[string]string{"team": "a"},
+		Annotations: map[string]string{testPrefix + engine.ControllerName: "kube-ns-suspender", testPrefix + engine.DesiredState: engine.Suspended},
+	}}
+	fakeCS := fake.NewSimpleClientset(n)
+	fakeCS.PrependReactor("update", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	cs = fakeCS
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/namespaces/team-a/unsuspend", nil)
+	if err := h.setState(r, zerolog.Nop(), "team-a", engine.Running, audit.OriginAPI); err == nil {
+		t.Fatal("setState() succeeded, want the write error")
+	}
+	if usage := budgets.Usage(); len(usage) != 1 || usage[0].Running != 0 {
+		t.Errorf("Usage() = %+v, want the namespace not counted as running", usage)
+	}
+	// the budget is left for another namespace of the team
+	other := *n.DeepCopy()
+	other.Name = "team-a-2"
+	if err := budgets.Admit(other, "bob", false); err != nil {
+		t.Errorf("Admit() error = %v, want the namespace admitted", err)
+	}
+}